@@ -0,0 +1,111 @@
+// Package clock предоставляет источник времени для сервиса
+// Логика, зависящая от времени (расписание, ограничения частоты, переподключение к БД, отложенная
+// проверка статуса), получает время через Clock, поэтому в тестах системные часы подменяются на Fake
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock - источник текущего времени и таймеров
+type Clock interface {
+	// Now возвращает текущее время
+	Now() time.Time
+	// After возвращает канал, в который будет отправлено время по истечении d
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real - системные часы
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Since возвращает время, прошедшее с t, по часам c
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Sleep ждет d по часам c
+func Sleep(c Clock, d time.Duration) {
+	<-c.After(d)
+}
+
+// Fake - часы, которые идут только при вызове Advance или Set
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter - канал After, ожидающий наступления момента at
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFake создает часы, показывающие время now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now возвращает текущее время часов
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After возвращает канал, срабатывающий, когда часы будут переведены на d вперед
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.waiters = append(f.waiters, fakeWaiter{at: f.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance переводит часы на d вперед и срабатывает наступившие таймеры
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	f.setLocked(f.now.Add(d))
+	f.mu.Unlock()
+}
+
+// Set переводит часы на время t и срабатывает наступившие таймеры
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	f.setLocked(t)
+	f.mu.Unlock()
+}
+
+// Waiters возвращает количество ожидающих таймеров (позволяет тесту дождаться, пока код начнет ожидание)
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// setLocked устанавливает время и срабатывает таймеры в порядке их наступления
+func (f *Fake) setLocked(t time.Time) {
+	f.now = t
+	sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].at.Before(f.waiters[j].at) })
+	fired := 0
+	for _, w := range f.waiters {
+		if w.at.After(t) {
+			break
+		}
+		w.ch <- t
+		fired++
+	}
+	f.waiters = f.waiters[fired:]
+}
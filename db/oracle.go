@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -11,6 +12,7 @@ import (
 	_ "github.com/godror/godror"
 	"go.uber.org/zap"
 
+	"email-service/clock"
 	"email-service/logger"
 	"email-service/settings"
 )
@@ -21,6 +23,11 @@ const (
 	QueryTimeout      = 30 * time.Second // Таймаут для запросов (экспортируется для использования в procedures.go)
 	ExecTimeout       = 30 * time.Second // Таймаут для выполнения команд (экспортируется для использования в queue.go)
 	connectionTimeout = 10 * time.Second // Таймаут для подключения
+
+	// Пауза перед закрытием старого пула после Hot Swap с активными операциями (с запасом больше QueryTimeout)
+	drainTimeout = 2 * time.Minute
+	// Максимальное ожидание закрытия старых пулов при завершении работы
+	drainShutdownTimeout = QueryTimeout + 5*time.Second
 )
 
 // DBConnection инкапсулирует соединение и операции с БД
@@ -33,23 +40,49 @@ type DBConnection struct {
 	reconnectTicker   *time.Ticker
 	reconnectStop     chan struct{}
 	reconnectWg       sync.WaitGroup
+	drainWg           sync.WaitGroup // Отложенные закрытия старых пулов после Hot Swap (draining)
 	lastReconnect     time.Time
 	reconnectInterval time.Duration // Интервал переподключения (30 минут)
 	activeOps         atomic.Int32  // Счетчик активных операций с БД
 	reconnectPending  atomic.Bool   // Флаг ожидания переподключения
+	generation        atomic.Uint64 // Поколение пула соединений, увеличивается при каждом открытии и подмене пула
+	clock             clock.Clock   // Источник времени для ожидания операций и пауз переподключения
+	packagesMu        sync.Mutex
+	readyPackages     map[string]bool         // Временные пакеты, уже созданные в схеме (ensureTempPackage)
+	packagePrefix     string                  // Префикс имен временных пакетов (package_prefix секции [queue])
+	connect           func() (*sql.DB, error) // Создание пула соединений (createConnection)
 }
 
 // NewDBConnection создает новое подключение к БД
 func NewDBConnection(cfg *settings.Config) (*DBConnection, error) {
+	prefix, err := packagePrefix(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	return &DBConnection{
+	d := &DBConnection{
 		cfg:               cfg,
 		ctx:               ctx,
 		cancel:            cancel,
 		reconnectInterval: 30 * time.Minute, // 30 минут по умолчанию
 		reconnectStop:     make(chan struct{}),
 		lastReconnect:     time.Now(),
-	}, nil
+		clock:             clock.Real,
+		packagePrefix:     prefix,
+	}
+	d.connect = d.createConnection
+	return d, nil
+}
+
+// SetClock устанавливает источник времени (nil - системные часы)
+// Вызывается до открытия соединения и запуска периодического переподключения
+func (d *DBConnection) SetClock(clk clock.Clock) {
+	if clk == nil {
+		clk = clock.Real
+	}
+	d.clock = clk
+	d.lastReconnect = clk.Now()
 }
 
 // OpenConnection открывает подключение к Oracle через драйвер godror
@@ -64,9 +97,13 @@ func (d *DBConnection) CloseConnection() {
 	// Останавливаем периодическое переподключение
 	d.StopPeriodicReconnect()
 
+	// Отмена контекста прерывает паузу draining: старые пулы закрываются сразу,
+	// sql.DB.Close дожидается завершения уже выполняющихся запросов
 	if d.cancel != nil {
 		d.cancel()
 	}
+	d.waitDrains(drainShutdownTimeout)
+
 	if d.db != nil {
 		_ = d.db.Close()
 		d.db = nil
@@ -116,7 +153,7 @@ func (d *DBConnection) waitForActiveOperations() error {
 	const checkInterval = 100 * time.Millisecond
 	const logInterval = 1 * time.Second
 
-	startTime := time.Now()
+	startTime := d.clock.Now()
 	lastLogTime := time.Time{}
 	lastActiveCount := int32(-1)
 
@@ -126,7 +163,7 @@ func (d *DBConnection) waitForActiveOperations() error {
 			return nil
 		}
 
-		if time.Since(startTime) > maxWaitTime {
+		if clock.Since(d.clock, startTime) > maxWaitTime {
 			if logger.Log != nil {
 				logger.Log.Warn("Превышено время ожидания завершения активных операций",
 					zap.Int32("activeOps", activeCount))
@@ -134,7 +171,7 @@ func (d *DBConnection) waitForActiveOperations() error {
 			return nil
 		}
 
-		now := time.Now()
+		now := d.clock.Now()
 		if now.Sub(lastLogTime) >= logInterval || activeCount != lastActiveCount {
 			if logger.Log != nil {
 				logger.Log.Debug("Ожидание завершения активных операций перед переподключением",
@@ -144,7 +181,7 @@ func (d *DBConnection) waitForActiveOperations() error {
 			lastActiveCount = activeCount
 		}
 
-		time.Sleep(checkInterval)
+		clock.Sleep(d.clock, checkInterval)
 	}
 }
 
@@ -200,7 +237,7 @@ func (d *DBConnection) StartPeriodicReconnect() {
 				d.reconnectPending.Store(true)
 
 				// 2. Ждем завершения активных операций (до 10 секунд)
-				waitStart := time.Now()
+				waitStart := d.clock.Now()
 				activeOps := d.GetActiveOperationsCount()
 
 				if activeOps > 0 {
@@ -210,8 +247,8 @@ func (d *DBConnection) StartPeriodicReconnect() {
 					}
 
 					// Цикл ожидания
-					for activeOps > 0 && time.Since(waitStart) < waitActiveOpsTimeout {
-						time.Sleep(100 * time.Millisecond)
+					for activeOps > 0 && clock.Since(d.clock, waitStart) < waitActiveOpsTimeout {
+						clock.Sleep(d.clock, 100*time.Millisecond)
 						activeOps = d.GetActiveOperationsCount()
 					}
 				}
@@ -243,7 +280,7 @@ func (d *DBConnection) StartPeriodicReconnect() {
 					// Операций нет - можно переподключаться
 					if logger.Log != nil {
 						logger.Log.Info("Выполняется плановое переподключение (Hot Swap)",
-							zap.Duration("sinceLastReconnect", time.Since(d.lastReconnect)))
+							zap.Duration("sinceLastReconnect", clock.Since(d.clock, d.lastReconnect)))
 					}
 				}
 
@@ -291,6 +328,35 @@ func (d *DBConnection) StopPeriodicReconnect() {
 	}
 }
 
+// ErrReconnectInProgress возвращается ReconnectNow, если переподключение уже выполняется
+var ErrReconnectInProgress = errors.New("переподключение к БД уже выполняется")
+
+// ReconnectNow выполняет внеплановое переподключение по команде оператора (например, после обслуживания БД)
+// Как и периодическое переподключение, блокирует новые операции и ждет завершения активных;
+// если они не завершились за отведенное время, старое соединение закрывается после паузы (draining)
+func (d *DBConnection) ReconnectNow() error {
+	const waitActiveOpsTimeout = 10 * time.Second
+
+	if !d.reconnectPending.CompareAndSwap(false, true) {
+		return ErrReconnectInProgress
+	}
+	defer d.reconnectPending.Store(false)
+
+	waitStart := d.clock.Now()
+	activeOps := d.GetActiveOperationsCount()
+	for activeOps > 0 && clock.Since(d.clock, waitStart) < waitActiveOpsTimeout {
+		clock.Sleep(d.clock, 100*time.Millisecond)
+		activeOps = d.GetActiveOperationsCount()
+	}
+
+	if logger.Log != nil {
+		logger.Log.Info("Выполняется переподключение к БД по команде оператора (Hot Swap)",
+			zap.Int32("activeOps", activeOps),
+			zap.Duration("sinceLastReconnect", clock.Since(d.clock, d.lastReconnect)))
+	}
+	return d.HotSwapReconnect(activeOps > 0)
+}
+
 // HotSwapReconnect выполняет переподключение с созданием нового соединения перед закрытием старого
 func (d *DBConnection) HotSwapReconnect(force bool) error {
 	if logger.Log != nil {
@@ -298,7 +364,7 @@ func (d *DBConnection) HotSwapReconnect(force bool) error {
 	}
 
 	// 1. Создаем новое соединение (это может занять время, но не блокирует работу)
-	newDB, err := d.createConnection()
+	newDB, err := d.connect()
 	if err != nil {
 		return fmt.Errorf("ошибка создания нового соединения для Hot Swap: %w", err)
 	}
@@ -307,7 +373,9 @@ func (d *DBConnection) HotSwapReconnect(force bool) error {
 	d.mu.Lock()
 	oldDB := d.db
 	d.db = newDB
-	d.lastReconnect = time.Now()
+	d.lastReconnect = d.clock.Now()
+	d.generation.Add(1)
+	d.forgetTempPackages()
 	d.mu.Unlock()
 
 	if logger.Log != nil {
@@ -319,26 +387,8 @@ func (d *DBConnection) HotSwapReconnect(force bool) error {
 		if force {
 			// Если принудительно (были активные операции), даем время на завершение
 			// Запускаем в отдельной горутине, чтобы не блокировать текущий поток
-			go func() {
-				// Ждем чуть больше максимального таймаута запроса (QueryTimeout = 30s)
-				// Дадим с запасом 2 минуты
-				drainTimeout := 2 * time.Minute
-				if logger.Log != nil {
-					logger.Log.Info("Hot Swap: старое соединение будет закрыто через паузу (draining)",
-						zap.Duration("timeout", drainTimeout))
-				}
-				time.Sleep(drainTimeout)
-
-				if err := oldDB.Close(); err != nil {
-					if logger.Log != nil {
-						logger.Log.Error("Ошибка при отложенном закрытии старого соединения", zap.Error(err))
-					}
-				} else {
-					if logger.Log != nil {
-						logger.Log.Info("Hot Swap: старое соединение успешно закрыто после draining")
-					}
-				}
-			}()
+			d.drainWg.Add(1)
+			go d.drainOldConnection(oldDB)
 		} else {
 			// Если операций не было, закрываем сразу
 			if err := oldDB.Close(); err != nil {
@@ -356,6 +406,57 @@ func (d *DBConnection) HotSwapReconnect(force bool) error {
 	return nil
 }
 
+// drainOldConnection закрывает старый пул после паузы draining, чтобы выполняющиеся на нем запросы
+// успели завершиться; при завершении работы (отмена контекста в CloseConnection) пауза прерывается
+func (d *DBConnection) drainOldConnection(oldDB *sql.DB) {
+	defer d.drainWg.Done()
+	if logger.Log != nil {
+		logger.Log.Info("Hot Swap: старое соединение будет закрыто через паузу (draining)",
+			zap.Duration("timeout", drainTimeout))
+	}
+	select {
+	case <-d.clock.After(drainTimeout):
+	case <-d.ctx.Done():
+		if logger.Log != nil {
+			logger.Log.Info("Hot Swap: завершение работы, старое соединение закрывается до окончания паузы")
+		}
+	}
+
+	if err := oldDB.Close(); err != nil {
+		if logger.Log != nil {
+			logger.Log.Error("Ошибка при отложенном закрытии старого соединения", zap.Error(err))
+		}
+	} else {
+		if logger.Log != nil {
+			logger.Log.Info("Hot Swap: старое соединение успешно закрыто после draining")
+		}
+	}
+}
+
+// waitDrains ожидает закрытия старых пулов после Hot Swap не дольше timeout
+// Возвращает false, если закрытие не завершилось за отведенное время (горутины завершатся сами
+// после окончания запросов на старом пуле)
+func (d *DBConnection) waitDrains(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		d.drainWg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		if logger.Log != nil {
+			logger.Log.Warn("Старое соединение после Hot Swap не закрыто до завершения работы",
+				zap.Duration("timeout", timeout))
+		}
+		return false
+	}
+}
+
 // createConnection создает и настраивает новое подключение к БД
 func (d *DBConnection) createConnection() (*sql.DB, error) {
 	if logger.Log != nil {
@@ -432,18 +533,26 @@ func (d *DBConnection) createConnection() (*sql.DB, error) {
 
 // openConnectionInternal использует createConnection для инициализации
 func (d *DBConnection) openConnectionInternal() error {
-	db, err := d.createConnection()
+	db, err := d.connect()
 	if err != nil {
 		return err
 	}
 	d.db = db
-	d.lastReconnect = time.Now()
+	d.lastReconnect = d.clock.Now()
+	d.generation.Add(1)
+	d.forgetTempPackages()
 	if logger.Log != nil {
 		logger.Log.Info("Database connection opened (using Oracle Instant Client via godror)")
 	}
 	return nil
 }
 
+// Generation возвращает поколение пула соединений
+// Значение меняется при каждом открытии соединения и Hot Swap переподключении
+func (d *DBConnection) Generation() uint64 {
+	return d.generation.Load()
+}
+
 // GetConfig возвращает конфигурацию
 func (d *DBConnection) GetConfig() *settings.Config {
 	return d.cfg
@@ -505,6 +614,9 @@ func (d *DBConnection) WithDBTx(ctx context.Context, fn func(*sql.Tx) error) err
 
 	// Выполняем функцию с транзакцией
 	if err := fn(tx); err != nil {
+		if isTempPackageError(err) {
+			d.resetTempPackages(err)
+		}
 		return err
 	}
 
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+	"email-service/settings"
+)
+
+const (
+	// defaultPackagePrefix - префикс имен временных пакетов по умолчанию (package_prefix секции [queue])
+	defaultPackagePrefix = "temp_"
+	// maxPackageNameLen - предельная длина имени пакета, допустимая во всех поддерживаемых версиях Oracle
+	maxPackageNameLen = 30
+	// longestPackageSuffix - самое длинное имя временного пакета без префикса
+	longestPackageSuffix = "email_report_clob_pkg"
+)
+
+// packagePrefixPattern - допустимый префикс: начинается с буквы, далее буквы, цифры и "_"
+// Префикс подставляется в DDL и PL/SQL как часть идентификатора, поэтому другие символы не допускаются
+var packagePrefixPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// packageNamePattern - имена временных пакетов в текстах SQL (temp_<назначение>_pkg)
+var packageNamePattern = regexp.MustCompile(`\btemp_(\w+?_pkg)\b`)
+
+// packagePrefix возвращает префикс имен временных пакетов из секции [queue] (package_prefix)
+// Разные префиксы позволяют нескольким экземплярам сервиса работать в одной схеме, не перекомпилируя
+// пакеты друг друга
+func packagePrefix(cfg *settings.Config) (string, error) {
+	prefix := defaultPackagePrefix
+	if cfg != nil && cfg.File != nil && cfg.File.HasSection("queue") {
+		prefix = strings.TrimSpace(cfg.File.Section("queue").Key("package_prefix").MustString(defaultPackagePrefix))
+	}
+	if !packagePrefixPattern.MatchString(prefix) {
+		return "", fmt.Errorf("недопустимый package_prefix %q: допустимы латинские буквы, цифры и _, первый символ - буква", prefix)
+	}
+	if maxLen := maxPackageNameLen - len(longestPackageSuffix); len(prefix) > maxLen {
+		return "", fmt.Errorf("слишком длинный package_prefix %q: не более %d символов", prefix, maxLen)
+	}
+	return prefix, nil
+}
+
+// packageSQL подставляет в текст SQL имена временных пакетов с префиксом экземпляра (package_prefix)
+func (d *DBConnection) packageSQL(query string) string {
+	if d.packagePrefix == "" || d.packagePrefix == defaultPackagePrefix {
+		return query
+	}
+	return packageNamePattern.ReplaceAllString(query, d.packagePrefix+"${1}")
+}
+
+// tempPackageErrors - ошибки Oracle, означающие, что временный пакет удален, недействителен или его состояние
+// сброшено перекомпиляцией (например, другим экземпляром сервиса); такой пакет создается заново
+var tempPackageErrors = []string{
+	"ORA-04068", // existing state of packages has been discarded
+	"ORA-04061", // existing state of package has been invalidated
+	"ORA-04063", // package has errors
+	"ORA-04065", // not executed, altered or dropped
+	"ORA-06508", // could not find program unit being called
+	"PLS-00201", // identifier must be declared
+}
+
+// isTempPackageError проверяет, что ошибка вызвана отсутствующим или недействительным временным пакетом
+func isTempPackageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	errStr := err.Error()
+	for _, code := range tempPackageErrors {
+		if strings.Contains(errStr, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// tempPackageReady проверяет, создан ли временный пакет name этим процессом
+func (d *DBConnection) tempPackageReady(name string) bool {
+	d.packagesMu.Lock()
+	defer d.packagesMu.Unlock()
+	return d.readyPackages[name]
+}
+
+// markTempPackageReady отмечает временный пакет name как созданный
+func (d *DBConnection) markTempPackageReady(name string) {
+	d.packagesMu.Lock()
+	defer d.packagesMu.Unlock()
+	if d.readyPackages == nil {
+		d.readyPackages = make(map[string]bool)
+	}
+	d.readyPackages[name] = true
+}
+
+// resetTempPackages сбрасывает отметки о созданных временных пакетах: при следующем вызове каждый пакет
+// создается заново. По ошибке нельзя определить, какой из пакетов недействителен, поэтому сбрасываются все
+func (d *DBConnection) resetTempPackages(cause error) {
+	d.packagesMu.Lock()
+	defer d.packagesMu.Unlock()
+	if len(d.readyPackages) == 0 {
+		return
+	}
+	if logger.Log != nil {
+		logger.Log.Warn("Временный пакет Oracle отсутствует или недействителен, пакеты будут созданы заново",
+			zap.Error(cause))
+	}
+	d.readyPackages = nil
+}
+
+// forgetTempPackages сбрасывает отметки о созданных временных пакетах при открытии нового пула соединений:
+// пока соединения не было, пакеты могли быть удалены или перекомпилированы (в том числе после переключения
+// на другую БД), поэтому после открытия и Hot Swap каждый пакет создается заново при первом вызове
+func (d *DBConnection) forgetTempPackages() {
+	d.packagesMu.Lock()
+	defer d.packagesMu.Unlock()
+	d.readyPackages = nil
+}
+
+// sqlExecer выполняет команды SQL (*sql.DB или *sql.Tx)
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// ensureTempPackage создает временный пакет name (спецификацию и тело), если он еще не создан
+// CREATE OR REPLACE перекомпилирует пакет на сервере и ожидает library cache lock, поэтому выполняется
+// один раз за время работы и повторяется только после ошибки, обнаруженной isTempPackageError
+// Имя пакета и тексты DDL задаются с префиксом по умолчанию и приводятся к package_prefix экземпляра
+func (d *DBConnection) ensureTempPackage(ctx context.Context, exec sqlExecer, name, createPackageSQL, createPackageBodySQL string) error {
+	name = d.packageSQL(name)
+	if d.tempPackageReady(name) {
+		return nil
+	}
+
+	_, err := exec.ExecContext(ctx, d.packageSQL(createPackageSQL))
+	if err != nil {
+		return fmt.Errorf("не удалось создать пакет %s: %w", name, err)
+	}
+	_, err = exec.ExecContext(ctx, d.packageSQL(createPackageBodySQL))
+	if err != nil {
+		return fmt.Errorf("не удалось создать тело пакета %s: %w", name, err)
+	}
+
+	d.markTempPackageReady(name)
+	if logger.Log != nil {
+		logger.Log.Debug("Создан временный пакет Oracle", zap.String("package", name))
+	}
+	return nil
+}
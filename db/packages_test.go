@@ -0,0 +1,244 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"email-service/settings"
+
+	"gopkg.in/ini.v1"
+)
+
+// recordingConnector - драйвер без БД: запоминает выполненные команды SQL, запросы завершаются ошибкой
+type recordingConnector struct {
+	mu    sync.Mutex
+	execs []string
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return &recordingConn{connector: c}, nil
+}
+
+func (c *recordingConnector) Driver() driver.Driver { return nil }
+
+// executed возвращает выполненные команды SQL
+func (c *recordingConnector) executed() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.execs...)
+}
+
+type recordingConn struct {
+	connector *recordingConnector
+}
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.connector.mu.Lock()
+	defer c.connector.mu.Unlock()
+	c.connector.execs = append(c.connector.execs, query)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *recordingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("запросы не поддерживаются в тестах")
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("транзакции не поддерживаются в тестах")
+}
+
+// newTestDBConnection создает DBConnection, пулы которого не подключаются к серверу,
+// а запоминают выполненные команды SQL в возвращаемом recordingConnector
+func newTestDBConnection(t *testing.T, cfg *settings.Config) (*DBConnection, *recordingConnector) {
+	t.Helper()
+	if cfg == nil {
+		cfg = &settings.Config{}
+	}
+	d, err := NewDBConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := &recordingConnector{}
+	d.connect = func() (*sql.DB, error) { return sql.OpenDB(connector), nil }
+	t.Cleanup(d.CloseConnection)
+	return d, connector
+}
+
+// newQueueConfig возвращает конфигурацию с секцией [queue] queueSection
+func newQueueConfig(t *testing.T, queueSection string) *settings.Config {
+	t.Helper()
+	f, err := ini.Load([]byte("[queue]\n" + queueSection + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &settings.Config{File: f}
+}
+
+func TestTempPackagesForgottenOnNewPool(t *testing.T) {
+	d, _ := newTestDBConnection(t, nil)
+	if err := d.OpenConnection(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.markTempPackageReady("temp_email_queue_pkg")
+	// Повторное открытие (переподключение после разрыва) создает пакеты заново
+	if err := d.OpenConnection(); err != nil {
+		t.Fatal(err)
+	}
+	if d.tempPackageReady("temp_email_queue_pkg") {
+		t.Error("после открытия соединения пакет считается созданным")
+	}
+
+	d.markTempPackageReady("temp_email_queue_pkg")
+	// Hot Swap подменяет пул: новые соединения могут вести на другую БД
+	if err := d.HotSwapReconnect(false); err != nil {
+		t.Fatal(err)
+	}
+	if d.tempPackageReady("temp_email_queue_pkg") {
+		t.Error("после Hot Swap пакет считается созданным")
+	}
+}
+
+func TestTempPackagesKeptOnFailedHotSwap(t *testing.T) {
+	d, _ := newTestDBConnection(t, nil)
+	if err := d.OpenConnection(); err != nil {
+		t.Fatal(err)
+	}
+	d.markTempPackageReady("temp_email_queue_pkg")
+
+	// Новый пул не создан, работа продолжается на прежнем, и пакеты в нем остаются созданными
+	d.connect = func() (*sql.DB, error) { return nil, errors.New("ORA-12541: TNS:no listener") }
+	if err := d.HotSwapReconnect(false); err == nil {
+		t.Fatal("Hot Swap без нового пула завершился без ошибки")
+	}
+	if !d.tempPackageReady("temp_email_queue_pkg") {
+		t.Error("после неудачного Hot Swap отметка о пакете сброшена")
+	}
+}
+
+func TestPackagePrefix(t *testing.T) {
+	tests := []struct {
+		queue   string
+		want    string
+		wantErr bool
+	}{
+		{queue: "", want: "temp_"},
+		{queue: "package_prefix = es1_", want: "es1_"},
+		{queue: "package_prefix =  Inst_B_ ", want: "Inst_B_"},
+		{queue: "package_prefix = abcdefghi", want: "abcdefghi"}, // 9 + 21 = 30 символов
+		{queue: "package_prefix = abcdefghij", wantErr: true},    // Имя пакета длиннее 30 символов
+		{queue: "package_prefix = 1es_", wantErr: true},
+		{queue: "package_prefix = _es", wantErr: true},
+		{queue: "package_prefix = es-1_", wantErr: true},
+		{queue: "package_prefix = es$1_", wantErr: true},
+		{queue: "package_prefix = es 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		prefix, err := packagePrefix(newQueueConfig(t, tt.queue))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: ожидалась ошибка, получен префикс %q", tt.queue, prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.queue, err)
+			continue
+		}
+		if prefix != tt.want {
+			t.Errorf("%q: префикс %q, ожидался %q", tt.queue, prefix, tt.want)
+		}
+	}
+
+	// Без секции [queue] используется префикс по умолчанию
+	if prefix, err := packagePrefix(&settings.Config{File: ini.Empty()}); err != nil || prefix != defaultPackagePrefix {
+		t.Errorf("без секции [queue]: префикс %q, ошибка %v", prefix, err)
+	}
+	// Недопустимый префикс не позволяет создать подключение
+	if _, err := NewDBConnection(newQueueConfig(t, "package_prefix = es-1_")); err == nil {
+		t.Error("NewDBConnection с недопустимым package_prefix завершился без ошибки")
+	}
+}
+
+func TestPackageSQL(t *testing.T) {
+	query := `BEGIN temp_queue_pkg.g_success := 0; END; SELECT temp_email_report_clob_pkg.get_clob() FROM DUAL; ` +
+		`SELECT my_temp_queue_pkg.x, temp_queue_pkg_old.y, temp_settings FROM DUAL`
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"temp_", query},
+		{"es1_", `BEGIN es1_queue_pkg.g_success := 0; END; SELECT es1_email_report_clob_pkg.get_clob() FROM DUAL; ` +
+			`SELECT my_temp_queue_pkg.x, temp_queue_pkg_old.y, temp_settings FROM DUAL`},
+	}
+	for _, tt := range tests {
+		d, _ := newTestDBConnection(t, newQueueConfig(t, "package_prefix = "+tt.prefix))
+		if got := d.packageSQL(query); got != tt.want {
+			t.Errorf("префикс %s:\n%s\nожидалось:\n%s", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestQueuePackagesDistinctPerPrefix(t *testing.T) {
+	ctx := context.Background()
+	ddl := make(map[string][]string)
+	for _, prefix := range []string{"es1_", "es2_"} {
+		d, connector := newTestDBConnection(t, newQueueConfig(t, "package_prefix = "+prefix))
+		if err := d.OpenConnection(); err != nil {
+			t.Fatal(err)
+		}
+		qr, err := NewQueueReader(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := qr.ensurePackageExists(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := qr.ensureArrayPackageExists(ctx); err != nil {
+			t.Fatal(err)
+		}
+		// Созданный пакет не перекомпилируется при повторном вызове
+		if err := qr.ensurePackageExists(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		executed := connector.executed()
+		if len(executed) != 4 {
+			t.Fatalf("префикс %s: выполнено %d команд DDL, ожидалось 4 (спецификация и тело двух пакетов)", prefix, len(executed))
+		}
+		for _, stmt := range executed {
+			if strings.Contains(stmt, "temp_") {
+				t.Errorf("префикс %s: DDL содержит имя с префиксом по умолчанию:\n%s", prefix, stmt)
+			}
+		}
+		for _, want := range []string{
+			"CREATE OR REPLACE PACKAGE " + prefix + "queue_pkg AS",
+			"CREATE OR REPLACE PACKAGE BODY " + prefix + "queue_pkg AS",
+			"END " + prefix + "queue_pkg;",
+			"CREATE OR REPLACE PACKAGE " + prefix + "queue_array_pkg AS",
+			"CREATE OR REPLACE PACKAGE BODY " + prefix + "queue_array_pkg AS",
+		} {
+			if !strings.Contains(strings.Join(executed, "\n"), want) {
+				t.Errorf("префикс %s: DDL не содержит %q", prefix, want)
+			}
+		}
+		if !d.tempPackageReady(prefix+"queue_pkg") || !d.tempPackageReady(prefix+"queue_array_pkg") {
+			t.Errorf("префикс %s: пакеты не отмечены как созданные", prefix)
+		}
+		ddl[prefix] = executed
+	}
+
+	// Экземпляры с разными префиксами создают разные пакеты и не перекомпилируют пакеты друг друга
+	for i := range ddl["es1_"] {
+		if ddl["es1_"][i] == ddl["es2_"][i] {
+			t.Errorf("команда %d совпадает для разных префиксов:\n%s", i+1, ddl["es1_"][i])
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"time"
 
@@ -71,7 +72,7 @@ func (d *DBConnection) SaveEmailResponse(ctx context.Context, params SaveEmailRe
 				temp_email_response_pkg.g_err_desc := v_err_desc;
 			END;`
 
-		_, err := tx.ExecContext(queryCtx, plsql,
+		_, err := tx.ExecContext(queryCtx, d.packageSQL(plsql),
 			params.TaskID,
 			params.StatusID,
 			params.ResponseDate,
@@ -99,7 +100,7 @@ func (d *DBConnection) SaveEmailResponse(ctx context.Context, params SaveEmailRe
 		}
 
 		checkResultSQL := `SELECT temp_email_response_pkg.get_err_code(), temp_email_response_pkg.get_err_desc() FROM DUAL`
-		err = tx.QueryRowContext(queryCtx, checkResultSQL).Scan(&errCode, &errDesc)
+		err = tx.QueryRowContext(queryCtx, d.packageSQL(checkResultSQL)).Scan(&errCode, &errDesc)
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка чтения результата процедуры",
@@ -145,6 +146,67 @@ func (d *DBConnection) SaveEmailResponse(ctx context.Context, params SaveEmailRe
 	return true, nil
 }
 
+// SaveEmailMetricsParams представляет параметры для вызова процедуры save_email_metrics
+type SaveEmailMetricsParams struct {
+	PeriodStart time.Time // P_PERIOD_START - начало часа
+	SmtpID      int       // P_SMTP_ID (-1, если SMTP сервер не определен)
+	StatusID    int       // P_STATUS_ID
+	Count       int       // P_COUNT - количество писем за период
+}
+
+// SaveEmailMetrics вызывает процедуру pcsystem.pkg_email.save_email_metrics()
+// Процедура должна добавлять Count к уже сохраненному значению за период (повторные сбросы за один час)
+func (d *DBConnection) SaveEmailMetrics(ctx context.Context, params SaveEmailMetricsParams) error {
+	if !d.CheckConnection() {
+		return fmt.Errorf("соединение с БД недоступно")
+	}
+
+	queryCtx, queryCancel := context.WithTimeout(ctx, ExecTimeout)
+	defer queryCancel()
+
+	err := d.WithDBTx(queryCtx, func(tx *sql.Tx) error {
+		plsql := `
+			BEGIN
+				pcsystem.pkg_email.save_email_metrics(
+					P_PERIOD_START => :1,
+					P_SMTP_ID => :2,
+					P_STATUS_ID => :3,
+					P_COUNT => :4
+				);
+			END;`
+
+		_, err := tx.ExecContext(queryCtx, plsql,
+			params.PeriodStart,
+			params.SmtpID,
+			params.StatusID,
+			params.Count,
+		)
+		if err != nil {
+			if logger.Log != nil {
+				logger.Log.Error("Ошибка вызова pcsystem.pkg_email.save_email_metrics",
+					zap.Time("periodStart", params.PeriodStart),
+					zap.Int("smtpID", params.SmtpID),
+					zap.Int("statusID", params.StatusID),
+					zap.Error(err))
+			}
+			return fmt.Errorf("ошибка вызова save_email_metrics: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("Вызов pcsystem.pkg_email.save_email_metrics() успешно",
+			zap.Time("periodStart", params.PeriodStart),
+			zap.Int("smtpID", params.SmtpID),
+			zap.Int("statusID", params.StatusID),
+			zap.Int("count", params.Count))
+	}
+	return nil
+}
+
 // ensureEmailResponsePackageExistsTx создает временный пакет Oracle для работы с OUT-параметрами
 func (d *DBConnection) ensureEmailResponsePackageExistsTx(tx *sql.Tx, ctx context.Context) error {
 	createPackageSQL := `
@@ -156,10 +218,6 @@ func (d *DBConnection) ensureEmailResponsePackageExistsTx(tx *sql.Tx, ctx contex
 			FUNCTION get_err_desc RETURN VARCHAR2;
 		END temp_email_response_pkg;
 	`
-	_, err := tx.ExecContext(ctx, createPackageSQL)
-	if err != nil {
-		return fmt.Errorf("не удалось создать пакет temp_email_response_pkg: %w", err)
-	}
 
 	createPackageBodySQL := `
 		CREATE OR REPLACE PACKAGE BODY temp_email_response_pkg AS
@@ -174,12 +232,7 @@ func (d *DBConnection) ensureEmailResponsePackageExistsTx(tx *sql.Tx, ctx contex
 			END;
 		END temp_email_response_pkg;
 	`
-	_, err = tx.ExecContext(ctx, createPackageBodySQL)
-	if err != nil {
-		return fmt.Errorf("не удалось создать тело пакета temp_email_response_pkg: %w", err)
-	}
-
-	return nil
+	return d.ensureTempPackage(ctx, tx, "temp_email_response_pkg", createPackageSQL, createPackageBodySQL)
 }
 
 // GetTestEmail получает тестовый email через pcsystem.PKG_EMAIL.GET_TEST_EMAIL()
@@ -204,7 +257,7 @@ func (d *DBConnection) GetTestEmail() (string, error) {
 			END;
 		`
 
-		_, err := tx.ExecContext(queryCtx, plsql)
+		_, err := tx.ExecContext(queryCtx, d.packageSQL(plsql))
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка выполнения PL/SQL для pcsystem.PKG_EMAIL.GET_TEST_EMAIL()", zap.Error(err))
@@ -213,7 +266,7 @@ func (d *DBConnection) GetTestEmail() (string, error) {
 		}
 
 		query := "SELECT temp_test_email_pkg.get_email() FROM DUAL"
-		err = tx.QueryRowContext(queryCtx, query).Scan(&testEmail)
+		err = tx.QueryRowContext(queryCtx, d.packageSQL(query)).Scan(&testEmail)
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка выполнения SELECT для temp_test_email_pkg.get_email()", zap.Error(err))
@@ -252,10 +305,6 @@ func (d *DBConnection) ensureTestEmailPackageExistsTx(tx *sql.Tx, ctx context.Co
 			FUNCTION get_email RETURN VARCHAR2;
 		END temp_test_email_pkg;
 	`
-	_, err := tx.ExecContext(ctx, createPackageSQL)
-	if err != nil {
-		return fmt.Errorf("не удалось создать пакет temp_test_email_pkg: %w", err)
-	}
 
 	createPackageBodySQL := `
 		CREATE OR REPLACE PACKAGE BODY temp_test_email_pkg AS
@@ -265,12 +314,90 @@ func (d *DBConnection) ensureTestEmailPackageExistsTx(tx *sql.Tx, ctx context.Co
 			END;
 		END temp_test_email_pkg;
 	`
-	_, err = tx.ExecContext(ctx, createPackageBodySQL)
+	return d.ensureTempPackage(ctx, tx, "temp_test_email_pkg", createPackageSQL, createPackageBodySQL)
+}
+
+// GetSendSchedule получает окна расписания отправки на текущий день через pcsystem.PKG_EMAIL.GET_SEND_SCHEDULE()
+// Результат - строка вида "HH:mm-HH:mm;HH:mm-HH:mm", разбор выполняет вызывающая сторона
+// Пустая строка (NULL) - окон на текущий день нет, отправка закрыта (выходной или праздник)
+func (d *DBConnection) GetSendSchedule() (string, error) {
+	if !d.CheckConnection() {
+		return "", fmt.Errorf("соединение с БД недоступно")
+	}
+
+	queryCtx, queryCancel := context.WithTimeout(context.Background(), QueryTimeout)
+	defer queryCancel()
+
+	var schedule sql.NullString
+
+	err := d.WithDBTx(queryCtx, func(tx *sql.Tx) error {
+		if err := d.ensureSendSchedulePackageExistsTx(tx, queryCtx); err != nil {
+			return fmt.Errorf("ошибка создания пакета: %w", err)
+		}
+
+		plsql := `
+			BEGIN
+				temp_send_schedule_pkg.g_schedule := pcsystem.PKG_EMAIL.GET_SEND_SCHEDULE();
+			END;
+		`
+
+		_, err := tx.ExecContext(queryCtx, d.packageSQL(plsql))
+		if err != nil {
+			if logger.Log != nil {
+				logger.Log.Error("Ошибка выполнения PL/SQL для pcsystem.PKG_EMAIL.GET_SEND_SCHEDULE()", zap.Error(err))
+			}
+			return fmt.Errorf("ошибка выполнения PL/SQL: %w", err)
+		}
+
+		query := "SELECT temp_send_schedule_pkg.get_schedule() FROM DUAL"
+		err = tx.QueryRowContext(queryCtx, d.packageSQL(query)).Scan(&schedule)
+		if err != nil {
+			if logger.Log != nil {
+				logger.Log.Error("Ошибка выполнения SELECT для temp_send_schedule_pkg.get_schedule()", zap.Error(err))
+			}
+			return fmt.Errorf("ошибка получения расписания: %w", err)
+		}
+
+		return nil
+	})
+
 	if err != nil {
-		return fmt.Errorf("не удалось создать тело пакета temp_test_email_pkg: %w", err)
+		return "", err
 	}
 
-	return nil
+	if !schedule.Valid || schedule.String == "" {
+		if logger.Log != nil {
+			logger.Log.Debug("pcsystem.PKG_EMAIL.GET_SEND_SCHEDULE() вернула пустое расписание: отправка сегодня закрыта")
+		}
+		return "", nil
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("pcsystem.PKG_EMAIL.GET_SEND_SCHEDULE() result",
+			zap.String("schedule", schedule.String))
+	}
+	return schedule.String, nil
+}
+
+// ensureSendSchedulePackageExistsTx создает временный пакет Oracle для работы с функцией GET_SEND_SCHEDULE
+func (d *DBConnection) ensureSendSchedulePackageExistsTx(tx *sql.Tx, ctx context.Context) error {
+	createPackageSQL := `
+		CREATE OR REPLACE PACKAGE temp_send_schedule_pkg AS
+			g_schedule VARCHAR2(4000);
+			
+			FUNCTION get_schedule RETURN VARCHAR2;
+		END temp_send_schedule_pkg;
+	`
+
+	createPackageBodySQL := `
+		CREATE OR REPLACE PACKAGE BODY temp_send_schedule_pkg AS
+			FUNCTION get_schedule RETURN VARCHAR2 IS
+			BEGIN
+				RETURN g_schedule;
+			END;
+		END temp_send_schedule_pkg;
+	`
+	return d.ensureTempPackage(ctx, tx, "temp_send_schedule_pkg", createPackageSQL, createPackageBodySQL)
 }
 
 // GetWebServiceUrl получает адрес Crystal Reports через pcsystem.PKG_EMAIL.GET_SOAP_ADDRESS()
@@ -295,7 +422,7 @@ func (d *DBConnection) GetWebServiceUrl() (string, error) {
 			END;
 		`
 
-		_, err := tx.ExecContext(queryCtx, plsql)
+		_, err := tx.ExecContext(queryCtx, d.packageSQL(plsql))
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка выполнения PL/SQL для pcsystem.PKG_EMAIL.GET_SOAP_ADDRESS()", zap.Error(err))
@@ -304,7 +431,7 @@ func (d *DBConnection) GetWebServiceUrl() (string, error) {
 		}
 
 		query := "SELECT temp_webservice_url_pkg.get_url() FROM DUAL"
-		err = tx.QueryRowContext(queryCtx, query).Scan(&url)
+		err = tx.QueryRowContext(queryCtx, d.packageSQL(query)).Scan(&url)
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка выполнения SELECT для temp_webservice_url_pkg.get_url()", zap.Error(err))
@@ -339,10 +466,6 @@ func (d *DBConnection) ensureWebServiceUrlPackageExistsTx(tx *sql.Tx, ctx contex
 			FUNCTION get_url RETURN VARCHAR2;
 		END temp_webservice_url_pkg;
 	`
-	_, err := tx.ExecContext(ctx, createPackageSQL)
-	if err != nil {
-		return fmt.Errorf("не удалось создать пакет temp_webservice_url_pkg: %w", err)
-	}
 
 	createPackageBodySQL := `
 		CREATE OR REPLACE PACKAGE BODY temp_webservice_url_pkg AS
@@ -352,21 +475,22 @@ func (d *DBConnection) ensureWebServiceUrlPackageExistsTx(tx *sql.Tx, ctx contex
 			END;
 		END temp_webservice_url_pkg;
 	`
-	_, err = tx.ExecContext(ctx, createPackageBodySQL)
-	if err != nil {
-		return fmt.Errorf("не удалось создать тело пакета temp_webservice_url_pkg: %w", err)
-	}
-
-	return nil
+	return d.ensureTempPackage(ctx, tx, "temp_webservice_url_pkg", createPackageSQL, createPackageBodySQL)
 }
 
+// ErrClobTooLarge возвращается GetEmailReportClob, если вложение больше допустимого размера
+var ErrClobTooLarge = errors.New("CLOB вложения превышает допустимый размер")
+
 // GetEmailReportClob получает CLOB вложения через pcsystem.pkg_email.get_email_report_clob()
-func (d *DBConnection) GetEmailReportClob(taskID int64, clobID int64) ([]byte, error) {
+// Запрос ограничен QueryTimeout и контекстом вызывающего (таймаут получения вложения)
+// maxSize - максимальный размер вложения в байтах после декодирования Base64 (0 - без ограничения):
+// длина CLOB проверяется через DBMS_LOB.GETLENGTH до чтения, чтобы не загружать в память слишком большое вложение
+func (d *DBConnection) GetEmailReportClob(ctx context.Context, taskID int64, clobID int64, maxSize int64) ([]byte, error) {
 	if !d.CheckConnection() {
 		return nil, fmt.Errorf("соединение с БД недоступно")
 	}
 
-	queryCtx, queryCancel := context.WithTimeout(context.Background(), QueryTimeout)
+	queryCtx, queryCancel := context.WithTimeout(ctx, QueryTimeout)
 	defer queryCancel()
 
 	var clobData sql.NullString
@@ -385,7 +509,7 @@ func (d *DBConnection) GetEmailReportClob(taskID int64, clobID int64) ([]byte, e
 			END;
 		`
 
-		_, err := tx.ExecContext(queryCtx, plsql, clobID)
+		_, err := tx.ExecContext(queryCtx, d.packageSQL(plsql), clobID)
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка выполнения PL/SQL для pcsystem.pkg_email.get_email_report_clob()",
@@ -396,8 +520,27 @@ func (d *DBConnection) GetEmailReportClob(taskID int64, clobID int64) ([]byte, e
 			return fmt.Errorf("ошибка выполнения PL/SQL: %w", err)
 		}
 
+		if maxSize > 0 {
+			var clobLen sql.NullInt64
+			err = tx.QueryRowContext(queryCtx, d.packageSQL("SELECT DBMS_LOB.GETLENGTH(temp_email_report_clob_pkg.get_clob()) FROM DUAL")).Scan(&clobLen)
+			if err != nil {
+				return fmt.Errorf("ошибка получения размера CLOB: %w", err)
+			}
+			// n символов Base64 декодируются не более чем в n/4*3 байт (переносы строк уменьшают размер)
+			if decodedMax := clobLen.Int64 / 4 * 3; clobLen.Valid && decodedMax > maxSize {
+				if logger.Log != nil {
+					logger.Log.Warn("CLOB вложения превышает допустимый размер, чтение не выполняется",
+						zap.Int64("taskID", taskID),
+						zap.Int64("clobID", clobID),
+						zap.Int64("clobLength", clobLen.Int64),
+						zap.Int64("maxSize", maxSize))
+				}
+				return fmt.Errorf("%w: около %d байт (длина CLOB %d), лимит %d байт", ErrClobTooLarge, decodedMax, clobLen.Int64, maxSize)
+			}
+		}
+
 		query := "SELECT temp_email_report_clob_pkg.get_clob() FROM DUAL"
-		err = tx.QueryRowContext(queryCtx, query).Scan(&clobData)
+		err = tx.QueryRowContext(queryCtx, d.packageSQL(query)).Scan(&clobData)
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка выполнения SELECT для temp_email_report_clob_pkg.get_clob()",
@@ -430,6 +573,9 @@ func (d *DBConnection) GetEmailReportClob(taskID int64, clobID int64) ([]byte, e
 		}
 		return nil, fmt.Errorf("ошибка декодирования Base64: %w", err)
 	}
+	if maxSize > 0 && int64(len(decoded)) > maxSize {
+		return nil, fmt.Errorf("%w: %d байт, лимит %d байт", ErrClobTooLarge, len(decoded), maxSize)
+	}
 
 	if logger.Log != nil {
 		logger.Log.Debug("pcsystem.pkg_email.get_email_report_clob() result",
@@ -449,10 +595,6 @@ func (d *DBConnection) ensureEmailReportClobPackageExistsTx(tx *sql.Tx, ctx cont
 			FUNCTION get_clob RETURN CLOB;
 		END temp_email_report_clob_pkg;
 	`
-	_, err := tx.ExecContext(ctx, createPackageSQL)
-	if err != nil {
-		return fmt.Errorf("не удалось создать пакет temp_email_report_clob_pkg: %w", err)
-	}
 
 	createPackageBodySQL := `
 		CREATE OR REPLACE PACKAGE BODY temp_email_report_clob_pkg AS
@@ -462,10 +604,5 @@ func (d *DBConnection) ensureEmailReportClobPackageExistsTx(tx *sql.Tx, ctx cont
 			END;
 		END temp_email_report_clob_pkg;
 	`
-	_, err = tx.ExecContext(ctx, createPackageBodySQL)
-	if err != nil {
-		return fmt.Errorf("не удалось создать тело пакета temp_email_report_clob_pkg: %w", err)
-	}
-
-	return nil
+	return d.ensureTempPackage(ctx, tx, "temp_email_report_clob_pkg", createPackageSQL, createPackageBodySQL)
 }
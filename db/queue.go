@@ -6,6 +6,7 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -17,20 +18,69 @@ import (
 
 // QueueMessage представляет сообщение из очереди Oracle AQ
 type QueueMessage struct {
-	MessageID   string
-	XMLPayload  string
-	RawPayload  []byte
-	DequeueTime time.Time
+	MessageID    string
+	XMLPayload   string
+	RawPayload   []byte
+	DequeueTime  time.Time
+	EmptyPayload bool // Сообщение извлечено из очереди, но XMLSerialize вернул NULL или пустую строку
+}
+
+// ErrEmptyPayload возвращается при разборе сообщения, извлеченного из очереди без payload
+var ErrEmptyPayload = errors.New("сообщение пусто или не содержит XML")
+
+// ErrMalformedCDATA возвращается, если секция CDATA в сообщении очереди не закрыта или не открыта
+var ErrMalformedCDATA = errors.New("некорректная секция CDATA в сообщении очереди")
+
+// Обработка некорректной секции CDATA в body сообщения (параметр malformed_cdata секции [queue])
+const (
+	// MalformedCDATAReject - сообщение отклоняется с ошибкой разбора
+	MalformedCDATAReject = "REJECT"
+	// MalformedCDATARepair - незакрытая секция считается продолжающейся до конца body,
+	// лишний маркер ]]> без открывающего удаляется; в лог записывается предупреждение
+	MalformedCDATARepair = "REPAIR"
+)
+
+// Режимы навигации DBMS_AQ при извлечении сообщений
+const (
+	// NavigationFirstMessage - каждое сообщение извлекается как первое в очереди (строгий порядок
+	// сортировки очереди, в том числе по приоритету, с учетом сообщений, поступивших во время выборки)
+	NavigationFirstMessage = "FIRST_MESSAGE"
+	// NavigationNextMessage - сообщения извлекаются последовательно из снимка очереди
+	NavigationNextMessage = "NEXT_MESSAGE"
+	// NavigationFirstThenNext - первое сообщение пакета DequeueMany извлекается с FIRST_MESSAGE,
+	// остальные с NEXT_MESSAGE
+	NavigationFirstThenNext = "FIRST_THEN_NEXT"
+)
+
+// oracleIdentifierPattern - простой (без кавычек) идентификатор Oracle для queue_name и consumer_name
+var oracleIdentifierPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_$#]{0,127}$`)
+
+// validQueueName проверяет имя очереди: идентификатор, при необходимости с префиксом схемы (schema.queue)
+func validQueueName(name string) bool {
+	parts := strings.Split(name, ".")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if !oracleIdentifierPattern.MatchString(part) {
+			return false
+		}
+	}
+	return true
 }
 
 // QueueReader инкапсулирует работу с очередью Oracle AQ
 type QueueReader struct {
-	dbConn         *DBConnection
-	queueName      string
-	consumerName   string
-	waitTimeout    int // в секундах
-	mu             sync.Mutex
-	packageCreated bool // Флаг, указывающий, что пакет уже создан
+	dbConn       *DBConnection
+	queueName    string
+	consumerName string
+	waitTimeout  int    // в секундах
+	navigation   string // Режим навигации DBMS_AQ (NavigationFirstMessage и т.д.)
+	mu           sync.Mutex
+	// Обработка некорректной секции CDATA (MalformedCDATAReject или MalformedCDATARepair)
+	malformedCDATA string
+	// Пакетное извлечение сообщений одним PL/SQL блоком (array_dequeue); false - по одному сообщению
+	arrayDequeue bool
 }
 
 // NewQueueReader создает новый экземпляр QueueReader
@@ -42,10 +92,29 @@ func NewQueueReader(dbConn *DBConnection) (*QueueReader, error) {
 
 	// Проверяем секцию [queue] или используем значения по умолчанию
 	var queueName, consumerName string
+	navigation := NavigationFirstMessage
+	malformedCDATA := MalformedCDATAReject
+	arrayDequeue := false
 	if cfg.File.HasSection("queue") {
 		queueSec := cfg.File.Section("queue")
-		queueName = queueSec.Key("queue_name").String()
-		consumerName = queueSec.Key("consumer_name").String()
+		queueName = strings.TrimSpace(queueSec.Key("queue_name").String())
+		consumerName = strings.TrimSpace(queueSec.Key("consumer_name").String())
+		navigation = strings.ToUpper(strings.TrimSpace(queueSec.Key("navigation").MustString(NavigationFirstMessage)))
+		malformedCDATA = strings.ToUpper(strings.TrimSpace(queueSec.Key("malformed_cdata").MustString(MalformedCDATAReject)))
+		arrayDequeue = queueSec.Key("array_dequeue").MustBool(false)
+	}
+
+	switch navigation {
+	case NavigationFirstMessage, NavigationNextMessage, NavigationFirstThenNext:
+	default:
+		return nil, fmt.Errorf("неизвестный режим навигации очереди: %s (допустимо: %s, %s, %s)",
+			navigation, NavigationFirstMessage, NavigationNextMessage, NavigationFirstThenNext)
+	}
+	switch malformedCDATA {
+	case MalformedCDATAReject, MalformedCDATARepair:
+	default:
+		return nil, fmt.Errorf("неизвестный режим malformed_cdata: %s (допустимо: %s, %s)",
+			malformedCDATA, MalformedCDATAReject, MalformedCDATARepair)
 	}
 
 	if queueName == "" {
@@ -54,12 +123,22 @@ func NewQueueReader(dbConn *DBConnection) (*QueueReader, error) {
 	if consumerName == "" {
 		consumerName = "SUB_EMAIL_SENDER" // Значение по умолчанию
 	}
+	if !validQueueName(queueName) {
+		return nil, fmt.Errorf("недопустимое имя очереди queue_name: %q (ожидается имя или схема.имя)", queueName)
+	}
+	if !oracleIdentifierPattern.MatchString(consumerName) {
+		return nil, fmt.Errorf("недопустимое имя потребителя consumer_name: %q", consumerName)
+	}
 
 	return &QueueReader{
 		dbConn:       dbConn,
 		queueName:    queueName,
 		consumerName: consumerName,
 		waitTimeout:  2, // 2 секунды по умолчанию
+		navigation:   navigation,
+
+		malformedCDATA: malformedCDATA,
+		arrayDequeue:   arrayDequeue,
 	}, nil
 }
 
@@ -89,12 +168,18 @@ func (qr *QueueReader) DequeueMany(ctx context.Context, count int) ([]*QueueMess
 	opCtx, cancel := context.WithTimeout(ctx, ExecTimeout)
 	defer cancel()
 
-	// Создаем пакет один раз перед извлечением всех сообщений (если еще не создан)
-	if !qr.packageCreated {
-		if err := qr.ensurePackageExists(opCtx); err != nil {
-			return nil, fmt.Errorf("ошибка создания пакета: %w", err)
-		}
-		qr.packageCreated = true
+	// Пакет очереди - объект схемы, он создается при первой выборке и пересоздается только после ошибки
+	// отсутствующего или недействительного пакета (см. ensureTempPackage)
+	ensurePackage := qr.ensurePackageExists
+	if qr.arrayDequeue {
+		ensurePackage = qr.ensureArrayPackageExists
+	}
+	if err := ensurePackage(opCtx); err != nil {
+		return nil, fmt.Errorf("ошибка создания пакета: %w", err)
+	}
+
+	if qr.arrayDequeue {
+		return qr.dequeueArray(opCtx, count)
 	}
 
 	var messages []*QueueMessage
@@ -124,7 +209,7 @@ func (qr *QueueReader) DequeueMany(ctx context.Context, count int) ([]*QueueMess
 		}
 
 		// Используем opCtx для ограничения общего времени выполнения пакета
-		msg, err := qr.dequeueOneMessageWithTimeout(opCtx, timeout)
+		msg, err := qr.dequeueOneMessageWithTimeout(opCtx, timeout, qr.dequeueNavigation(i))
 		if err != nil {
 			if ctx.Err() != nil {
 				if logger.Log != nil {
@@ -163,17 +248,6 @@ func (qr *QueueReader) ensurePackageExists(ctx context.Context) error {
 		END temp_queue_pkg;
 	`
 
-	err := qr.dbConn.WithDB(func(db *sql.DB) error {
-		_, err := db.ExecContext(ctx, createPackageSQL)
-		if err != nil {
-			return fmt.Errorf("не удалось создать пакет: %w", err)
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-
 	createPackageBodySQL := `
 		CREATE OR REPLACE PACKAGE BODY temp_queue_pkg AS
 			FUNCTION get_success RETURN NUMBER IS
@@ -203,22 +277,31 @@ func (qr *QueueReader) ensurePackageExists(ctx context.Context) error {
 		END temp_queue_pkg;
 	`
 
-	err = qr.dbConn.WithDB(func(db *sql.DB) error {
-		_, err := db.ExecContext(ctx, createPackageBodySQL)
-		if err != nil {
-			return fmt.Errorf("не удалось создать тело пакета: %w", err)
-		}
-		return nil
+	return qr.dbConn.WithDB(func(db *sql.DB) error {
+		return qr.dbConn.ensureTempPackage(ctx, db, "temp_queue_pkg", createPackageSQL, createPackageBodySQL)
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	return nil
+// dequeueNavigation возвращает константу навигации DBMS_AQ для i-го сообщения пакета
+func (qr *QueueReader) dequeueNavigation(i int) string {
+	switch qr.navigation {
+	case NavigationNextMessage:
+		return NavigationNextMessage
+	case NavigationFirstThenNext:
+		if i > 0 {
+			return NavigationNextMessage
+		}
+	}
+	return NavigationFirstMessage
 }
 
 // dequeueOneMessageWithTimeout извлекает одно сообщение из очереди с указанным timeout (в секундах)
-func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout float64) (*QueueMessage, error) {
+// navigation - константа DBMS_AQ (FIRST_MESSAGE или NEXT_MESSAGE), подставляется в PL/SQL блок
+func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout float64, navigation string) (*QueueMessage, error) {
+	if navigation != NavigationFirstMessage && navigation != NavigationNextMessage {
+		return nil, fmt.Errorf("недопустимый режим навигации DBMS_AQ: %s", navigation)
+	}
+
 	plsql := `
 		DECLARE
 			v_dequeue_options DBMS_AQ.dequeue_options_t;
@@ -233,7 +316,7 @@ func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout
 			-- Настраиваем опции dequeue
 			v_dequeue_options.dequeue_mode := DBMS_AQ.REMOVE;
 			v_dequeue_options.wait := :1;
-			v_dequeue_options.navigation := DBMS_AQ.FIRST_MESSAGE;
+			v_dequeue_options.navigation := DBMS_AQ.{{NAVIGATION}};
 			
 			-- Устанавливаем consumer_name только если он не пустой
 			IF :2 IS NOT NULL THEN
@@ -271,6 +354,9 @@ func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout
 		END;
 	`
 
+	// Константа навигации не может передаваться bind-переменной, значение проверено выше
+	plsql = strings.Replace(plsql, "{{NAVIGATION}}", navigation, 1)
+
 	var consumerParam interface{}
 	if qr.consumerName == "" {
 		consumerParam = nil
@@ -287,7 +373,7 @@ func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout
 
 	var msg *QueueMessage
 	err := qr.dbConn.WithDBTx(txCtx, func(tx *sql.Tx) error {
-		_, err := tx.ExecContext(txCtx, plsql,
+		_, err := tx.ExecContext(txCtx, qr.dbConn.packageSQL(plsql),
 			timeout,
 			consumerParam,
 			qr.queueName,
@@ -326,7 +412,7 @@ func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout
 		checkSuccessSQL := `SELECT temp_queue_pkg.get_success(), temp_queue_pkg.get_error_code(), temp_queue_pkg.get_error_msg() FROM DUAL`
 		var successFlag, errorCode sql.NullInt64
 		var errorMsg sql.NullString
-		err = tx.QueryRowContext(txCtx, checkSuccessSQL).Scan(&successFlag, &errorCode, &errorMsg)
+		err = tx.QueryRowContext(txCtx, qr.dbConn.packageSQL(checkSuccessSQL)).Scan(&successFlag, &errorCode, &errorMsg)
 		if err != nil {
 			isContextCanceled := ctx.Err() == context.Canceled || txCtx.Err() == context.Canceled
 			if isContextCanceled {
@@ -353,7 +439,7 @@ func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout
 		             XMLSerialize(DOCUMENT temp_queue_pkg.get_payload() AS CLOB) as payload 
 		          FROM DUAL`
 
-		rows, err := tx.QueryContext(txCtx, query)
+		rows, err := tx.QueryContext(txCtx, qr.dbConn.packageSQL(query))
 		if err != nil {
 			if logger.Log != nil {
 				logger.Log.Error("Ошибка выполнения SELECT с XMLSerialize", zap.Error(err))
@@ -371,22 +457,34 @@ func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout
 			return fmt.Errorf("ошибка чтения данных: %w", err)
 		}
 
+		msgidStr := ""
+		if msgid.Valid {
+			msgidStr = msgid.String
+		}
+
+		// DEQUEUE прошел успешно, значит сообщение уже удалено из AQ: пустой payload - это не пустая очередь,
+		// а потерянное сообщение, которое нужно вернуть вызывающему коду, а не отбросить молча
 		if !payload.Valid || payload.String == "" {
+			msg = &QueueMessage{
+				MessageID:    msgidStr,
+				DequeueTime:  qr.dbConn.clock.Now(),
+				EmptyPayload: true,
+			}
+			if logger.Log != nil {
+				logger.Log.Error("Сообщение извлечено из очереди, но payload пуст (XMLSerialize вернул NULL)",
+					zap.String("messageID", msgidStr),
+					zap.Bool("payloadNull", !payload.Valid))
+			}
 			return nil
 		}
 
 		xmlString := payload.String
 
-		msgidStr := ""
-		if msgid.Valid {
-			msgidStr = msgid.String
-		}
-
 		msg = &QueueMessage{
 			MessageID:   msgidStr,
 			XMLPayload:  xmlString,
 			RawPayload:  []byte(xmlString),
-			DequeueTime: time.Now(),
+			DequeueTime: qr.dbConn.clock.Now(),
 		}
 
 		if logger.Log != nil {
@@ -414,7 +512,7 @@ func (qr *QueueReader) dequeueOneMessageWithTimeout(ctx context.Context, timeout
 // ParseXMLMessage парсит XML сообщение из очереди
 func (qr *QueueReader) ParseXMLMessage(msg *QueueMessage) (map[string]interface{}, error) {
 	if msg == nil || msg.XMLPayload == "" {
-		return nil, errors.New("сообщение пусто или не содержит XML")
+		return nil, ErrEmptyPayload
 	}
 
 	// Парсим корневой элемент root
@@ -428,6 +526,21 @@ func (qr *QueueReader) ParseXMLMessage(msg *QueueMessage) (map[string]interface{
 		} `xml:"body"`
 	}
 
+	// Секции CDATA проверяются до разбора; исправленное в режиме REPAIR сообщение сохраняется в msg,
+	// чтобы вложения разбирались из того же XML
+	payload, err := checkCDATA(msg.XMLPayload, qr.malformedCDATA == MalformedCDATARepair)
+	if err != nil {
+		if qr.malformedCDATA != MalformedCDATARepair || payload == msg.XMLPayload {
+			return nil, fmt.Errorf("%w, XML: %s", err, truncateString(msg.XMLPayload, 500))
+		}
+		if logger.Log != nil {
+			logger.Log.Warn("Секция CDATA в сообщении исправлена",
+				zap.String("messageID", msg.MessageID),
+				zap.Error(err))
+		}
+		msg.XMLPayload = payload
+	}
+
 	var root Root
 	xmlBytes := []byte(msg.XMLPayload)
 	if err := xml.Unmarshal(xmlBytes, &root); err != nil {
@@ -436,12 +549,26 @@ func (qr *QueueReader) ParseXMLMessage(msg *QueueMessage) (map[string]interface{
 
 	// Парсим внутренний XML из body
 	type EmailData struct {
-		EmailTaskID     string `xml:"email_task_id,attr"`
-		SmtpID          string `xml:"smtp_id,attr"`
-		EmailAddress    string `xml:"email_address,attr"`
-		EmailTitle      string `xml:"email_title,attr"`
-		EmailText       string `xml:"email_text,attr"`
-		SendingSchedule string `xml:"sending_schedule,attr"`
+		EmailTaskID       string `xml:"email_task_id,attr"`
+		SmtpID            string `xml:"smtp_id,attr"`
+		EmailAddress      string `xml:"email_address,attr"`
+		EmailTitle        string `xml:"email_title,attr"`
+		EmailText         string `xml:"email_text,attr"`
+		EmailTextPlain    string `xml:"email_text_plain,attr"`
+		EmailTextHTML     string `xml:"email_text_html,attr"`
+		SendingSchedule   string `xml:"sending_schedule,attr"`
+		BypassSchedule    string `xml:"bypass_schedule,attr"`
+		Bulk              string `xml:"bulk,attr"`
+		ListUnsubscribe   string `xml:"list_unsubscribe,attr"`
+		ExpiresAt         string `xml:"expires_at,attr"`
+		RecipientTimezone string `xml:"recipient_timezone,attr"`
+		Language          string `xml:"language,attr"`
+		Headers           struct {
+			Header []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"header"`
+		} `xml:"headers"`
 	}
 
 	var emailData EmailData
@@ -459,21 +586,85 @@ func (qr *QueueReader) ParseXMLMessage(msg *QueueMessage) (map[string]interface{
 		return nil, fmt.Errorf("ошибка парсинга внутреннего XML из body: %w, body content: %s", err, truncateString(bodyXML, 500))
 	}
 
+	// Дополнительные заголовки письма: <headers><header name="..." value="..."/></headers>
+	// Проверка имен и значений выполняется в email.ParseEmailMessage
+	var customHeaders map[string]string
+	if len(emailData.Headers.Header) > 0 {
+		customHeaders = make(map[string]string, len(emailData.Headers.Header))
+		for _, h := range emailData.Headers.Header {
+			customHeaders[h.Name] = h.Value
+		}
+	}
+
 	result := map[string]interface{}{
-		"message_id":       msg.MessageID,
-		"dequeue_time":     msg.DequeueTime,
-		"date_active_from": root.Head.DateActiveFrom,
-		"email_task_id":    emailData.EmailTaskID,
-		"smtp_id":          emailData.SmtpID,
-		"email_address":    emailData.EmailAddress,
-		"email_title":      emailData.EmailTitle,
-		"email_text":       emailData.EmailText,
-		"sending_schedule": emailData.SendingSchedule,
+		"message_id":         msg.MessageID,
+		"dequeue_time":       msg.DequeueTime,
+		"date_active_from":   root.Head.DateActiveFrom,
+		"email_task_id":      emailData.EmailTaskID,
+		"smtp_id":            emailData.SmtpID,
+		"email_address":      emailData.EmailAddress,
+		"email_title":        emailData.EmailTitle,
+		"email_text":         emailData.EmailText,
+		"email_text_plain":   emailData.EmailTextPlain,
+		"email_text_html":    emailData.EmailTextHTML,
+		"sending_schedule":   emailData.SendingSchedule,
+		"bypass_schedule":    emailData.BypassSchedule,
+		"bulk":               emailData.Bulk,
+		"list_unsubscribe":   emailData.ListUnsubscribe,
+		"expires_at":         emailData.ExpiresAt,
+		"recipient_timezone": emailData.RecipientTimezone,
+		"language":           emailData.Language,
+		"custom_headers":     customHeaders,
 	}
 
 	return result, nil
 }
 
+// checkCDATA проверяет парность маркеров CDATA в сообщении до разбора XML: без проверки незакрытая
+// секция или лишний ]]> дают малопонятную синтаксическую ошибку XML. Сообщение без CDATA (обычный XML)
+// считается корректным. При repair незакрытая секция закрывается перед </body>, лишний ]]> удаляется;
+// возвращаются исправленное сообщение и ErrMalformedCDATA с описанием исправления
+func checkCDATA(payload string, repair bool) (string, error) {
+	const cdataStart, cdataEnd = "<![CDATA[", "]]>"
+
+	var problems []string
+	pos := 0
+	for {
+		start := strings.Index(payload[pos:], cdataStart)
+		end := strings.Index(payload[pos:], cdataEnd)
+		if end != -1 && (start == -1 || end < start) {
+			problems = append(problems, fmt.Sprintf("маркер %s без открывающего %s (позиция %d)", cdataEnd, cdataStart, pos+end))
+			if !repair {
+				break
+			}
+			payload = payload[:pos+end] + payload[pos+end+len(cdataEnd):]
+			continue
+		}
+		if start == -1 {
+			break
+		}
+
+		contentStart := pos + start + len(cdataStart)
+		end = strings.Index(payload[contentStart:], cdataEnd)
+		if end != -1 {
+			pos = contentStart + end + len(cdataEnd)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("нет завершающего %s для секции, начатой в позиции %d", cdataEnd, pos+start))
+		bodyEnd := strings.LastIndex(payload, "</body>")
+		if !repair || bodyEnd < contentStart {
+			return payload, fmt.Errorf("%w: %s", ErrMalformedCDATA, strings.Join(problems, "; "))
+		}
+		payload = payload[:bodyEnd] + cdataEnd + payload[bodyEnd:]
+		break
+	}
+
+	if len(problems) == 0 {
+		return payload, nil
+	}
+	return payload, fmt.Errorf("%w: %s", ErrMalformedCDATA, strings.Join(problems, "; "))
+}
+
 // extractCDATAContent извлекает содержимое из CDATA секции
 func extractCDATAContent(s string) string {
 	s = strings.TrimSpace(s)
@@ -515,6 +706,11 @@ func (qr *QueueReader) GetQueueName() string {
 	return qr.queueName
 }
 
+// GetNavigation возвращает режим навигации DBMS_AQ
+func (qr *QueueReader) GetNavigation() string {
+	return qr.navigation
+}
+
 // GetConsumerName возвращает имя consumer
 func (qr *QueueReader) GetConsumerName() string {
 	return qr.consumerName
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+)
+
+// ensureArrayPackageExists создает пакет Oracle для пакетного извлечения сообщений (array_dequeue)
+// Извлеченные сообщения сохраняются в коллекции пакета и читаются одним запросом через конвейерную функцию
+func (qr *QueueReader) ensureArrayPackageExists(ctx context.Context) error {
+	createPackageSQL := `
+		CREATE OR REPLACE PACKAGE temp_queue_array_pkg AS
+			TYPE t_message IS RECORD (
+				seq NUMBER,
+				msgid RAW(16),
+				payload CLOB
+			);
+			TYPE t_messages IS TABLE OF t_message;
+
+			g_messages t_messages := t_messages();
+
+			FUNCTION get_messages RETURN t_messages PIPELINED;
+		END temp_queue_array_pkg;
+	`
+
+	createPackageBodySQL := `
+		CREATE OR REPLACE PACKAGE BODY temp_queue_array_pkg AS
+			FUNCTION get_messages RETURN t_messages PIPELINED IS
+			BEGIN
+				FOR i IN 1 .. g_messages.COUNT LOOP
+					PIPE ROW (g_messages(i));
+				END LOOP;
+				RETURN;
+			END;
+		END temp_queue_array_pkg;
+	`
+
+	return qr.dbConn.WithDB(func(db *sql.DB) error {
+		return qr.dbConn.ensureTempPackage(ctx, db, "temp_queue_array_pkg", createPackageSQL, createPackageBodySQL)
+	})
+}
+
+// dequeueArray извлекает до count сообщений одним PL/SQL блоком и читает их одним запросом в той же
+// транзакции: два обращения к БД на пакет вместо трех на каждое сообщение
+// Первое сообщение ожидается waitTimeout секунд, остальные извлекаются без ожидания; пустая очередь
+// (ORA-25228) завершает выборку. При ошибке или отмене контекста транзакция откатывается, и сообщения
+// остаются в очереди
+func (qr *QueueReader) dequeueArray(ctx context.Context, count int) ([]*QueueMessage, error) {
+	plsql := `
+		DECLARE
+			v_dequeue_options DBMS_AQ.dequeue_options_t;
+			v_message_properties DBMS_AQ.message_properties_t;
+			v_wait BINARY_INTEGER := :1;
+			v_consumer_name VARCHAR2(128) := :2;
+			v_queue_name VARCHAR2(128) := :3;
+			v_max_count PLS_INTEGER := :4;
+			v_payload XMLType;
+			v_msgid RAW(16);
+			v_count PLS_INTEGER := 0;
+		BEGIN
+			temp_queue_array_pkg.g_messages := temp_queue_array_pkg.t_messages();
+
+			v_dequeue_options.dequeue_mode := DBMS_AQ.REMOVE;
+
+			-- Устанавливаем consumer_name только если он не пустой
+			IF LENGTH(TRIM(v_consumer_name)) > 0 THEN
+				v_dequeue_options.consumer_name := TRIM(v_consumer_name);
+			END IF;
+
+			FOR i IN 1 .. v_max_count LOOP
+				IF i = 1 THEN
+					v_dequeue_options.wait := v_wait;
+					v_dequeue_options.navigation := DBMS_AQ.{{FIRST_NAVIGATION}};
+				ELSE
+					-- Остальные сообщения пакета извлекаются без ожидания
+					v_dequeue_options.wait := DBMS_AQ.NO_WAIT;
+					v_dequeue_options.navigation := DBMS_AQ.{{NEXT_NAVIGATION}};
+				END IF;
+
+				v_payload := NULL;
+				BEGIN
+					DBMS_AQ.DEQUEUE(
+						queue_name => v_queue_name,
+						dequeue_options => v_dequeue_options,
+						message_properties => v_message_properties,
+						payload => v_payload,
+						msgid => v_msgid
+					);
+				EXCEPTION
+					WHEN OTHERS THEN
+						IF SQLCODE = -25228 THEN
+							-- Очередь пуста - это нормально
+							EXIT;
+						END IF;
+						RAISE;
+				END;
+
+				v_count := v_count + 1;
+				temp_queue_array_pkg.g_messages.EXTEND;
+				temp_queue_array_pkg.g_messages(v_count).seq := v_count;
+				temp_queue_array_pkg.g_messages(v_count).msgid := v_msgid;
+				IF v_payload IS NOT NULL THEN
+					temp_queue_array_pkg.g_messages(v_count).payload := v_payload.getClobVal();
+				END IF;
+			END LOOP;
+		END;
+	`
+
+	// Константы навигации не могут передаваться bind-переменными, значения проверены в NewQueueReader
+	plsql = strings.Replace(plsql, "{{FIRST_NAVIGATION}}", qr.dequeueNavigation(0), 1)
+	plsql = strings.Replace(plsql, "{{NEXT_NAVIGATION}}", qr.dequeueNavigation(1), 1)
+
+	var consumerParam interface{}
+	if qr.consumerName != "" {
+		consumerParam = strings.TrimSpace(qr.consumerName)
+	}
+
+	txTimeout := time.Duration(qr.waitTimeout)*time.Second + 5*time.Second
+	if txTimeout > ExecTimeout {
+		txTimeout = ExecTimeout
+	}
+	txCtx, txCancel := context.WithTimeout(ctx, txTimeout)
+	defer txCancel()
+
+	var messages []*QueueMessage
+	err := qr.dbConn.WithDBTx(txCtx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(txCtx, qr.dbConn.packageSQL(plsql),
+			qr.waitTimeout,
+			consumerParam,
+			qr.queueName,
+			count,
+		); err != nil {
+			if ctx.Err() == context.Canceled || txCtx.Err() == context.Canceled {
+				return fmt.Errorf("операция отменена: %w", ctx.Err())
+			}
+			if logger.Log != nil {
+				logger.Log.Error("Ошибка выполнения PL/SQL для пакетного dequeue",
+					zap.Error(err),
+					zap.String("consumer", qr.consumerName),
+					zap.String("queue", qr.queueName),
+					zap.Int("count", count))
+			}
+			return fmt.Errorf("ошибка выполнения PL/SQL: %w", err)
+		}
+
+		query := `SELECT RAWTOHEX(msgid) AS msgid, payload
+		          FROM TABLE(temp_queue_array_pkg.get_messages())
+		          ORDER BY seq`
+
+		rows, err := tx.QueryContext(txCtx, qr.dbConn.packageSQL(query))
+		if err != nil {
+			if ctx.Err() == context.Canceled || txCtx.Err() == context.Canceled {
+				return fmt.Errorf("операция отменена: %w", ctx.Err())
+			}
+			return fmt.Errorf("ошибка чтения извлеченных сообщений: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var msgid, payload sql.NullString
+			if err := rows.Scan(&msgid, &payload); err != nil {
+				return fmt.Errorf("ошибка чтения данных: %w", err)
+			}
+			messages = append(messages, qr.newDequeuedMessage(msgid, payload))
+		}
+		return rows.Err()
+	})
+
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			if logger.Log != nil {
+				logger.Log.Info("Пакетный dequeue отменен из-за graceful shutdown, сообщения остаются в очереди")
+			}
+			return nil, fmt.Errorf("операция отменена: %w", ctx.Err())
+		}
+		return nil, err
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("Пакетный dequeue выполнен",
+			zap.Int("requested", count),
+			zap.Int("received", len(messages)))
+	}
+	return messages, nil
+}
+
+// newDequeuedMessage формирует QueueMessage из идентификатора и payload, прочитанных после DEQUEUE
+// Сообщение уже удалено из AQ: пустой payload возвращается как EmptyPayload, а не отбрасывается
+func (qr *QueueReader) newDequeuedMessage(msgid, payload sql.NullString) *QueueMessage {
+	msgidStr := ""
+	if msgid.Valid {
+		msgidStr = msgid.String
+	}
+
+	if !payload.Valid || payload.String == "" {
+		if logger.Log != nil {
+			logger.Log.Error("Сообщение извлечено из очереди, но payload пуст",
+				zap.String("messageID", msgidStr),
+				zap.Bool("payloadNull", !payload.Valid))
+		}
+		return &QueueMessage{
+			MessageID:    msgidStr,
+			DequeueTime:  qr.dbConn.clock.Now(),
+			EmptyPayload: true,
+		}
+	}
+
+	msg := &QueueMessage{
+		MessageID:   msgidStr,
+		XMLPayload:  payload.String,
+		RawPayload:  []byte(payload.String),
+		DequeueTime: qr.dbConn.clock.Now(),
+	}
+	if logger.Log != nil {
+		logger.Log.Debug("Получено сообщение из очереди",
+			zap.String("messageID", msg.MessageID),
+			zap.Int("size", len(msg.RawPayload)))
+	}
+	return msg
+}
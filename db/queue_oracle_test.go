@@ -0,0 +1,236 @@
+//go:build oracle
+
+// Интеграционные тесты извлечения сообщений из Oracle AQ на реальной БД
+// Запуск: EMAIL_SERVICE_TEST_CONFIG=/path/settings.ini go test -tags oracle -run Oracle -bench Oracle ./db
+// Используется секция [ORACLE] файла; пользователю нужны права на DBMS_AQADM и DBMS_AQ
+// Тест создает в схеме пользователя собственную очередь и удаляет ее по завершении, рабочая очередь
+// из секции [queue] не затрагивается
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"email-service/settings"
+)
+
+const (
+	oracleTestQueueTable = "es_test_qt"
+	oracleTestQueue      = "es_test_q"
+	oracleTestConsumer   = "ES_TEST_CONSUMER"
+)
+
+// openOracleTest подключается к БД из EMAIL_SERVICE_TEST_CONFIG и создает тестовую очередь
+func openOracleTest(tb testing.TB) *DBConnection {
+	tb.Helper()
+	path := os.Getenv("EMAIL_SERVICE_TEST_CONFIG")
+	if path == "" {
+		tb.Skip("EMAIL_SERVICE_TEST_CONFIG не задан")
+	}
+	cfg, err := settings.LoadConfig(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// Тестовая очередь и отдельный префикс временных пакетов, чтобы не мешать работающему сервису
+	queueSec := cfg.File.Section("queue")
+	queueSec.Key("queue_name").SetValue(oracleTestQueue)
+	queueSec.Key("consumer_name").SetValue(oracleTestConsumer)
+	queueSec.Key("package_prefix").SetValue("estest_")
+
+	dbConn, err := NewDBConnection(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := dbConn.OpenConnection(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(dbConn.CloseConnection)
+
+	dropOracleTestQueue(dbConn)
+	err = dbConn.WithDB(func(db *sql.DB) error {
+		_, err := db.Exec(fmt.Sprintf(`
+			BEGIN
+				DBMS_AQADM.CREATE_QUEUE_TABLE(
+					queue_table => '%s',
+					queue_payload_type => 'SYS.XMLTYPE',
+					multiple_consumers => TRUE);
+				DBMS_AQADM.CREATE_QUEUE(queue_name => '%s', queue_table => '%s');
+				DBMS_AQADM.START_QUEUE(queue_name => '%s');
+				DBMS_AQADM.ADD_SUBSCRIBER(
+					queue_name => '%s',
+					subscriber => SYS.AQ$_AGENT('%s', NULL, NULL));
+			END;`,
+			oracleTestQueueTable, oracleTestQueue, oracleTestQueueTable, oracleTestQueue,
+			oracleTestQueue, oracleTestConsumer))
+		return err
+	})
+	if err != nil {
+		tb.Fatalf("ошибка создания тестовой очереди: %v", err)
+	}
+	tb.Cleanup(func() { dropOracleTestQueue(dbConn) })
+	return dbConn
+}
+
+// dropOracleTestQueue удаляет тестовую очередь вместе с таблицей, если они остались от прошлого запуска
+func dropOracleTestQueue(dbConn *DBConnection) {
+	dbConn.WithDB(func(db *sql.DB) error {
+		_, err := db.Exec(fmt.Sprintf(`
+			BEGIN
+				DBMS_AQADM.DROP_QUEUE_TABLE(queue_table => '%s', force => TRUE);
+			EXCEPTION
+				WHEN OTHERS THEN
+					IF SQLCODE != -24002 THEN
+						RAISE;
+					END IF;
+			END;`, oracleTestQueueTable))
+		return err
+	})
+}
+
+// enqueueOracleTest помещает в тестовую очередь count сообщений с номерами по порядку
+func enqueueOracleTest(tb testing.TB, dbConn *DBConnection, count int) {
+	tb.Helper()
+	err := dbConn.WithDB(func(db *sql.DB) error {
+		_, err := db.Exec(fmt.Sprintf(`
+			DECLARE
+				v_enqueue_options DBMS_AQ.enqueue_options_t;
+				v_message_properties DBMS_AQ.message_properties_t;
+				v_msgid RAW(16);
+			BEGIN
+				FOR i IN 1 .. :1 LOOP
+					DBMS_AQ.ENQUEUE(
+						queue_name => '%s',
+						enqueue_options => v_enqueue_options,
+						message_properties => v_message_properties,
+						payload => XMLType('<email><seq>' || i || '</seq></email>'),
+						msgid => v_msgid);
+				END LOOP;
+				COMMIT;
+			END;`, oracleTestQueue), count)
+		return err
+	})
+	if err != nil {
+		tb.Fatalf("ошибка помещения сообщений в очередь: %v", err)
+	}
+}
+
+// newOracleTestReader создает QueueReader тестовой очереди в режиме array_dequeue или по одному сообщению
+func newOracleTestReader(tb testing.TB, dbConn *DBConnection, arrayDequeue bool) *QueueReader {
+	tb.Helper()
+	dbConn.GetConfig().File.Section("queue").Key("array_dequeue").SetValue(fmt.Sprint(arrayDequeue))
+	qr, err := NewQueueReader(dbConn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	qr.SetWaitTimeout(1)
+	return qr
+}
+
+func TestOracleArrayDequeue(t *testing.T) {
+	dbConn := openOracleTest(t)
+	qr := newOracleTestReader(t, dbConn, true)
+	ctx := context.Background()
+
+	const total = 25
+	enqueueOracleTest(t, dbConn, total)
+
+	// Пакет из 10 сообщений извлекается одним вызовом в порядке помещения в очередь
+	var received []*QueueMessage
+	calls := 0
+	for len(received) < total {
+		start := time.Now()
+		messages, err := qr.DequeueMany(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		t.Logf("вызов %d: %d сообщений за %s", calls, len(messages), time.Since(start))
+		if len(messages) == 0 {
+			t.Fatalf("очередь пуста после %d из %d сообщений", len(received), total)
+		}
+		received = append(received, messages...)
+	}
+	if calls != 3 {
+		t.Errorf("вызовов DequeueMany: %d, ожидалось 3 (10 + 10 + 5)", calls)
+	}
+	for i, msg := range received {
+		if msg.EmptyPayload || msg.MessageID == "" {
+			t.Fatalf("сообщение %d: MessageID=%q EmptyPayload=%v", i+1, msg.MessageID, msg.EmptyPayload)
+		}
+		if want := fmt.Sprintf("<seq>%d</seq>", i+1); !strings.Contains(msg.XMLPayload, want) {
+			t.Errorf("сообщение %d: payload %q не содержит %s", i+1, msg.XMLPayload, want)
+		}
+	}
+
+	// Пустая очередь (ORA-25228) - пустой результат без ошибки
+	messages, err := qr.DequeueMany(ctx, 10)
+	if err != nil || len(messages) != 0 {
+		t.Errorf("пустая очередь: %d сообщений, ошибка %v", len(messages), err)
+	}
+}
+
+func TestOracleArrayDequeueCanceledKeepsMessages(t *testing.T) {
+	dbConn := openOracleTest(t)
+	qr := newOracleTestReader(t, dbConn, true)
+	enqueueOracleTest(t, dbConn, 3)
+
+	// Отмененная выборка откатывается, и сообщения остаются в очереди
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := qr.DequeueMany(ctx, 10); err == nil {
+		t.Fatal("выборка с отмененным контекстом завершилась без ошибки")
+	}
+
+	messages, err := qr.DequeueMany(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("после отмены в очереди %d сообщений, ожидалось 3", len(messages))
+	}
+}
+
+// BenchmarkOracleDequeue сравнивает пакетное извлечение и извлечение по одному сообщению
+// Метрика msgs/call - сообщений за вызов DequeueMany, ns/msg - время на одно сообщение
+func BenchmarkOracleDequeue(b *testing.B) {
+	const batch = 100
+	for _, mode := range []struct {
+		name         string
+		arrayDequeue bool
+	}{
+		{"array", true},
+		{"single", false},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			dbConn := openOracleTest(b)
+			qr := newOracleTestReader(b, dbConn, mode.arrayDequeue)
+			ctx := context.Background()
+
+			received, calls := 0, 0
+			var elapsed time.Duration
+			for b.Loop() {
+				b.StopTimer()
+				enqueueOracleTest(b, dbConn, batch)
+				b.StartTimer()
+
+				start := time.Now()
+				messages, err := qr.DequeueMany(ctx, batch)
+				elapsed += time.Since(start)
+				if err != nil {
+					b.Fatal(err)
+				}
+				received += len(messages)
+				calls++
+			}
+			if calls > 0 && received > 0 {
+				b.ReportMetric(float64(received)/float64(calls), "msgs/call")
+				b.ReportMetric(float64(elapsed.Nanoseconds())/float64(received), "ns/msg")
+			}
+		})
+	}
+}
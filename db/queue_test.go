@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+const (
+	cdataEmail    = `<email email_task_id="5" smtp_id="0" email_address="user@example.org"/>`
+	cdataBalanced = `<root><head></head><body><![CDATA[` + cdataEmail + `]]></body></root>`
+	cdataAbsent   = `<root><head></head><body>` + cdataEmail + `</body></root>`
+	cdataUnclosed = `<root><head></head><body><![CDATA[` + cdataEmail + `</body></root>`
+	cdataUnopened = `<root><head></head><body>` + cdataEmail + `]]></body></root>`
+)
+
+func TestCheckCDATA(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     string
+		repair      bool
+		wantPayload string
+		wantErr     bool
+	}{
+		{"сбалансированная секция", cdataBalanced, false, cdataBalanced, false},
+		{"без CDATA", cdataAbsent, false, cdataAbsent, false},
+		{"две секции", `<a><![CDATA[x]]><![CDATA[y]]></a>`, false, `<a><![CDATA[x]]><![CDATA[y]]></a>`, false},
+		{"незакрытая секция", cdataUnclosed, false, cdataUnclosed, true},
+		{"лишний маркер", cdataUnopened, false, cdataUnopened, true},
+		{"незакрытая секция исправляется", cdataUnclosed, true, cdataBalanced, true},
+		{"лишний маркер удаляется", cdataUnopened, true, cdataAbsent, true},
+		{"незакрытая секция без </body>", `<root><body><![CDATA[x`, true, `<root><body><![CDATA[x`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := checkCDATA(tt.payload, tt.repair)
+			if payload != tt.wantPayload {
+				t.Errorf("checkCDATA() = %q, ожидалось %q", payload, tt.wantPayload)
+			}
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrMalformedCDATA)) {
+				t.Errorf("ошибка %v, ожидалась ErrMalformedCDATA: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseXMLMessageCDATA(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		payload string
+		wantErr bool
+	}{
+		{"сбалансированная секция", MalformedCDATAReject, cdataBalanced, false},
+		{"без CDATA", MalformedCDATAReject, cdataAbsent, false},
+		{"незакрытая секция отклоняется", MalformedCDATAReject, cdataUnclosed, true},
+		{"лишний маркер отклоняется", MalformedCDATAReject, cdataUnopened, true},
+		{"незакрытая секция исправляется", MalformedCDATARepair, cdataUnclosed, false},
+		{"лишний маркер удаляется", MalformedCDATARepair, cdataUnopened, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr := &QueueReader{malformedCDATA: tt.mode}
+			msg := &QueueMessage{MessageID: "m1", XMLPayload: tt.payload}
+			data, err := qr.ParseXMLMessage(msg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMalformedCDATA) {
+					t.Fatalf("ошибка %v, ожидалась ErrMalformedCDATA", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("сообщение не разобрано: %v", err)
+			}
+			if data["email_task_id"] != "5" || data["email_address"] != "user@example.org" {
+				t.Errorf("разобрано %v", data)
+			}
+		})
+	}
+}
+
+func TestValidQueueName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"aq_ask", true},
+		{"askaq.aq_ask", true},
+		{"ASKAQ.AQ$ASK#1", true},
+		{"", false},
+		{"askaq.", false},
+		{".aq_ask", false},
+		{"a.b.c", false},
+		{"1queue", false},
+		{"aq_ask'; DROP TABLE x; --", false},
+		{`"askaq"."aq_ask"`, false},
+		{"aq ask", false},
+	}
+	for _, tt := range tests {
+		if got := validQueueName(tt.name); got != tt.want {
+			t.Errorf("validQueueName(%q) = %v, ожидалось %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewQueueReaderSettings(t *testing.T) {
+	tests := []struct {
+		queue        string
+		wantErr      bool
+		wantQueue    string
+		wantConsumer string
+		wantArray    bool
+	}{
+		{queue: "", wantQueue: "askaq.aq_ask", wantConsumer: "SUB_EMAIL_SENDER"},
+		{queue: "queue_name = app.email_q\nconsumer_name = SUB_APP", wantQueue: "app.email_q", wantConsumer: "SUB_APP"},
+		{queue: "array_dequeue = true", wantQueue: "askaq.aq_ask", wantConsumer: "SUB_EMAIL_SENDER", wantArray: true},
+		{queue: "queue_name = app.email-q", wantErr: true},
+		{queue: "queue_name = a.b.c", wantErr: true},
+		{queue: "consumer_name = SUB-APP", wantErr: true},
+		{queue: "consumer_name = SUB APP", wantErr: true},
+		{queue: "navigation = LAST_MESSAGE", wantErr: true},
+		{queue: "malformed_cdata = ignore", wantErr: true},
+	}
+	for _, tt := range tests {
+		d, _ := newTestDBConnection(t, newQueueConfig(t, tt.queue))
+		qr, err := NewQueueReader(d)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: ожидалась ошибка", tt.queue)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.queue, err)
+			continue
+		}
+		if qr.queueName != tt.wantQueue || qr.consumerName != tt.wantConsumer || qr.arrayDequeue != tt.wantArray {
+			t.Errorf("%q: очередь %q, потребитель %q, array_dequeue %v; ожидалось %q, %q, %v", tt.queue,
+				qr.queueName, qr.consumerName, qr.arrayDequeue, tt.wantQueue, tt.wantConsumer, tt.wantArray)
+		}
+	}
+}
+
+func TestParseXMLMessageAlternativeBodies(t *testing.T) {
+	payload := `<root><head></head><body><![CDATA[<email email_task_id="5" smtp_id="0" email_address="user@example.org"` +
+		` email_title="Счет" email_text="текст" email_text_plain="Текстовая версия" email_text_html="&lt;p&gt;HTML&lt;/p&gt;"/>]]></body></root>`
+	data, err := (&QueueReader{}).ParseXMLMessage(&QueueMessage{MessageID: "m1", XMLPayload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["email_text_plain"] != "Текстовая версия" || data["email_text_html"] != "<p>HTML</p>" {
+		t.Errorf("версии тела: %q, %q", data["email_text_plain"], data["email_text_html"])
+	}
+}
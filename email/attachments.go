@@ -2,11 +2,17 @@ package email
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -39,20 +45,291 @@ func NewAttachmentProcessor(dbConn *db.DBConnection, cfg *settings.Config) *Atta
 }
 
 // ProcessAttachment обрабатывает вложение и возвращает данные для отправки
+// Если в очереди передана контрольная сумма вложения, полученные данные проверяются по ней
 func (p *AttachmentProcessor) ProcessAttachment(ctx context.Context, attach *Attachment, taskID int64) (*AttachmentData, error) {
+	var data *AttachmentData
+	var err error
+
 	switch attach.ReportType {
 	case 1:
 		// Тип 1: Crystal Reports
-		return p.processCrystalReport(ctx, attach, taskID)
+		data, err = p.processCrystalReport(ctx, attach, taskID)
 	case 2:
 		// Тип 2: CLOB из БД
-		return p.processCLOB(ctx, attach, taskID)
+		data, err = p.withFetchTimeout(ctx, "CLOB", func(ctx context.Context) (*AttachmentData, error) {
+			return p.processCLOB(ctx, attach, taskID)
+		})
 	case 3:
 		// Тип 3: Готовый файл (поддерживает локальные пути и UNC пути через CIFS/SMB)
-		return p.processFile(ctx, attach)
+		data, err = p.processFile(ctx, attach)
 	default:
 		return nil, fmt.Errorf("неизвестный тип вложения: %d", attach.ReportType)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.cfg != nil && p.cfg.Mode.VerifyAttachmentChecksums {
+		if err := verifyChecksum(attach, data.Data); err != nil {
+			return nil, err
+		}
+		if attach.Checksum != "" && logger.Log != nil {
+			logger.Log.Debug("Контрольная сумма вложения совпадает",
+				zap.Int64("taskID", taskID),
+				zap.String("fileName", data.FileName),
+				zap.String("algo", attach.ChecksumAlgo))
+		}
+	}
+
+	if err := p.stageAttachment(data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// stageAttachment записывает данные вложения во временный каталог Mode.AttachmentStagingDir,
+// чтобы до отправки письма они не занимали память; письмо формируется потоково из файла.
+// Вложения меньше Mode.AttachmentStagingMinSizeKB остаются в памяти
+func (p *AttachmentProcessor) stageAttachment(data *AttachmentData) error {
+	if p.cfg == nil || p.cfg.Mode.AttachmentStagingDir == "" || len(data.Data) == 0 ||
+		len(data.Data) < p.cfg.Mode.AttachmentStagingMinSizeKB*1024 {
+		return nil
+	}
+
+	file, err := os.CreateTemp(p.cfg.Mode.AttachmentStagingDir, "attach_*.tmp")
+	if err != nil {
+		return fmt.Errorf("ошибка создания временного файла вложения: %w", err)
+	}
+	if _, err := file.Write(data.Data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("ошибка записи временного файла вложения: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("ошибка записи временного файла вложения: %w", err)
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("Вложение буферизовано во временный файл",
+			zap.String("fileName", data.FileName),
+			zap.String("path", file.Name()),
+			zap.Int("size", len(data.Data)))
+	}
+
+	data.Path = file.Name()
+	data.size = len(data.Data)
+	data.Data = nil
+	return nil
+}
+
+// withFetchTimeout выполняет получение вложения с отдельным таймаутом источника (CLOB, файл, UNC),
+// чтобы один медленный источник не расходовал весь лимит времени письма.
+// Операции, не принимающие контекст (чтение файла, SMB), выполняются в горутине и по таймауту
+// прерывается только ожидание результата. Если таймаут источника не задан, он не применяется
+func (p *AttachmentProcessor) withFetchTimeout(ctx context.Context, source string, fetch func(context.Context) (*AttachmentData, error)) (*AttachmentData, error) {
+	var timeoutSec int
+	if p.cfg != nil {
+		switch source {
+		case "CLOB":
+			timeoutSec = p.cfg.Mode.CLOBFetchTimeoutSec
+		case "file":
+			timeoutSec = p.cfg.Mode.FileFetchTimeoutSec
+		case "UNC":
+			timeoutSec = p.cfg.Mode.UNCFetchTimeoutSec
+		}
+	}
+	if timeoutSec <= 0 {
+		return fetch(ctx)
+	}
+
+	timeout := time.Duration(timeoutSec) * time.Second
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type fetchResult struct {
+		data *AttachmentData
+		err  error
+	}
+	done := make(chan fetchResult, 1)
+	go func() {
+		data, err := fetch(fetchCtx)
+		done <- fetchResult{data: data, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil && ctx.Err() == nil && errors.Is(fetchCtx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("превышен таймаут получения вложения (%s, %v): %w", source, timeout, res.err)
+		}
+		return res.data, res.err
+	case <-fetchCtx.Done():
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if logger.Log != nil {
+			logger.Log.Warn("Превышен таймаут получения вложения",
+				zap.String("source", source),
+				zap.Duration("timeout", timeout))
+		}
+		return nil, fmt.Errorf("превышен таймаут получения вложения (%s, %v)", source, timeout)
+	}
+}
+
+// verifyChecksum сравнивает контрольную сумму данных вложения с ожидаемой
+// Защищает от отправки файла, поврежденного при чтении из CIFS или CLOB
+func verifyChecksum(attach *Attachment, data []byte) error {
+	if attach.Checksum == "" {
+		return nil
+	}
+
+	var actual string
+	switch attach.ChecksumAlgo {
+	case "md5":
+		sum := md5.Sum(data)
+		actual = hex.EncodeToString(sum[:])
+	case "sha256":
+		sum := sha256.Sum256(data)
+		actual = hex.EncodeToString(sum[:])
+	default:
+		return fmt.Errorf("неподдерживаемый алгоритм контрольной суммы: %s", attach.ChecksumAlgo)
+	}
+
+	if actual != attach.Checksum {
+		return fmt.Errorf("контрольная сумма вложения не совпадает (%s): ожидается %s, получено %s",
+			attach.ChecksumAlgo, attach.Checksum, actual)
+	}
+	return nil
+}
+
+// ExpandAttachment раскрывает шаблон имени файла во вложении типа 3 (например, \\server\share\dir\*.pdf)
+// Возвращает по одному вложению на каждый найденный файл (не более Mode.MaxGlobAttachments)
+// Вложения других типов и пути без шаблона возвращаются без изменений
+func (p *AttachmentProcessor) ExpandAttachment(ctx context.Context, attach *Attachment) ([]Attachment, error) {
+	if attach.ReportType != 3 || !strings.ContainsAny(attach.ReportFile, "*?[") {
+		return []Attachment{*attach}, nil
+	}
+
+	reportFile := p.normalizeReportPath(attach.ReportFile)
+	isUNCPath := strings.HasPrefix(reportFile, `\\`) || strings.HasPrefix(reportFile, `//`)
+
+	// Шаблон допускается только в имени файла, директория должна быть указана явно
+	sep := string(filepath.Separator)
+	if isUNCPath {
+		sep = `\`
+	}
+	idx := strings.LastIndex(reportFile, sep)
+	if idx == -1 {
+		return nil, fmt.Errorf("не удалось выделить директорию из пути %s", reportFile)
+	}
+	dir, pattern := reportFile[:idx], reportFile[idx+1:]
+	if strings.ContainsAny(dir, "*?[") {
+		return nil, fmt.Errorf("шаблон допускается только в имени файла: %s", reportFile)
+	}
+	// Проверяем корректность шаблона
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("неверный шаблон имени файла %s: %w", pattern, err)
+	}
+
+	var names []string
+	var err error
+	if isUNCPath {
+		names, err = p.listUNCDir(ctx, dir)
+	} else {
+		names, err = listLocalDir(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Сравнение без учета регистра, как в файловых системах Windows
+	var matched []string
+	for _, name := range names {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			matched = append(matched, name)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("не найдено файлов по шаблону %s", reportFile)
+	}
+	sort.Strings(matched)
+
+	maxCount := 20
+	if p.cfg != nil && p.cfg.Mode.MaxGlobAttachments > 0 {
+		maxCount = p.cfg.Mode.MaxGlobAttachments
+	}
+	if len(matched) > maxCount {
+		if logger.Log != nil {
+			logger.Log.Warn("По шаблону найдено больше файлов, чем допускается, лишние файлы не прикладываются",
+				zap.String("pattern", reportFile),
+				zap.Int("found", len(matched)),
+				zap.Int("limit", maxCount))
+		}
+		matched = matched[:maxCount]
+	}
+
+	expanded := make([]Attachment, 0, len(matched))
+	for _, name := range matched {
+		fileAttach := *attach
+		fileAttach.ReportFile = dir + sep + name
+		fileAttach.FileName = name
+		// Контрольная сумма относится к одному файлу и для шаблона не применяется
+		fileAttach.ChecksumAlgo = ""
+		fileAttach.Checksum = ""
+		expanded = append(expanded, fileAttach)
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("Шаблон вложения раскрыт",
+			zap.String("pattern", reportFile),
+			zap.Strings("files", matched))
+	}
+
+	return expanded, nil
+}
+
+// listUNCDir возвращает имена файлов в директории по UNC пути через CIFS/SMB
+func (p *AttachmentProcessor) listUNCDir(ctx context.Context, dir string) ([]string, error) {
+	if p.cifsManager == nil {
+		return nil, fmt.Errorf("CIFS менеджер не инициализирован, проверьте настройки [share] в конфигурации")
+	}
+
+	server, share, relDir, err := storage.ParseUNCPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка парсинга UNC пути %s: %w", dir, err)
+	}
+
+	client, err := p.cifsManager.GetClient(ctx, server, share, relDir)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к CIFS шаре %s\\%s: %w", server, share, err)
+	}
+
+	names, err := client.ListFiles(relDir)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения директории %s: %w", dir, err)
+	}
+	return names, nil
+}
+
+// listLocalDir возвращает имена файлов в локальной директории
+func listLocalDir(dir string) ([]string, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("путь к файлу должен быть абсолютным: %s", dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения директории %s: %w", dir, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
 }
 
 // processCrystalReport обрабатывает Crystal Reports вложение через Web Service
@@ -211,7 +488,7 @@ func (p *AttachmentProcessor) processCrystalReport(ctx context.Context, attach *
 	}
 
 	if len(data) == 0 {
-		return nil, fmt.Errorf("пустой отчет")
+		return nil, fmt.Errorf("%w: %s", ErrEmptyReport, attach.File)
 	}
 
 	// Проверяем, что данные являются валидным PDF файлом (проверка магических байтов)
@@ -262,8 +539,12 @@ func (p *AttachmentProcessor) processCLOB(ctx context.Context, attach *Attachmen
 			zap.Int64("clobID", *attach.ClobAttachID))
 	}
 
-	// Получаем CLOB из БД
-	clobData, err := p.dbConn.GetEmailReportClob(taskID, *attach.ClobAttachID)
+	// Получаем CLOB из БД, размер проверяется до чтения
+	maxSizeMB := 100
+	if p.cfg != nil && p.cfg.Mode.MaxAttachmentSizeMB > 0 {
+		maxSizeMB = p.cfg.Mode.MaxAttachmentSizeMB
+	}
+	clobData, err := p.dbConn.GetEmailReportClob(ctx, taskID, *attach.ClobAttachID, int64(maxSizeMB)*1024*1024)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка получения CLOB: %w", err)
 	}
@@ -310,10 +591,19 @@ func (p *AttachmentProcessor) processFile(ctx context.Context, attach *Attachmen
 
 	if isUNCPath {
 		// Обрабатываем UNC путь через CIFS/SMB
-		return p.processUNCFile(ctx, attach)
+		return p.withFetchTimeout(ctx, "UNC", func(ctx context.Context) (*AttachmentData, error) {
+			return p.processUNCFile(ctx, attach)
+		})
 	}
 
 	// Обрабатываем локальный путь
+	return p.withFetchTimeout(ctx, "file", func(ctx context.Context) (*AttachmentData, error) {
+		return p.processLocalFile(ctx, attach)
+	})
+}
+
+// processLocalFile читает файл вложения по локальному абсолютному пути
+func (p *AttachmentProcessor) processLocalFile(ctx context.Context, attach *Attachment) (*AttachmentData, error) {
 	// Валидация пути для безопасности
 	if !filepath.IsAbs(attach.ReportFile) {
 		return nil, fmt.Errorf("путь к файлу должен быть абсолютным: %s", attach.ReportFile)
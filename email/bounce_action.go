@@ -0,0 +1,141 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"go.uber.org/zap"
+
+	"email-service/logger"
+	"email-service/settings"
+)
+
+// Действия с обработанными bounce messages (параметр IMAPBounceAction секции SMTP)
+const (
+	// BounceActionNone - bounce остается в папке без изменений
+	BounceActionNone = "none"
+	// BounceActionSeen - bounce помечается прочитанным (\Seen)
+	BounceActionSeen = "seen"
+	// BounceActionMove - bounce перемещается в папку IMAPBounceMoveFolder (UID MOVE)
+	BounceActionMove = "move"
+	// BounceActionDelete - bounce помечается \Deleted, папка очищается (EXPUNGE)
+	BounceActionDelete = "delete"
+)
+
+// normalizeBounceAction приводит действие с обработанными bounce messages к каноническому виду и проверяет его
+func normalizeBounceAction(action string) (string, error) {
+	action = strings.ToLower(strings.TrimSpace(action))
+	switch action {
+	case "":
+		return BounceActionNone, nil
+	case BounceActionNone, BounceActionSeen, BounceActionMove, BounceActionDelete:
+		return action, nil
+	}
+	return "", fmt.Errorf("неизвестное значение IMAPBounceAction %q (допустимо: %s, %s, %s, %s)",
+		action, BounceActionNone, BounceActionSeen, BounceActionMove, BounceActionDelete)
+}
+
+// checkBounceActionSettings проверяет IMAPBounceAction и IMAPBounceMoveFolder SMTP сервера при запуске
+func checkBounceActionSettings(cfg *settings.SMTPConfig) error {
+	action, err := normalizeBounceAction(cfg.IMAPBounceAction)
+	if err != nil {
+		return fmt.Errorf("SMTP %s: %w", cfg.Host, err)
+	}
+	if action == BounceActionMove && cfg.IMAPBounceMoveFolder == "" {
+		return fmt.Errorf("SMTP %s: для IMAPBounceAction = %s не задан IMAPBounceMoveFolder", cfg.Host, BounceActionMove)
+	}
+	return nil
+}
+
+// processedBounce - bounce message, сопоставленный с письмом, для действия IMAPBounceAction
+type processedBounce struct {
+	folder string
+	uid    uint32
+}
+
+// bounceAction возвращает действие с обработанными bounce messages
+func (c *IMAPClient) bounceAction() string {
+	// Значение проверено checkBounceActionSettings при создании сервиса
+	action, _ := normalizeBounceAction(c.cfg.IMAPBounceAction)
+	return action
+}
+
+// markProcessed запоминает сопоставленный bounce message для applyBounceActions
+func (c *IMAPClient) markProcessed(folderName string, uid uint32) {
+	if c.bounceAction() == BounceActionNone {
+		return
+	}
+	bounce := processedBounce{folder: folderName, uid: uid}
+	for _, p := range c.processed {
+		if p == bounce {
+			return
+		}
+	}
+	c.processed = append(c.processed, bounce)
+}
+
+// applyBounceActions выполняет IMAPBounceAction для bounce messages, сопоставленных с письмами
+// Вызывается после записи статуса: ошибка записывается в лог и не влияет на уже записанный статус,
+// bounce остается в папке и при следующих проверках пропускается по кешу
+func (c *IMAPClient) applyBounceActions() {
+	processed := c.processed
+	c.processed = nil
+	if len(processed) == 0 || c.conn == nil {
+		return
+	}
+
+	action := c.bounceAction()
+	for _, bounce := range processed {
+		if err := c.applyBounceAction(action, bounce); err != nil {
+			if logger.Log != nil {
+				logger.Log.Warn("Не удалось обработать bounce message после записи статуса",
+					zap.String("action", action),
+					zap.String("folder", bounce.folder),
+					zap.Uint32("uid", bounce.uid),
+					zap.Error(err))
+			}
+			continue
+		}
+		if logger.Log != nil {
+			logger.Log.Debug("Bounce message обработан",
+				zap.String("action", action),
+				zap.String("folder", bounce.folder),
+				zap.Uint32("uid", bounce.uid))
+		}
+	}
+}
+
+// applyBounceAction выполняет действие с одним bounce message в открытом сеансе
+func (c *IMAPClient) applyBounceAction(action string, bounce processedBounce) error {
+	// STORE и MOVE требуют папку, открытую для записи (SELECT, а не EXAMINE)
+	if mbox := c.conn.Mailbox(); mbox == nil || mbox.Name != bounce.folder || mbox.ReadOnly {
+		if _, err := c.conn.Select(bounce.folder, false); err != nil {
+			return fmt.Errorf("ошибка выбора папки %s: %w", bounce.folder, err)
+		}
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(bounce.uid)
+	switch action {
+	case BounceActionSeen:
+		flags := []interface{}{imap.SeenFlag}
+		if err := c.conn.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+			return fmt.Errorf("ошибка UID STORE: %w", err)
+		}
+	case BounceActionMove:
+		// Без расширения MOVE go-imap выполняет COPY, STORE \Deleted и EXPUNGE
+		if err := c.conn.UidMove(seqSet, c.cfg.IMAPBounceMoveFolder); err != nil {
+			return fmt.Errorf("ошибка UID MOVE в папку %s: %w", c.cfg.IMAPBounceMoveFolder, err)
+		}
+	case BounceActionDelete:
+		flags := []interface{}{imap.DeletedFlag}
+		if err := c.conn.UidStore(seqSet, imap.FormatFlagsOp(imap.AddFlags, true), flags, nil); err != nil {
+			return fmt.Errorf("ошибка UID STORE: %w", err)
+		}
+		if err := c.conn.Expunge(nil); err != nil {
+			return fmt.Errorf("ошибка EXPUNGE: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package email
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+
+	"email-service/settings"
+)
+
+func TestCheckBounceActionSettings(t *testing.T) {
+	tests := []struct {
+		action, folder string
+		wantErr        bool
+	}{
+		{"", "", false},
+		{"None", "", false},
+		{"seen", "", false},
+		{"delete", "", false},
+		{"move", "Processed", false},
+		{"move", "", true},
+		{"archive", "", true},
+	}
+	for _, tt := range tests {
+		cfg := &settings.SMTPConfig{Host: "smtp.example.com", IMAPBounceAction: tt.action, IMAPBounceMoveFolder: tt.folder}
+		if err := checkBounceActionSettings(cfg); (err != nil) != tt.wantErr {
+			t.Errorf("IMAPBounceAction %q, папка %q: ошибка %v", tt.action, tt.folder, err)
+		}
+	}
+}
+
+func TestCheckBatchAppliesBounceAction(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    string
+		noMove    bool
+		wantOps   []string
+		wantInbox int // Писем в INBOX после проверки
+		wantMoved int // Писем в папке Processed после проверки
+	}{
+		{"none", BounceActionNone, false, nil, 1, 0},
+		{"seen", BounceActionSeen, false, []string{"STORE 1 +FLAGS \\Seen"}, 1, 0},
+		{"move", BounceActionMove, false, []string{"MOVE 1 Processed"}, 0, 1},
+		{"delete", BounceActionDelete, false, []string{"STORE 1 +FLAGS \\Deleted", "EXPUNGE 1"}, 0, 0},
+		{"move отклонен", BounceActionMove, true, nil, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeIMAPServer(t)
+			server.addMailbox("Processed")
+			server.addMessage("INBOX", testBounceMessage(testMessageID(1), "missing@example.org"))
+			server.noMove = tt.noMove
+			cfg := server.smtpConfig()
+			cfg.IMAPBounceAction = tt.action
+			cfg.IMAPBounceMoveFolder = "Processed"
+
+			recorder := newStatusRecorder()
+			sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{cfg}}, recorder.callback)
+			sc.checkBatch(context.Background(), 0, scheduleTestChecks(sc, 0, 1, 2))
+
+			// Статус записывается независимо от результата действия
+			if result, _ := recorder.get(1); result.status != StatusFailed {
+				t.Errorf("задача 1: статус %v, ожидался StatusFailed", result.status)
+			}
+			if result, _ := recorder.get(2); result.status != StatusDelivered {
+				t.Errorf("задача 2: статус %v, ожидался StatusDelivered", result.status)
+			}
+			if ops := server.operations(); !reflect.DeepEqual(ops, tt.wantOps) {
+				t.Errorf("изменения писем %q, ожидалось %q", ops, tt.wantOps)
+			}
+			inbox, moved := server.messages("INBOX"), server.messages("Processed")
+			if len(inbox) != tt.wantInbox || len(moved) != tt.wantMoved {
+				t.Errorf("писем в INBOX %d, в Processed %d; ожидалось %d и %d", len(inbox), len(moved), tt.wantInbox, tt.wantMoved)
+			}
+			if tt.action == BounceActionSeen && !inbox[0].hasFlag(imap.SeenFlag) {
+				t.Errorf("bounce без флага \\Seen: %q", inbox[0].flags)
+			}
+		})
+	}
+}
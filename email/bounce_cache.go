@@ -0,0 +1,126 @@
+package email
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	// bounceCacheMaxEntries - максимальное число bounce messages, сведения о которых хранятся между проверками
+	bounceCacheMaxEntries = 2000
+	// bounceCacheMaxBodyBytes - максимальный суммарный объем тел bounce messages в кеше
+	bounceCacheMaxBodyBytes = 32 * 1024 * 1024
+)
+
+// bounceKey идентифицирует письмо в папке IMAP: UID уникален в пределах папки и ее UIDVALIDITY
+type bounceKey struct {
+	mailbox     string // Сервер, пользователь и папка
+	uidValidity uint32
+	uid         uint32
+}
+
+// bounceEntry - сведения о просмотренном bounce message
+type bounceEntry struct {
+	key      bounceKey
+	envelope *imap.Envelope
+	body     []byte // Начало письма (fetchBounceBody), nil - тело не загружалось
+	consumed bool   // Bounce уже сопоставлен с письмом и записан, при следующих проверках пропускается
+}
+
+// bounceCache хранит конверты и тела просмотренных bounce messages между проверками статусов,
+// чтобы повторные проверки не загружали их снова, а найденный bounce не записывался повторно
+// Общий для всех IMAPClient StatusChecker; при превышении лимитов вытесняются давно не использованные записи
+type bounceCache struct {
+	mu        sync.Mutex
+	entries   map[bounceKey]*list.Element
+	order     *list.List // В начале - недавно использованные записи
+	bodyBytes int
+}
+
+// newBounceCache создает пустой кеш просмотренных bounce messages
+func newBounceCache() *bounceCache {
+	return &bounceCache{
+		entries: make(map[bounceKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// lookup возвращает сохраненные сведения о письме (nil, если письмо еще не просматривалось)
+// Возвращается копия записи, ее можно читать без блокировки
+func (bc *bounceCache) lookup(key bounceKey) *bounceEntry {
+	if bc == nil {
+		return nil
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	elem, ok := bc.entries[key]
+	if !ok {
+		return nil
+	}
+	bc.order.MoveToFront(elem)
+	entry := *elem.Value.(*bounceEntry)
+	return &entry
+}
+
+// storeEnvelope сохраняет конверт просмотренного письма
+func (bc *bounceCache) storeEnvelope(key bounceKey, envelope *imap.Envelope) {
+	if bc == nil || envelope == nil {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.entry(key).envelope = envelope
+	bc.evict()
+}
+
+// storeBody сохраняет загруженное начало письма
+func (bc *bounceCache) storeBody(key bounceKey, body []byte) {
+	if bc == nil || body == nil || len(body) > bounceCacheMaxBodyBytes {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	entry := bc.entry(key)
+	bc.bodyBytes += len(body) - len(entry.body)
+	entry.body = body
+	bc.evict()
+}
+
+// consume отмечает bounce как сопоставленный с письмом
+func (bc *bounceCache) consume(key bounceKey) {
+	if bc == nil {
+		return
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	entry := bc.entry(key)
+	entry.consumed = true
+	// Тело больше не понадобится
+	bc.bodyBytes -= len(entry.body)
+	entry.body = nil
+	bc.evict()
+}
+
+// entry возвращает запись для письма, создавая ее при необходимости (вызывается под mu)
+func (bc *bounceCache) entry(key bounceKey) *bounceEntry {
+	if elem, ok := bc.entries[key]; ok {
+		bc.order.MoveToFront(elem)
+		return elem.Value.(*bounceEntry)
+	}
+	entry := &bounceEntry{key: key}
+	bc.entries[key] = bc.order.PushFront(entry)
+	return entry
+}
+
+// evict вытесняет давно не использованные записи сверх лимитов (вызывается под mu)
+func (bc *bounceCache) evict() {
+	for bc.order.Len() > bounceCacheMaxEntries || bc.bodyBytes > bounceCacheMaxBodyBytes {
+		elem := bc.order.Back()
+		entry := elem.Value.(*bounceEntry)
+		bc.order.Remove(elem)
+		delete(bc.entries, entry.key)
+		bc.bodyBytes -= len(entry.body)
+	}
+}
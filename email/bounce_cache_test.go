@@ -0,0 +1,85 @@
+package email
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestBounceCacheEviction(t *testing.T) {
+	bc := newBounceCache()
+	key := func(uid uint32) bounceKey { return bounceKey{mailbox: "imap|user|INBOX", uidValidity: 1, uid: uid} }
+
+	for uid := uint32(1); uid <= bounceCacheMaxEntries; uid++ {
+		bc.storeEnvelope(key(uid), &imap.Envelope{})
+	}
+	// Обращение к записи делает ее недавно использованной: вытесняется следующая по давности
+	bc.lookup(key(1))
+	bc.storeEnvelope(key(bounceCacheMaxEntries+1), &imap.Envelope{})
+	if bc.lookup(key(1)) == nil {
+		t.Error("вытеснена недавно использованная запись")
+	}
+	if bc.lookup(key(2)) != nil {
+		t.Error("давно не использованная запись не вытеснена при превышении числа записей")
+	}
+
+	// Превышение объема тел вытесняет записи, пока объем не станет допустимым
+	bc.storeBody(key(3), make([]byte, bounceCacheMaxBodyBytes/2))
+	bc.storeBody(key(4), make([]byte, bounceCacheMaxBodyBytes/2))
+	bc.storeBody(key(5), make([]byte, 1))
+	if bc.lookup(key(3)) != nil {
+		t.Error("запись с телом не вытеснена при превышении объема")
+	}
+	if bc.bodyBytes > bounceCacheMaxBodyBytes {
+		t.Errorf("объем тел в кеше %d превышает лимит %d", bc.bodyBytes, bounceCacheMaxBodyBytes)
+	}
+
+	// Сопоставленный bounce освобождает тело
+	bc.consume(key(4))
+	if entry := bc.lookup(key(4)); entry == nil || !entry.consumed || entry.body != nil {
+		t.Errorf("запись после consume: %+v", entry)
+	}
+	if bc.bodyBytes != 1 {
+		t.Errorf("объем тел после consume %d, ожидался 1", bc.bodyBytes)
+	}
+}
+
+func TestCheckEmailStatusUsesBounceCache(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	server.addMessage("INBOX", testBounceMessage(testMessageID(1), "missing@example.org"))
+	server.addMessage("INBOX", testBounceMessage(testMessageID(2), "other@example.org"))
+	cfg := server.smtpConfig()
+	client := NewIMAPClient(&cfg)
+	client.SetBounceCache(newBounceCache())
+
+	// Письмо без bounce: конверты и тела просмотренных bounce загружаются один раз
+	for i := 0; i < 2; i++ {
+		before := server.fetchCount()
+		status, _, _, err := client.CheckEmailStatus(context.Background(), testMessageID(3))
+		if err != nil || status != StatusDelivered {
+			t.Fatalf("проверка %d: статус %v, ошибка %v", i+1, status, err)
+		}
+		fetches := server.fetchCount() - before
+		if i == 0 && fetches == 0 {
+			t.Fatal("первая проверка не загрузила bounce messages")
+		}
+		if i == 1 && fetches != 0 {
+			t.Errorf("повторная проверка выполнила %d FETCH, ожидалось 0", fetches)
+		}
+	}
+
+	// Найденный bounce записывается один раз: повторная отправка с тем же Message-ID его не получает
+	status, _, _, err := client.CheckEmailStatus(context.Background(), testMessageID(1))
+	if err != nil || status != StatusFailed {
+		t.Fatalf("задача 1: статус %v, ошибка %v; ожидался StatusFailed", status, err)
+	}
+	before := server.fetchCount()
+	status, _, _, err = client.CheckEmailStatus(context.Background(), testMessageID(1))
+	if err != nil || status != StatusDelivered {
+		t.Errorf("повторная проверка задачи 1: статус %v, ошибка %v; использованный bounce записан снова", status, err)
+	}
+	if fetches := server.fetchCount() - before; fetches != 0 {
+		t.Errorf("повторная проверка задачи 1 выполнила %d FETCH, ожидалось 0", fetches)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -22,6 +23,36 @@ const (
 	ExportFormatPDF = 5
 )
 
+// ErrNonSOAPResponse возвращается, если Web Service вернул не SOAP/XML ответ
+// (например, HTML страницу ошибки прокси или 404 при неверном URL)
+var ErrNonSOAPResponse = errors.New("Web Service Crystal Reports вернул ответ, не являющийся SOAP")
+
+// ErrEmptyReport возвращается, если Web Service вернул отчет нулевого размера
+// Отчет без строк данных, сформированный как корректный PDF, пустым не считается и отправляется как обычно
+var ErrEmptyReport = errors.New("Web Service Crystal Reports вернул пустой отчет (0 байт)")
+
+// Поведение при пустом отчете Crystal Reports (CrystalReportsEmptyPolicy секции [Mode]
+// и атрибут email_attach_empty вложения)
+const (
+	// EmptyReportFail - вложение считается ошибочным
+	EmptyReportFail = "fail"
+	// EmptyReportNote - письмо отправляется без отчета с пометкой в тексте
+	EmptyReportNote = "note"
+)
+
+// normalizeEmptyReportPolicy приводит поведение при пустом отчете к каноническому виду и проверяет его
+func normalizeEmptyReportPolicy(policy string) (string, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	switch policy {
+	case "":
+		return EmptyReportFail, nil
+	case EmptyReportFail, EmptyReportNote:
+		return policy, nil
+	}
+	return "", fmt.Errorf("неизвестное поведение при пустом отчете %q (допустимо: %s, %s)",
+		policy, EmptyReportFail, EmptyReportNote)
+}
+
 // ReportRequest представляет XML запрос для Crystal Reports getReportInfo
 type ReportRequest struct {
 	XMLName xml.Name `xml:"Report"`
@@ -175,6 +206,19 @@ func (c *CrystalReportsClient) callSOAP(ctx context.Context, action string, body
 
 	bodyStr := string(bodyBytes)
 
+	// Проверяем, что получен SOAP/XML ответ, а не HTML страница ошибки
+	if err := checkSOAPResponse(resp, bodyBytes); err != nil {
+		if logger.Log != nil {
+			logger.Log.Error("Web Service Crystal Reports вернул не SOAP ответ",
+				zap.String("action", action),
+				zap.String("url", c.baseURL),
+				zap.Int("statusCode", resp.StatusCode),
+				zap.String("contentType", resp.Header.Get("Content-Type")),
+				zap.String("response", truncateString(bodyStr, 3000)))
+		}
+		return "", err
+	}
+
 	// Проверяем на SOAP Fault (различные варианты написания)
 	if strings.Contains(bodyStr, "soap:Fault") ||
 		strings.Contains(bodyStr, "<Fault>") ||
@@ -267,6 +311,34 @@ func (c *CrystalReportsClient) callSOAP(ctx context.Context, action string, body
 	return bodyStr, nil
 }
 
+// checkSOAPResponse проверяет по Content-Type и первым байтам тела, что ответ является SOAP/XML
+// Возвращает ошибку ErrNonSOAPResponse с HTTP статусом и началом ответа для диагностики
+func checkSOAPResponse(resp *http.Response, body []byte) error {
+	contentType := strings.ToLower(resp.Header.Get("Content-Type"))
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")), " \t\r\n")
+	head := strings.ToLower(string(trimmed[:min(len(trimmed), 64)]))
+
+	var reason string
+	switch {
+	case len(trimmed) == 0:
+		reason = "пустой ответ"
+	case strings.Contains(contentType, "html"):
+		reason = "Content-Type " + contentType
+	case strings.HasPrefix(head, "<!doctype html") || strings.HasPrefix(head, "<html"):
+		reason = "получена HTML страница"
+	case strings.HasPrefix(contentType, "multipart/"):
+		// MTOM/XOP ответ начинается с границы multipart, а не с '<'
+		return nil
+	case trimmed[0] != '<':
+		reason = "ответ не является XML"
+	default:
+		return nil
+	}
+
+	return fmt.Errorf("%w (HTTP %d, %s): %s", ErrNonSOAPResponse, resp.StatusCode, reason,
+		truncateString(strings.TrimSpace(string(trimmed)), 200))
+}
+
 // parseSOAPResponse извлекает содержимое из SOAP ответа
 func (c *CrystalReportsClient) parseSOAPResponse(soapResponse, action string) (string, error) {
 	decoder := xml.NewDecoder(strings.NewReader(soapResponse))
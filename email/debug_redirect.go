@@ -0,0 +1,65 @@
+package email
+
+import (
+	"strings"
+)
+
+// parseKeepDomains разбирает список доменов DebugKeepDomains (через запятую) в нижний регистр
+func parseKeepDomains(value string) []string {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), ".@"))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// keepDomainMatches проверяет, относится ли адрес к одному из доменов (или их поддоменов)
+func keepDomainMatches(address string, domains []string) bool {
+	domain := addressDomain(address)
+	if domain == "" {
+		return false
+	}
+	for _, keep := range domains {
+		if domain == keep || strings.HasSuffix(domain, "."+keep) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTestRecipients разбирает список адресов TestRecipients (через запятую) в набор адресов в нижнем регистре
+func parseTestRecipients(value string) map[string]bool {
+	recipients := make(map[string]bool)
+	for _, address := range strings.Split(value, ",") {
+		if address = testRecipientKey(address); address != "" {
+			recipients[address] = true
+		}
+	}
+	return recipients
+}
+
+// testRecipientKey приводит адрес к виду для сравнения со списком TestRecipients
+func testRecipientKey(address string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(address), "<>"))
+}
+
+// debugRecipients распределяет получателей в Debug режиме: тестовые получатели (testRecipients) и адреса
+// доменов keepDomains получают письмо как обычно, остальные заменяются тестовым адресом (один раз на письмо)
+// Возвращает итоговый список получателей и перенаправленные адреса
+func debugRecipients(addresses []string, testEmail string, keepDomains []string, testRecipients map[string]bool) (recipients []string, redirected []string) {
+	recipients = make([]string, 0, len(addresses)+1)
+	for _, address := range addresses {
+		if testRecipients[testRecipientKey(address)] || keepDomainMatches(address, keepDomains) {
+			recipients = append(recipients, address)
+			continue
+		}
+		redirected = append(redirected, address)
+	}
+	if len(redirected) > 0 {
+		recipients = append(recipients, testEmail)
+	}
+	return recipients, redirected
+}
@@ -0,0 +1,78 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"email-service/settings"
+)
+
+// Режимы проверки выравнивания доменов From и envelope-from для DMARC (параметр DMARCAlignment секции [Mode])
+const (
+	// DMARCAlignmentOff - выравнивание не проверяется
+	DMARCAlignmentOff = "off"
+	// DMARCAlignmentWarn - невыровненные домены записываются в лог при запуске
+	DMARCAlignmentWarn = "warn"
+	// DMARCAlignmentEnforce - сервис не запускается с невыровненными доменами
+	DMARCAlignmentEnforce = "enforce"
+)
+
+// ErrDMARCMisaligned возвращается, если домены From и envelope-from не выровнены для DMARC (SPF alignment)
+var ErrDMARCMisaligned = errors.New("домены From и envelope-from не выровнены для DMARC")
+
+// normalizeDMARCAlignment приводит режим проверки выравнивания к каноническому виду и проверяет его
+func normalizeDMARCAlignment(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return DMARCAlignmentWarn, nil
+	case DMARCAlignmentOff, DMARCAlignmentWarn, DMARCAlignmentEnforce:
+		return mode, nil
+	}
+	return "", fmt.Errorf("неизвестный режим DMARCAlignment %q (допустимо: %s, %s, %s)",
+		mode, DMARCAlignmentOff, DMARCAlignmentWarn, DMARCAlignmentEnforce)
+}
+
+// checkDMARCAlignment проверяет, что домен envelope-from (MAIL FROM, Return-Path) выровнен с доменом From
+// в нестрогом режиме DMARC (relaxed): совпадают организационные домены, например bounce.example.com
+// и example.com. Организационный домен определяется по двум последним меткам имени, поэтому для
+// доменов в зонах вида co.uk проверка строже, чем требует DMARC
+func checkDMARCAlignment(cfg *settings.SMTPConfig) error {
+	fromDomain := addressDomain(cfg.User)
+	envelopeDomain := addressDomain(envelopeFrom(cfg))
+	if fromDomain == "" || envelopeDomain == "" {
+		return nil
+	}
+	if organizationalDomain(fromDomain) != organizationalDomain(envelopeDomain) {
+		return fmt.Errorf("%w: SMTP %s, From %s, envelope-from %s",
+			ErrDMARCMisaligned, cfg.Host, fromDomain, envelopeDomain)
+	}
+	return nil
+}
+
+// envelopeFrom возвращает адрес для MAIL FROM и Return-Path (EnvelopeFrom, по умолчанию User)
+func envelopeFrom(cfg *settings.SMTPConfig) string {
+	if cfg.EnvelopeFrom != "" {
+		return cfg.EnvelopeFrom
+	}
+	return cfg.User
+}
+
+// addressDomain возвращает домен адреса в нижнем регистре (пусто, если адрес без домена)
+func addressDomain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(address[at+1:]), ">."))
+}
+
+// organizationalDomain возвращает две последние метки доменного имени
+func organizationalDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
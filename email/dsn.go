@@ -0,0 +1,330 @@
+package email
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"email-service/settings"
+)
+
+const (
+	// bounceFetchLimit - максимальный объем bounce-сообщения, загружаемый с IMAP сервера
+	// Части text/plain и message/delivery-status идут в начале отчета, а вложенное исходное
+	// письмо (message/rfc822) в конце, поэтому его тело можно не загружать
+	bounceFetchLimit = 512 * 1024
+	// maxDSNLineLength - максимальная длина строки, анализируемой парсером (остаток строки отбрасывается)
+	maxDSNLineLength = 8 * 1024
+	// maxDSNPartDepth - максимальная глубина вложенности multipart частей
+	maxDSNPartDepth = 5
+)
+
+// negativeSubjectKeywords - фрагменты темы, однозначно указывающие на недоставку письма
+var negativeSubjectKeywords = []string{
+	"mail delivery failed",
+	"undelivered mail",
+	"returned mail",
+	"delivery failure",
+	"failure notice",
+	"недоставленное сообщение",
+	"недоставленное письмо",
+	"ошибка доставки",
+	"возврат письма",
+	"не может быть отправлено",
+}
+
+// dsnReport содержит сведения, извлеченные из bounce-сообщения (RFC 3464)
+type dsnReport struct {
+	Subject           string    // Тема bounce-сообщения
+	MessageIDFound    bool      // Message-ID исходного письма найден в bounce-сообщении
+	HasDeliveryStatus bool      // Найдена часть message/delivery-status
+	Action            string    // Action из delivery-status (failed, delayed, delivered, relayed, expanded)
+	Status            string    // Status из delivery-status (например, 5.1.1)
+	DiagnosticCode    string    // Diagnostic-Code из delivery-status
+	ErrorDesc         string    // Описание ошибки по типичным паттернам в тексте
+	ArrivalDate       time.Time // Arrival-Date из delivery-status: время получения письма MTA
+	LastAttemptDate   time.Time // Last-Attempt-Date получателя из delivery-status: время последней попытки доставки
+	Date              time.Time // Date bounce-сообщения
+}
+
+// parseDSNBody потоково разбирает bounce-сообщение, не загружая его целиком в память
+// Анализируются только текстовые части, часть message/delivery-status и заголовки вложенного
+// исходного письма; тела вложений пропускаются. Описание ошибки определяется по errorPatterns
+func parseDSNBody(r io.Reader, messageIDClean string, errorPatterns []settings.BouncePattern) *dsnReport {
+	report := &dsnReport{}
+
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return report
+	}
+	report.Subject = msg.Header.Get("Subject")
+	if date, err := msg.Header.Date(); err == nil {
+		report.Date = date
+	}
+
+	p := &dsnParser{report: report, messageIDClean: messageIDClean, errorPatterns: errorPatterns}
+	p.scanEntity(msg.Header, msg.Body, 0)
+
+	return report
+}
+
+// mimeHeader - общий интерфейс заголовков mail.Header и textproto.MIMEHeader
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// dsnParser хранит состояние потокового разбора bounce-сообщения
+type dsnParser struct {
+	report         *dsnReport
+	messageIDClean string
+	errorPatterns  []settings.BouncePattern
+}
+
+// scanEntity разбирает одну MIME сущность в зависимости от ее Content-Type
+func (p *dsnParser) scanEntity(header mimeHeader, body io.Reader, depth int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if depth >= maxDSNPartDepth || params["boundary"] == "" {
+			return
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				// io.EOF - конец сообщения, иначе сообщение обрезано (bounceFetchLimit) или повреждено
+				return
+			}
+			p.scanEntity(part.Header, part, depth+1)
+		}
+
+	case mediaType == "message/delivery-status":
+		p.report.HasDeliveryStatus = true
+		p.scanDeliveryStatus(decodeTransferEncoding(header, body))
+
+	case mediaType == "message/rfc822" || mediaType == "text/rfc822-headers":
+		// Из исходного письма нужны только заголовки (Message-ID), тело пропускаем
+		p.scanHeaders(decodeTransferEncoding(header, body))
+
+	case strings.HasPrefix(mediaType, "text/"):
+		p.scanText(decodeTransferEncoding(header, body))
+	}
+}
+
+// scanText ищет Message-ID и типичные сообщения об ошибках в текстовой части
+func (p *dsnParser) scanText(r io.Reader) {
+	prevLine := ""
+	scanDSNLines(r, func(line string) bool {
+		p.checkMessageID(line)
+		if p.report.ErrorDesc == "" {
+			// Склеиваем с предыдущей строкой, чтобы найти фразы, перенесенные на новую строку
+			window := strings.ToLower(prevLine + " " + line)
+			for _, pattern := range p.errorPatterns {
+				if strings.Contains(window, pattern.Pattern) {
+					p.report.ErrorDesc = pattern.Desc
+					break
+				}
+			}
+		}
+		prevLine = line
+		return true
+	})
+}
+
+// scanHeaders ищет Message-ID в заголовках вложенного письма и прекращает чтение на первой пустой строке
+func (p *dsnParser) scanHeaders(r io.Reader) {
+	scanDSNLines(r, func(line string) bool {
+		if strings.TrimSpace(line) == "" {
+			return false
+		}
+		p.checkMessageID(line)
+		return true
+	})
+}
+
+// scanDeliveryStatus извлекает поля Action, Status и Diagnostic-Code из части message/delivery-status
+// При нескольких получателях приоритет отдается получателю с Action: failed
+func (p *dsnParser) scanDeliveryStatus(r io.Reader) {
+	var action, status, diagnostic string
+	var lastAttempt time.Time
+	flush := func() {
+		if action == "" {
+			return
+		}
+		if p.report.Action == "" || (action == "failed" && p.report.Action != "failed") {
+			p.report.Action = action
+			p.report.Status = status
+			p.report.DiagnosticCode = diagnostic
+			p.report.LastAttemptDate = lastAttempt
+		}
+		action, status, diagnostic = "", "", ""
+		lastAttempt = time.Time{}
+	}
+
+	scanDSNLines(r, func(line string) bool {
+		p.checkMessageID(line)
+
+		if strings.TrimSpace(line) == "" {
+			// Пустая строка разделяет поля сообщения и поля отдельных получателей
+			flush()
+			return true
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return true
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "action":
+			action = strings.ToLower(value)
+		case "status":
+			status = value
+		case "diagnostic-code":
+			diagnostic = value
+		case "arrival-date":
+			if date, err := mail.ParseDate(value); err == nil {
+				p.report.ArrivalDate = date
+			}
+		case "last-attempt-date":
+			if date, err := mail.ParseDate(value); err == nil {
+				lastAttempt = date
+			}
+		}
+		return true
+	})
+	flush()
+}
+
+// checkMessageID отмечает, что Message-ID исходного письма встретился в строке
+func (p *dsnParser) checkMessageID(line string) {
+	if !p.report.MessageIDFound && p.messageIDClean != "" && strings.Contains(line, p.messageIDClean) {
+		p.report.MessageIDFound = true
+	}
+}
+
+// decodeTransferEncoding оборачивает тело части декодером по Content-Transfer-Encoding
+// quoted-printable внутри multipart уже декодирован multipart.Reader (заголовок при этом удаляется)
+func decodeTransferEncoding(header mimeHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// scanDSNLines построчно читает r и вызывает fn для каждой строки, пока fn возвращает true
+// Строки длиннее maxDSNLineLength обрезаются, чтобы ограничить потребление памяти
+func scanDSNLines(r io.Reader, fn func(line string) bool) {
+	br := bufio.NewReaderSize(r, maxDSNLineLength)
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err != nil {
+			return
+		}
+		line := string(chunk)
+		// Пропускаем остаток слишком длинной строки
+		for isPrefix {
+			_, isPrefix, err = br.ReadLine()
+			if err != nil {
+				fn(line)
+				return
+			}
+		}
+		if !fn(line) {
+			return
+		}
+	}
+}
+
+// failureDescription возвращает описание ошибки доставки, если bounce-сообщение относится к исходному
+// письму и сообщает о недоставке
+// Если найдена часть delivery-status, решение принимается по полю Action: failed - ошибка,
+// delayed/delivered/relayed/expanded - не ошибка. Нестандартные значения Action игнорируются,
+// если не задан unknownActionAsFailure: тогда они считаются ошибкой при явных признаках недоставки
+// в теме или тексте. Без delivery-status используется поиск типичных сообщений об ошибках в тексте
+func (r *dsnReport) failureDescription(folderName string, unknownActionAsFailure bool) (string, bool) {
+	if !r.MessageIDFound {
+		return "", false
+	}
+
+	if r.HasDeliveryStatus && r.Action != "" {
+		switch r.Action {
+		case "failed":
+		case "delayed", "delivered", "relayed", "expanded":
+			return "", false
+		default:
+			if !unknownActionAsFailure || !r.isClearlyNegative() {
+				return "", false
+			}
+			desc := fmt.Sprintf("Bounce message в папке '%s': нестандартный Action '%s'", folderName, truncateString(r.Action, 100))
+			if r.Status != "" {
+				desc += fmt.Sprintf(" (Status: %s)", r.Status)
+			}
+			if r.DiagnosticCode != "" {
+				desc += fmt.Sprintf(": %s", truncateString(r.DiagnosticCode, 500))
+			} else if r.ErrorDesc != "" {
+				desc += fmt.Sprintf(": %s", r.ErrorDesc)
+			}
+			return desc, true
+		}
+		desc := fmt.Sprintf("Bounce message в папке '%s': доставка не удалась", folderName)
+		if r.Status != "" {
+			desc += fmt.Sprintf(" (Status: %s)", r.Status)
+		}
+		if r.DiagnosticCode != "" {
+			desc += fmt.Sprintf(": %s", truncateString(r.DiagnosticCode, 500))
+		} else if r.ErrorDesc != "" {
+			desc += fmt.Sprintf(": %s", r.ErrorDesc)
+		}
+		return desc, true
+	}
+
+	if r.ErrorDesc != "" {
+		return fmt.Sprintf("Bounce message в папке '%s': %s", folderName, r.ErrorDesc), true
+	}
+
+	// Если не нашли конкретную ошибку, возвращаем общее сообщение
+	return fmt.Sprintf("Найдено bounce message о недоставке в папке '%s'", folderName), true
+}
+
+// eventTime возвращает время события доставки по данным MTA: Last-Attempt-Date получателя,
+// Arrival-Date или дату bounce-сообщения; нулевое время, если ни одна дата не указана
+func (r *dsnReport) eventTime() time.Time {
+	switch {
+	case !r.LastAttemptDate.IsZero():
+		return r.LastAttemptDate
+	case !r.ArrivalDate.IsZero():
+		return r.ArrivalDate
+	default:
+		return r.Date
+	}
+}
+
+// isClearlyNegative проверяет, указывают ли тема или текст bounce-сообщения на недоставку
+func (r *dsnReport) isClearlyNegative() bool {
+	if r.ErrorDesc != "" || strings.HasPrefix(r.Status, "5.") {
+		return true
+	}
+	subject := strings.ToLower(r.Subject)
+	for _, keyword := range negativeSubjectKeywords {
+		if strings.Contains(subject, keyword) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package email
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"email-service/settings"
+)
+
+const dsnMessageID = "20260115.42.abc@mail.example.com"
+
+var testBouncePatterns = []settings.BouncePattern{
+	{Pattern: "user unknown", Desc: "Пользователь не найден"},
+	{Pattern: "mailbox full", Desc: "Почтовый ящик переполнен"},
+}
+
+// buildReport формирует bounce-сообщение multipart/report (RFC 3464) с частью delivery-status
+func buildReport(subject, text, deliveryStatus, statusEncoding string) string {
+	var b strings.Builder
+	b.WriteString("From: MAILER-DAEMON@mx.example.com\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("Date: Thu, 15 Jan 2026 10:00:00 +0300\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/report; report-type=delivery-status; boundary=\"BND\"\r\n\r\n")
+	b.WriteString("--BND\r\nContent-Type: text/plain\r\n\r\n" + text + "\r\n")
+	if deliveryStatus != "" {
+		b.WriteString("--BND\r\nContent-Type: message/delivery-status\r\n")
+		if statusEncoding == "base64" {
+			b.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+			b.WriteString(base64.StdEncoding.EncodeToString([]byte(deliveryStatus)) + "\r\n")
+		} else {
+			b.WriteString("\r\n" + deliveryStatus + "\r\n")
+		}
+	}
+	b.WriteString("--BND\r\nContent-Type: text/rfc822-headers\r\n\r\n")
+	b.WriteString("Message-ID: <" + dsnMessageID + ">\r\nSubject: Отчет\r\n\r\n")
+	b.WriteString("--BND--\r\n")
+	return b.String()
+}
+
+func TestParseDSNBodyFailed(t *testing.T) {
+	status := "Reporting-MTA: dns; mx.example.com\r\n" +
+		"Arrival-Date: Thu, 15 Jan 2026 09:58:00 +0300\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; user@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n" +
+		"Last-Attempt-Date: Thu, 15 Jan 2026 09:59:00 +0300\r\n"
+	body := buildReport("Undelivered Mail Returned to Sender", "This is the mail system.", status, "")
+
+	report := parseDSNBody(strings.NewReader(body), dsnMessageID, testBouncePatterns)
+	if !report.MessageIDFound || !report.HasDeliveryStatus {
+		t.Fatalf("MessageIDFound=%v HasDeliveryStatus=%v, ожидались true", report.MessageIDFound, report.HasDeliveryStatus)
+	}
+	if report.Action != "failed" || report.Status != "5.1.1" {
+		t.Errorf("Action=%q Status=%q", report.Action, report.Status)
+	}
+	if report.DiagnosticCode != "smtp; 550 5.1.1 User unknown" {
+		t.Errorf("DiagnosticCode=%q", report.DiagnosticCode)
+	}
+
+	desc, found := report.failureDescription("INBOX", false)
+	if !found {
+		t.Fatal("недоставка не распознана")
+	}
+	if !strings.Contains(desc, "5.1.1") || !strings.Contains(desc, "User unknown") {
+		t.Errorf("описание %q не содержит Status и Diagnostic-Code", desc)
+	}
+
+	want := time.Date(2026, 1, 15, 9, 59, 0, 0, time.FixedZone("", 3*3600))
+	if !report.eventTime().Equal(want) {
+		t.Errorf("eventTime=%v, ожидалось %v (Last-Attempt-Date)", report.eventTime(), want)
+	}
+}
+
+func TestParseDSNBodyFailedRecipientPreferred(t *testing.T) {
+	status := "Reporting-MTA: dns; mx.example.com\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; first@example.org\r\n" +
+		"Action: delayed\r\n" +
+		"Status: 4.4.1\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; second@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.2.2\r\n"
+	body := buildReport("Delivery Status Notification", "", status, "base64")
+
+	report := parseDSNBody(strings.NewReader(body), dsnMessageID, testBouncePatterns)
+	if report.Action != "failed" || report.Status != "5.2.2" {
+		t.Errorf("Action=%q Status=%q, ожидался получатель с Action: failed", report.Action, report.Status)
+	}
+}
+
+func TestParseDSNBodyActions(t *testing.T) {
+	tests := []struct {
+		name          string
+		subject       string
+		action        string
+		status        string
+		unknownAsFail bool
+		wantFailure   bool
+	}{
+		{"delayed", "Delivery delayed", "delayed", "4.4.7", false, false},
+		{"delivered", "Delivery report", "delivered", "2.0.0", false, false},
+		{"unknown ignored", "Mail delivery failed", "bounced", "5.0.0", false, false},
+		{"unknown as failure", "Mail delivery failed", "bounced", "5.0.0", true, true},
+		{"unknown not negative", "Notification", "bounced", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := "Final-Recipient: rfc822; user@example.org\r\nAction: " + tt.action + "\r\n"
+			if tt.status != "" {
+				status += "Status: " + tt.status + "\r\n"
+			}
+			body := buildReport(tt.subject, "", status, "")
+			report := parseDSNBody(strings.NewReader(body), dsnMessageID, testBouncePatterns)
+			if _, found := report.failureDescription("INBOX", tt.unknownAsFail); found != tt.wantFailure {
+				t.Errorf("failureDescription found=%v, ожидалось %v", found, tt.wantFailure)
+			}
+		})
+	}
+}
+
+func TestParseDSNBodyTextPatterns(t *testing.T) {
+	text := "Delivery to the following recipient failed permanently:\r\n" +
+		"user@example.org: recipient rejected, user\r\nunknown in virtual mailbox table"
+	body := buildReport("Mail delivery failed", text, "", "")
+
+	report := parseDSNBody(strings.NewReader(body), dsnMessageID, testBouncePatterns)
+	if report.HasDeliveryStatus {
+		t.Fatal("часть delivery-status не должна быть найдена")
+	}
+	desc, found := report.failureDescription("INBOX", false)
+	if !found || !strings.Contains(desc, "Пользователь не найден") {
+		t.Errorf("failureDescription=%q found=%v: фраза, перенесенная на новую строку, не найдена", desc, found)
+	}
+}
+
+func TestParseDSNBodyOtherMessage(t *testing.T) {
+	status := "Final-Recipient: rfc822; user@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\n"
+	body := buildReport("Undelivered Mail Returned to Sender", "", status, "")
+
+	report := parseDSNBody(strings.NewReader(body), "other.1@mail.example.com", testBouncePatterns)
+	if _, found := report.failureDescription("INBOX", false); found {
+		t.Error("bounce другого письма принят за недоставку")
+	}
+}
+
+func TestParseDSNBodyTruncated(t *testing.T) {
+	status := "Final-Recipient: rfc822; user@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\n"
+	body := buildReport("Undelivered Mail Returned to Sender", "Message-ID: <"+dsnMessageID+">", status, "")
+	// Сообщение обрезано внутри вложенного письма, как при загрузке не более bounceFetchLimit
+	body = body[:strings.Index(body, "Subject: Отчет")]
+
+	report := parseDSNBody(strings.NewReader(body), dsnMessageID, testBouncePatterns)
+	if report.Action != "failed" || !report.MessageIDFound {
+		t.Errorf("Action=%q MessageIDFound=%v: поля до места обрыва не разобраны", report.Action, report.MessageIDFound)
+	}
+}
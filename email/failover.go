@@ -0,0 +1,76 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ErrPartialDelivery возвращается, если письмо принято SMTP сервером только для части получателей
+// Такое письмо не передается резервному серверу, чтобы получатели не получили его дважды
+var ErrPartialDelivery = errors.New("письмо доставлено на SMTP сервер не всем получателям")
+
+// parseFailoverOrder разбирает порядок резервных SMTP серверов (SMTPFailoverOrder): номера секций
+// SMTP через запятую. Пустая строка - серверы по порядку, начиная со следующего за выбранным
+func parseFailoverOrder(order string, servers int) ([]int, error) {
+	var indexes []int
+	seen := make(map[int]bool)
+	for _, item := range strings.Split(order, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		index, err := strconv.Atoi(item)
+		if err != nil || index < 0 || index >= servers {
+			return nil, fmt.Errorf("неверный номер SMTP сервера %q в SMTPFailoverOrder (настроено серверов: %d)", item, servers)
+		}
+		if !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+// failoverCandidates возвращает серверы для отправки письма: сначала выбранный по smtp_id,
+// затем резервные в порядке SMTPFailoverOrder (без него - по кругу после выбранного)
+func (s *Service) failoverCandidates(selected int) []int {
+	candidates := []int{selected}
+	if !s.cfg.Mode.SMTPFailover {
+		return candidates
+	}
+	if len(s.failoverOrder) > 0 {
+		for _, index := range s.failoverOrder {
+			if index != selected {
+				candidates = append(candidates, index)
+			}
+		}
+		return candidates
+	}
+	for i := 1; i < len(s.smtpClients); i++ {
+		candidates = append(candidates, (selected+i)%len(s.smtpClients))
+	}
+	return candidates
+}
+
+// isFailoverError проверяет, можно ли повторить отправку через резервный сервер:
+// да для ошибок подключения (сеть, TLS, отсутствие приветствия) и временных ответов 4xx,
+// нет для постоянного отказа 5xx, частичной доставки, отклоненных адресов получателей и отмены контекста
+func isFailoverError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrPartialDelivery) || errors.Is(err, ErrMessageTooLarge) {
+		return false
+	}
+	var rejectedErr *RecipientsRejectedError
+	if errors.As(err, &rejectedErr) {
+		return false
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code < 500
+	}
+	return true
+}
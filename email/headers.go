@@ -0,0 +1,225 @@
+package email
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// reservedHeaders - заголовки, которые формирует сам сервис; переопределить их через
+// <headers> в сообщении очереди нельзя, чтобы в письме не появлялись дубликаты
+var reservedHeaders = map[string]bool{
+	"From":                      true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Return-Path":               true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// validateCustomHeader проверяет имя и значение пользовательского заголовка
+// Имя - непустая последовательность печатных ASCII символов без двоеточия (RFC 5322, field-name),
+// значение не должно содержать управляющих символов (кроме табуляции), в том числе CR и LF,
+// чтобы через него нельзя было добавить в письмо другие заголовки
+func validateCustomHeader(name, value string) error {
+	if name == "" {
+		return fmt.Errorf("пустое имя заголовка")
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return fmt.Errorf("недопустимый символ в имени заголовка %q", name)
+		}
+	}
+	if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		return fmt.Errorf("заголовок %s формируется сервисом и не может быть переопределен", name)
+	}
+	for _, r := range value {
+		if (r < 32 && r != '\t') || r == 127 {
+			return fmt.Errorf("недопустимый управляющий символ в значении заголовка %s", name)
+		}
+	}
+	return nil
+}
+
+// parseCustomHeaders отбирает допустимые пользовательские заголовки
+// Имя сохраняется в написании из очереди (X-Campaign-ID), повтор имени в другом регистре отклоняется.
+// Недопустимые заголовки не попадают в письмо и возвращаются списком ошибок для лога
+func parseCustomHeaders(headers map[string]string) (map[string]string, []string) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	// Имена обрабатываются по порядку, чтобы из повторяющихся всегда оставался один и тот же заголовок
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	valid := make(map[string]string, len(headers))
+	seen := make(map[string]bool, len(headers))
+	var rejected []string
+	for _, rawName := range names {
+		name := strings.TrimSpace(rawName)
+		value := strings.TrimSpace(headers[rawName])
+		if err := validateCustomHeader(name, value); err != nil {
+			rejected = append(rejected, err.Error())
+			continue
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if seen[key] {
+			rejected = append(rejected, fmt.Sprintf("заголовок %s указан повторно", name))
+			continue
+		}
+		seen[key] = true
+		valid[name] = value
+	}
+	sort.Strings(rejected)
+	return valid, rejected
+}
+
+// hasCustomHeader проверяет наличие пользовательского заголовка без учета регистра имени
+func hasCustomHeader(headers map[string]string, name string) bool {
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	for header := range headers {
+		if textproto.CanonicalMIMEHeaderKey(header) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parseContentLanguage проверяет язык тела письма из очереди (атрибут language) и приводит его к виду
+// заголовка Content-Language: один или несколько языковых тегов BCP 47 через запятую (ru, en-US)
+func parseContentLanguage(value string) (string, error) {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !isLanguageTag(tag) {
+			return "", fmt.Errorf("недопустимый языковой тег %q", tag)
+		}
+		tags = append(tags, tag)
+	}
+	return strings.Join(tags, ", "), nil
+}
+
+// isLanguageTag проверяет форму языкового тега: части из 1-8 латинских букв и цифр через дефис,
+// первая часть - только буквы
+func isLanguageTag(tag string) bool {
+	for i, subtag := range strings.Split(tag, "-") {
+		if len(subtag) == 0 || len(subtag) > 8 {
+			return false
+		}
+		for j := 0; j < len(subtag); j++ {
+			c := subtag[j]
+			isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+			if !isLetter && (i == 0 || c < '0' || c > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// contentLanguageHeader возвращает заголовок Content-Language для текстовой части письма
+// (пусто, если язык тела не задан)
+func contentLanguageHeader(msg *EmailMessage) string {
+	if msg.Language == "" {
+		return ""
+	}
+	return fmt.Sprintf("Content-Language: %s\r\n", msg.Language)
+}
+
+// customHeaderLines формирует строки пользовательских заголовков в порядке имен
+// Заголовки, уже добавленные сервисом для этого письма (skip, имена в каноническом виде), пропускаются
+func customHeaderLines(headers map[string]string, skip map[string]bool) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if !skip[textproto.CanonicalMIMEHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(encodeHeader(headers[name]))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+// mimeParamMaxLen - максимальная длина значения параметра (или его части) в одной строке заголовка,
+// чтобы строка вместе с именем параметра не превышала 78 символов (RFC 5322)
+const mimeParamMaxLen = 60
+
+// mimeParam формирует параметр MIME заголовка (filename в Content-Disposition, name в Content-Type)
+// Короткое ASCII значение записывается в кавычках: ; filename="report.pdf". Значение с не-ASCII
+// символами или длинное кодируется по RFC 2231 (filename*=UTF-8 и байты %XX) и при необходимости
+// разбивается на части filename*0*, filename*1*..., каждая на отдельной строке заголовка
+func mimeParam(name, value string) string {
+	if len(value) <= mimeParamMaxLen && isPrintableASCII(value) {
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+		return fmt.Sprintf("; %s=\"%s\"", name, value)
+	}
+
+	// Разбиваем закодированное значение на части, не разрывая символы UTF-8: некоторые клиенты
+	// декодируют каждую часть отдельно
+	var chunks []string
+	var chunk strings.Builder
+	chunk.WriteString("UTF-8''")
+	for _, r := range value {
+		var token strings.Builder
+		for _, c := range []byte(string(r)) {
+			if isRFC2231AttributeChar(c) {
+				token.WriteByte(c)
+			} else {
+				fmt.Fprintf(&token, "%%%02X", c)
+			}
+		}
+		if chunk.Len()+token.Len() > mimeParamMaxLen {
+			chunks = append(chunks, chunk.String())
+			chunk.Reset()
+		}
+		chunk.WriteString(token.String())
+	}
+	chunks = append(chunks, chunk.String())
+
+	if len(chunks) == 1 {
+		return fmt.Sprintf(";\r\n %s*=%s", name, chunks[0])
+	}
+	var b strings.Builder
+	for i, part := range chunks {
+		fmt.Fprintf(&b, ";\r\n %s*%d*=%s", name, i, part)
+	}
+	return b.String()
+}
+
+// isPrintableASCII проверяет, что строка состоит только из печатных ASCII символов
+func isPrintableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 32 || s[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// isRFC2231AttributeChar проверяет, можно ли записать байт в значении параметра RFC 2231 без кодирования %XX
+func isRFC2231AttributeChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
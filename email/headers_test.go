@@ -0,0 +1,228 @@
+package email
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+
+	"email-service/db"
+	"email-service/settings"
+)
+
+func TestValidateCustomHeader(t *testing.T) {
+	tests := []struct {
+		name, value string
+		wantErr     bool
+	}{
+		{"X-Campaign-ID", "spring-2024", false},
+		{"X-Tags", "a\tb", false},
+		{"X-Campaign-ID", "42\r\nBcc: victim@example.org", true}, // Внедрение заголовка через CRLF
+		{"X-Campaign-ID", "42\nBcc: victim@example.org", true},
+		{"X-Null", "a\x00b", true},
+		{"X-Bad:Name", "1", true},
+		{"X Bad", "1", true},
+		{"", "1", true},
+		{"subject", "Подмена темы", true}, // Служебные заголовки не переопределяются
+		{"BCC", "victim@example.org", true},
+		{"message-id", "<x@example.org>", true},
+	}
+	for _, tt := range tests {
+		err := validateCustomHeader(tt.name, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateCustomHeader(%q, %q) = %v, ожидалась ошибка: %v", tt.name, tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCustomHeaders(t *testing.T) {
+	valid, rejected := parseCustomHeaders(map[string]string{
+		" x-priority ":  " 1 ",
+		"X-Campaign-ID": "spring-2024",
+		"X-Injected":    "v\r\nTo: victim@example.org",
+		"From":          "boss@example.org",
+		// Повтор имени в другом регистре: остается первое по порядку имен (X-Tag)
+		"X-Tag": "a",
+		"x-tag": "b",
+	})
+	// Имена сохраняют написание из очереди
+	want := map[string]string{"x-priority": "1", "X-Campaign-ID": "spring-2024", "X-Tag": "a"}
+	if !reflect.DeepEqual(valid, want) {
+		t.Errorf("valid = %v, ожидалось %v", valid, want)
+	}
+	if len(rejected) != 3 {
+		t.Errorf("отклонено %d заголовков, ожидалось 3: %v", len(rejected), rejected)
+	}
+
+	if valid, rejected := parseCustomHeaders(nil); valid != nil || rejected != nil {
+		t.Errorf("пустой список: valid = %v, rejected = %v", valid, rejected)
+	}
+}
+
+func TestCustomHeadersSkipServiceHeaders(t *testing.T) {
+	client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", User: "sender@example.com"})
+	msg := &EmailMessage{
+		TaskID:        1,
+		Title:         "Тема",
+		Text:          "текст",
+		AutoSubmitted: true,
+		CustomHeaders: map[string]string{
+			"precedence": "list", // Уже добавлен сервисом для этого письма (имя в другом регистре)
+			"X-Priority": "1",
+		},
+	}
+	body := client.GetEmailBody(msg, []string{"user@example.org"}, false, false)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("письмо не разбирается: %v", err)
+	}
+	if got := parsed.Header["Precedence"]; !reflect.DeepEqual(got, []string{"bulk"}) {
+		t.Errorf("Precedence = %q, ожидался один заголовок сервиса", got)
+	}
+	if got := parsed.Header.Get("X-Priority"); got != "1" {
+		t.Errorf("X-Priority = %q", got)
+	}
+}
+
+func TestCustomHeadersRoundTrip(t *testing.T) {
+	// Заголовки из сообщения очереди проходят разбор и проверку и попадают в письмо
+	payload := `<root><head></head><body><email email_task_id="7" smtp_id="0" email_address="user@example.org" email_title="Тема" email_text="текст">` +
+		`<headers>` +
+		`<header name="X-Campaign-ID" value="spring-2024"/>` +
+		`<header name="X-Note" value="Привет"/>` +
+		`<header name="X-Injected" value="1&#13;&#10;Bcc: victim@example.org"/>` +
+		`<header name="Subject" value="Подмена"/>` +
+		`</headers></email></body></root>`
+
+	data, err := (&db.QueueReader{}).ParseXMLMessage(&db.QueueMessage{XMLPayload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedMsg, err := ParseEmailMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", User: "sender@example.com"})
+	msg := &EmailMessage{TaskID: parsedMsg.TaskID, Title: parsedMsg.Title, Text: parsedMsg.Text, CustomHeaders: parsedMsg.CustomHeaders}
+	body := client.GetEmailBody(msg, []string{"user@example.org"}, false, false)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("письмо не разбирается: %v", err)
+	}
+	// Имя заголовка в письме совпадает с написанием в очереди
+	if !strings.Contains(body, "\r\nX-Campaign-ID: spring-2024\r\n") {
+		t.Errorf("в письме нет заголовка X-Campaign-ID в исходном написании:\n%s", body)
+	}
+	if got, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("X-Note")); got != "Привет" {
+		t.Errorf("X-Note = %q", got)
+	}
+	if got := parsed.Header.Get("X-Injected"); got != "" {
+		t.Errorf("заголовок с CRLF попал в письмо: %q", got)
+	}
+	if got := parsed.Header["Bcc"]; len(got) != 0 {
+		t.Errorf("внедренный Bcc попал в письмо: %q", got)
+	}
+	if got := parsed.Header["Subject"]; len(got) != 1 {
+		t.Errorf("Subject встречается %d раз", len(got))
+	}
+}
+
+func TestMimeParamRoundTrip(t *testing.T) {
+	tests := []struct {
+		value      string
+		wantQuoted bool
+	}{
+		{"report.pdf", true},
+		{`отчет "квартал".pdf`, false},
+		{`a "b" \c.txt`, true},
+		{"Отчет о доставке писем.xlsx", false},
+		{strings.Repeat("Длинное имя вложения ", 6) + ".pdf", false},
+		{strings.Repeat("long-ascii-name-", 5) + ".csv", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			param := mimeParam("filename", tt.value)
+			if quoted := strings.HasPrefix(param, `; filename="`); quoted != tt.wantQuoted {
+				t.Errorf("mimeParam(%q) = %q, ожидалась запись в кавычках: %v", tt.value, param, tt.wantQuoted)
+			}
+			// Строки заголовка не превышают 78 символов
+			for _, line := range strings.Split("Content-Disposition: attachment"+param, "\r\n") {
+				if len(line) > 78 {
+					t.Errorf("строка заголовка длиной %d: %q", len(line), line)
+				}
+			}
+
+			_, params, err := mime.ParseMediaType("attachment" + strings.ReplaceAll(param, "\r\n", ""))
+			if err != nil {
+				t.Fatalf("заголовок не разбирается: %v (%q)", err, param)
+			}
+			if params["filename"] != tt.value {
+				t.Errorf("имя файла %q, ожидалось %q", params["filename"], tt.value)
+			}
+		})
+	}
+}
+
+func TestAttachmentFileNameRoundTrip(t *testing.T) {
+	// Русские имена вложений восстанавливаются почтовым клиентом из письма без искажений
+	names := []string{"Счет №42.pdf", "Акт сверки взаиморасчетов за третий квартал 2024 года.xlsx", "report.txt"}
+	msg := &EmailMessage{TaskID: 1, Title: "Документы", Text: "текст"}
+	for _, name := range names {
+		msg.Attachments = append(msg.Attachments, AttachmentData{FileName: name, Data: []byte("данные")})
+	}
+	client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", User: "sender@example.com"})
+	body := client.GetEmailBody(msg, []string{"user@example.org"}, false, false)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("письмо не разбирается: %v", err)
+	}
+	_, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	var got []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.FileName() == "" {
+			continue
+		}
+		got = append(got, part.FileName())
+		_, ctParams, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || ctParams["name"] != part.FileName() {
+			t.Errorf("Content-Type name = %q, ожидалось %q (%v)", ctParams["name"], part.FileName(), err)
+		}
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("имена вложений %q, ожидалось %q", got, names)
+	}
+}
+
+func TestNoReplyKeepsCustomReplyTo(t *testing.T) {
+	client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", User: "noreply@example.com",
+		NoReplySender: true, SupportReplyTo: "support@example.com"})
+	// Reply-To из очереди в любом регистре заменяет адрес поддержки
+	msg := &EmailMessage{TaskID: 1, Title: "Тема", Text: "текст", CustomHeaders: map[string]string{"reply-to": "manager@example.com"}}
+	body := client.GetEmailBody(msg, []string{"user@example.org"}, false, false)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("письмо не разбирается: %v", err)
+	}
+	if got := parsed.Header["Reply-To"]; !reflect.DeepEqual(got, []string{"manager@example.com"}) {
+		t.Errorf("Reply-To = %q, ожидался один заголовок из очереди", got)
+	}
+}
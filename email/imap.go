@@ -3,8 +3,11 @@ package email
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -20,9 +23,23 @@ import (
 
 // IMAPClient представляет IMAP клиент для получения статусов доставки
 type IMAPClient struct {
-	cfg            *settings.SMTPConfig
-	lastStatusTime time.Time
-	mu             sync.Mutex
+	cfg                       *settings.SMTPConfig
+	lastStatusTime            time.Time
+	unknownDSNActionAsFailure bool // Считать нестандартный Action в DSN ошибкой при явных признаках недоставки
+	mu                        sync.Mutex
+
+	// Открытый сеанс (Connect/Login) для проверки нескольких писем подряд, nil - сеанс не открыт
+	conn    *client.Client
+	folders []string // Папки для поиска bounce messages, определяются при Login
+
+	// Команда сеанса (SEARCH, FETCH) прервана по таймауту и может еще выполняться на сервере:
+	// ответы на следующие команды смешаются с ее ответом, поэтому сеанс повторно не используется
+	interrupted bool
+
+	cache *bounceCache // Просмотренные bounce messages (nil - без кеша)
+
+	// Сопоставленные с письмами bounce messages, ожидающие действия IMAPBounceAction
+	processed []processedBounce
 }
 
 // NewIMAPClient создает новый IMAP клиент
@@ -33,57 +50,148 @@ func NewIMAPClient(cfg *settings.SMTPConfig) *IMAPClient {
 	}
 }
 
-// CheckEmailStatus проверяет наличие bounce messages по Message-ID во всех папках входящих
-// Возвращает status (3 - bounce найден/ошибка, 4 - bounce не найден/доставлено), описание и ошибку
-// Общий таймаут операции: 60 секунд
-func (c *IMAPClient) CheckEmailStatus(ctx context.Context, messageID string) (int, string, error) {
-	if c.cfg.IMAPHost == "" {
-		return 4, "IMAP не настроен, считаем письмо доставленным", nil
+// operationTimeout возвращает общий таймаут проверки статуса письма (IMAPTimeoutSec, по умолчанию 60 секунд)
+func (c *IMAPClient) operationTimeout() time.Duration {
+	return secondsOrDefault(c.cfg.IMAPTimeoutSec, 60*time.Second)
+}
+
+// connectTimeout возвращает таймаут подключения к IMAP серверу (IMAPConnectTimeoutSec, по умолчанию 15 секунд)
+func (c *IMAPClient) connectTimeout() time.Duration {
+	return secondsOrDefault(c.cfg.IMAPConnectTimeoutSec, 15*time.Second)
+}
+
+// folderTimeout возвращает таймаут проверки одной папки (IMAPFolderTimeoutSec, по умолчанию 30 секунд)
+func (c *IMAPClient) folderTimeout() time.Duration {
+	return secondsOrDefault(c.cfg.IMAPFolderTimeoutSec, 30*time.Second)
+}
+
+// fetchTimeout возвращает таймаут одной команды FETCH (IMAPFetchTimeoutSec, по умолчанию 15 секунд)
+func (c *IMAPClient) fetchTimeout() time.Duration {
+	return secondsOrDefault(c.cfg.IMAPFetchTimeoutSec, 15*time.Second)
+}
+
+// secondsOrDefault переводит значение параметра в секундах в time.Duration (0 и меньше - значение по умолчанию)
+func secondsOrDefault(sec int, def time.Duration) time.Duration {
+	if sec <= 0 {
+		return def
 	}
+	return time.Duration(sec) * time.Second
+}
 
-	// Устанавливаем общий таймаут для всей операции: 60 секунд
-	// Это достаточно для проверки нескольких папок, но предотвращает зависание
-	timeoutCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
-	defer cancel()
+// SetUnknownDSNActionAsFailure включает обработку нестандартных значений Action в DSN как ошибки доставки
+func (c *IMAPClient) SetUnknownDSNActionAsFailure(enabled bool) {
+	c.unknownDSNActionAsFailure = enabled
+}
 
-	// Подключаемся к IMAP серверу
-	addr := fmt.Sprintf("%s:%d", c.cfg.IMAPHost, c.cfg.IMAPPort)
-	var imapClient *client.Client
-	var err error
+// SetBounceCache задает кеш просмотренных bounce messages, общий для нескольких клиентов
+func (c *IMAPClient) SetBounceCache(cache *bounceCache) {
+	c.cache = cache
+}
+
+// bounceKey возвращает ключ кеша для письма папки folderName
+func (c *IMAPClient) bounceKey(folderName string, uidValidity, uid uint32) bounceKey {
+	return bounceKey{
+		mailbox:     c.cfg.IMAPHost + "|" + c.cfg.User + "|" + folderName,
+		uidValidity: uidValidity,
+		uid:         uid,
+	}
+}
+
+// Connect устанавливает соединение с IMAP сервером (TLS на порту 993, иначе STARTTLS)
+// Таймаут подключения ограничивает установку соединения и ожидание приветствия сервера
+func (c *IMAPClient) Connect() error {
+	if c.conn != nil {
+		return nil
+	}
 
+	addr := fmt.Sprintf("%s:%d", c.cfg.IMAPHost, c.cfg.IMAPPort)
+	dialer := &net.Dialer{Timeout: c.connectTimeout()}
 	if c.cfg.IMAPPort == 993 {
 		// SSL/TLS соединение
-		imapClient, err = client.DialTLS(addr, &tls.Config{
-			ServerName:         c.cfg.IMAPHost,
-			InsecureSkipVerify: false,
-		})
-	} else {
-		// Обычное соединение с STARTTLS
-		imapClient, err = client.Dial(addr)
-		if err == nil {
-			// Пробуем STARTTLS
-			if err := imapClient.StartTLS(&tls.Config{
-				ServerName:         c.cfg.IMAPHost,
-				InsecureSkipVerify: false,
-			}); err != nil {
-				imapClient.Logout()
-				return 4, "Ошибка STARTTLS, считаем письмо доставленным", fmt.Errorf("ошибка STARTTLS: %w", err)
-			}
+		imapClient, err := client.DialWithDialerTLS(dialer, addr, newTLSConfig(c.cfg, c.cfg.IMAPHost))
+		if err != nil {
+			return fmt.Errorf("ошибка подключения к IMAP: %w", err)
 		}
+		c.conn = imapClient
+		return nil
 	}
 
+	// Обычное соединение с STARTTLS
+	imapClient, err := client.DialWithDialer(dialer, addr)
 	if err != nil {
-		return 4, "Ошибка подключения к IMAP, считаем письмо доставленным", fmt.Errorf("ошибка подключения к IMAP: %w", err)
+		return fmt.Errorf("ошибка подключения к IMAP: %w", err)
 	}
-	defer imapClient.Logout()
+	if err := imapClient.StartTLS(newTLSConfig(c.cfg, c.cfg.IMAPHost)); err != nil {
+		imapClient.Logout()
+		return fmt.Errorf("ошибка STARTTLS: %w", err)
+	}
+	c.conn = imapClient
+	return nil
+}
+
+// Login выполняет аутентификацию в открытом соединении и определяет папки для поиска bounce messages
+func (c *IMAPClient) Login() error {
+	if c.conn == nil {
+		return fmt.Errorf("соединение с IMAP не установлено")
+	}
+	if err := c.conn.Login(c.cfg.User, c.cfg.Password); err != nil {
+		return fmt.Errorf("ошибка аутентификации IMAP: %w", err)
+	}
+	// Проверяем bounce messages во входящих, корзине и спаме (имена папок определяются через LIST)
+	// или в папках IMAPBounceFolders
+	c.folders = c.resolveBounceFolders(c.conn)
+	return nil
+}
+
+// Logout завершает сеанс и закрывает соединение
+// Сеанс с прерванной по таймауту командой закрывается без LOGOUT: сервер может не ответить на него
+func (c *IMAPClient) Logout() {
+	if c.conn == nil {
+		return
+	}
+	if c.interrupted {
+		_ = c.conn.Terminate()
+	} else {
+		_ = c.conn.Logout()
+	}
+	c.conn = nil
+	c.folders = nil
+	c.interrupted = false
+}
 
-	// Аутентификация
-	if err := imapClient.Login(c.cfg.User, c.cfg.Password); err != nil {
-		return 4, "Ошибка аутентификации IMAP, считаем письмо доставленным", fmt.Errorf("ошибка аутентификации IMAP: %w", err)
+// Connected сообщает, что сеанс открыт
+func (c *IMAPClient) Connected() bool {
+	return c.conn != nil
+}
+
+// CheckEmailStatus проверяет наличие bounce messages по Message-ID во всех папках входящих
+// Возвращает статус (StatusFailed - bounce найден, StatusDelivered - bounce не найден), описание,
+// время события по данным bounce message (нулевое, если bounce не найден или дата неизвестна) и ошибку
+// Если сеанс открыт через Connect и Login, используется он; иначе соединение устанавливается
+// для одной проверки и закрывается после нее
+// Общий таймаут операции задается IMAPTimeoutSec (по умолчанию 60 секунд)
+func (c *IMAPClient) CheckEmailStatus(ctx context.Context, messageID string) (Status, string, time.Time, error) {
+	if c.cfg.IMAPHost == "" {
+		return StatusDelivered, "IMAP не настроен, считаем письмо доставленным", time.Time{}, nil
 	}
 
-	// Проверяем bounce messages в трех основных папках: INBOX, Trash, Spam
-	foldersToCheck := []string{"INBOX", "Trash", "Spam"}
+	// Устанавливаем общий таймаут для всей операции
+	// Его должно хватать для проверки нескольких папок, но он предотвращает зависание
+	operationTimeout := c.operationTimeout()
+	timeoutCtx, cancel := context.WithTimeout(ctx, operationTimeout)
+	defer cancel()
+
+	if c.conn == nil {
+		if err := c.Connect(); err != nil {
+			return StatusDelivered, "Ошибка подключения к IMAP, считаем письмо доставленным", time.Time{}, err
+		}
+		defer c.Logout()
+		if err := c.Login(); err != nil {
+			return StatusDelivered, "Ошибка аутентификации IMAP, считаем письмо доставленным", time.Time{}, err
+		}
+	}
+	imapClient := c.conn
+	foldersToCheck := c.folders
 
 	for _, folderName := range foldersToCheck {
 		// Проверяем, не истек ли общий таймаут
@@ -92,13 +200,14 @@ func (c *IMAPClient) CheckEmailStatus(ctx context.Context, messageID string) (in
 			if logger.Log != nil {
 				logger.Log.Warn("Таймаут проверки статуса письма",
 					zap.String("messageID", messageID),
-					zap.String("reason", "превышен общий таймаут 60 секунд"))
+					zap.String("reason", "превышен общий таймаут"),
+					zap.Duration("timeout", operationTimeout))
 			}
-			return 4, "Таймаут проверки статуса, считаем письмо доставленным", timeoutCtx.Err()
+			return StatusDelivered, "Таймаут проверки статуса, считаем письмо доставленным", time.Time{}, timeoutCtx.Err()
 		default:
 		}
 
-		bounceStatus, bounceDesc, err := c.checkBounceMessages(timeoutCtx, imapClient, folderName, messageID)
+		bounceStatus, bounceDesc, eventTime, err := c.checkBounceMessages(timeoutCtx, imapClient, folderName, messageID)
 		// Проверяем, является ли ошибка таймаутом
 		if err != nil && (err == context.DeadlineExceeded || err == context.Canceled) {
 			if logger.Log != nil {
@@ -107,9 +216,9 @@ func (c *IMAPClient) CheckEmailStatus(ctx context.Context, messageID string) (in
 					zap.String("folder", folderName),
 					zap.Error(err))
 			}
-			return 4, "Таймаут проверки статуса, считаем письмо доставленным", err
+			return StatusDelivered, "Таймаут проверки статуса, считаем письмо доставленным", time.Time{}, err
 		}
-		if err == nil && bounceStatus == 3 {
+		if err == nil && bounceStatus == StatusFailed {
 			// Найдено bounce message - письмо не доставлено
 			if logger.Log != nil {
 				logger.Log.Info("Найден bounce message",
@@ -117,7 +226,7 @@ func (c *IMAPClient) CheckEmailStatus(ctx context.Context, messageID string) (in
 					zap.String("folder", folderName),
 					zap.String("description", bounceDesc))
 			}
-			return 3, bounceDesc, nil
+			return StatusFailed, bounceDesc, eventTime, nil
 		}
 	}
 
@@ -126,34 +235,193 @@ func (c *IMAPClient) CheckEmailStatus(ctx context.Context, messageID string) (in
 		logger.Log.Debug("Bounce messages не найдено, письмо считается доставленным",
 			zap.String("messageID", messageID))
 	}
-	return 4, "Bounce messages не найдено, письмо доставлено", nil
+	return StatusDelivered, "Bounce messages не найдено, письмо доставлено", time.Time{}, nil
+}
+
+// defaultBounceFolders - папки для проверки, если получить список папок через LIST не удалось
+var defaultBounceFolders = []string{"INBOX", "Trash", "Spam"}
+
+// bounceFolderNames - известные имена папок корзины и спама (в нижнем регистре), в том числе локализованные
+var bounceFolderNames = map[string]bool{
+	"trash":               true,
+	"deleted items":       true,
+	"deleted messages":    true,
+	"корзина":             true,
+	"удаленные":           true,
+	"удалённые":           true,
+	"spam":                true,
+	"junk":                true,
+	"junk e-mail":         true,
+	"junk email":          true,
+	"спам":                true,
+	"нежелательная почта": true,
+}
+
+// resolveBounceFolders возвращает список папок для поиска bounce messages: INBOX, а также папки корзины
+// и спама, найденные через LIST по атрибутам \Trash/\Junk или по известным именам.
+// Имена папок IMAP передаются в modified UTF-7; библиотека декодирует их при разборе LIST и кодирует
+// обратно при SELECT, поэтому сравнение выполняется с обычными строками (например, "Спам").
+// Если задан IMAPBounceFolders, проверяются только перечисленные папки (configuredBounceFolders)
+func (c *IMAPClient) resolveBounceFolders(imapClient *client.Client) []string {
+	if len(c.cfg.IMAPBounceFolders) > 0 {
+		return c.configuredBounceFolders(imapClient)
+	}
+
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- imapClient.List("", "*", mailboxes)
+	}()
+
+	folders := []string{"INBOX"}
+	for mbox := range mailboxes {
+		if strings.EqualFold(mbox.Name, "INBOX") {
+			continue
+		}
+		if isBounceFolder(mbox) {
+			folders = append(folders, mbox.Name)
+		}
+	}
+
+	if err := <-done; err != nil {
+		if logger.Log != nil {
+			logger.Log.Warn("Не удалось получить список папок IMAP, используются папки по умолчанию",
+				zap.Strings("folders", defaultBounceFolders),
+				zap.Error(err))
+		}
+		return defaultBounceFolders
+	}
+
+	if len(folders) == 1 {
+		// Сервер не вернул ни корзины, ни спама - проверяем стандартные имена
+		return defaultBounceFolders
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("Папки IMAP для поиска bounce messages",
+			zap.Strings("folders", folders))
+	}
+	return folders
+}
+
+// configuredBounceFolders возвращает папки IMAPBounceFolders в порядке параметра
+// Имя без символов шаблона используется как есть; шаблон (*, ?, [...], как в path.Match)
+// сравнивается с именами папок из LIST. Если LIST не выполнился, проверяются только имена без шаблона
+func (c *IMAPClient) configuredBounceFolders(imapClient *client.Client) []string {
+	mailboxes := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- imapClient.List("", "*", mailboxes)
+	}()
+
+	var listed []string
+	for mbox := range mailboxes {
+		if !hasMailboxAttr(mbox, imap.NoSelectAttr) {
+			listed = append(listed, mbox.Name)
+		}
+	}
+	if err := <-done; err != nil {
+		listed = nil
+		if logger.Log != nil {
+			logger.Log.Warn("Не удалось получить список папок IMAP, шаблоны IMAPBounceFolders не применяются",
+				zap.Strings("patterns", c.cfg.IMAPBounceFolders),
+				zap.Error(err))
+		}
+	}
+
+	var folders []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			folders = append(folders, name)
+		}
+	}
+	for _, pattern := range c.cfg.IMAPBounceFolders {
+		if !strings.ContainsAny(pattern, "*?[") {
+			add(pattern)
+			continue
+		}
+		for _, name := range listed {
+			// Шаблон проверен при чтении конфигурации
+			if ok, _ := path.Match(pattern, name); ok {
+				add(name)
+			}
+		}
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("Папки IMAP для поиска bounce messages (IMAPBounceFolders)",
+			zap.Strings("folders", folders))
+	}
+	return folders
+}
+
+// hasMailboxAttr проверяет наличие атрибута у папки из ответа LIST
+func hasMailboxAttr(mbox *imap.MailboxInfo, attr string) bool {
+	for _, a := range mbox.Attributes {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// isBounceFolder определяет, является ли папка корзиной или спамом
+func isBounceFolder(mbox *imap.MailboxInfo) bool {
+	for _, attr := range mbox.Attributes {
+		if attr == imap.NoSelectAttr {
+			return false
+		}
+	}
+	for _, attr := range mbox.Attributes {
+		if attr == imap.TrashAttr || attr == imap.JunkAttr {
+			return true
+		}
+	}
+
+	// Сравниваем последний уровень иерархии, чтобы учитывать вложенные папки вида "INBOX/Спам"
+	name := mbox.Name
+	if mbox.Delimiter != "" {
+		if idx := strings.LastIndex(name, mbox.Delimiter); idx >= 0 {
+			name = name[idx+len(mbox.Delimiter):]
+		}
+	}
+	return bounceFolderNames[strings.ToLower(strings.TrimSpace(name))]
 }
 
 // checkBounceMessages проверяет наличие bounce messages в указанной папке
-// Использует SEARCH для поиска bounce-сообщений на сервере, затем FETCH только для найденных
-// Таймаут: 30 секунд на папку
-func (c *IMAPClient) checkBounceMessages(ctx context.Context, imapClient *client.Client, folderName, messageID string) (int, string, error) {
+// Использует UID SEARCH для поиска кандидатов на сервере (ответы на письмо по In-Reply-To
+// и письма от mailer-daemon), затем UID FETCH конвертов найденных страницами по IMAPScanPageSize
+// от новых к старым, пока не найден bounce письма
+// Таймаут на папку задается IMAPFolderTimeoutSec (по умолчанию 30 секунд)
+func (c *IMAPClient) checkBounceMessages(ctx context.Context, imapClient *client.Client, folderName, messageID string) (Status, string, time.Time, error) {
 	// Пробуем выбрать папку
 	mbox, err := imapClient.Select(folderName, false)
 	if err != nil {
 		// Если папка недоступна, возвращаем что не найдено
-		return 0, "", err
+		return StatusNone, "", time.Time{}, err
 	}
 
 	if mbox.Messages == 0 {
-		return 0, "", nil
+		return StatusNone, "", time.Time{}, nil
 	}
 
 	messageIDClean := strings.Trim(messageID, "<>")
 
-	// Таймаут для всей операции проверки папки: 30 секунд
-	searchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	// Таймаут для всей операции проверки папки
+	searchCtx, cancel := context.WithTimeout(ctx, c.folderTimeout())
 	defer cancel()
 
-	// Используем SEARCH для поиска bounce messages от mailer-daemon
-	// Это намного быстрее, чем FETCH всех писем
+	// Используем SEARCH для поиска bounce messages: ответы на наше письмо (In-Reply-To)
+	// или письма от mailer-daemon. Это намного быстрее, чем FETCH всех писем
+	inReplyTo := imap.NewSearchCriteria()
+	inReplyTo.Header.Add("In-Reply-To", messageIDClean)
+	fromDaemon := imap.NewSearchCriteria()
+	fromDaemon.Header.Add("From", "mailer-daemon")
+
 	criteria := imap.NewSearchCriteria()
-	criteria.Header.Add("From", "mailer-daemon")
+	criteria.Or = [][2]*imap.SearchCriteria{{inReplyTo, fromDaemon}}
 
 	// Ограничиваем поиск последними письмами (за последние 7 дней)
 	weekAgo := time.Now().AddDate(0, 0, -7)
@@ -162,26 +430,27 @@ func (c *IMAPClient) checkBounceMessages(ctx context.Context, imapClient *client
 	if logger.Log != nil {
 		logger.Log.Debug("IMAP SEARCH bounce messages",
 			zap.String("folder", folderName),
-			zap.String("criteria", "FROM mailer-daemon, SINCE 7 days ago"))
+			zap.String("criteria", "OR In-Reply-To <messageID> FROM mailer-daemon, SINCE 7 days ago"))
 	}
 
-	// Выполняем SEARCH
+	// Выполняем UID SEARCH: UID не меняются при удалении писем из папки между SEARCH и FETCH
 	searchDone := make(chan error, 1)
 	var uids []uint32
 
 	go func() {
 		var searchErr error
-		uids, searchErr = imapClient.Search(criteria)
+		uids, searchErr = imapClient.UidSearch(criteria)
 		searchDone <- searchErr
 	}()
 
 	select {
 	case <-searchCtx.Done():
+		c.interrupted = true
 		if logger.Log != nil {
 			logger.Log.Debug("Таймаут SEARCH папки IMAP",
 				zap.String("folder", folderName))
 		}
-		return 0, "", context.DeadlineExceeded
+		return StatusNone, "", time.Time{}, context.DeadlineExceeded
 	case err := <-searchDone:
 		if err != nil {
 			if logger.Log != nil {
@@ -189,13 +458,13 @@ func (c *IMAPClient) checkBounceMessages(ctx context.Context, imapClient *client
 					zap.String("folder", folderName),
 					zap.Error(err))
 			}
-			return 0, "", err
+			return StatusNone, "", time.Time{}, err
 		}
 	}
 
 	if len(uids) == 0 {
 		// Bounce messages не найдено
-		return 0, "", nil
+		return StatusNone, "", time.Time{}, nil
 	}
 
 	if logger.Log != nil {
@@ -204,47 +473,169 @@ func (c *IMAPClient) checkBounceMessages(ctx context.Context, imapClient *client
 			zap.Int("count", len(uids)))
 	}
 
-	// Ограничиваем количество проверяемых писем (последние 20 bounce)
-	if len(uids) > 20 {
-		uids = uids[len(uids)-20:]
+	// Просматриваем не более IMAPScanMaxMessages последних писем страницами от новых к старым:
+	// bounce недавнего письма обычно среди последних, и остальные страницы не загружаются
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if limit := c.scanMaxMessages(); len(uids) > limit {
+		uids = uids[len(uids)-limit:]
 	}
+	pageSize := c.scanPageSize()
+	for end := len(uids); end > 0; end -= pageSize {
+		start := end - pageSize
+		if start < 0 {
+			start = 0
+		}
+		page, err := c.loadEnvelopes(searchCtx, imapClient, folderName, mbox.UidValidity, uids[start:end])
+		if err != nil {
+			return StatusNone, "", time.Time{}, err
+		}
+		if status, desc, eventTime, found := c.matchBounce(searchCtx, imapClient, folderName, mbox.UidValidity, page, messageIDClean); found {
+			if start > 0 && logger.Log != nil {
+				logger.Log.Debug("Bounce найден, просмотр папки остановлен",
+					zap.String("folder", folderName),
+					zap.Int("skipped", start))
+			}
+			return status, desc, eventTime, nil
+		}
+		if c.interrupted {
+			// Загрузка тела письма прервана по таймауту: остальные письма в этом сеансе не проверяются
+			return StatusNone, "", time.Time{}, context.DeadlineExceeded
+		}
+	}
+
+	// Bounce messages найдены, но не для нашего письма
+	return StatusNone, "", time.Time{}, nil
+}
+
+// scanMaxMessages возвращает число последних писем папки, просматриваемых при проверке (IMAPScanMaxMessages)
+func (c *IMAPClient) scanMaxMessages() int {
+	if c.cfg.IMAPScanMaxMessages > 0 {
+		return c.cfg.IMAPScanMaxMessages
+	}
+	return 20
+}
+
+// scanPageSize возвращает число писем, конверты которых загружаются одним FETCH (IMAPScanPageSize)
+func (c *IMAPClient) scanPageSize() int {
+	if size := c.cfg.IMAPScanPageSize; size > 0 && size < c.scanMaxMessages() {
+		return size
+	}
+	return c.scanMaxMessages()
+}
 
-	// Делаем FETCH только для найденных bounce messages
+// loadEnvelopes возвращает конверты писем uids от новых к старым
+// Письма, просмотренные при прошлых проверках, берутся из кеша; уже сопоставленные bounce пропускаются
+func (c *IMAPClient) loadEnvelopes(ctx context.Context, imapClient *client.Client, folderName string, uidValidity uint32, uids []uint32) ([]*imap.Message, error) {
+	var msgs []*imap.Message
 	seqSet := new(imap.SeqSet)
 	for _, uid := range uids {
-		seqSet.AddNum(uid)
+		cached := c.cache.lookup(c.bounceKey(folderName, uidValidity, uid))
+		switch {
+		case cached != nil && cached.consumed:
+		case cached != nil && cached.envelope != nil:
+			msgs = append(msgs, &imap.Message{Uid: uid, Envelope: cached.envelope})
+		default:
+			seqSet.AddNum(uid)
+		}
+	}
+	if !seqSet.Empty() {
+		fetched, err := c.fetchEnvelopes(ctx, imapClient, folderName, seqSet, len(uids))
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range fetched {
+			c.cache.storeEnvelope(c.bounceKey(folderName, uidValidity, msg.Uid), msg.Envelope)
+		}
+		msgs = append(msgs, fetched...)
 	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Uid > msgs[j].Uid })
+	return msgs, nil
+}
 
+// matchBounce ищет среди писем bounce для messageIDClean; found - bounce найден и отмечен как сопоставленный
+func (c *IMAPClient) matchBounce(ctx context.Context, imapClient *client.Client, folderName string, uidValidity uint32, msgs []*imap.Message, messageIDClean string) (Status, string, time.Time, bool) {
+	// Проверяем каждое bounce сообщение на наличие нашего Message-ID
+	for _, msg := range msgs {
+		if c.interrupted {
+			// Загрузка тела предыдущего письма прервана, сеанс больше не используется
+			break
+		}
+		if msg.Envelope == nil {
+			continue
+		}
+		// Письмо, найденное только по In-Reply-To, может быть обычным ответом или автоответом:
+		// такие письма проверяются по ключевым словам отправителя и темы
+		if !isFromMailerDaemon(msg) && !c.isBounceMessage(msg, messageIDClean) {
+			continue
+		}
+		key := c.bounceKey(folderName, uidValidity, msg.Uid)
+
+		// Проверяем InReplyTo заголовок
+		if msg.Envelope.InReplyTo != "" {
+			inReplyToClean := strings.Trim(msg.Envelope.InReplyTo, "<>")
+			if strings.Contains(inReplyToClean, messageIDClean) || strings.Contains(messageIDClean, inReplyToClean) {
+				// Найден bounce для нашего письма!
+				errorDesc, eventTime, found := c.extractBounceError(ctx, imapClient, folderName, key, messageIDClean)
+				c.cache.consume(key)
+				c.markProcessed(folderName, msg.Uid)
+				if found {
+					return StatusFailed, errorDesc, eventTime, true
+				}
+				// Даже если не удалось извлечь детали, это наш bounce; время события - дата bounce message
+				return StatusFailed, fmt.Sprintf("Bounce message найден в папке '%s' (InReplyTo match)", folderName), msg.Envelope.Date, true
+			}
+		}
+
+		// Если InReplyTo не совпал, проверяем тело письма
+		errorDesc, eventTime, found := c.extractBounceError(ctx, imapClient, folderName, key, messageIDClean)
+		if found {
+			c.cache.consume(key)
+			c.markProcessed(folderName, msg.Uid)
+			return StatusFailed, errorDesc, eventTime, true
+		}
+	}
+	return StatusNone, "", time.Time{}, false
+}
+
+// fetchEnvelopes загружает конверты писем seqSet (UID)
+// Ограничен контекстом проверки папки и IMAPFetchTimeoutSec
+func (c *IMAPClient) fetchEnvelopes(ctx context.Context, imapClient *client.Client, folderName string, seqSet *imap.SeqSet, count int) ([]*imap.Message, error) {
 	items := []imap.FetchItem{
 		imap.FetchEnvelope,
 		imap.FetchUid,
 	}
 
-	messages := make(chan *imap.Message, len(uids))
+	messages := make(chan *imap.Message, count)
 	fetchDone := make(chan error, 1)
 
 	go func() {
-		fetchDone <- imapClient.Fetch(seqSet, items, messages)
+		fetchDone <- imapClient.UidFetch(seqSet, items, messages)
 	}()
 
 	// Собираем сообщения
 	var fetchedMsgs []*imap.Message
-	fetchTimeout := time.After(15 * time.Second)
+	fetchTimeout := time.After(c.fetchTimeout())
 
 fetchLoop:
 	for {
 		select {
-		case <-searchCtx.Done():
-			return 0, "", context.DeadlineExceeded
+		case <-ctx.Done():
+			c.interrupted = true
+			return nil, context.DeadlineExceeded
 		case <-fetchTimeout:
+			c.interrupted = true
 			if logger.Log != nil {
 				logger.Log.Debug("Таймаут FETCH bounce messages",
 					zap.String("folder", folderName))
 			}
-			return 0, "", context.DeadlineExceeded
+			return nil, context.DeadlineExceeded
 		case err := <-fetchDone:
 			if err != nil {
-				return 0, "", err
+				return nil, err
+			}
+			// FETCH завершен и закрыл канал: забираем письма, оставшиеся в буфере
+			for msg := range messages {
+				fetchedMsgs = append(fetchedMsgs, msg)
 			}
 			break fetchLoop
 		case msg := <-messages:
@@ -253,90 +644,49 @@ fetchLoop:
 			}
 		}
 	}
+	return fetchedMsgs, nil
+}
 
-	// Проверяем каждое bounce сообщение на наличие нашего Message-ID
-	for _, msg := range fetchedMsgs {
-		if msg.Envelope == nil {
-			continue
-		}
-
-		// Проверяем InReplyTo заголовок
-		if msg.Envelope.InReplyTo != "" {
-			inReplyToClean := strings.Trim(msg.Envelope.InReplyTo, "<>")
-			if strings.Contains(inReplyToClean, messageIDClean) || strings.Contains(messageIDClean, inReplyToClean) {
-				// Найден bounce для нашего письма!
-				errorDesc, found := c.extractBounceError(searchCtx, msg, imapClient, folderName, messageIDClean)
-				if found {
-					return 3, errorDesc, nil
-				}
-				// Даже если не удалось извлечь детали, это наш bounce
-				return 3, fmt.Sprintf("Bounce message найден в папке '%s' (InReplyTo match)", folderName), nil
-			}
-		}
-
-		// Если InReplyTo не совпал, проверяем тело письма
-		errorDesc, found := c.extractBounceError(searchCtx, msg, imapClient, folderName, messageIDClean)
-		if found {
-			return 3, errorDesc, nil
+// isFromMailerDaemon проверяет, что письмо отправлено mailer-daemon (адрес или имя отправителя)
+func isFromMailerDaemon(msg *imap.Message) bool {
+	for _, addr := range msg.Envelope.From {
+		if strings.Contains(strings.ToLower(addr.Address()+" "+addr.PersonalName), "mailer-daemon") {
+			return true
 		}
 	}
-
-	// Bounce messages найдены, но не для нашего письма
-	return 0, "", nil
+	return false
 }
 
-// isBounceMessage проверяет, является ли письмо bounce message для указанного Message-ID
-func (c *IMAPClient) isBounceMessage(msg *imap.Message, messageIDClean string) bool {
-	if msg.Envelope == nil {
-		return false
-	}
-
-	// Проверяем отправителя на типичные адреса bounce messages
+// bounceSignals проверяет отправителя (BounceConfig.FromKeywords) и тему (BounceConfig.SubjectKeywords)
+// письма на типичные признаки bounce messages
+func (c *IMAPClient) bounceSignals(msg *imap.Message) (isBounceFrom, isBounceSubject bool) {
 	from := ""
 	if len(msg.Envelope.From) > 0 {
 		from = strings.ToLower(msg.Envelope.From[0].Address())
 	}
-
-	bounceFromKeywords := []string{
-		"mailer-daemon",
-		"postmaster",
-		"mail delivery subsystem",
-		"mailer@",
-		"noreply@",
-	}
-
-	isBounceFrom := false
-	for _, keyword := range bounceFromKeywords {
+	for _, keyword := range c.cfg.Bounce.FromKeywords {
 		if strings.Contains(from, keyword) {
 			isBounceFrom = true
 			break
 		}
 	}
 
-	// Проверяем Subject на типичные паттерны bounce messages
 	subject := strings.ToLower(msg.Envelope.Subject)
-	bounceKeywords := []string{
-		"delivery status notification",
-		"mail delivery failed",
-		"undelivered mail",
-		"returned mail",
-		"mail delivery subsystem",
-		"delivery failure",
-		"failure notice",
-		"недоставленное сообщение",
-		"недоставленное письмо",
-		"ошибка доставки",
-		"возврат письма",
-		"не может быть отправлено",
-	}
-
-	isBounceSubject := false
-	for _, keyword := range bounceKeywords {
+	for _, keyword := range c.cfg.Bounce.SubjectKeywords {
 		if strings.Contains(subject, keyword) {
 			isBounceSubject = true
 			break
 		}
 	}
+	return isBounceFrom, isBounceSubject
+}
+
+// isBounceMessage проверяет, является ли письмо bounce message для указанного Message-ID
+func (c *IMAPClient) isBounceMessage(msg *imap.Message, messageIDClean string) bool {
+	if msg.Envelope == nil {
+		return false
+	}
+	isBounceFrom, isBounceSubject := c.bounceSignals(msg)
 
 	// Если это не bounce message по отправителю и теме, пропускаем
 	if !isBounceFrom && !isBounceSubject {
@@ -358,18 +708,39 @@ func (c *IMAPClient) isBounceMessage(msg *imap.Message, messageIDClean string) b
 }
 
 // extractBounceError извлекает описание ошибки из bounce message и проверяет наличие Message-ID в теле
-// Возвращает описание ошибки и флаг, указывающий, найден ли Message-ID в теле письма
-// Таймаут: 8 секунд
-func (c *IMAPClient) extractBounceError(ctx context.Context, msg *imap.Message, imapClient *client.Client, folderName, messageIDClean string) (string, bool) {
-	if msg.Uid == 0 {
-		return "", false
+// Возвращает описание ошибки, время события (Last-Attempt-Date, Arrival-Date или Date bounce message)
+// и флаг, указывающий, найден ли Message-ID в теле письма
+// Загружается не более bounceFetchLimit байт письма (fetchBounceBody), тело, загруженное при прошлых
+// проверках, берется из кеша
+func (c *IMAPClient) extractBounceError(ctx context.Context, imapClient *client.Client, folderName string, key bounceKey, messageIDClean string) (string, time.Time, bool) {
+	body := c.cachedBounceBody(ctx, imapClient, folderName, key)
+	if body == nil {
+		return "", time.Time{}, false
+	}
+	return c.parseBounceBody(body, folderName, messageIDClean)
+}
+
+// cachedBounceBody возвращает начало письма из кеша или загружает его (fetchBounceBody) и сохраняет в кеш
+func (c *IMAPClient) cachedBounceBody(ctx context.Context, imapClient *client.Client, folderName string, key bounceKey) []byte {
+	if cached := c.cache.lookup(key); cached != nil && cached.body != nil {
+		return cached.body
+	}
+	body := c.fetchBounceBody(ctx, imapClient, folderName, key.uid)
+	c.cache.storeBody(key, body)
+	return body
+}
+
+// fetchBounceBody загружает начало письма: заголовки, текст и delivery-status (не более bounceFetchLimit байт)
+// Таймаут задается IMAPFetchTimeoutSec (по умолчанию 15 секунд); nil - письмо не получено
+func (c *IMAPClient) fetchBounceBody(ctx context.Context, imapClient *client.Client, folderName string, uid uint32) []byte {
+	if uid == 0 {
+		return nil
 	}
 
-	// Получаем тело письма
 	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(msg.Uid)
+	seqSet.AddNum(uid)
 
-	section := &imap.BodySectionName{}
+	section := &imap.BodySectionName{Partial: []int{0, bounceFetchLimit}}
 	items := []imap.FetchItem{section.FetchItem()}
 
 	messages := make(chan *imap.Message, 1)
@@ -379,79 +750,63 @@ func (c *IMAPClient) extractBounceError(ctx context.Context, msg *imap.Message,
 		done <- imapClient.UidFetch(seqSet, items, messages)
 	}()
 
-	// Таймаут для получения тела письма: 15 секунд
-	timeout := time.After(15 * time.Second)
+	// Таймаут для получения тела письма
+	fetchTimeout := c.fetchTimeout()
+	timeout := time.After(fetchTimeout)
 
+	var msg *imap.Message
 	select {
 	case <-ctx.Done():
-		return "", false
+		c.interrupted = true
+		return nil
 	case <-timeout:
+		c.interrupted = true
 		if logger.Log != nil {
 			logger.Log.Debug("Таймаут получения тела письма IMAP",
 				zap.String("folder", folderName),
-				zap.Duration("timeout", 15*time.Second))
+				zap.Duration("timeout", fetchTimeout))
 		}
-		return "", false
+		return nil
 	case err := <-done:
 		if err != nil {
-			return "", false
+			return nil
 		}
-	case msg := <-messages:
-		if msg == nil {
-			return "", false
+		// FETCH завершен и закрыл канал: письмо могло остаться в буфере
+		msg = <-messages
+	case msg = <-messages:
+		// Сеанс используется следующими командами (пакетная проверка, IDLE): дожидаемся завершения FETCH
+		select {
+		case <-done:
+		case <-timeout:
+			c.interrupted = true
 		}
+	}
+	if msg == nil {
+		return nil
+	}
 
-		// Извлекаем тело письма
-		if body := msg.GetBody(section); body != nil {
-			buf := new(bytes.Buffer)
-			if _, err := buf.ReadFrom(body); err == nil {
-				bodyText := buf.String()
-				bodyLower := strings.ToLower(bodyText)
-
-				// Проверяем наличие Message-ID в теле письма
-				// Ищем Message-ID с угловыми скобками и без них
-				messageIDInBody := strings.Contains(bodyText, messageIDClean) ||
-					strings.Contains(bodyText, "<"+messageIDClean+">") ||
-					strings.Contains(bodyText, "message-id:") && strings.Contains(bodyText, messageIDClean)
-
-				if !messageIDInBody {
-					// Message-ID не найден в теле - это не наш bounce message
-					return "", false
-				}
-
-				// Ищем типичные сообщения об ошибках
-				errorPatterns := []struct {
-					pattern string
-					desc    string
-				}{
-					{"550", "Адрес получателя не существует (550)"},
-					{"551", "Пользователь не найден (551)"},
-					{"552", "Превышен лимит почтового ящика (552)"},
-					{"553", "Адрес получателя неверен (553)"},
-					{"user unknown", "Пользователь не найден"},
-					{"mailbox full", "Почтовый ящик переполнен"},
-					{"address rejected", "Адрес отклонен"},
-					{"relay denied", "Ретрансляция запрещена"},
-					{"host or domain name not found", "Домен или хост не найден"},
-					{"host not found", "Хост не найден"},
-					{"name service error", "Ошибка службы имен"},
-					{"не существует", "Адрес не существует"},
-					{"не найден", "Пользователь не найден"},
-					{"переполнен", "Почтовый ящик переполнен"},
-					{"не может быть отправлено", "Письмо не может быть отправлено"},
-				}
-
-				for _, pattern := range errorPatterns {
-					if strings.Contains(bodyLower, pattern.pattern) {
-						return fmt.Sprintf("Bounce message в папке '%s': %s", folderName, pattern.desc), true
-					}
-				}
-
-				// Если не нашли конкретную ошибку, возвращаем общее сообщение
-				return fmt.Sprintf("Найдено bounce message о недоставке в папке '%s'", folderName), true
-			}
-		}
+	body := msg.GetBody(section)
+	if body == nil {
+		return nil
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil
 	}
+	return data
+}
 
-	return "", false
+// parseBounceBody разбирает загруженное bounce message (parseDSNBody) для указанного Message-ID
+// Возвращает описание ошибки, время события и флаг, указывающий, что письмо - отчет о недоставке этого письма
+func (c *IMAPClient) parseBounceBody(body []byte, folderName, messageIDClean string) (string, time.Time, bool) {
+	report := parseDSNBody(bytes.NewReader(body), messageIDClean, c.cfg.Bounce.ErrorPatterns)
+	if logger.Log != nil && report.HasDeliveryStatus {
+		logger.Log.Debug("Разобран delivery-status bounce message",
+			zap.String("folder", folderName),
+			zap.Bool("messageIDFound", report.MessageIDFound),
+			zap.String("action", report.Action),
+			zap.String("status", report.Status))
+	}
+	desc, found := report.failureDescription(folderName, c.unknownDSNActionAsFailure)
+	return desc, report.eventTime(), found
 }
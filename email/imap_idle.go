@@ -0,0 +1,246 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"go.uber.org/zap"
+
+	"email-service/logger"
+	"email-service/settings"
+)
+
+// idleFolder - папка, в которой IDLE ожидает новые письма (bounce messages приходят во входящие)
+const idleFolder = "INBOX"
+
+// idleRetryDelay - пауза перед повторным открытием сеанса IDLE после ошибки
+const idleRetryDelay = 30 * time.Second
+
+// errIdleNotSupported - сервер не поддерживает IDLE, статусы проверяются только плановой проверкой
+var errIdleNotSupported = errors.New("IMAP сервер не поддерживает IDLE")
+
+// idleWatcher держит сеанс IMAP IDLE для SMTP сервера с IMAPUseIdle и проверяет новые письма на bounce
+// Найденный bounce сразу записывается для ожидающей проверки отправки; плановая проверка этой отправки
+// затем отбрасывается. После ошибки сеанс открывается заново через idleRetryDelay
+func (sc *StatusChecker) idleWatcher(ctx context.Context, smtpID int, smtpCfg *settings.SMTPConfig) {
+	for {
+		err := sc.watchMailbox(ctx, smtpID, smtpCfg)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errIdleNotSupported) {
+			if logger.Log != nil {
+				logger.Log.Warn("IMAP сервер не поддерживает IDLE, статусы проверяются только по расписанию",
+					zap.Int("smtpID", smtpID),
+					zap.String("imapHost", smtpCfg.IMAPHost))
+			}
+			return
+		}
+		if logger.Log != nil {
+			logger.Log.Warn("Сеанс IMAP IDLE прерван, повторное подключение",
+				zap.Int("smtpID", smtpID),
+				zap.String("imapHost", smtpCfg.IMAPHost),
+				zap.Duration("delay", idleRetryDelay),
+				zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.clock.After(idleRetryDelay):
+		}
+	}
+}
+
+// watchMailbox открывает сеанс IDLE и обрабатывает новые письма до ошибки или отмены контекста
+func (sc *StatusChecker) watchMailbox(ctx context.Context, smtpID int, smtpCfg *settings.SMTPConfig) error {
+	// Уведомления сервера читаются постоянно: go-imap блокируется, если канал Updates не читают
+	updates := make(chan client.Update, 16)
+	newMail := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case update := <-updates:
+				if _, ok := update.(*client.MailboxUpdate); ok {
+					select {
+					case newMail <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	imapClient := NewIMAPClient(smtpCfg)
+	imapClient.SetUnknownDSNActionAsFailure(sc.cfg.Mode.UnknownDSNActionAsFailure)
+	imapClient.SetBounceCache(sc.bounceCache)
+	if err := imapClient.Connect(); err != nil {
+		return err
+	}
+	defer imapClient.Logout()
+	imapClient.conn.Updates = updates
+	if err := imapClient.Login(); err != nil {
+		return err
+	}
+
+	supported, err := imapClient.conn.Support("IDLE")
+	if err != nil {
+		return fmt.Errorf("ошибка CAPABILITY: %w", err)
+	}
+	if !supported {
+		return errIdleNotSupported
+	}
+
+	// Для IMAPBounceAction папка открывается для записи
+	mbox, err := imapClient.conn.Select(idleFolder, imapClient.bounceAction() == BounceActionNone)
+	if err != nil {
+		return fmt.Errorf("ошибка выбора папки %s: %w", idleFolder, err)
+	}
+	nextUID := mbox.UidNext
+	if nextUID == 0 {
+		// Сервер не сообщил UIDNEXT: первая проверка просмотрит всю папку
+		nextUID = 1
+	}
+
+	if logger.Log != nil {
+		logger.Log.Info("Запущен сеанс IMAP IDLE для проверки bounce",
+			zap.Int("smtpID", smtpID),
+			zap.String("imapHost", smtpCfg.IMAPHost),
+			zap.String("folder", idleFolder))
+	}
+
+	for {
+		stop := make(chan struct{})
+		idleDone := make(chan error, 1)
+		go func() {
+			idleDone <- imapClient.conn.Idle(stop, nil)
+		}()
+
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-idleDone
+			return nil
+		case err := <-idleDone:
+			if err == nil {
+				err = errors.New("IDLE завершен сервером")
+			}
+			return err
+		case <-newMail:
+			close(stop)
+			if err := <-idleDone; err != nil {
+				return err
+			}
+		}
+
+		nextUID, err = sc.scanNewMessages(ctx, imapClient, smtpID, mbox.UidValidity, nextUID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// scanNewMessages проверяет письма INBOX с UID не меньше fromUID на bounce ожидающих проверки отправок
+// SMTP сервера и возвращает UID, с которого начнется следующая проверка
+func (sc *StatusChecker) scanNewMessages(ctx context.Context, imapClient *IMAPClient, smtpID int, uidValidity, fromUID uint32) (uint32, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(fromUID, 0)
+
+	messages := make(chan *imap.Message, 16)
+	fetchDone := make(chan error, 1)
+	go func() {
+		fetchDone <- imapClient.conn.UidFetch(seqSet, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}, messages)
+	}()
+
+	var fetched []*imap.Message
+	for msg := range messages {
+		// Диапазон fromUID:* всегда включает последнее письмо папки, даже если его UID меньше fromUID
+		if msg.Uid >= fromUID {
+			fetched = append(fetched, msg)
+		}
+	}
+	if err := <-fetchDone; err != nil {
+		return fromUID, fmt.Errorf("ошибка FETCH новых писем: %w", err)
+	}
+
+	nextUID := fromUID
+	for _, msg := range fetched {
+		if msg.Uid >= nextUID {
+			nextUID = msg.Uid + 1
+		}
+		if ctx.Err() != nil {
+			return nextUID, nil
+		}
+		if msg.Envelope == nil {
+			continue
+		}
+		isBounceFrom, isBounceSubject := imapClient.bounceSignals(msg)
+		if !isBounceFrom && !isBounceSubject && !isFromMailerDaemon(msg) {
+			continue
+		}
+		pending := sc.pendingFor(smtpID)
+		if len(pending) == 0 {
+			continue
+		}
+
+		key := imapClient.bounceKey(idleFolder, uidValidity, msg.Uid)
+		imapClient.cache.storeEnvelope(key, msg.Envelope)
+		body := imapClient.cachedBounceBody(ctx, imapClient.conn, idleFolder, key)
+		if imapClient.interrupted {
+			// Сеанс с прерванной командой не используется повторно: watchMailbox закроет его и переподключится
+			return nextUID, errors.New("таймаут загрузки письма, сеанс IDLE будет открыт заново")
+		}
+		inReplyTo := strings.Trim(msg.Envelope.InReplyTo, "<>")
+		for _, sentInfo := range pending {
+			messageIDClean := strings.Trim(sentInfo.MessageID, "<>")
+			repliesTo := inReplyTo != "" && inReplyTo == messageIDClean
+			if !repliesTo && !bytes.Contains(body, []byte(messageIDClean)) {
+				continue
+			}
+
+			desc, eventTime, found := imapClient.parseBounceBody(body, idleFolder, messageIDClean)
+			if !found && repliesTo {
+				desc = fmt.Sprintf("Bounce message найден в папке '%s' (InReplyTo match)", idleFolder)
+				eventTime, found = msg.Envelope.Date, true
+			}
+			if !found {
+				continue
+			}
+
+			if logger.Log != nil {
+				logger.Log.Info("Найден bounce message (IMAP IDLE)",
+					zap.Int64("taskID", sentInfo.TaskID),
+					zap.String("messageID", sentInfo.MessageID),
+					zap.String("description", desc))
+			}
+			imapClient.cache.consume(key)
+			imapClient.markProcessed(idleFolder, msg.Uid)
+			sc.reportStatusAt(sentInfo, StatusFailed, desc, desc, eventTime)
+		}
+		imapClient.applyBounceActions()
+	}
+	return nextUID, nil
+}
+
+// pendingFor возвращает отправки SMTP сервера, ожидающие проверки статуса
+func (sc *StatusChecker) pendingFor(smtpID int) []*SentEmailInfo {
+	sc.sentEmailsMu.RLock()
+	defer sc.sentEmailsMu.RUnlock()
+	var pending []*SentEmailInfo
+	for _, sentInfo := range sc.sentEmails {
+		if sentInfo.SmtpID == smtpID {
+			pending = append(pending, sentInfo)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,608 @@
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+
+	"email-service/settings"
+)
+
+// fakeIMAPServer - IMAP сервер для тестов проверки статусов: STARTTLS, LOGIN, LIST, SELECT, SEARCH, FETCH и IDLE
+// над почтовыми ящиками в памяти; считает входы, чтобы тесты проверяли переиспользование сеанса
+type fakeIMAPServer struct {
+	ln      net.Listener
+	pool    *x509.CertPool      // Пул для проверки сертификата сервера клиентом
+	updates chan backend.Update // Уведомления о новых письмах для сеансов IDLE
+
+	mu        sync.Mutex
+	logins    int
+	attempts  int        // Попытки входа, включая неудачные
+	selects   int        // Количество запросов состояния ящика (SELECT и STATUS)
+	fetches   int        // Количество команд FETCH
+	envelopes [][]uint32 // UID писем каждой команды FETCH конвертов
+	ops       []string   // Изменения писем: STORE, COPY, MOVE, EXPUNGE
+	noMove    bool       // Сервер отклоняет MOVE
+	password  string
+	mailboxes []*fakeMailbox
+	nextUID   uint32
+
+	// Команда ("SEARCH" или "FETCH BODY"), ответ на которую сервер задерживает до завершения теста
+	stall   string
+	release chan struct{}
+}
+
+// fakeIMAPMessage - письмо в почтовом ящике тестового сервера
+type fakeIMAPMessage struct {
+	uid   uint32
+	date  time.Time
+	flags []string
+	raw   []byte
+}
+
+// fakeMailbox - почтовый ящик тестового сервера (реализует backend.Mailbox)
+type fakeMailbox struct {
+	s        *fakeIMAPServer
+	name     string
+	attrs    []string
+	messages []*fakeIMAPMessage
+}
+
+// fakeIMAPUser - сеанс пользователя тестового сервера (реализует backend.User)
+type fakeIMAPUser struct {
+	s *fakeIMAPServer
+}
+
+// newFakeIMAPServer запускает IMAP сервер со STARTTLS на случайном порту с ящиком INBOX
+func newFakeIMAPServer(t *testing.T) *fakeIMAPServer {
+	t.Helper()
+	cert, pool := newTestCertificate(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeIMAPServer{ln: ln, pool: pool, updates: make(chan backend.Update, 16), password: "secret", nextUID: 1}
+	s.addMailbox("INBOX")
+
+	srv := server.New(s)
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return s
+}
+
+// stallCommand задерживает ответы на команду cmd ("SEARCH" или "FETCH BODY") до завершения теста
+func (s *fakeIMAPServer) stallCommand(t *testing.T, cmd string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stall = cmd
+	s.release = make(chan struct{})
+	t.Cleanup(func() { close(s.release) })
+}
+
+// wait задерживает выполнение команды cmd, если она задана в stallCommand
+func (s *fakeIMAPServer) wait(cmd string) {
+	s.mu.Lock()
+	stall, release := s.stall, s.release
+	s.mu.Unlock()
+	if stall == cmd {
+		<-release
+	}
+}
+
+// smtpConfig возвращает параметры SMTP сервера, у которого проверка статусов выполняется через этот IMAP сервер
+func (s *fakeIMAPServer) smtpConfig() settings.SMTPConfig {
+	return settings.SMTPConfig{
+		Host:       "127.0.0.1",
+		User:       "sender@example.com",
+		Password:   "secret",
+		IMAPHost:   "127.0.0.1",
+		IMAPPort:   s.ln.Addr().(*net.TCPAddr).Port,
+		TLSRootCAs: s.pool,
+		Bounce: settings.BounceConfig{
+			FromKeywords:    []string{"mailer-daemon", "postmaster"},
+			SubjectKeywords: []string{"delivery status notification", "undelivered mail"},
+		},
+	}
+}
+
+// loginAttempts возвращает количество попыток входа, включая неудачные
+func (s *fakeIMAPServer) loginAttempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+// loginCount возвращает количество успешных входов
+func (s *fakeIMAPServer) loginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// selectCount возвращает количество запросов состояния почтовых ящиков
+func (s *fakeIMAPServer) selectCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selects
+}
+
+// fetchCount возвращает количество выполненных команд FETCH
+func (s *fakeIMAPServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+// envelopeFetches возвращает UID писем каждой выполненной команды FETCH конвертов
+func (s *fakeIMAPServer) envelopeFetches() [][]uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]uint32(nil), s.envelopes...)
+}
+
+// operations возвращает журнал изменений писем
+func (s *fakeIMAPServer) operations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ops...)
+}
+
+// messages возвращает письма почтового ящика name
+func (s *fakeIMAPServer) messages(name string) []fakeIMAPMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []fakeIMAPMessage
+	for _, mbox := range s.mailboxes {
+		if mbox.name == name {
+			for _, msg := range mbox.messages {
+				messages = append(messages, *msg)
+			}
+		}
+	}
+	return messages
+}
+
+// notify сообщает сеансам, выбравшим почтовый ящик name, его текущее количество писем (untagged EXISTS)
+func (s *fakeIMAPServer) notify(name string) {
+	s.mu.Lock()
+	status := imap.NewMailboxStatus(name, []imap.StatusItem{imap.StatusMessages})
+	for _, mbox := range s.mailboxes {
+		if mbox.name == name {
+			status.Messages = uint32(len(mbox.messages))
+		}
+	}
+	s.mu.Unlock()
+	s.updates <- &backend.MailboxUpdate{Update: backend.NewUpdate("", name), MailboxStatus: status}
+}
+
+// addMailbox добавляет почтовый ящик с атрибутами LIST (например, \Junk)
+func (s *fakeIMAPServer) addMailbox(name string, attrs ...string) *fakeMailbox {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mbox := &fakeMailbox{s: s, name: name, attrs: attrs}
+	s.mailboxes = append(s.mailboxes, mbox)
+	return mbox
+}
+
+// addMessage помещает письмо в почтовый ящик name и возвращает его UID
+func (s *fakeIMAPServer) addMessage(name string, raw string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, mbox := range s.mailboxes {
+		if mbox.name == name {
+			msg := &fakeIMAPMessage{uid: s.nextUID, date: time.Now(), raw: []byte(strings.ReplaceAll(raw, "\n", "\r\n"))}
+			s.nextUID++
+			mbox.messages = append(mbox.messages, msg)
+			return msg.uid
+		}
+	}
+	panic("нет почтового ящика " + name)
+}
+
+// testBounceTime - время последней попытки доставки в testBounceMessage
+var testBounceTime = time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC)
+
+// testBounceMessage формирует bounce message (DSN) для письма с Message-ID messageID
+func testBounceMessage(messageID, recipient string) string {
+	return `From: Mail Delivery System <MAILER-DAEMON@mx.example.org>
+To: sender@example.com
+Subject: Undelivered Mail Returned to Sender
+In-Reply-To: ` + messageID + `
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="dsn"
+
+--dsn
+Content-Type: text/plain
+
+Письмо не доставлено.
+
+--dsn
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.org
+
+Final-Recipient: rfc822; ` + recipient + `
+Action: failed
+Status: 5.1.1
+Last-Attempt-Date: Fri, 15 Mar 2024 10:30:00 +0000
+Diagnostic-Code: smtp; 550 5.1.1 User unknown
+
+--dsn
+Content-Type: text/rfc822-headers
+
+Message-ID: ` + messageID + `
+To: ` + recipient + `
+
+--dsn--
+`
+}
+
+// Updates реализует backend.BackendUpdater
+func (s *fakeIMAPServer) Updates() <-chan backend.Update { return s.updates }
+
+// Login реализует backend.Backend
+func (s *fakeIMAPServer) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if password != s.password {
+		return nil, backend.ErrInvalidCredentials
+	}
+	s.logins++
+	return &fakeIMAPUser{s: s}, nil
+}
+
+func (u *fakeIMAPUser) Username() string { return "sender@example.com" }
+
+func (u *fakeIMAPUser) ListMailboxes(bool) ([]backend.Mailbox, error) {
+	u.s.mu.Lock()
+	defer u.s.mu.Unlock()
+	mailboxes := make([]backend.Mailbox, 0, len(u.s.mailboxes))
+	for _, mbox := range u.s.mailboxes {
+		mailboxes = append(mailboxes, mbox)
+	}
+	return mailboxes, nil
+}
+
+func (u *fakeIMAPUser) GetMailbox(name string) (backend.Mailbox, error) {
+	u.s.mu.Lock()
+	defer u.s.mu.Unlock()
+	for _, mbox := range u.s.mailboxes {
+		if strings.EqualFold(mbox.name, name) {
+			return mbox, nil
+		}
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+func (u *fakeIMAPUser) CreateMailbox(string) error         { return backend.ErrMailboxAlreadyExists }
+func (u *fakeIMAPUser) DeleteMailbox(string) error         { return backend.ErrNoSuchMailbox }
+func (u *fakeIMAPUser) RenameMailbox(string, string) error { return backend.ErrNoSuchMailbox }
+func (u *fakeIMAPUser) Logout() error                      { return nil }
+
+func (m *fakeMailbox) Name() string { return m.name }
+
+func (m *fakeMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Attributes: m.attrs, Delimiter: "/", Name: m.name}, nil
+}
+
+func (m *fakeMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.selects++
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.DeletedFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.DeletedFlag}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(m.messages))
+		case imap.StatusUidNext:
+			status.UidNext = m.s.nextUID
+		case imap.StatusUidValidity:
+			status.UidValidity = 1
+		}
+	}
+	return status, nil
+}
+
+func (m *fakeMailbox) SetSubscribed(bool) error { return nil }
+func (m *fakeMailbox) Check() error             { return nil }
+
+func (m *fakeMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	if !slices.Contains(items, imap.FetchEnvelope) {
+		m.s.wait("FETCH BODY")
+	}
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.fetches++
+	var fetched []uint32
+	for i, msg := range m.messages {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+		fetched = append(fetched, msg.uid)
+		ch <- msg.fetch(seqNum, items)
+	}
+	if slices.Contains(items, imap.FetchEnvelope) {
+		m.s.envelopes = append(m.s.envelopes, fetched)
+	}
+	return nil
+}
+
+func (m *fakeMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.s.wait("SEARCH")
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	var ids []uint32
+	for i, msg := range m.messages {
+		seqNum := uint32(i + 1)
+		if !msg.match(seqNum, criteria) {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+func (m *fakeMailbox) CreateMessage([]string, time.Time, imap.Literal) error { return nil }
+
+// UpdateMessagesFlags изменяет флаги писем (STORE)
+func (m *fakeMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, msg := range m.selected(uid, seqSet) {
+		switch op {
+		case imap.SetFlags:
+			msg.flags = append([]string(nil), flags...)
+		case imap.AddFlags:
+			for _, flag := range flags {
+				if !msg.hasFlag(flag) {
+					msg.flags = append(msg.flags, flag)
+				}
+			}
+		case imap.RemoveFlags:
+			kept := msg.flags[:0]
+			for _, f := range msg.flags {
+				if !containsFold(flags, f) {
+					kept = append(kept, f)
+				}
+			}
+			msg.flags = kept
+		}
+		m.s.ops = append(m.s.ops, fmt.Sprintf("STORE %d %s %s", msg.uid, op, strings.Join(flags, " ")))
+	}
+	return nil
+}
+
+// CopyMessages копирует письма в почтовый ящик dest
+func (m *fakeMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	return m.copyMessages(uid, seqSet, dest, "COPY")
+}
+
+// MoveMessages перемещает письма в почтовый ящик dest (реализует backend.MoveMailbox)
+func (m *fakeMailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if m.s.noMove {
+		return errors.New("MOVE отклонен")
+	}
+	moved := m.selected(uid, seqSet)
+	if err := m.copyMessages(uid, seqSet, dest, "MOVE"); err != nil {
+		return err
+	}
+	kept := m.messages[:0]
+	for _, msg := range m.messages {
+		if !slices.Contains(moved, msg) {
+			kept = append(kept, msg)
+		}
+	}
+	m.messages = kept
+	return nil
+}
+
+// Expunge удаляет письма с флагом \Deleted
+func (m *fakeMailbox) Expunge() error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	kept := m.messages[:0]
+	for _, msg := range m.messages {
+		if msg.hasFlag(imap.DeletedFlag) {
+			m.s.ops = append(m.s.ops, fmt.Sprintf("EXPUNGE %d", msg.uid))
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	m.messages = kept
+	return nil
+}
+
+// copyMessages копирует письма в почтовый ящик dest с новыми UID (вызывается под mu)
+func (m *fakeMailbox) copyMessages(uid bool, seqSet *imap.SeqSet, dest, op string) error {
+	var target *fakeMailbox
+	for _, mbox := range m.s.mailboxes {
+		if mbox.name == dest {
+			target = mbox
+		}
+	}
+	if target == nil {
+		return backend.ErrNoSuchMailbox
+	}
+	for _, msg := range m.selected(uid, seqSet) {
+		copied := *msg
+		copied.uid = m.s.nextUID
+		copied.flags = append([]string(nil), msg.flags...)
+		m.s.nextUID++
+		target.messages = append(target.messages, &copied)
+		m.s.ops = append(m.s.ops, fmt.Sprintf("%s %d %s", op, msg.uid, dest))
+	}
+	return nil
+}
+
+// selected возвращает письма из seqSet (номера или UID) (вызывается под mu)
+func (m *fakeMailbox) selected(uid bool, seqSet *imap.SeqSet) []*fakeIMAPMessage {
+	var messages []*fakeIMAPMessage
+	for i, msg := range m.messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.uid
+		}
+		if seqSet.Contains(id) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// header возвращает заголовки письма
+func (msg *fakeIMAPMessage) header() mail.Header {
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg.raw))
+	if err != nil {
+		return mail.Header{}
+	}
+	return parsed.Header
+}
+
+// fetch формирует ответ FETCH с запрошенными элементами
+func (msg *fakeIMAPMessage) fetch(seqNum uint32, items []imap.FetchItem) *imap.Message {
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			header := msg.header()
+			envelope := &imap.Envelope{
+				Date:      msg.date,
+				Subject:   header.Get("Subject"),
+				InReplyTo: header.Get("In-Reply-To"),
+				MessageId: header.Get("Message-Id"),
+			}
+			if from, err := mail.ParseAddress(header.Get("From")); err == nil {
+				mailbox, host, _ := strings.Cut(from.Address, "@")
+				envelope.From = []*imap.Address{{PersonalName: from.Name, MailboxName: mailbox, HostName: host}}
+			}
+			fetched.Envelope = envelope
+		case imap.FetchFlags:
+			fetched.Flags = msg.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.date
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(msg.raw))
+		case imap.FetchUid:
+			fetched.Uid = msg.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				continue
+			}
+			body := msg.raw
+			headerEnd := bytes.Index(body, []byte("\r\n\r\n")) + 4
+			switch section.Specifier {
+			case imap.HeaderSpecifier:
+				body = body[:headerEnd]
+			case imap.TextSpecifier:
+				body = body[headerEnd:]
+			}
+			fetched.Body[section] = bytes.NewReader(section.ExtractPartial(body))
+		}
+	}
+	return fetched
+}
+
+// match проверяет письмо по критериям SEARCH, которые использует проверка статусов
+func (msg *fakeIMAPMessage) match(seqNum uint32, c *imap.SearchCriteria) bool {
+	if c.SeqNum != nil && !c.SeqNum.Contains(seqNum) {
+		return false
+	}
+	if c.Uid != nil && !c.Uid.Contains(msg.uid) {
+		return false
+	}
+	if !c.Since.IsZero() && msg.date.Before(c.Since) {
+		return false
+	}
+	if !c.Before.IsZero() && !msg.date.Before(c.Before) {
+		return false
+	}
+	header := msg.header()
+	for key, values := range c.Header {
+		for _, value := range values {
+			if !strings.Contains(strings.ToLower(header.Get(key)), strings.ToLower(value)) {
+				return false
+			}
+		}
+	}
+	for _, value := range c.Body {
+		if !bytes.Contains(bytes.ToLower(msg.raw), []byte(strings.ToLower(value))) {
+			return false
+		}
+	}
+	for _, value := range c.Text {
+		if !bytes.Contains(bytes.ToLower(msg.raw), []byte(strings.ToLower(value))) {
+			return false
+		}
+	}
+	for _, flag := range c.WithFlags {
+		if !msg.hasFlag(flag) {
+			return false
+		}
+	}
+	for _, flag := range c.WithoutFlags {
+		if msg.hasFlag(flag) {
+			return false
+		}
+	}
+	for _, not := range c.Not {
+		if msg.match(seqNum, not) {
+			return false
+		}
+	}
+	for _, or := range c.Or {
+		if !msg.match(seqNum, or[0]) && !msg.match(seqNum, or[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasFlag проверяет наличие флага у письма
+func (msg *fakeIMAPMessage) hasFlag(flag string) bool {
+	return containsFold(msg.flags, flag)
+}
+
+// containsFold проверяет наличие строки в списке без учета регистра
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"email-service/settings"
+)
+
+// addBounces помещает в INBOX n bounce messages от mailer-daemon с UID 1..n в ответ на письма other-UID,
+// письмо с UID matchUID - bounce для target; тело bounce не содержит Message-ID, поэтому письмо
+// сопоставляется только по In-Reply-To
+func addBounces(server *fakeIMAPServer, n int, matchUID uint32, target string) {
+	for uid := uint32(1); uid <= uint32(n); uid++ {
+		inReplyTo := fmt.Sprintf("other-%d@example.com", uid)
+		if uid == matchUID {
+			inReplyTo = target
+		}
+		server.addMessage("INBOX", "From: Mail Delivery System <MAILER-DAEMON@mx.example.com>\n"+
+			"Subject: Undelivered Mail Returned to Sender\n"+
+			"In-Reply-To: <"+inReplyTo+">\n\n"+
+			"Письмо не доставлено.\n")
+	}
+}
+
+// newTestIMAPClient создает IMAPClient с открытым сеансом на сервере server
+// Параметры просмотра берутся из scan, подключения - из server.smtpConfig
+func newTestIMAPClient(t *testing.T, server *fakeIMAPServer, scan settings.SMTPConfig) *IMAPClient {
+	t.Helper()
+	cfg := server.smtpConfig()
+	cfg.IMAPScanMaxMessages = scan.IMAPScanMaxMessages
+	cfg.IMAPScanPageSize = scan.IMAPScanPageSize
+	c := NewIMAPClient(&cfg)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Logout)
+	if err := c.Login(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestIMAPScanLimits(t *testing.T) {
+	tests := []struct {
+		maxMessages, pageSize int
+		wantMax, wantPage     int
+	}{
+		{0, 0, 20, 20},
+		{50, 10, 50, 10},
+		{10, 50, 10, 10}, // Страница не больше лимита просмотра
+		{10, -1, 10, 10},
+		{-5, 5, 20, 5},
+	}
+	for _, tt := range tests {
+		c := NewIMAPClient(&settings.SMTPConfig{IMAPScanMaxMessages: tt.maxMessages, IMAPScanPageSize: tt.pageSize})
+		if got := c.scanMaxMessages(); got != tt.wantMax {
+			t.Errorf("scanMaxMessages(%d) = %d, ожидалось %d", tt.maxMessages, got, tt.wantMax)
+		}
+		if got := c.scanPageSize(); got != tt.wantPage {
+			t.Errorf("scanPageSize(%d, %d) = %d, ожидалось %d", tt.maxMessages, tt.pageSize, got, tt.wantPage)
+		}
+	}
+}
+
+func TestCheckEmailStatusPagesNewestFirst(t *testing.T) {
+	const target = "target@example.com"
+	tests := []struct {
+		name        string
+		maxMessages int
+		matchUID    uint32
+		wantStatus  Status
+		wantFetches [][]uint32
+	}{
+		{
+			// Bounce среди последних писем: остальные страницы не загружаются
+			name:        "match in newest page",
+			maxMessages: 20,
+			matchUID:    9,
+			wantStatus:  StatusFailed,
+			wantFetches: [][]uint32{{8, 9, 10}},
+		},
+		{
+			name:        "match in older page",
+			maxMessages: 20,
+			matchUID:    2,
+			wantStatus:  StatusFailed,
+			wantFetches: [][]uint32{{8, 9, 10}, {5, 6, 7}, {2, 3, 4}},
+		},
+		{
+			// Последняя страница неполная
+			name:        "no match",
+			maxMessages: 20,
+			wantStatus:  StatusDelivered,
+			wantFetches: [][]uint32{{8, 9, 10}, {5, 6, 7}, {2, 3, 4}, {1}},
+		},
+		{
+			// Письма старше IMAPScanMaxMessages последних не просматриваются
+			name:        "match beyond scan limit",
+			maxMessages: 5,
+			matchUID:    3,
+			wantStatus:  StatusDelivered,
+			wantFetches: [][]uint32{{8, 9, 10}, {6, 7}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeIMAPServer(t)
+			addBounces(server, 10, tt.matchUID, target)
+			c := newTestIMAPClient(t, server, settings.SMTPConfig{IMAPScanMaxMessages: tt.maxMessages, IMAPScanPageSize: 3})
+
+			status, desc, _, err := c.CheckEmailStatus(context.Background(), "<"+target+">")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("статус %v (%s), ожидался %v", status, desc, tt.wantStatus)
+			}
+			if got := server.envelopeFetches(); !reflect.DeepEqual(got, tt.wantFetches) {
+				t.Errorf("загружены конверты %v, ожидалось %v", got, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestCheckEmailStatusUsesEnvelopeCache(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	addBounces(server, 6, 2, "first@example.com")
+	c := newTestIMAPClient(t, server, settings.SMTPConfig{IMAPScanPageSize: 3})
+	c.SetBounceCache(newBounceCache())
+
+	// Первая проверка загружает обе страницы и находит bounce в старой
+	status, _, _, err := c.CheckEmailStatus(context.Background(), "<first@example.com>")
+	if err != nil || status != StatusFailed {
+		t.Fatalf("первое письмо: статус %v, ошибка %v", status, err)
+	}
+	if got := len(server.envelopeFetches()); got != 2 {
+		t.Fatalf("FETCH конвертов: %d, ожидалось 2", got)
+	}
+
+	// Повторная проверка берет конверты из кеша, а сопоставленный bounce пропускает
+	status, _, _, err = c.CheckEmailStatus(context.Background(), "<first@example.com>")
+	if err != nil || status != StatusDelivered {
+		t.Errorf("повторная проверка: статус %v, ошибка %v", status, err)
+	}
+	if got := len(server.envelopeFetches()); got != 2 {
+		t.Errorf("FETCH конвертов после повторной проверки: %d, ожидалось 2", got)
+	}
+}
@@ -0,0 +1,144 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+)
+
+// ErrRecipientDomainNotFound возвращается, если у домена получателя нет ни MX, ни A/AAAA записей
+var ErrRecipientDomainNotFound = errors.New("домен получателя не принимает почту (нет MX и A записей)")
+
+// mxResolver - DNS запросы, необходимые для проверки домена получателя (реализуется net.Resolver)
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// mxCacheEntry - закешированный результат проверки домена
+type mxCacheEntry struct {
+	exists  bool
+	expires time.Time
+}
+
+// mxChecker проверяет, что домены получателей принимают почту, и кеширует результат на ttl
+// Ошибки DNS, не означающие отсутствие домена (таймаут, SERVFAIL), не кешируются
+// и не мешают отправке: решение в этом случае остается за SMTP сервером
+type mxChecker struct {
+	resolver mxResolver
+	ttl      time.Duration
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	cache map[string]mxCacheEntry
+}
+
+// newMXChecker создает проверку доменов получателей
+func newMXChecker(resolver mxResolver, ttl, timeout time.Duration) *mxChecker {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &mxChecker{
+		resolver: resolver,
+		ttl:      ttl,
+		timeout:  timeout,
+		cache:    make(map[string]mxCacheEntry),
+	}
+}
+
+// filter разделяет адреса на те, чьи домены принимают почту, и те, чьи домены не существуют
+func (m *mxChecker) filter(ctx context.Context, addresses []string) (valid []string, unresolved []string) {
+	valid = make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		at := strings.LastIndex(addr, "@")
+		if at < 0 {
+			valid = append(valid, addr)
+			continue
+		}
+		domain := strings.ToLower(strings.Trim(strings.TrimSpace(addr[at+1:]), ">"))
+		if m.domainExists(ctx, domain) {
+			valid = append(valid, addr)
+		} else {
+			unresolved = append(unresolved, addr)
+		}
+	}
+	return valid, unresolved
+}
+
+// domainExists проверяет наличие MX записей домена (или A/AAAA записей при их отсутствии, RFC 5321)
+func (m *mxChecker) domainExists(ctx context.Context, domain string) bool {
+	if domain == "" {
+		return true
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	if entry, ok := m.cache[domain]; ok && now.Before(entry.expires) {
+		m.mu.Unlock()
+		return entry.exists
+	}
+	m.mu.Unlock()
+
+	exists, definitive := m.lookup(ctx, domain)
+	if !definitive {
+		return true
+	}
+
+	m.mu.Lock()
+	m.cache[domain] = mxCacheEntry{exists: exists, expires: now.Add(m.ttl)}
+	m.mu.Unlock()
+	return exists
+}
+
+// lookup выполняет DNS запросы с таймаутом
+// definitive = false, если результат не удалось получить (ошибка, отличная от отсутствия домена)
+func (m *mxChecker) lookup(ctx context.Context, domain string) (exists bool, definitive bool) {
+	lookupCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	mxs, err := m.resolver.LookupMX(lookupCtx, domain)
+	if err == nil {
+		// Null MX (RFC 7505) - домен явно не принимает почту
+		if len(mxs) == 1 && strings.Trim(mxs[0].Host, ".") == "" {
+			return false, true
+		}
+		if len(mxs) > 0 {
+			return true, true
+		}
+	} else if !isDNSNotFound(err) {
+		if logger.Log != nil {
+			logger.Log.Debug("Не удалось проверить MX записи домена получателя",
+				zap.String("domain", domain),
+				zap.Error(err))
+		}
+		return false, false
+	}
+
+	// MX записей нет - почта доставляется на A/AAAA запись домена
+	hosts, err := m.resolver.LookupHost(lookupCtx, domain)
+	if err != nil {
+		if isDNSNotFound(err) {
+			return false, true
+		}
+		if logger.Log != nil {
+			logger.Log.Debug("Не удалось проверить A записи домена получателя",
+				zap.String("domain", domain),
+				zap.Error(err))
+		}
+		return false, false
+	}
+	return len(hosts) > 0, true
+}
+
+// isDNSNotFound проверяет, означает ли ошибка DNS отсутствие записей (NXDOMAIN или пустой ответ)
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,135 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"email-service/settings"
+)
+
+// stubResolver - DNS для тестов: записи задаются по доменам, отсутствующий домен дает NXDOMAIN
+type stubResolver struct {
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	failing map[string]bool // Домены, для которых DNS не отвечает (временная ошибка)
+	calls   int
+}
+
+func (r *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.calls++
+	if r.failing[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.calls++
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func newStubResolver() *stubResolver {
+	return &stubResolver{
+		mx: map[string][]*net.MX{
+			"example.org": {{Host: "mx.example.org.", Pref: 10}},
+			"nullmx.org":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"a-only.org": {"192.0.2.1"},
+		},
+		failing: map[string]bool{"flaky.org": true},
+	}
+}
+
+func TestMXCheckerFilter(t *testing.T) {
+	checker := newMXChecker(newStubResolver(), time.Minute, time.Second)
+
+	addresses := []string{
+		"user@example.org", // MX запись есть
+		"user@A-Only.org",  // Нет MX, есть A запись
+		"user@missing.org", // Домен не существует
+		"user@nullmx.org",  // Null MX - домен не принимает почту
+		"user@flaky.org",   // DNS не ответил - решение за SMTP сервером
+		"not-an-address",   // Без домена - не проверяется
+	}
+	valid, unresolved := checker.filter(context.Background(), addresses)
+
+	wantValid := []string{"user@example.org", "user@A-Only.org", "user@flaky.org", "not-an-address"}
+	wantUnresolved := []string{"user@missing.org", "user@nullmx.org"}
+	if !reflect.DeepEqual(valid, wantValid) {
+		t.Errorf("valid = %v, ожидалось %v", valid, wantValid)
+	}
+	if !reflect.DeepEqual(unresolved, wantUnresolved) {
+		t.Errorf("unresolved = %v, ожидалось %v", unresolved, wantUnresolved)
+	}
+}
+
+func TestMXCheckerCache(t *testing.T) {
+	resolver := newStubResolver()
+	checker := newMXChecker(resolver, time.Minute, time.Second)
+	ctx := context.Background()
+
+	// Окончательный результат кешируется: повторная проверка не обращается к DNS
+	for _, domain := range []string{"example.org", "missing.org"} {
+		checker.domainExists(ctx, domain)
+		calls := resolver.calls
+		checker.domainExists(ctx, domain)
+		if resolver.calls != calls {
+			t.Errorf("%s: повторная проверка обратилась к DNS", domain)
+		}
+	}
+
+	// Временная ошибка DNS не кешируется
+	checker.domainExists(ctx, "flaky.org")
+	calls := resolver.calls
+	checker.domainExists(ctx, "flaky.org")
+	if resolver.calls == calls {
+		t.Error("временная ошибка DNS закеширована")
+	}
+}
+
+func TestIsDNSNotFound(t *testing.T) {
+	if !isDNSNotFound(&net.DNSError{IsNotFound: true}) {
+		t.Error("NXDOMAIN не распознан")
+	}
+	if isDNSNotFound(&net.DNSError{IsTimeout: true}) || isDNSNotFound(errors.New("no such host")) {
+		t.Error("временная ошибка принята за отсутствие домена")
+	}
+}
+
+func TestSendEmailVerifiesRecipientMX(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	cfg := &settings.Config{}
+	cfg.SMTP = []settings.SMTPConfig{{Host: "127.0.0.1", Port: server.port(), User: "sender@example.com"}}
+	s, err := NewService(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.mxChecker = newMXChecker(newStubResolver(), time.Minute, time.Second)
+
+	// Без DropInvalidRecipients письмо с несуществующим доменом не отправляется
+	msg := &EmailMessage{TaskID: 1, EmailAddress: "user@example.org;user@missing.org", Text: "текст"}
+	if err := s.SendEmail(context.Background(), msg); !errors.Is(err, ErrRecipientDomainNotFound) {
+		t.Fatalf("ошибка %v, ожидалась ErrRecipientDomainNotFound", err)
+	}
+
+	// С DropInvalidRecipients такой получатель исключается, остальным письмо отправляется
+	cfg.Mode.DropInvalidRecipients = true
+	if err := s.SendEmail(context.Background(), msg); err != nil {
+		t.Fatalf("отправка завершилась ошибкой: %v", err)
+	}
+	if got := server.acceptedRecipients(); !reflect.DeepEqual(got, [][]string{{"user@example.org"}}) {
+		t.Errorf("сервер принял %v, ожидалось только user@example.org", got)
+	}
+}
@@ -0,0 +1,45 @@
+package email
+
+import (
+	"fmt"
+	"net/mail"
+
+	"email-service/settings"
+)
+
+// autoResponseSuppress - значение заголовка X-Auto-Response-Suppress для писем с адреса, не принимающего ответы:
+// Exchange и Outlook не отправляют на него уведомления об отсутствии и автоответы
+// Уведомления о недоставке (NDR, DR) не подавляются: по ним проверяется статус письма через IMAP
+const autoResponseSuppress = "OOF, AutoReply"
+
+// checkNoReplySettings проверяет адрес SupportReplyTo SMTP сервера при запуске
+func checkNoReplySettings(cfg *settings.SMTPConfig) error {
+	if cfg.SupportReplyTo == "" {
+		return nil
+	}
+	if _, err := mail.ParseAddress(cfg.SupportReplyTo); err != nil {
+		return fmt.Errorf("SMTP %s: некорректный адрес SupportReplyTo %q: %w", cfg.Host, cfg.SupportReplyTo, err)
+	}
+	if !cfg.NoReplySender {
+		return fmt.Errorf("SMTP %s: SupportReplyTo действует только при NoReplySender = True", cfg.Host)
+	}
+	return nil
+}
+
+// noReplyHeaders формирует заголовки письма с адреса, не принимающего ответы (NoReplySender):
+// Reply-To с адресом поддержки (SupportReplyTo) и X-Auto-Response-Suppress
+// Reply-To из заголовков сообщения очереди сохраняется: он задан для конкретного письма
+func (c *SMTPClient) noReplyHeaders(msg *EmailMessage) string {
+	if !c.cfg.NoReplySender {
+		return ""
+	}
+	var headers string
+	if !hasCustomHeader(msg.CustomHeaders, "Reply-To") && c.cfg.SupportReplyTo != "" {
+		// Адрес проверен checkNoReplySettings при создании сервиса
+		if addr, err := mail.ParseAddress(c.cfg.SupportReplyTo); err == nil {
+			headers += fmt.Sprintf("Reply-To: %s\r\n", addr.String())
+		}
+	}
+	headers += fmt.Sprintf("X-Auto-Response-Suppress: %s\r\n", autoResponseSuppress)
+	return headers
+}
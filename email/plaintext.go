@@ -0,0 +1,117 @@
+package email
+
+import (
+	"html"
+	"strings"
+)
+
+// plainTextBlockElements - элементы, границы которых в текстовой версии письма переносят строку
+var plainTextBlockElements = map[string]bool{
+	"p": true, "div": true, "tr": true, "table": true, "blockquote": true, "pre": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"ul": true, "ol": true, "li": true, "hr": true, "center": true,
+}
+
+// htmlToPlainText формирует текстовую версию HTML тела для multipart/alternative:
+// теги удаляются, блочные элементы и <br> переносят строку, элементы списка начинаются с "- ",
+// содержимое head, style и script не выводится, HTML сущности раскрываются
+func htmlToPlainText(body string) string {
+	var out strings.Builder
+	out.Grow(len(body))
+
+	i := 0
+	for i < len(body) {
+		lt := strings.IndexByte(body[i:], '<')
+		if lt < 0 {
+			out.WriteString(body[i:])
+			break
+		}
+		out.WriteString(body[i : i+lt])
+		i += lt
+
+		if strings.HasPrefix(body[i:], "<!--") {
+			end := strings.Index(body[i+4:], "-->")
+			if end < 0 {
+				break
+			}
+			i += 4 + end + 3
+			continue
+		}
+
+		end := tagEnd(body, i)
+		if end < 0 {
+			out.WriteByte('<')
+			i++
+			continue
+		}
+		start := i
+		raw := body[i : end+1]
+		i = end + 1
+
+		if strings.HasPrefix(raw, "<!") {
+			continue
+		}
+		name, _, closing, _ := parseTag(raw)
+		switch {
+		case name == "":
+			out.WriteByte('<')
+			i = start + 1
+		case !closing && (name == "head" || name == "style" || name == "script" || name == "title"):
+			i = skipElementContent(body, i, name)
+		case name == "br":
+			out.WriteByte('\n')
+		case name == "li":
+			if !closing {
+				out.WriteString("\n- ")
+			}
+		case name == "td" || name == "th":
+			if closing {
+				out.WriteByte('\t')
+			}
+		case plainTextBlockElements[name]:
+			out.WriteByte('\n')
+		}
+	}
+
+	return collapsePlainText(html.UnescapeString(out.String()))
+}
+
+// collapsePlainText убирает отступы разметки: пробелы внутри строк сжимаются до одного,
+// подряд идущие пустые строки - до одной
+func collapsePlainText(text string) string {
+	lines := strings.Split(text, "\n")
+	result := make([]string, 0, len(lines))
+	blank := true // Пустые строки в начале текста не выводятся
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			if !blank {
+				result = append(result, "")
+			}
+			blank = true
+			continue
+		}
+		result = append(result, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(result, "\r\n"))
+}
+
+// AppendAttachmentNote добавляет в конец тела письма список вложений, которые не удалось приложить
+// Для HTML тела пометка добавляется отдельным абзацем с экранированными именами файлов
+func AppendAttachmentNote(text string, isHTML bool, names []string) string {
+	note := "Не удалось приложить файлы: " + strings.Join(names, ", ")
+	if isHTML {
+		return text + "<p>" + html.EscapeString(note) + "</p>"
+	}
+	return text + "\r\n\r\n" + note
+}
+
+// AppendEmptyReportNote добавляет в конец тела письма список отчетов, не содержащих данных
+func AppendEmptyReportNote(text string, isHTML bool, names []string) string {
+	note := "Отчеты не содержат данных и не приложены: " + strings.Join(names, ", ")
+	if isHTML {
+		return text + "<p>" + html.EscapeString(note) + "</p>"
+	}
+	return text + "\r\n\r\n" + note
+}
@@ -0,0 +1,49 @@
+package email
+
+import "testing"
+
+func TestHTMLToPlainText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "абзацы и переносы строк",
+			html: "<p>Здравствуйте,</p>\n  <p>ваш   заказ<br>готов.</p>",
+			want: "Здравствуйте,\r\n\r\nваш заказ\r\nготов.",
+		},
+		{
+			name: "списки",
+			html: "<ul><li>первый</li><li>второй</li></ul>",
+			want: "- первый\r\n- второй",
+		},
+		{
+			name: "служебные элементы не выводятся",
+			html: "<html><head><title>Т</title><style>p{color:red}</style></head><body><script>x()</script>Текст<!-- комментарий --></body></html>",
+			want: "Текст",
+		},
+		{
+			name: "сущности раскрываются",
+			html: "<b>1 &lt; 2</b> &amp;&nbsp;&quot;кавычки&quot;",
+			want: "1 < 2 & \"кавычки\"",
+		},
+		{
+			name: "ячейки таблицы разделяются",
+			html: "<table><tr><td>Сумма</td><td>100</td></tr></table>",
+			want: "Сумма 100",
+		},
+		{
+			name: "не тег",
+			html: "a < b",
+			want: "a < b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := htmlToPlainText(tt.html); got != tt.want {
+				t.Errorf("htmlToPlainText() = %q, ожидалось %q", got, tt.want)
+			}
+		})
+	}
+}
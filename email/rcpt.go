@@ -0,0 +1,49 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// RejectedRecipient - получатель, отклоненный SMTP сервером в ответ на команду RCPT
+type RejectedRecipient struct {
+	Address string
+	Code    int    // Код ответа SMTP, например 550
+	Message string // Текст ответа сервера (обычно начинается с расширенного кода, например 5.1.1)
+}
+
+// RecipientsRejectedError возвращается, если SMTP сервер отклонил часть получателей письма
+// Если принят хотя бы один получатель (Accepted > 0), письмо передано им и ошибка означает частичную доставку
+type RecipientsRejectedError struct {
+	Rejected []RejectedRecipient
+	Accepted int // Количество получателей, принятых сервером
+}
+
+func (e *RecipientsRejectedError) Error() string {
+	items := make([]string, 0, len(e.Rejected))
+	for _, r := range e.Rejected {
+		items = append(items, fmt.Sprintf("%s (%d %s)", r.Address, r.Code, r.Message))
+	}
+	return fmt.Sprintf("SMTP сервер отклонил получателей (%d из %d): %s",
+		len(e.Rejected), len(e.Rejected)+e.Accepted, strings.Join(items, ", "))
+}
+
+// Unwrap позволяет проверить частичную доставку через errors.Is(err, ErrPartialDelivery)
+func (e *RecipientsRejectedError) Unwrap() error {
+	if e.Accepted > 0 {
+		return ErrPartialDelivery
+	}
+	return nil
+}
+
+// rejectedRecipient проверяет, что ошибка RCPT - отказ сервера для адреса (ответ 4xx или 5xx),
+// а не ошибка соединения, после которой транзакцию продолжать нельзя
+func rejectedRecipient(address string, err error) (RejectedRecipient, bool) {
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		return RejectedRecipient{}, false
+	}
+	return RejectedRecipient{Address: address, Code: tpErr.Code, Message: tpErr.Msg}, true
+}
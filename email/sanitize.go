@@ -0,0 +1,372 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Режимы обработки HTML тела письма (параметр HTMLSanitizePolicy секции [Mode])
+const (
+	// HTMLPolicyOff - тело письма отправляется без проверки
+	HTMLPolicyOff = "off"
+	// HTMLPolicySanitize - недопустимые элементы и атрибуты удаляются из тела письма
+	HTMLPolicySanitize = "sanitize"
+	// HTMLPolicyReject - письмо с недопустимыми элементами или атрибутами не отправляется
+	HTMLPolicyReject = "reject"
+)
+
+// ErrHTMLRejected возвращается, если HTML тело письма не прошло проверку по списку разрешенных элементов
+var ErrHTMLRejected = errors.New("HTML тело письма содержит недопустимые элементы")
+
+// normalizeHTMLPolicy приводит режим обработки HTML к каноническому виду и проверяет его
+func normalizeHTMLPolicy(policy string) (string, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	switch policy {
+	case "":
+		return HTMLPolicyOff, nil
+	case HTMLPolicyOff, HTMLPolicySanitize, HTMLPolicyReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("неизвестный режим HTMLSanitizePolicy %q (допустимо: %s, %s, %s)",
+		policy, HTMLPolicyOff, HTMLPolicySanitize, HTMLPolicyReject)
+}
+
+// htmlAllowedElements - элементы, разрешенные в HTML теле письма
+var htmlAllowedElements = map[string]bool{
+	"html": true, "head": true, "body": true, "meta": true, "title": true, "style": true,
+	"a": true, "abbr": true, "b": true, "blockquote": true, "br": true, "caption": true,
+	"center": true, "cite": true, "code": true, "col": true, "colgroup": true, "dd": true,
+	"del": true, "div": true, "dl": true, "dt": true, "em": true, "font": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"hr": true, "i": true, "img": true, "ins": true, "li": true, "ol": true, "p": true,
+	"pre": true, "q": true, "s": true, "small": true, "span": true, "strike": true,
+	"strong": true, "sub": true, "sup": true, "table": true, "tbody": true, "td": true,
+	"tfoot": true, "th": true, "thead": true, "tr": true, "u": true, "ul": true, "wbr": true,
+	"article": true, "section": true, "header": true, "footer": true, "main": true,
+}
+
+// htmlDroppedElements - элементы, которые удаляются вместе с содержимым
+var htmlDroppedElements = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true, "object": true,
+	"embed": true, "applet": true, "noscript": true, "template": true, "svg": true, "math": true,
+}
+
+// htmlAllowedAttributes - атрибуты, разрешенные у любых разрешенных элементов
+var htmlAllowedAttributes = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "charset": true, "class": true, "color": true, "cols": true,
+	"colspan": true, "content": true, "dir": true, "face": true, "height": true,
+	"id": true, "lang": true, "name": true, "rowspan": true, "size": true, "span": true,
+	"start": true, "style": true, "target": true, "title": true, "type": true,
+	"valign": true, "width": true,
+	"href": true, "src": true, "background": true, "http-equiv": true,
+}
+
+// htmlURLAttributes - атрибуты со ссылками, схема которых проверяется отдельно
+var htmlURLAttributes = map[string]bool{"href": true, "src": true, "background": true}
+
+// sanitizeHTML удаляет из HTML недопустимые элементы и атрибуты по списку разрешенных.
+// Скрипты, фреймы и встраиваемые объекты удаляются вместе с содержимым, прочие неразрешенные
+// элементы - без содержимого (текст внутри сохраняется), комментарии удаляются.
+// Возвращает очищенный HTML и список удаленных элементов и атрибутов (пустой, если тело не изменилось)
+func sanitizeHTML(body string) (string, []string) {
+	var out strings.Builder
+	out.Grow(len(body))
+
+	var removed []string
+	seen := make(map[string]bool)
+	report := func(item string) {
+		if !seen[item] {
+			seen[item] = true
+			removed = append(removed, item)
+		}
+	}
+
+	i := 0
+	for i < len(body) {
+		lt := strings.IndexByte(body[i:], '<')
+		if lt < 0 {
+			out.WriteString(body[i:])
+			break
+		}
+		out.WriteString(body[i : i+lt])
+		i += lt
+
+		// Комментарии (в том числе условные комментарии Outlook) удаляются
+		if strings.HasPrefix(body[i:], "<!--") {
+			end := strings.Index(body[i+4:], "-->")
+			if end < 0 {
+				break
+			}
+			i += 4 + end + 3
+			continue
+		}
+
+		end := tagEnd(body, i)
+		if end < 0 {
+			// Незакрытый тег - выводим '<' как текст
+			out.WriteString("&lt;")
+			i++
+			continue
+		}
+		start := i
+		raw := body[i : end+1]
+		i = end + 1
+
+		if strings.HasPrefix(raw, "<!") {
+			if strings.HasPrefix(strings.ToLower(raw), "<!doctype") {
+				out.WriteString(raw)
+			} else {
+				report(raw)
+			}
+			continue
+		}
+
+		name, attrs, closing, selfClosing := parseTag(raw)
+		if name == "" {
+			// Не тег (например, "a < b") - экранируем '<' и продолжаем разбор со следующего символа
+			out.WriteString("&lt;")
+			i = start + 1
+			continue
+		}
+
+		if htmlDroppedElements[name] {
+			report("<" + name + ">")
+			if !closing && !selfClosing {
+				// Пропускаем содержимое до закрывающего тега
+				i = skipElementContent(body, i, name)
+			}
+			continue
+		}
+
+		// Таблица стилей проверяется целиком: при недопустимых конструкциях удаляется вместе с содержимым
+		if name == "style" && !closing && !selfClosing {
+			contentEnd := indexFold(body[i:], "</style")
+			if contentEnd < 0 {
+				contentEnd = len(body) - i
+			}
+			if reason := unsafeCSS(body[i : i+contentEnd]); reason != "" {
+				report("<style>" + reason)
+				i = skipElementContent(body, i, name)
+				continue
+			}
+		}
+
+		if !htmlAllowedElements[name] {
+			report("<" + name + ">")
+			continue
+		}
+
+		if closing {
+			out.WriteString("</" + name + ">")
+			continue
+		}
+
+		out.WriteString("<" + name)
+		for _, attr := range attrs {
+			if reason := disallowedAttribute(name, attr); reason != "" {
+				report(reason)
+				continue
+			}
+			out.WriteString(" " + attr.name)
+			if attr.hasValue {
+				out.WriteString(`="` + strings.ReplaceAll(attr.value, `"`, "&quot;") + `"`)
+			}
+		}
+		if selfClosing {
+			out.WriteString(" /")
+		}
+		out.WriteString(">")
+	}
+
+	return out.String(), removed
+}
+
+// htmlAttribute - атрибут HTML тега
+type htmlAttribute struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+// disallowedAttribute возвращает описание нарушения для атрибута или пустую строку, если атрибут разрешен
+func disallowedAttribute(element string, attr htmlAttribute) string {
+	if !htmlAllowedAttributes[attr.name] {
+		return attr.name
+	}
+
+	value := strings.ToLower(html.UnescapeString(attr.value))
+	switch {
+	case htmlURLAttributes[attr.name]:
+		if !isSafeURL(attr.name, value) {
+			return attr.name + "=" + attr.value
+		}
+	case attr.name == "style":
+		if unsafeCSS(value) != "" {
+			return "style=" + attr.value
+		}
+	case attr.name == "http-equiv":
+		// Разрешаем только объявление кодировки, refresh и прочие директивы запрещены
+		if element != "meta" || strings.TrimSpace(value) != "content-type" {
+			return "http-equiv=" + attr.value
+		}
+	}
+	return ""
+}
+
+// unsafeCSS возвращает найденную в CSS недопустимую конструкцию или пустую строку
+func unsafeCSS(css string) string {
+	css = strings.ToLower(css)
+	for _, token := range []string{"expression(", "javascript:", "@import", "behavior:", "-moz-binding"} {
+		if strings.Contains(css, token) {
+			return token
+		}
+	}
+	return ""
+}
+
+// skipElementContent возвращает позицию после закрывающего тега элемента name, начиная поиск с pos
+// Если закрывающий тег не найден, возвращается конец строки
+func skipElementContent(body string, pos int, name string) int {
+	closeIdx := indexFold(body[pos:], "</"+name)
+	if closeIdx < 0 {
+		return len(body)
+	}
+	closeEnd := tagEnd(body, pos+closeIdx)
+	if closeEnd < 0 {
+		return len(body)
+	}
+	return closeEnd + 1
+}
+
+// indexFold ищет подстроку без учета регистра ASCII символов (substr должна быть в нижнем регистре)
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isSafeURL проверяет схему ссылки: разрешены http, https, mailto, tel, cid, относительные ссылки
+// и встроенные изображения data:image (только в src)
+func isSafeURL(attrName, value string) bool {
+	// Браузеры игнорируют пробелы и управляющие символы внутри схемы
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value)
+
+	colon := strings.IndexByte(value, ':')
+	if colon < 0 || strings.ContainsAny(value[:colon], "/?#") {
+		return true // Относительная ссылка
+	}
+
+	switch value[:colon] {
+	case "http", "https", "mailto", "tel", "cid":
+		return true
+	case "data":
+		return attrName == "src" && strings.HasPrefix(value, "data:image/") && !strings.HasPrefix(value, "data:image/svg")
+	}
+	return false
+}
+
+// tagEnd возвращает индекс символа '>', закрывающего тег, начинающийся с позиции start, с учетом кавычек
+func tagEnd(body string, start int) int {
+	var quote byte
+	for j := start + 1; j < len(body); j++ {
+		c := body[j]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return j
+		case c == '<' && j == start+1:
+			return -1
+		}
+	}
+	return -1
+}
+
+// parseTag разбирает тег вида <name attr="value" ...>, </name> или <name ... />
+// Имя тега и атрибутов приводится к нижнему регистру. Если строка не является тегом, name пустой
+func parseTag(raw string) (name string, attrs []htmlAttribute, closing, selfClosing bool) {
+	s := raw[1 : len(raw)-1]
+	if strings.HasPrefix(s, "/") {
+		closing = true
+		s = s[1:]
+	}
+
+	n := 0
+	for n < len(s) && isTagNameChar(s[n], n == 0) {
+		n++
+	}
+	if n == 0 {
+		return "", nil, false, false
+	}
+	name = strings.ToLower(s[:n])
+	s = s[n:]
+
+	if trimmed := strings.TrimRight(s, " \t\r\n"); strings.HasSuffix(trimmed, "/") {
+		selfClosing = true
+		s = strings.TrimSuffix(trimmed, "/")
+	}
+	if closing {
+		return name, nil, true, false
+	}
+
+	for {
+		s = strings.TrimLeft(s, " \t\r\n/")
+		if s == "" {
+			break
+		}
+		k := strings.IndexAny(s, " \t\r\n=/")
+		if k < 0 {
+			k = len(s)
+		}
+		attr := htmlAttribute{name: strings.ToLower(s[:k])}
+		s = strings.TrimLeft(s[k:], " \t\r\n")
+		if strings.HasPrefix(s, "=") {
+			s = strings.TrimLeft(s[1:], " \t\r\n")
+			attr.hasValue = true
+			if s != "" && (s[0] == '"' || s[0] == '\'') {
+				q := s[0]
+				if e := strings.IndexByte(s[1:], q); e >= 0 {
+					attr.value = s[1 : 1+e]
+					s = s[2+e:]
+				} else {
+					attr.value = s[1:]
+					s = ""
+				}
+			} else {
+				e := strings.IndexAny(s, " \t\r\n")
+				if e < 0 {
+					e = len(s)
+				}
+				attr.value = s[:e]
+				s = s[e:]
+			}
+		}
+		if attr.name != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return name, attrs, false, selfClosing
+}
+
+// isTagNameChar проверяет, допустим ли символ в имени тега
+func isTagNameChar(c byte, first bool) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return !first && (c >= '0' && c <= '9' || c == '-')
+}
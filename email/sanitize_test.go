@@ -0,0 +1,134 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"email-service/settings"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		want        string
+		wantRemoved []string
+	}{
+		{
+			name:        "скрипт удаляется вместе с содержимым",
+			body:        `<p>Привет</p><script>alert("x")</script><p>мир</p>`,
+			want:        `<p>Привет</p><p>мир</p>`,
+			wantRemoved: []string{"<script>"},
+		},
+		{
+			name:        "скрипт в верхнем регистре",
+			body:        `<div><SCRIPT type="text/javascript">document.cookie</SCRIPT>текст</div>`,
+			want:        `<div>текст</div>`,
+			wantRemoved: []string{"<script>"},
+		},
+		{
+			name:        "обработчики событий",
+			body:        `<img src="https://example.com/a.png" onerror="alert(1)">`,
+			want:        `<img src="https://example.com/a.png">`,
+			wantRemoved: []string{"onerror"},
+		},
+		{
+			name:        "ссылка javascript:",
+			body:        `<a href="javascript:alert(1)">ссылка</a>`,
+			want:        `<a>ссылка</a>`,
+			wantRemoved: []string{"href=javascript:alert(1)"},
+		},
+		{
+			name:        "iframe и неизвестный элемент",
+			body:        `<iframe src="https://evil.example"></iframe><blink>текст</blink>`,
+			want:        `текст`,
+			wantRemoved: []string{"<iframe>", "<blink>"},
+		},
+		{
+			name:        "комментарии удаляются",
+			body:        `<p>a<!-- <script>x</script> -->b</p>`,
+			want:        `<p>ab</p>`,
+			wantRemoved: nil,
+		},
+		{
+			name:        "разрешенная разметка не меняется",
+			body:        `<!DOCTYPE html><table width="100%"><tr><td style="color: red">1 &lt; 2</td></tr></table><br />`,
+			want:        `<!DOCTYPE html><table width="100%"><tr><td style="color: red">1 &lt; 2</td></tr></table><br />`,
+			wantRemoved: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, removed := sanitizeHTML(tt.body)
+			if got != tt.want {
+				t.Errorf("sanitizeHTML() = %q, ожидалось %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("удалено %q, ожидалось %q", removed, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestNormalizeHTMLPolicy(t *testing.T) {
+	for in, want := range map[string]string{"": HTMLPolicyOff, " Sanitize ": HTMLPolicySanitize, "REJECT": HTMLPolicyReject} {
+		if got, err := normalizeHTMLPolicy(in); err != nil || got != want {
+			t.Errorf("normalizeHTMLPolicy(%q) = %q, %v; ожидалось %q", in, got, err, want)
+		}
+	}
+	if _, err := normalizeHTMLPolicy("strict"); err == nil {
+		t.Error("неизвестный режим принят")
+	}
+}
+
+// newHTMLPolicyTestService создает email сервис с HTML телом писем и указанным режимом проверки
+func newHTMLPolicyTestService(t *testing.T, server *fakeSMTPServer, policy string) *Service {
+	t.Helper()
+	cfg := &settings.Config{}
+	cfg.Mode.IsBodyHTML = true
+	cfg.Mode.HTMLSanitizePolicy = policy
+	cfg.SMTP = []settings.SMTPConfig{{Host: "127.0.0.1", Port: server.port(), User: "sender@example.com"}}
+	s, err := NewService(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSendEmailHTMLPolicy(t *testing.T) {
+	const body = `<p>Счет</p><script>steal()</script>`
+
+	t.Run("reject", func(t *testing.T) {
+		server := newFakeSMTPServer(t)
+		s := newHTMLPolicyTestService(t, server, HTMLPolicyReject)
+
+		msg := &EmailMessage{TaskID: 1, EmailAddress: "user@example.org", Title: "Счет", Text: body}
+		err := s.SendEmail(context.Background(), msg)
+		if !errors.Is(err, ErrHTMLRejected) || !strings.Contains(err.Error(), "<script>") {
+			t.Fatalf("ошибка %v, ожидалась ErrHTMLRejected с описанием <script>", err)
+		}
+		if got := server.acceptedRecipients(); len(got) != 0 {
+			t.Errorf("отклоненное письмо отправлено: %v", got)
+		}
+	})
+
+	t.Run("sanitize", func(t *testing.T) {
+		server := newFakeSMTPServer(t)
+		s := newHTMLPolicyTestService(t, server, HTMLPolicySanitize)
+
+		msg := &EmailMessage{TaskID: 2, EmailAddress: "user@example.org", Title: "Счет", Text: body}
+		if err := s.SendEmail(context.Background(), msg); err != nil {
+			t.Fatalf("отправка завершилась ошибкой: %v", err)
+		}
+		if msg.Text != "<p>Счет</p>" {
+			t.Errorf("тело письма %q, ожидалось без <script>", msg.Text)
+		}
+		if got := server.acceptedRecipients(); len(got) != 1 {
+			t.Errorf("сервер принял %d писем, ожидалось 1", len(got))
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// TransientError - временная ошибка отправки (сеть, таймаут, ответ 4xx): письмо можно отправить повторно позже
+// Текст ошибки не меняется, исходная ошибка доступна через errors.Unwrap
+type TransientError struct {
+	err error
+}
+
+func (e *TransientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.err
+}
+
+// PermanentError - постоянная ошибка отправки (ответ 5xx, нет допустимых получателей, письмо больше лимита,
+// частичная доставка): повторная отправка того же письма не поможет или приведет к дубликатам
+type PermanentError struct {
+	err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.err
+}
+
+// RateLimitedError - SMTP сервер временно отказал из-за ограничения частоты или объема отправки:
+// письмо можно отправить повторно после паузы, сам сервер при этом исправен
+type RateLimitedError struct {
+	err error
+}
+
+func (e *RateLimitedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return e.err
+}
+
+// rateLimitReplyMarkers - признаки ограничения частоты в тексте временного отказа SMTP сервера (в нижнем регистре)
+var rateLimitReplyMarkers = []string{
+	"rate limit",
+	"ratelimit",
+	"rate-limit",
+	"too many",
+	"throttl",
+}
+
+// classifySendError оборачивает ошибку отправки в *TransientError, *PermanentError или *RateLimitedError
+// Не оборачиваются: отмена контекста (остановка сервиса) и отказ части получателей при доставке остальным
+// (*RecipientsRejectedError с Accepted > 0 - письмо отправлено)
+func classifySendError(err error) error {
+	if err == nil || errors.Is(err, context.Canceled) || isRecipientsPartiallyRejected(err) {
+		return err
+	}
+
+	if errors.Is(err, ErrNoValidRecipients) || errors.Is(err, ErrRecipientDomainNotFound) ||
+		errors.Is(err, ErrInvalidSMTPID) || errors.Is(err, ErrHTMLRejected) ||
+		errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrPartialDelivery) {
+		return &PermanentError{err: err}
+	}
+	var rejectedErr *RecipientsRejectedError
+	if errors.As(err, &rejectedErr) {
+		return &PermanentError{err: err}
+	}
+
+	var replyErr *SMTPReplyError
+	if errors.As(err, &replyErr) {
+		switch {
+		case replyErr.Permanent():
+			return &PermanentError{err: err}
+		case isRateLimitReply(replyErr):
+			return &RateLimitedError{err: err}
+		}
+	}
+	return &TransientError{err: err}
+}
+
+// isRateLimitReply проверяет, что временный отказ SMTP сервера вызван ограничением частоты отправки:
+// расширенный код 4.7.x (политика сервера) или характерный текст ответа
+func isRateLimitReply(replyErr *SMTPReplyError) bool {
+	if !replyErr.Transient() {
+		return false
+	}
+	if strings.HasPrefix(replyErr.Enhanced, "4.7.") {
+		return true
+	}
+	text := strings.ToLower(replyErr.Error())
+	for _, marker := range rateLimitReplyMarkers {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"testing"
+
+	"email-service/settings"
+)
+
+func TestClassifySendError(t *testing.T) {
+	reply := func(code int, msg string) error {
+		return wrapSMTPReply(fmt.Errorf("ошибка DATA: %w", &textproto.Error{Code: code, Msg: msg}))
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"550 5.1.1", reply(550, "5.1.1 User unknown"), "permanent"},
+		{"451 4.7.1", reply(451, "4.7.1 Try again later"), "rate_limited"},
+		{"421 too many", reply(421, "Too many connections from your IP"), "rate_limited"},
+		{"451 4.3.0", reply(451, "4.3.0 Temporary system problem"), "transient"},
+		{"нет соединения", errors.New("dial tcp 127.0.0.1:25: connection refused"), "transient"},
+		{"нет получателей", fmt.Errorf("письмо не отправлено: %w", ErrNoValidRecipients), "permanent"},
+		{"письмо больше лимита", ErrMessageTooLarge, "permanent"},
+		{"все получатели отклонены", &RecipientsRejectedError{Rejected: []RejectedRecipient{{Address: "a@example.org"}}}, "permanent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifySendError(tt.err)
+			if got := sendErrorKind(err); got != tt.want {
+				t.Errorf("класс ошибки %q (%T), ожидался %q", got, err, tt.want)
+			}
+			// Текст и цепочка исходной ошибки сохраняются
+			if err.Error() != tt.err.Error() || !errors.Is(err, tt.err) {
+				t.Errorf("исходная ошибка потеряна: %v", err)
+			}
+		})
+	}
+
+	// Не оборачиваются: отмена контекста и частичный отказ получателей при отправленном письме
+	partial := &RecipientsRejectedError{Rejected: []RejectedRecipient{{Address: "a@example.org"}}, Accepted: 1}
+	for _, err := range []error{nil, context.Canceled, partial} {
+		if got := classifySendError(err); got != err {
+			t.Errorf("classifySendError(%v) = %T, ожидалась исходная ошибка", err, got)
+		}
+	}
+}
+
+func TestSendEmailReturnsTypedErrors(t *testing.T) {
+	rateLimited := newFakeSMTPServer(t)
+	rateLimited.dataReply = func(int) string { return "451 4.7.1 Sending rate exceeded" }
+	rejected := newFakeSMTPServer(t)
+	rejected.rcptReply = func(string) string { return "550 5.1.1 User unknown" }
+	// Порт закрытого слушателя: подключение отклоняется
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := &settings.Config{}
+	for _, port := range []int{rateLimited.port(), rejected.port(), closedPort} {
+		cfg.SMTP = append(cfg.SMTP, settings.SMTPConfig{Host: "127.0.0.1", Port: port, User: "sender@example.com"})
+	}
+	s, err := NewService(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for smtpID, want := range []string{"rate_limited", "permanent", "transient"} {
+		msg := &EmailMessage{TaskID: int64(smtpID + 1), SmtpID: smtpID, EmailAddress: "user@example.org", Text: "текст"}
+		err := s.SendEmail(context.Background(), msg)
+		if got := sendErrorKind(err); got != want {
+			t.Errorf("smtp_id %d: ошибка %v (%T), ожидался класс %q", smtpID, err, err, want)
+		}
+	}
+}
+
+// sendErrorKind возвращает класс ошибки отправки по ее типу
+func sendErrorKind(err error) string {
+	var transientErr *TransientError
+	var permanentErr *PermanentError
+	var rateErr *RateLimitedError
+	switch {
+	case errors.As(err, &rateErr):
+		return "rate_limited"
+	case errors.As(err, &permanentErr):
+		return "permanent"
+	case errors.As(err, &transientErr):
+		return "transient"
+	}
+	return ""
+}
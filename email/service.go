@@ -1,19 +1,29 @@
 package email
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
+	"email-service/clock"
 	"email-service/db"
 	"email-service/logger"
 	"email-service/settings"
 )
 
+// ErrInvalidSMTPID возвращается, если smtp_id сообщения не соответствует ни одному настроенному SMTP серверу
+// (при Mode.SMTPIDFallback = True вместо ошибки используется первый сервер)
+var ErrInvalidSMTPID = errors.New("smtp_id не соответствует настроенному SMTP серверу")
+
 // Service представляет email сервис
 type Service struct {
 	cfg                 *settings.Config
@@ -24,6 +34,14 @@ type Service struct {
 	testEmailCacheTime  time.Time
 	testEmailMu         sync.RWMutex
 	testEmailCacheTTL   time.Duration
+	htmlPolicy          string     // Режим проверки HTML тела письма (HTMLPolicyOff, HTMLPolicySanitize, HTMLPolicyReject)
+	autoSubmitted       string     // Для каких писем добавлять Precedence/Auto-Submitted (AutoSubmittedOff, AutoSubmittedBulk, AutoSubmittedAll)
+	mxChecker           *mxChecker // Проверка MX записей доменов получателей (nil - отключена)
+	clock               clock.Clock
+	failoverOrder       []int           // Порядок резервных SMTP серверов (SMTPFailoverOrder), пусто - по кругу
+	debugKeepDomains    []string        // Домены, письма на которые в Debug режиме не перенаправляются (DebugKeepDomains)
+	testRecipients      map[string]bool // Адреса, письма на которые в Debug режиме не перенаправляются (TestRecipients)
+	emptyReportPolicy   string          // Поведение при пустом отчете Crystal Reports (EmptyReportFail, EmptyReportNote)
 
 	// Проверка статуса отправленных писем (bounce через IMAP)
 	statusChecker       *StatusChecker
@@ -33,10 +51,78 @@ type Service struct {
 
 // NewService создает новый email сервис
 func NewService(cfg *settings.Config, dbConn *db.DBConnection, statusCallback StatusUpdateCallback) (*Service, error) {
+	htmlPolicy, err := normalizeHTMLPolicy(cfg.Mode.HTMLSanitizePolicy)
+	if err != nil {
+		return nil, err
+	}
+	autoSubmitted, err := normalizeAutoSubmitted(cfg.Mode.AutoSubmittedHeaders)
+	if err != nil {
+		return nil, err
+	}
+	dmarcAlignment, err := normalizeDMARCAlignment(cfg.Mode.DMARCAlignment)
+	if err != nil {
+		return nil, err
+	}
+	failoverOrder, err := parseFailoverOrder(cfg.Mode.SMTPFailoverOrder, len(cfg.SMTP))
+	if err != nil {
+		return nil, err
+	}
+	emptyReportPolicy, err := normalizeEmptyReportPolicy(cfg.Mode.CrystalReportsEmptyPolicy)
+	if err != nil {
+		return nil, err
+	}
+	transcriptMode, err := normalizeSMTPTranscript(cfg.Mode.SMTPTranscript)
+	if err != nil {
+		return nil, err
+	}
+	// Протокол SMTP содержит адреса и темы писем, поэтому записывается только в Debug режиме
+	if transcriptMode != SMTPTranscriptOff && !cfg.Mode.Debug {
+		if logger.Log != nil {
+			logger.Log.Warn("SMTPTranscript действует только в Debug режиме, протокол SMTP не записывается",
+				zap.String("mode", transcriptMode))
+		}
+		transcriptMode = SMTPTranscriptOff
+	}
+	if transcriptMode == SMTPTranscriptFile && cfg.Mode.SMTPTranscriptDir == "" {
+		return nil, fmt.Errorf("для SMTPTranscript = %s не задан SMTPTranscriptDir", SMTPTranscriptFile)
+	}
+
+	// Проверяем выравнивание доменов From и envelope-from (DMARC)
+	if dmarcAlignment != DMARCAlignmentOff {
+		for i := range cfg.SMTP {
+			err := checkDMARCAlignment(&cfg.SMTP[i])
+			if err == nil {
+				continue
+			}
+			if dmarcAlignment == DMARCAlignmentEnforce {
+				return nil, err
+			}
+			if logger.Log != nil {
+				logger.Log.Warn("Письма могут не пройти проверку DMARC", zap.Error(err))
+			}
+		}
+	}
+
+	// Проверяем TLS параметры, адрес для ответов и действие с bounce messages SMTP серверов
+	for i := range cfg.SMTP {
+		if err := checkTLSSettings(&cfg.SMTP[i]); err != nil {
+			return nil, err
+		}
+		if err := checkNoReplySettings(&cfg.SMTP[i]); err != nil {
+			return nil, err
+		}
+		if err := checkBounceActionSettings(&cfg.SMTP[i]); err != nil {
+			return nil, err
+		}
+	}
+
 	// Создаем SMTP клиенты для каждого SMTP сервера
 	smtpClients := make([]*SMTPClient, 0, len(cfg.SMTP))
 	for i := range cfg.SMTP {
 		smtpClient := NewSMTPClient(&cfg.SMTP[i])
+		smtpClient.SetInlineImageMaxSize(cfg.Mode.InlineImageMaxSizeKB * 1024)
+		smtpClient.SetXMailer(cfg.Mode.XMailer)
+		smtpClient.SetTranscript(transcriptMode, cfg.Mode.SMTPTranscriptDir)
 		smtpClients = append(smtpClients, smtpClient)
 	}
 
@@ -46,7 +132,20 @@ func NewService(cfg *settings.Config, dbConn *db.DBConnection, statusCallback St
 		smtpClients:         smtpClients,
 		attachmentProcessor: NewAttachmentProcessor(dbConn, cfg),
 		testEmailCacheTTL:   5 * time.Minute, // Кеш тестового email на 5 минут
+		htmlPolicy:          htmlPolicy,
+		autoSubmitted:       autoSubmitted,
 		statusChecker:       NewStatusChecker(cfg, statusCallback),
+		clock:               clock.Real,
+		failoverOrder:       failoverOrder,
+		debugKeepDomains:    parseKeepDomains(cfg.Mode.DebugKeepDomains),
+		testRecipients:      parseTestRecipients(cfg.Mode.TestRecipients),
+		emptyReportPolicy:   emptyReportPolicy,
+	}
+
+	if cfg.Mode.VerifyRecipientMX {
+		service.mxChecker = newMXChecker(net.DefaultResolver,
+			time.Duration(cfg.Mode.MXCacheTTLSec)*time.Second,
+			time.Duration(cfg.Mode.MXLookupTimeoutSec)*time.Second)
 	}
 
 	// Создаём контекст с возможностью отмены для StatusChecker
@@ -56,13 +155,39 @@ func NewService(cfg *settings.Config, dbConn *db.DBConnection, statusCallback St
 	return service, nil
 }
 
+// SetClock устанавливает источник времени сервиса, его SMTP клиентов и проверки статусов (nil - системные часы)
+// Вызывается до начала отправки писем
+func (s *Service) SetClock(clk clock.Clock) {
+	if clk == nil {
+		clk = clock.Real
+	}
+	s.clock = clk
+	for _, smtpClient := range s.smtpClients {
+		smtpClient.SetClock(clk)
+	}
+	s.statusChecker.SetClock(clk)
+}
+
+// statusCheckerStopTimeout - время ожидания завершения проверок статусов при закрытии сервиса
+const statusCheckerStopTimeout = 10 * time.Second
+
 // Close закрывает сервис
+// Дожидается завершения проверок статусов, чтобы после закрытия сервиса не поступали новые статусы
 func (s *Service) Close() error {
 	// Отменяем контекст StatusChecker для graceful shutdown
 	if s.statusCheckerCancel != nil {
 		s.statusCheckerCancel()
+		if !s.statusChecker.Wait(statusCheckerStopTimeout) {
+			if logger.Log != nil {
+				logger.Log.Warn("Проверки статусов писем не завершились до закрытия email сервиса",
+					zap.Duration("timeout", statusCheckerStopTimeout))
+			}
+		}
+	}
+	// Закрываем открытые соединения с SMTP серверами
+	for _, smtpClient := range s.smtpClients {
+		smtpClient.Close()
 	}
-	// SMTP клиенты не требуют явного закрытия (используют стандартный net/smtp)
 	if logger.Log != nil {
 		logger.Log.Info("Email сервис закрыт")
 	}
@@ -70,10 +195,18 @@ func (s *Service) Close() error {
 }
 
 // SendEmail отправляет email
+// Если SMTP сервер отклонил часть получателей, письмо считается отправленным (проверка статуса планируется)
+// и возвращается *RecipientsRejectedError со списком отклоненных адресов
+// Ошибка отправки возвращается как *TransientError, *PermanentError или *RateLimitedError (classifySendError)
 func (s *Service) SendEmail(ctx context.Context, msg *EmailMessage) error {
+	return classifySendError(s.sendEmail(ctx, msg))
+}
+
+// sendEmail выбирает SMTP сервер и получателей письма и отправляет его
+func (s *Service) sendEmail(ctx context.Context, msg *EmailMessage) error {
 	// Получаем тестовый email, если включен Debug режим
 	var testEmail string
-	if s.cfg.Mode.Debug {
+	if s.cfg.Mode.Debug && s.cfg.Mode.RedirectAllTo == "" {
 		testEmail = s.getTestEmail(ctx)
 		if testEmail == "" {
 			if logger.Log != nil {
@@ -86,42 +219,151 @@ func (s *Service) SendEmail(ctx context.Context, msg *EmailMessage) error {
 	// Выбираем SMTP клиент по SmtpID (индекс в массиве)
 	smtpIndex := msg.SmtpID
 	if smtpIndex < 0 || smtpIndex >= len(s.smtpClients) {
-		smtpIndex = 0 // Используем первый SMTP сервер по умолчанию
+		if !s.cfg.Mode.SMTPIDFallback {
+			return fmt.Errorf("%w: %d (настроено серверов: %d)", ErrInvalidSMTPID, msg.SmtpID, len(s.smtpClients))
+		}
+		if logger.Log != nil {
+			logger.Log.Warn("smtp_id вне диапазона настроенных серверов, используется первый SMTP сервер",
+				zap.Int64("taskID", msg.TaskID),
+				zap.Int("smtpID", msg.SmtpID),
+				zap.Int("smtpServers", len(s.smtpClients)))
+		}
+		smtpIndex = 0
 	}
 
 	smtpClient := s.smtpClients[smtpIndex]
 
-	// Получаем тело письма для отправки
-	recipientEmails := smtpClient.parseEmailAddresses(msg.EmailAddress, testEmail)
-	emailBody := smtpClient.GetEmailBody(msg, recipientEmails, s.cfg.Mode.IsBodyHTML, s.cfg.Mode.SendHiddenCopyToSelf)
+	// Определяем адреса получателей (тестовый режим или оригинальные) и отбрасываем некорректные
+	// В Debug режиме адреса TestRecipients и доменов DebugKeepDomains не перенаправляются на тестовый адрес
+	var recipientEmails []string
+	if testEmail != "" && (len(s.debugKeepDomains) > 0 || len(s.testRecipients) > 0) {
+		var redirected []string
+		recipientEmails, redirected = debugRecipients(smtpClient.parseEmailAddresses(msg.EmailAddress, ""), testEmail, s.debugKeepDomains, s.testRecipients)
+		if len(redirected) > 0 && logger.Log != nil {
+			logger.Log.Debug("Внешние получатели перенаправлены на тестовый адрес (Debug)",
+				zap.Int64("taskID", msg.TaskID),
+				zap.Strings("redirected", redirected),
+				zap.Strings("to", recipientEmails))
+		}
+	} else {
+		recipientEmails = smtpClient.parseEmailAddresses(msg.EmailAddress, testEmail)
+	}
 
-	// Извлекаем Message-ID из письма для последующей проверки bounce
-	messageID := extractMessageIDFromBody(emailBody)
-	if messageID == "" {
-		// Если не удалось извлечь, формируем как обычно
-		smtpCfg := &s.cfg.SMTP[smtpIndex]
-		messageID = fmt.Sprintf("askemailsender%d@%s", msg.TaskID, smtpCfg.Host)
+	// Перенаправление всех писем на заданные адреса (тестовые стенды без Debug режима)
+	// Исходные получатели сохраняются в заголовке X-Original-To
+	if s.cfg.Mode.RedirectAllTo != "" {
+		msg.OriginalRecipients = strings.Join(recipientEmails, ", ")
+		recipientEmails = smtpClient.parseEmailAddresses(s.cfg.Mode.RedirectAllTo, "")
+		if logger.Log != nil {
+			logger.Log.Debug("Письмо перенаправлено (RedirectAllTo)",
+				zap.Int64("taskID", msg.TaskID),
+				zap.String("originalTo", msg.OriginalRecipients),
+				zap.Strings("to", recipientEmails))
+		}
+	}
+	recipientEmails, invalidEmails := filterRecipients(recipientEmails, s.cfg.Mode.DropInvalidRecipients)
+	if len(invalidEmails) > 0 && logger.Log != nil {
+		logger.Log.Warn("Некорректные адреса получателей исключены из рассылки",
+			zap.Int64("taskID", msg.TaskID),
+			zap.Strings("invalid", invalidEmails))
 	}
 
-	// Отправляем email с параметрами из конфигурации
-	if err := smtpClient.SendEmail(ctx, msg, testEmail, s.cfg.Mode.IsBodyHTML, s.cfg.Mode.SendHiddenCopyToSelf); err != nil {
-		return fmt.Errorf("ошибка отправки через SMTP: %w", err)
+	// Проверяем, что домены получателей принимают почту (в Debug режиме адрес тестовый, проверка не нужна)
+	if s.mxChecker != nil && testEmail == "" {
+		resolved, unresolved := s.mxChecker.filter(ctx, recipientEmails)
+		if len(unresolved) > 0 {
+			if !s.cfg.Mode.DropInvalidRecipients {
+				return fmt.Errorf("%w: %s", ErrRecipientDomainNotFound, strings.Join(unresolved, ", "))
+			}
+			if logger.Log != nil {
+				logger.Log.Warn("Получатели с несуществующими почтовыми доменами исключены из рассылки",
+					zap.Int64("taskID", msg.TaskID),
+					zap.Strings("unresolved", unresolved))
+			}
+			recipientEmails = resolved
+		}
 	}
 
-	// Сохраняем информацию об отправленном письме для последующей проверки bounce
-	smtpCfg := &s.cfg.SMTP[smtpIndex]
-	// Message-ID должен совпадать с тем, что в заголовке письма
-	// В smtp.go он формируется как: <askemailsender%d@%s>
-	// Используем Message-ID, который мы уже извлекли из тела письма выше
-	// Если он не был извлечен, формируем как обычно
-	if messageID == "" {
-		messageID = fmt.Sprintf("askemailsender%d@%s", msg.TaskID, smtpCfg.Host)
+	if len(recipientEmails) == 0 {
+		return fmt.Errorf("%w (адреса: %q)", ErrNoValidRecipients, msg.EmailAddress)
+	}
+
+	// Для массовой рассылки без адресов отписки в очереди используем адреса из конфигурации
+	if msg.Bulk && msg.ListUnsubscribe == "" {
+		msg.ListUnsubscribe = strings.Trim(s.cfg.Mode.ListUnsubscribeMailto+","+s.cfg.Mode.ListUnsubscribeURL, ",")
 	}
+
+	// Помечаем автоматические письма, чтобы на них не приходили автоответы (RFC 3834)
+	switch s.autoSubmitted {
+	case AutoSubmittedAll:
+		msg.AutoSubmitted = true
+	case AutoSubmittedBulk:
+		msg.AutoSubmitted = msg.Bulk
+	}
+
+	// Проверяем HTML тело письма по списку разрешенных элементов
+	// HTML версия из очереди (email_text_html) проверяется независимо от Mode.IsBodyHTML
+	var err error
+	if s.cfg.Mode.IsBodyHTML {
+		if msg.Text, err = s.checkHTMLBody(msg.TaskID, msg.Text); err != nil {
+			return err
+		}
+	}
+	if msg.TextHTML != "" {
+		if msg.TextHTML, err = s.checkHTMLBody(msg.TaskID, msg.TextHTML); err != nil {
+			return err
+		}
+	}
+
+	// Текстовая и HTML версии тела (multipart/alternative): HTML тело Text дополняется текстовой версией
+	// при Mode.PlainTextAlternative или если текстовая версия передана в очереди (email_text_plain);
+	// без HTML версии письмо формируется из Text, как и раньше
+	if s.cfg.Mode.IsBodyHTML && (s.cfg.Mode.PlainTextAlternative || msg.TextPlain != "") && msg.TextHTML == "" {
+		msg.TextHTML = msg.Text
+	}
+	if msg.TextHTML != "" && msg.TextPlain == "" {
+		msg.TextPlain = htmlToPlainText(msg.TextHTML)
+	}
+
+	// Отправляем email с параметрами из конфигурации; при SMTPFailover, если сервер недоступен,
+	// письмо передается резервным серверам
+	sentIndex := -1
+	var sendErr error
+	for _, index := range s.failoverCandidates(smtpIndex) {
+		if sendErr != nil {
+			if !isFailoverError(sendErr) {
+				break
+			}
+			if logger.Log != nil {
+				logger.Log.Warn("SMTP сервер недоступен, письмо передается резервному серверу",
+					zap.Int64("taskID", msg.TaskID),
+					zap.String("failedHost", smtpClient.cfg.Host),
+					zap.String("host", s.smtpClients[index].cfg.Host),
+					zap.Error(sendErr))
+			}
+		}
+		smtpClient = s.smtpClients[index]
+		sendErr = smtpClient.SendEmail(ctx, msg, recipientEmails, s.cfg.Mode.IsBodyHTML, s.cfg.Mode.SendHiddenCopyToSelf)
+		if sendErr == nil || isRecipientsPartiallyRejected(sendErr) {
+			sentIndex = index
+			break
+		}
+	}
+	if sentIndex < 0 {
+		return fmt.Errorf("ошибка отправки через SMTP: %w", sendErr)
+	}
+
+	// Message-ID письма для последующей проверки bounce (письмо целиком заранее не формируется)
+	messageID := smtpClient.messageID(msg.TaskID)
+
+	// Сохраняем информацию об отправленном письме для последующей проверки bounce
+	// Message-ID и SmtpID относятся к серверу, который фактически принял письмо:
+	// bounce ищется в ящике этого сервера
 	sentInfo := &SentEmailInfo{
 		TaskID:    msg.TaskID,
-		SmtpID:    msg.SmtpID,
+		SmtpID:    sentIndex,
 		MessageID: messageID,
-		SendTime:  time.Now(),
+		SendTime:  s.clock.Now(),
 	}
 
 	if logger.Log != nil {
@@ -133,6 +375,60 @@ func (s *Service) SendEmail(ctx context.Context, msg *EmailMessage) error {
 	// Планируем проверку статуса через 30 секунд
 	s.statusChecker.ScheduleCheck(sentInfo)
 
+	// Письмо отправлено, но часть получателей отклонена сервером (*RecipientsRejectedError)
+	return sendErr
+}
+
+// isRecipientsPartiallyRejected проверяет, что письмо принято сервером для части получателей,
+// а остальные адреса отклонены
+func isRecipientsPartiallyRejected(err error) bool {
+	var rejectedErr *RecipientsRejectedError
+	return errors.As(err, &rejectedErr) && rejectedErr.Accepted > 0
+}
+
+// checkHTMLBody проверяет HTML тело письма по списку разрешенных элементов (Mode.HTMLSanitizePolicy)
+// Возвращает очищенное тело или ErrHTMLRejected, если политика запрещает отправку такого письма
+func (s *Service) checkHTMLBody(taskID int64, body string) (string, error) {
+	if s.htmlPolicy == HTMLPolicyOff {
+		return body, nil
+	}
+	sanitized, removed := sanitizeHTML(body)
+	if len(removed) == 0 {
+		return body, nil
+	}
+	if s.htmlPolicy == HTMLPolicyReject {
+		return "", fmt.Errorf("%w: %s", ErrHTMLRejected, strings.Join(removed, ", "))
+	}
+	if logger.Log != nil {
+		logger.Log.Warn("Из HTML тела письма удалены недопустимые элементы",
+			zap.Int64("taskID", taskID),
+			zap.Strings("removed", removed))
+	}
+	return sanitized, nil
+}
+
+// SendNotification отправляет служебное письмо (например, операторам) через указанный SMTP сервер
+// В отличие от SendEmail не подменяет адрес в Debug режиме и не планирует проверку статуса доставки
+func (s *Service) SendNotification(ctx context.Context, smtpID int, emailAddress, title, text string) error {
+	if smtpID < 0 || smtpID >= len(s.smtpClients) {
+		smtpID = 0
+	}
+	smtpClient := s.smtpClients[smtpID]
+
+	recipientEmails, _ := filterRecipients(smtpClient.parseEmailAddresses(emailAddress, ""), true)
+	if len(recipientEmails) == 0 {
+		return fmt.Errorf("%w (адреса: %q)", ErrNoValidRecipients, emailAddress)
+	}
+
+	msg := &EmailMessage{
+		SmtpID:       smtpID,
+		EmailAddress: emailAddress,
+		Title:        title,
+		Text:         text,
+	}
+	if err := smtpClient.SendEmail(ctx, msg, recipientEmails, false, false); err != nil {
+		return classifySendError(fmt.Errorf("ошибка отправки через SMTP: %w", err))
+	}
 	return nil
 }
 
@@ -140,7 +436,7 @@ func (s *Service) SendEmail(ctx context.Context, msg *EmailMessage) error {
 func (s *Service) getTestEmail(ctx context.Context) string {
 	s.testEmailMu.RLock()
 	// Проверяем кеш
-	if s.testEmail != "" && time.Since(s.testEmailCacheTime) < s.testEmailCacheTTL {
+	if s.testEmail != "" && clock.Since(s.clock, s.testEmailCacheTime) < s.testEmailCacheTTL {
 		cachedEmail := s.testEmail
 		s.testEmailMu.RUnlock()
 		return cachedEmail
@@ -160,17 +456,32 @@ func (s *Service) getTestEmail(ctx context.Context) string {
 	// Обновляем кеш
 	s.testEmailMu.Lock()
 	s.testEmail = testEmail
-	s.testEmailCacheTime = time.Now()
+	s.testEmailCacheTime = s.clock.Now()
 	s.testEmailMu.Unlock()
 
 	return testEmail
 }
 
+// ExpandAttachment раскрывает шаблон имени файла во вложении типа 3 в список вложений
+func (s *Service) ExpandAttachment(ctx context.Context, attach *Attachment) ([]Attachment, error) {
+	return s.attachmentProcessor.ExpandAttachment(ctx, attach)
+}
+
 // ProcessAttachment обрабатывает вложение и возвращает данные для отправки
 func (s *Service) ProcessAttachment(ctx context.Context, attach *Attachment, taskID int64) (*AttachmentData, error) {
 	return s.attachmentProcessor.ProcessAttachment(ctx, attach, taskID)
 }
 
+// EmptyReportAllowed сообщает, что письмо можно отправить без пустого отчета Crystal Reports (ErrEmptyReport)
+// с пометкой в тексте; поведение задается атрибутом email_attach_empty или CrystalReportsEmptyPolicy
+func (s *Service) EmptyReportAllowed(attach *Attachment) bool {
+	policy := attach.EmptyPolicy
+	if policy == "" {
+		policy = s.emptyReportPolicy
+	}
+	return policy == EmptyReportNote
+}
+
 // EmailMessage представляет email сообщение для отправки
 type EmailMessage struct {
 	TaskID       int64
@@ -179,25 +490,71 @@ type EmailMessage struct {
 	Title        string
 	Text         string
 	Attachments  []AttachmentData
+
+	Bulk            bool   // Массовая рассылка (добавляются заголовки List-Unsubscribe)
+	ListUnsubscribe string // Адреса отписки (URL и/или mailto через запятую), пусто - из конфигурации
+	AutoSubmitted   bool   // Автоматическое письмо (добавляются заголовки Precedence: bulk и Auto-Submitted)
+
+	// Текстовая и HTML версии тела; если заданы обе, письмо формируется как multipart/alternative,
+	// иначе используется Text (HTML или текст в зависимости от Mode.IsBodyHTML)
+	TextPlain string
+	TextHTML  string
+
+	// Исходные получатели при перенаправлении (Mode.RedirectAllTo), записываются в заголовок X-Original-To
+	OriginalRecipients string
+
+	// Дополнительные заголовки из очереди (проверены при разборе сообщения)
+	CustomHeaders map[string]string
+
+	// Язык тела письма (Content-Language текстовых частей), пусто - заголовок не добавляется
+	Language string
 }
 
 // AttachmentData представляет данные вложения
 type AttachmentData struct {
 	FileName string
 	Data     []byte
+	// Файл во временном каталоге, если данные буферизованы на диск (Mode.AttachmentStagingDir);
+	// в этом случае Data пустой, а файл удаляется через Release после отправки
+	Path string
+	size int
+	// Встроенное изображение HTML тела (multipart/related) с Content-ID для ссылок cid:;
+	// пустой ContentID назначается при формировании письма
+	Inline    bool
+	ContentID string
 }
 
-// extractMessageIDFromBody извлекает Message-ID из тела письма
-func extractMessageIDFromBody(emailBody string) string {
-	lines := strings.Split(emailBody, "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(strings.ToLower(line), "message-id:") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
-				return strings.TrimSpace(parts[1])
-			}
-		}
+// Len возвращает размер данных вложения
+func (a AttachmentData) Len() int {
+	if a.Path != "" {
+		return a.size
+	}
+	return len(a.Data)
+}
+
+// Open открывает данные вложения для чтения (из памяти или из временного файла)
+func (a AttachmentData) Open() (io.ReadCloser, error) {
+	if a.Path != "" {
+		return os.Open(a.Path)
+	}
+	return io.NopCloser(bytes.NewReader(a.Data)), nil
+}
+
+// Release удаляет временный файл вложения, буферизованного на диск
+func (a AttachmentData) Release() {
+	if a.Path == "" {
+		return
+	}
+	if err := os.Remove(a.Path); err != nil && !os.IsNotExist(err) && logger.Log != nil {
+		logger.Log.Warn("Не удалось удалить временный файл вложения",
+			zap.String("path", a.Path),
+			zap.Error(err))
+	}
+}
+
+// ReleaseAttachments удаляет временные файлы вложений после отправки письма (успешной или нет)
+func ReleaseAttachments(attachments []AttachmentData) {
+	for _, attach := range attachments {
+		attach.Release()
 	}
-	return ""
 }
@@ -0,0 +1,124 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"email-service/settings"
+)
+
+func TestSendEmailInvalidSMTPID(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback bool
+		smtpID   int
+		wantErr  error
+		wantSent [2]int // Писем, принятых первым и вторым сервером
+	}{
+		{"корректный smtp_id", false, 1, nil, [2]int{0, 1}},
+		{"вне диапазона без fallback", false, 2, ErrInvalidSMTPID, [2]int{0, 0}},
+		{"отрицательный без fallback", false, -1, ErrInvalidSMTPID, [2]int{0, 0}},
+		{"вне диапазона с fallback", true, 2, nil, [2]int{1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servers := [2]*fakeSMTPServer{newFakeSMTPServer(t), newFakeSMTPServer(t)}
+			cfg := &settings.Config{}
+			cfg.Mode.SMTPIDFallback = tt.fallback
+			for _, server := range servers {
+				cfg.SMTP = append(cfg.SMTP, settings.SMTPConfig{Host: "127.0.0.1", Port: server.port(), User: "sender@example.com"})
+			}
+			s, err := NewService(cfg, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			msg := &EmailMessage{TaskID: 1, SmtpID: tt.smtpID, EmailAddress: "user@example.org", Text: "текст"}
+			err = s.SendEmail(context.Background(), msg)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("ошибка %v, ожидалась %v", err, tt.wantErr)
+			}
+			sent := [2]int{len(servers[0].acceptedRecipients()), len(servers[1].acceptedRecipients())}
+			if !reflect.DeepEqual(sent, tt.wantSent) {
+				t.Errorf("серверы приняли %v писем, ожидалось %v", sent, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestSendEmailAlternativeBodies(t *testing.T) {
+	const html = "<p>HTML версия</p>"
+	tests := []struct {
+		name       string
+		isBodyHTML bool
+		msg        EmailMessage
+		want       string
+		wantText   string // Текст, который должен быть в письме
+	}{
+		{"обе версии из очереди", false,
+			EmailMessage{Text: "текст", TextPlain: "Текстовая версия", TextHTML: html},
+			"multipart/alternative[text/plain,text/html]", "Текстовая версия"},
+		{"текстовая версия к HTML телу", true,
+			EmailMessage{Text: html, TextPlain: "Текстовая версия"},
+			"multipart/alternative[text/plain,text/html]", "Текстовая версия"},
+		{"текстовая версия из HTML версии", false,
+			EmailMessage{Text: "текст", TextHTML: html},
+			"multipart/alternative[text/plain,text/html]", "\r\nHTML версия\r\n"},
+		{"текстовая версия без HTML", false,
+			EmailMessage{Text: "текст", TextPlain: "Текстовая версия"},
+			"text/plain", "текст"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t)
+			cfg := &settings.Config{SMTP: []settings.SMTPConfig{{Host: "127.0.0.1", Port: server.port(), User: "sender@example.com"}}}
+			cfg.Mode.IsBodyHTML = tt.isBodyHTML
+			s, err := NewService(cfg, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			msg := tt.msg
+			msg.TaskID, msg.EmailAddress = 1, "user@example.org"
+			if err := s.SendEmail(context.Background(), &msg); err != nil {
+				t.Fatal(err)
+			}
+			messages := server.acceptedMessages()
+			if len(messages) != 1 {
+				t.Fatalf("сервер принял %d писем", len(messages))
+			}
+			if got := mimeStructure(t, messages[0]); got != tt.want {
+				t.Errorf("структура письма %s, ожидалось %s", got, tt.want)
+			}
+			if !strings.Contains(messages[0], tt.wantText) {
+				t.Errorf("письмо не содержит %q:\n%s", tt.wantText, messages[0])
+			}
+		})
+	}
+}
+
+func TestSendEmailRejectsUnsafeHTMLVersion(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	cfg := &settings.Config{SMTP: []settings.SMTPConfig{{Host: "127.0.0.1", Port: server.port(), User: "sender@example.com"}}}
+	cfg.Mode.HTMLSanitizePolicy = "reject"
+	s, err := NewService(cfg, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// HTML версия из очереди проверяется и при IsBodyHTML = False
+	msg := &EmailMessage{TaskID: 1, EmailAddress: "user@example.org", Text: "текст",
+		TextHTML: `<p>Счет</p><script>alert(1)</script>`}
+	if err := s.SendEmail(context.Background(), msg); !errors.Is(err, ErrHTMLRejected) {
+		t.Fatalf("ошибка %v, ожидалась ErrHTMLRejected", err)
+	}
+	if n := len(server.acceptedMessages()); n != 0 {
+		t.Errorf("сервер принял %d писем", n)
+	}
+}
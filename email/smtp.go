@@ -4,27 +4,149 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"mime"
-	"net"
+	"net/mail"
 	"net/smtp"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
+	"email-service/clock"
 	"email-service/logger"
 	"email-service/settings"
 )
 
+// ErrNoValidRecipients возвращается, если после фильтрации не осталось ни одного получателя
+var ErrNoValidRecipients = errors.New("все получатели отфильтрованы или невалидны")
+
 // SMTPClient представляет SMTP клиент для отправки email
 type SMTPClient struct {
-	cfg           *settings.SMTPConfig
-	lastSendTime  time.Time
+	cfg *settings.SMTPConfig
+
+	// Состояние ограничения частоты отправки; mu защищает только его,
+	// сами отправки выполняются параллельно, каждая в своем соединении
+	lastSendTime  time.Time            // Время, раньше которого не может начаться следующая отправка
 	lastEmailTime map[string]time.Time // Ключ - email адрес
 	mu            sync.Mutex
+
+	// Максимальный размер изображения, встраиваемого в HTML тело через CID (0 - не встраивать)
+	inlineImageMaxSize int
+
+	// Значение заголовка X-Mailer (пусто - заголовок не добавляется)
+	xMailer string
+
+	// Генератор MIME boundary (подменяется для получения детерминированного письма)
+	boundary BoundaryGenerator
+
+	// Расширения, объявленные сервером при последнем подключении (обновляются при каждом подключении)
+	caps   smtpCapabilities
+	capsMu sync.RWMutex
+
+	// Открытые соединения для повторного использования (ConnectionPoolSize > 0)
+	pool smtpPool
+
+	// Источник времени для ограничения частоты, пауз между повторами и простоя соединений
+	clock clock.Clock
+
+	// Запись протокола обмена с сервером для отладки (SMTPTranscriptOff, Log или File)
+	transcriptMode string
+	transcriptDir  string
+
+	// Клиентский сертификат для mTLS (TLSClientCertFile), загружается при первой отправке
+	clientCert   *tls.Certificate
+	clientCertMu sync.Mutex
+}
+
+// ErrMessageTooLarge возвращается, если размер письма превышает лимит SIZE, объявленный SMTP сервером
+var ErrMessageTooLarge = errors.New("размер письма превышает лимит SMTP сервера (SIZE)")
+
+// smtpCapabilities - расширения, объявленные SMTP сервером в ответе EHLO
+type smtpCapabilities struct {
+	Known      bool      // Расширения уже получены хотя бы одним подключением
+	Pipelining bool      // PIPELINING (RFC 2920)
+	StartTLS   bool      // STARTTLS
+	Auth       string    // Поддерживаемые механизмы AUTH
+	Size       int64     // Максимальный размер письма (SIZE), 0 - не объявлен
+	UTF8       bool      // SMTPUTF8
+	UpdatedAt  time.Time // Время получения расширений
+}
+
+// readCapabilities считывает расширения из ответа EHLO текущего соединения
+// net/smtp выполняет EHLO один раз на соединение и кеширует ответ, повторных запросов к серверу нет
+func readCapabilities(client *smtp.Client) smtpCapabilities {
+	caps := smtpCapabilities{Known: true, UpdatedAt: time.Now()}
+	caps.Pipelining, _ = client.Extension("PIPELINING")
+	caps.StartTLS, _ = client.Extension("STARTTLS")
+	caps.UTF8, _ = client.Extension("SMTPUTF8")
+	if ok, mechanisms := client.Extension("AUTH"); ok {
+		caps.Auth = mechanisms
+	}
+	if ok, size := client.Extension("SIZE"); ok {
+		if n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64); err == nil && n > 0 {
+			caps.Size = n
+		}
+	}
+	return caps
+}
+
+// capabilities возвращает расширения сервера, полученные при последнем подключении
+func (c *SMTPClient) capabilities() smtpCapabilities {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return c.caps
+}
+
+// setCapabilities сохраняет расширения сервера, полученные при подключении
+func (c *SMTPClient) setCapabilities(caps smtpCapabilities) {
+	c.capsMu.Lock()
+	changed := c.caps.Known && (c.caps.Pipelining != caps.Pipelining || c.caps.Size != caps.Size || c.caps.Auth != caps.Auth)
+	c.caps = caps
+	c.capsMu.Unlock()
+
+	if changed && logger.Log != nil {
+		logger.Log.Info("Изменились расширения SMTP сервера",
+			zap.String("host", c.cfg.Host),
+			zap.Bool("pipelining", caps.Pipelining),
+			zap.Int64("size", caps.Size),
+			zap.String("auth", caps.Auth))
+	}
+}
+
+// checkMessageSize проверяет размер письма по лимиту SIZE, объявленному сервером
+func checkMessageSize(caps smtpCapabilities, size int64) error {
+	if caps.Size > 0 && size > caps.Size {
+		return fmt.Errorf("%w: %d байт, лимит %d байт", ErrMessageTooLarge, size, caps.Size)
+	}
+	return nil
+}
+
+// messageWriter записывает письмо целиком в поток (DATA транзакции)
+type messageWriter func(w io.Writer) error
+
+// messageSize вычисляет размер письма, формируя его без сохранения данных
+func messageSize(writeBody messageWriter) (int64, error) {
+	var counter countingWriter
+	if err := writeBody(&counter); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// BoundaryGenerator формирует MIME boundary для части письма
+// kind - вид части (boundary для multipart/mixed, related для multipart/related)
+type BoundaryGenerator func(kind string, taskID int64) string
+
+// defaultBoundary формирует boundary из вида части, taskID и текущего времени
+func defaultBoundary(kind string, taskID int64) string {
+	return fmt.Sprintf("%s_%d_%d", kind, taskID, time.Now().Unix())
 }
 
 // NewSMTPClient создает новый SMTP клиент
@@ -32,30 +154,60 @@ func NewSMTPClient(cfg *settings.SMTPConfig) *SMTPClient {
 	return &SMTPClient{
 		cfg:           cfg,
 		lastEmailTime: make(map[string]time.Time),
+		boundary:      defaultBoundary,
+		pool:          smtpPool{stop: make(chan struct{})},
+		clock:         clock.Real,
 	}
 }
 
-// SendEmail отправляет email через SMTP
-func (c *SMTPClient) SendEmail(ctx context.Context, msg *EmailMessage, testEmail string, isBodyHTML bool, sendHiddenCopyToSelf bool) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// SetClock устанавливает источник времени (nil - системные часы)
+func (c *SMTPClient) SetClock(clk clock.Clock) {
+	if clk == nil {
+		clk = clock.Real
+	}
+	c.clock = clk
+}
 
-	// Проверяем ограничение частоты отправки
-	now := time.Now()
-	if c.cfg.MinSendIntervalMsec > 0 {
-		waitCount := 0
-		for c.lastSendTime.After(now) && waitCount < 100 {
-			time.Sleep(50 * time.Millisecond)
-			now = time.Now()
-			waitCount++
-		}
+// SetBoundaryGenerator устанавливает генератор MIME boundary (nil - генератор по умолчанию)
+func (c *SMTPClient) SetBoundaryGenerator(gen BoundaryGenerator) {
+	if gen == nil {
+		gen = defaultBoundary
+	}
+	c.boundary = gen
+}
+
+// SetInlineImageMaxSize устанавливает максимальный размер изображения (в байтах) для встраивания в HTML тело
+func (c *SMTPClient) SetInlineImageMaxSize(size int) {
+	c.inlineImageMaxSize = size
+}
+
+// SetXMailer устанавливает значение заголовка X-Mailer (пусто - заголовок не добавляется)
+// Переводы строк заменяются пробелами, чтобы значение не могло добавить в письмо другие заголовки
+func (c *SMTPClient) SetXMailer(value string) {
+	c.xMailer = strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(value))
+}
+
+// SendEmail отправляет email через SMTP на уже отфильтрованный список получателей
+// Если сервер отклонил часть получателей, письмо передается остальным и возвращается *RecipientsRejectedError
+func (c *SMTPClient) SendEmail(ctx context.Context, msg *EmailMessage, recipientEmails []string, isBodyHTML bool, sendHiddenCopyToSelf bool) error {
+	if len(recipientEmails) == 0 {
+		return ErrNoValidRecipients
 	}
 
-	// Определяем адреса получателей (тестовый режим или оригинальные)
-	recipientEmails := c.parseEmailAddresses(msg.EmailAddress, testEmail)
+	// Проверяем ограничение частоты отправки
+	if err := c.waitSendSlot(ctx); err != nil {
+		return err
+	}
 
-	// Формируем сообщение
-	emailBody := c.buildEmailMessage(msg, recipientEmails, isBodyHTML, sendHiddenCopyToSelf)
+	// Письмо формируется заново при передаче в каждой транзакции и не хранится в памяти целиком;
+	// заранее вычисляется только его размер
+	writeBody := func(w io.Writer) error {
+		return c.writeEmailMessage(w, msg, recipientEmails, isBodyHTML, sendHiddenCopyToSelf)
+	}
+	size, err := messageSize(writeBody)
+	if err != nil {
+		return fmt.Errorf("ошибка формирования письма: %w", err)
+	}
 
 	// Подключаемся к SMTP серверу с reconnect логикой
 	addr := fmt.Sprintf("%s:%d", c.cfg.Host, c.cfg.Port)
@@ -65,62 +217,73 @@ func (c *SMTPClient) SendEmail(ctx context.Context, msg *EmailMessage, testEmail
 	}
 
 	// Создаем TLS конфигурацию
-	tlsConfig := &tls.Config{
-		ServerName:         c.cfg.Host,
-		InsecureSkipVerify: false,
+	tlsConfig := newTLSConfig(c.cfg, c.tlsServerName())
+	if err := c.applyClientCertificate(tlsConfig); err != nil {
+		return fmt.Errorf("ошибка отправки email: %w", err)
 	}
 
-	// Отправляем email с повторной попыткой при таймауте и сетевых ошибках
-	var err error
-	const maxAttempts = 3
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		err = c.sendWithTLS(ctx, addr, auth, tlsConfig, msg, recipientEmails, emailBody)
-		if err == nil {
-			break
-		}
-
-		// Проверяем на ошибки, при которых стоит повторить попытку
-		errStr := strings.ToLower(err.Error())
-		shouldRetry := false
-		if strings.Contains(errStr, "smtp command timeout") {
-			shouldRetry = true
-		} else if strings.Contains(errStr, "connection reset") {
-			shouldRetry = true
-		} else if strings.Contains(errStr, "eof") {
-			shouldRetry = true
-		} else if strings.Contains(errStr, "broken pipe") {
-			shouldRetry = true
-		} else if strings.Contains(errStr, "temporary failure") {
-			shouldRetry = true
-		}
+	// Письмо больше лимита SIZE, известного по предыдущему подключению, не отправляем
+	if err := checkMessageSize(c.capabilities(), size); err != nil {
+		return fmt.Errorf("ошибка отправки email: %w", err)
+	}
 
-		if shouldRetry {
-			if logger.Log != nil {
-				logger.Log.Warn("Временная ошибка SMTP, повторная попытка",
-					zap.Int64("taskID", msg.TaskID),
-					zap.Int("attempt", attempt+1),
-					zap.String("error", err.Error()))
+	// Разбиваем получателей на транзакции и соединения согласно ограничениям провайдера
+	connections := batchRecipients(recipientEmails, c.cfg.MaxRecipientsPerTransaction, c.cfg.MaxTransactionsPerConnection)
+	sentCount := 0
+	var rejected []RejectedRecipient
+	for _, transactions := range connections {
+		sent, connRejected, err := c.sendWithRetry(ctx, addr, auth, tlsConfig, msg, transactions, writeBody, size)
+		sentCount += sent
+		if err != nil {
+			if sentCount > 0 {
+				if logger.Log != nil {
+					logger.Log.Warn("Письмо доставлено на SMTP сервер не всем получателям",
+						zap.Int64("taskID", msg.TaskID),
+						zap.Int("sent", sentCount),
+						zap.Int("total", len(recipientEmails)))
+				}
+				return fmt.Errorf("ошибка отправки email: %w (%d из %d): %w", ErrPartialDelivery, sentCount, len(recipientEmails), err)
 			}
-			// Небольшая пауза перед повтором
-			time.Sleep(time.Duration(attempt+1) * time.Second)
-			continue
+			return fmt.Errorf("ошибка отправки email: %w", err)
 		}
-		// Другие ошибки - не повторяем
-		break
+		rejected = append(rejected, connRejected...)
 	}
 
-	if err != nil {
-		return fmt.Errorf("ошибка отправки email: %w", err)
+	// Получатели, отклоненные сервером, письмо не получили
+	accepted := recipientEmails
+	if len(rejected) > 0 {
+		rejectedSet := make(map[string]bool, len(rejected))
+		for _, r := range rejected {
+			rejectedSet[r.Address] = true
+		}
+		accepted = make([]string, 0, len(recipientEmails)-len(rejected))
+		for _, emailAddr := range recipientEmails {
+			if !rejectedSet[emailAddr] {
+				accepted = append(accepted, emailAddr)
+			}
+		}
+		if len(accepted) == 0 {
+			return fmt.Errorf("ошибка отправки email: %w", &RecipientsRejectedError{Rejected: rejected})
+		}
 	}
 
-	// Обновляем время последней отправки
-	if c.cfg.MinSendIntervalMsec > 0 {
-		c.lastSendTime = time.Now().Add(time.Duration(c.cfg.MinSendIntervalMsec) * time.Millisecond)
+	// Обновляем время последней отправки для каждого адреса
+	c.mu.Lock()
+	now := c.clock.Now()
+	for _, emailAddr := range accepted {
+		c.lastEmailTime[emailAddr] = now
 	}
+	c.mu.Unlock()
 
-	// Обновляем время последней отправки для каждого адреса
-	for _, emailAddr := range recipientEmails {
-		c.lastEmailTime[emailAddr] = time.Now()
+	if len(rejected) > 0 {
+		if logger.Log != nil {
+			logger.Log.Warn("Email отправлен не всем получателям: часть адресов отклонена SMTP сервером",
+				zap.Int64("taskID", msg.TaskID),
+				zap.Strings("to", accepted),
+				zap.Int("rejected", len(rejected)),
+				zap.String("subject", msg.Title))
+		}
+		return &RecipientsRejectedError{Rejected: rejected, Accepted: len(accepted)}
 	}
 
 	if logger.Log != nil {
@@ -133,9 +296,155 @@ func (c *SMTPClient) SendEmail(ctx context.Context, msg *EmailMessage, testEmail
 	return nil
 }
 
+// waitSendSlot резервирует время начала отправки с учетом MinSendIntervalMsec и ждет его наступления
+// Резервирование выполняется под блокировкой, поэтому параллельные отправки через один клиент
+// начинаются не чаще одной за интервал, а ожидание и сама отправка идут без блокировки
+func (c *SMTPClient) waitSendSlot(ctx context.Context) error {
+	if c.cfg.MinSendIntervalMsec <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	start := c.clock.Now()
+	if c.lastSendTime.After(start) {
+		start = c.lastSendTime
+	}
+	c.lastSendTime = start.Add(time.Duration(c.cfg.MinSendIntervalMsec) * time.Millisecond)
+	c.mu.Unlock()
+
+	wait := start.Sub(c.clock.Now())
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-c.clock.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tlsServerName возвращает имя для SNI и проверки сертификата сервера
+// TLSServerName задается, если подключение идет по IP или через relay, а сертификат выдан на другое имя
+func (c *SMTPClient) tlsServerName() string {
+	if c.cfg.TLSServerName != "" {
+		return c.cfg.TLSServerName
+	}
+	return c.cfg.Host
+}
+
+// sendWithRetry передает письмо в одном соединении с повторной попыткой при таймауте и сетевых ошибках
+// transactions - получатели, разбитые по SMTP транзакциям. Транзакции, уже принятые сервером, при повторе
+// не передаются, иначе их получатели получили бы письмо дважды
+// Возвращает число получателей в принятых транзакциях и получателей, отклоненных сервером
+// Количество повторов, пауза и признаки временных ошибок задаются параметрами SMTPMaxRetries,
+// SMTPRetryBackoffMsec, SMTPRetryExponential, SMTPRetryJitter и SMTPRetryErrors сервера
+func (c *SMTPClient) sendWithRetry(ctx context.Context, addr string, auth smtp.Auth, tlsConfig *tls.Config, msg *EmailMessage, transactions [][]string, writeBody messageWriter, size int64) (int, []RejectedRecipient, error) {
+	var rejected []RejectedRecipient
+	var err error
+	sent := 0
+	maxAttempts := max(c.cfg.SMTPMaxRetries, 0) + 1
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var committed int
+		var txRejected []RejectedRecipient
+		committed, txRejected, err = c.sendWithTLS(ctx, addr, auth, tlsConfig, msg, transactions, writeBody, size)
+		rejected = append(rejected, txRejected...)
+		for _, batch := range transactions[:committed] {
+			sent += len(batch)
+		}
+		transactions = transactions[committed:]
+		if err == nil || !c.isRetryableError(err) || attempt == maxAttempts-1 {
+			break
+		}
+
+		delay := c.retryDelay(attempt)
+		if logger.Log != nil {
+			logger.Log.Warn("Временная ошибка SMTP, повторная попытка",
+				zap.Int64("taskID", msg.TaskID),
+				zap.Int("attempt", attempt+1),
+				zap.Int("remainingTransactions", len(transactions)),
+				zap.Duration("nextRetryIn", delay),
+				zap.String("error", err.Error()))
+		}
+		select {
+		case <-c.clock.After(delay):
+		case <-ctx.Done():
+			return sent, rejected, err
+		}
+	}
+
+	return sent, rejected, err
+}
+
+// isRetryableError проверяет, является ли ошибка временной: по коду ответа сервера (4xx - временный отказ,
+// 5xx - постоянный), для остальных ошибок - по подстрокам SMTPRetryErrors
+func (c *SMTPClient) isRetryableError(err error) bool {
+	var replyErr *SMTPReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Transient()
+	}
+	errStr := strings.ToLower(err.Error())
+	for _, pattern := range c.cfg.SMTPRetryErrors {
+		if pattern != "" && strings.Contains(errStr, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay возвращает паузу перед повтором после попытки attempt (с нуля):
+// SMTPRetryBackoffMsec * (attempt+1) или, при SMTPRetryExponential, SMTPRetryBackoffMsec * 2^attempt;
+// при SMTPRetryJitter пауза случайно уменьшается до 50%, чтобы повторы разных писем не совпадали
+func (c *SMTPClient) retryDelay(attempt int) time.Duration {
+	base := time.Duration(c.cfg.SMTPRetryBackoffMsec) * time.Millisecond
+	if base <= 0 {
+		return 0
+	}
+	delay := base * time.Duration(attempt+1)
+	if c.cfg.SMTPRetryExponential {
+		delay = base << min(attempt, 16)
+	}
+	if c.cfg.SMTPRetryJitter {
+		delay -= time.Duration(rand.Int64N(int64(delay)/2 + 1))
+	}
+	return delay
+}
+
+// batchRecipients разбивает получателей на SMTP транзакции (не более perTransaction получателей)
+// и группирует транзакции по соединениям (не более perConnection транзакций)
+// Нулевые и отрицательные лимиты означают отсутствие ограничения
+func batchRecipients(recipients []string, perTransaction, perConnection int) [][][]string {
+	if perTransaction <= 0 {
+		perTransaction = len(recipients)
+	}
+	var transactions [][]string
+	for start := 0; start < len(recipients); start += perTransaction {
+		end := min(start+perTransaction, len(recipients))
+		transactions = append(transactions, recipients[start:end])
+	}
+
+	if perConnection <= 0 {
+		perConnection = len(transactions)
+	}
+	var connections [][][]string
+	for start := 0; start < len(transactions); start += perConnection {
+		end := min(start+perConnection, len(transactions))
+		connections = append(connections, transactions[start:end])
+	}
+	return connections
+}
+
 // GetEmailBody возвращает тело письма для сохранения в папку Sent
+// Письмо целиком размещается в памяти; для больших вложений следует использовать WriteEmailBody
 func (c *SMTPClient) GetEmailBody(msg *EmailMessage, recipientEmails []string, isBodyHTML bool, sendHiddenCopyToSelf bool) string {
-	return c.buildEmailMessage(msg, recipientEmails, isBodyHTML, sendHiddenCopyToSelf)
+	var body strings.Builder
+	c.writeEmailMessage(&body, msg, recipientEmails, isBodyHTML, sendHiddenCopyToSelf)
+	return body.String()
+}
+
+// WriteEmailBody записывает тело письма в w потоком (например, во временный файл для папки Sent)
+func (c *SMTPClient) WriteEmailBody(w io.Writer, msg *EmailMessage, recipientEmails []string, isBodyHTML bool, sendHiddenCopyToSelf bool) error {
+	return c.writeEmailMessage(w, msg, recipientEmails, isBodyHTML, sendHiddenCopyToSelf)
 }
 
 // parseEmailAddresses парсит email адреса с поддержкой разделителей ; и ,
@@ -162,6 +471,46 @@ func (c *SMTPClient) parseEmailAddresses(emailAddresses string, testEmail string
 	return result
 }
 
+// filterRecipients отделяет синтаксически корректные адреса от некорректных
+// Если dropInvalid = false, все адреса считаются корректными (проверку выполнит SMTP сервер)
+func filterRecipients(addresses []string, dropInvalid bool) (valid []string, invalid []string) {
+	if !dropInvalid {
+		return addresses, nil
+	}
+
+	valid = make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil || parsed.Address != addr {
+			invalid = append(invalid, addr)
+			continue
+		}
+		valid = append(valid, addr)
+	}
+	return valid, invalid
+}
+
+// messageID формирует Message-ID письма (без угловых скобок)
+// При HideInternalHost вместо хоста SMTP сервера используется нейтральный внешний домен
+func (c *SMTPClient) messageID(taskID int64) string {
+	return fmt.Sprintf("askemailsender%d@%s", taskID, c.messageIDDomain())
+}
+
+// messageIDDomain возвращает домен для Message-ID и других заголовков, ссылающихся на отправителя
+func (c *SMTPClient) messageIDDomain() string {
+	if !c.cfg.HideInternalHost {
+		return c.cfg.Host
+	}
+	if c.cfg.PublicDomain != "" {
+		return c.cfg.PublicDomain
+	}
+	// По умолчанию используем домен адреса отправителя, он и так виден получателю
+	if at := strings.LastIndex(c.cfg.User, "@"); at != -1 && at < len(c.cfg.User)-1 {
+		return c.cfg.User[at+1:]
+	}
+	return "localhost.localdomain"
+}
+
 // encodeHeader кодирует заголовок по RFC 2047 для не-ASCII символов
 func encodeHeader(text string) string {
 	if text == "" {
@@ -185,8 +534,10 @@ func encodeHeader(text string) string {
 	return mime.QEncoding.Encode("UTF-8", text)
 }
 
-// buildEmailMessage формирует тело email сообщения с поддержкой вложений
-func (c *SMTPClient) buildEmailMessage(msg *EmailMessage, recipientEmails []string, isBodyHTML bool, sendHiddenCopyToSelf bool) string {
+// writeEmailMessage записывает email сообщение с поддержкой вложений в w
+// Письмо формируется потоком: данные вложений кодируются в Base64 непосредственно при записи,
+// поэтому память не зависит от размера вложений
+func (c *SMTPClient) writeEmailMessage(w io.Writer, msg *EmailMessage, recipientEmails []string, isBodyHTML bool, sendHiddenCopyToSelf bool) error {
 	// Формируем основные заголовки
 	// Кодируем DisplayName если он не пустой
 	fromHeader := c.cfg.User
@@ -199,6 +550,10 @@ func (c *SMTPClient) buildEmailMessage(msg *EmailMessage, recipientEmails []stri
 	// To: адреса
 	toHeader := strings.Join(recipientEmails, ", ")
 	headers += fmt.Sprintf("To: %s\r\n", toHeader)
+	if msg.OriginalRecipients != "" {
+		originalTo := strings.NewReplacer("\r", " ", "\n", " ").Replace(msg.OriginalRecipients)
+		headers += fmt.Sprintf("X-Original-To: %s\r\n", originalTo)
+	}
 
 	// BCC: скрытая копия себе (если включено)
 	if sendHiddenCopyToSelf {
@@ -212,9 +567,30 @@ func (c *SMTPClient) buildEmailMessage(msg *EmailMessage, recipientEmails []stri
 	}
 	encodedSubject := encodeHeader(subject)
 	headers += fmt.Sprintf("Subject: %s\r\n", encodedSubject)
-	headers += fmt.Sprintf("Message-ID: <%s@%s>\r\n", fmt.Sprintf("askemailsender%d", msg.TaskID), c.cfg.Host)
-	headers += fmt.Sprintf("Return-Path: <%s>\r\n", c.cfg.User)
+	headers += fmt.Sprintf("Message-ID: <%s>\r\n", c.messageID(msg.TaskID))
+	headers += fmt.Sprintf("Return-Path: <%s>\r\n", envelopeFrom(c.cfg))
+	if msg.Bulk {
+		headers += listUnsubscribeHeaders(msg.ListUnsubscribe)
+	}
+	if msg.AutoSubmitted {
+		headers += "Precedence: bulk\r\n"
+		headers += "Auto-Submitted: auto-generated\r\n"
+	}
+	if c.xMailer != "" {
+		headers += fmt.Sprintf("X-Mailer: %s\r\n", c.xMailer)
+	}
+	headers += c.noReplyHeaders(msg)
 	headers += "MIME-Version: 1.0\r\n"
+	if len(msg.CustomHeaders) > 0 {
+		skip := serviceHeaders(msg)
+		if c.xMailer != "" {
+			skip["X-Mailer"] = true
+		}
+		if c.cfg.NoReplySender {
+			skip["X-Auto-Response-Suppress"] = true
+		}
+		headers += customHeaderLines(msg.CustomHeaders, skip)
+	}
 
 	// Определяем Content-Type для тела сообщения
 	textContentType := "text/plain; charset=UTF-8"
@@ -222,232 +598,497 @@ func (c *SMTPClient) buildEmailMessage(msg *EmailMessage, recipientEmails []stri
 		textContentType = "text/html; charset=UTF-8"
 	}
 
+	m := &mimeWriter{w: w}
+	m.writeString(headers)
+
+	// Текстовая и HTML версии тела - multipart/alternative
+	if msg.TextPlain != "" && msg.TextHTML != "" {
+		c.writeAlternativeBody(m, msg)
+		return m.err
+	}
+
+	// Небольшие изображения встраиваем в HTML тело (multipart/related), остальное - обычные вложения
+	inline, regular := c.splitInlineImages(msg.Attachments, isBodyHTML)
+	if len(inline) > 0 {
+		c.writeInlineBody(m, msg, inline, regular, textContentType)
+		return m.err
+	}
+
 	// Если есть вложения, используем multipart/mixed
 	if len(msg.Attachments) > 0 {
-		boundary := fmt.Sprintf("boundary_%d_%d", msg.TaskID, time.Now().Unix())
-		headers += fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary)
-		headers += "\r\n"
-
-		// Тело сообщения
-		body := fmt.Sprintf("--%s\r\n", boundary)
-		body += fmt.Sprintf("Content-Type: %s\r\n", textContentType)
-		body += "Content-Transfer-Encoding: 8bit\r\n"
-		body += "\r\n"
-		body += msg.Text
-		body += "\r\n\r\n"
-
-		// Добавляем вложения
-		for _, attach := range msg.Attachments {
-			// Проверяем, что вложение не пустое
-			if len(attach.Data) == 0 {
-				if logger.Log != nil {
-					logger.Log.Warn("Пропуск пустого вложения при формировании письма",
-						zap.Int64("taskID", msg.TaskID),
-						zap.String("fileName", attach.FileName))
-				}
-				continue
-			}
+		c.writeMixedBody(m, msg, func() {
+			m.printf("Content-Type: %s\r\n", textContentType)
+			m.writeString(contentLanguageHeader(msg))
+			m.writeString("Content-Transfer-Encoding: 8bit\r\n")
+			m.writeString("\r\n")
+			m.writeString(msg.Text)
+			m.writeString("\r\n")
+		}, msg.Attachments)
+		return m.err
+	}
 
-			// Определяем MIME тип по расширению файла
-			ext := filepath.Ext(attach.FileName)
-			mimeType := mime.TypeByExtension(ext)
-			if mimeType == "" {
-				mimeType = "application/octet-stream"
-			}
+	// Без вложений - простое сообщение
+	m.printf("Content-Type: %s\r\n", textContentType)
+	m.writeString(contentLanguageHeader(msg))
+	m.writeString("\r\n")
+	m.writeString(msg.Text)
+	return m.err
+}
 
-			body += fmt.Sprintf("--%s\r\n", boundary)
-			body += fmt.Sprintf("Content-Type: %s\r\n", mimeType)
-			body += fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", attach.FileName)
-			body += "Content-Transfer-Encoding: base64\r\n"
-			body += "\r\n"
-
-			// Кодируем вложение в Base64
-			encoded := base64.StdEncoding.EncodeToString(attach.Data)
-			// Разбиваем на строки по 76 символов (RFC 2045)
-			for i := 0; i < len(encoded); i += 76 {
-				end := i + 76
-				if end > len(encoded) {
-					end = len(encoded)
-				}
-				body += encoded[i:end] + "\r\n"
-			}
-			body += "\r\n"
+// Режимы добавления заголовков автоматического письма (параметр AutoSubmittedHeaders секции [Mode])
+const (
+	// AutoSubmittedOff - заголовки не добавляются
+	AutoSubmittedOff = "off"
+	// AutoSubmittedBulk - заголовки добавляются только к массовой рассылке (bulk="1")
+	AutoSubmittedBulk = "bulk"
+	// AutoSubmittedAll - заголовки добавляются ко всем письмам
+	AutoSubmittedAll = "all"
+)
+
+// normalizeAutoSubmitted приводит режим добавления заголовков автоматического письма к каноническому виду и проверяет его
+func normalizeAutoSubmitted(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return AutoSubmittedOff, nil
+	case AutoSubmittedOff, AutoSubmittedBulk, AutoSubmittedAll:
+		return mode, nil
+	}
+	return "", fmt.Errorf("неизвестный режим AutoSubmittedHeaders %q (допустимо: %s, %s, %s)",
+		mode, AutoSubmittedOff, AutoSubmittedBulk, AutoSubmittedAll)
+}
+
+// serviceHeaders возвращает заголовки, которые сервис добавил в письмо помимо reservedHeaders;
+// одноименные заголовки из очереди для такого письма пропускаются
+func serviceHeaders(msg *EmailMessage) map[string]bool {
+	skip := make(map[string]bool)
+	if msg.Bulk && listUnsubscribeHeaders(msg.ListUnsubscribe) != "" {
+		skip["List-Unsubscribe"] = true
+		skip["List-Unsubscribe-Post"] = true
+	}
+	if msg.AutoSubmitted {
+		skip["Precedence"] = true
+		skip["Auto-Submitted"] = true
+	}
+	if msg.OriginalRecipients != "" {
+		skip["X-Original-To"] = true
+	}
+	if msg.Language != "" {
+		skip["Content-Language"] = true
+	}
+	return skip
+}
+
+// listUnsubscribeHeaders формирует заголовки List-Unsubscribe (RFC 2369) для массовой рассылки
+// List-Unsubscribe-Post (RFC 8058, отписка в один клик) добавляется только при наличии HTTPS адреса
+func listUnsubscribeHeaders(list string) string {
+	var uris []string
+	hasHTTPS := false
+	for _, item := range strings.Split(list, ",") {
+		item = strings.Trim(strings.TrimSpace(item), "<>")
+		if item == "" {
+			continue
 		}
+		lower := strings.ToLower(item)
+		switch {
+		case strings.HasPrefix(lower, "https://"):
+			hasHTTPS = true
+		case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "mailto:"):
+		case strings.Contains(item, "@"):
+			// Адрес без схемы считаем почтовым
+			item = "mailto:" + item
+		default:
+			continue
+		}
+		uris = append(uris, "<"+item+">")
+	}
+	if len(uris) == 0 {
+		return ""
+	}
 
-		body += fmt.Sprintf("--%s--\r\n", boundary)
-		return headers + body
+	headers := fmt.Sprintf("List-Unsubscribe: %s\r\n", strings.Join(uris, ", "))
+	if hasHTTPS {
+		headers += "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"
 	}
+	return headers
+}
 
-	// Без вложений - простое сообщение
-	headers += fmt.Sprintf("Content-Type: %s\r\n", textContentType)
-	headers += "\r\n"
-	body := headers + msg.Text
+// inlineImage - изображение, встраиваемое в HTML тело письма
+type inlineImage struct {
+	attach    AttachmentData
+	contentID string
+}
 
-	return body
+// splitInlineImages отделяет изображения, которые можно встроить в HTML тело, от обычных вложений
+// Встраиваются только при HTML теле непустые вложения, явно помеченные как встроенные (Inline),
+// и изображения не больше inlineImageMaxSize
+func (c *SMTPClient) splitInlineImages(attachments []AttachmentData, isBodyHTML bool) ([]inlineImage, []AttachmentData) {
+	if !isBodyHTML {
+		return nil, attachments
+	}
+
+	var inline []inlineImage
+	var regular []AttachmentData
+	for _, attach := range attachments {
+		if attach.Len() > 0 && attach.Inline {
+			inline = append(inline, inlineImage{attach: attach, contentID: attach.ContentID})
+			continue
+		}
+		if attach.Len() > 0 && attach.Len() <= c.inlineImageMaxSize &&
+			strings.HasPrefix(attachmentMimeType(attach.FileName), "image/") {
+			inline = append(inline, inlineImage{attach: attach})
+			continue
+		}
+		regular = append(regular, attach)
+	}
+	return inline, regular
 }
 
-// sendWithTLS отправляет email с поддержкой TLS
-func (c *SMTPClient) sendWithTLS(ctx context.Context, addr string, auth smtp.Auth, tlsConfig *tls.Config, msg *EmailMessage, recipientEmails []string, body string) error {
-	// Создаем канал для результата
-	done := make(chan error, 1)
+// writeInlineBody записывает тело письма со встроенными изображениями
+// Структура: multipart/mixed (если есть обычные вложения) -> multipart/related -> HTML + изображения
+func (c *SMTPClient) writeInlineBody(m *mimeWriter, msg *EmailMessage, inline []inlineImage, regular []AttachmentData, textContentType string) {
+	writeRelated := func() {
+		c.writeRelatedPart(m, msg, msg.Text, inline, textContentType)
+	}
+	if len(regular) == 0 {
+		writeRelated()
+		return
+	}
+	c.writeMixedBody(m, msg, writeRelated, regular)
+}
 
-	// Канал для уведомления горутины об отмене
-	stopChan := make(chan struct{})
+// writeAlternativeBody записывает тело с текстовой и HTML версиями (multipart/alternative)
+// По RFC 2046 версии идут в порядке возрастания точности: сначала text/plain, затем text/html.
+// Встраиваемые изображения относятся к HTML версии (multipart/related внутри alternative),
+// остальные вложения - к письму целиком (alternative внутри multipart/mixed)
+func (c *SMTPClient) writeAlternativeBody(m *mimeWriter, msg *EmailMessage) {
+	const htmlContentType = "text/html; charset=UTF-8"
+	inline, regular := c.splitInlineImages(msg.Attachments, true)
 
-	go func() {
-		var client *smtp.Client
-		var conn net.Conn
-		var err error
-
-		// Порт 465 использует SMTPS (SMTP over SSL) - прямое TLS соединение
-		// Порт 587 использует STARTTLS - сначала обычное соединение, потом переключение на TLS
-		if c.cfg.Port == 465 {
-			// Для порта 465 используем прямое TLS соединение
-			dialer := &net.Dialer{Timeout: 30 * time.Second}
-			conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
-			if err != nil {
-				select {
-				case done <- fmt.Errorf("ошибка подключения к SMTP через TLS (порт 465): %w", err):
-				case <-stopChan:
-				}
-				return
-			}
-			defer conn.Close()
-
-			// Создаем SMTP клиент поверх TLS соединения
-			client, err = smtp.NewClient(conn, c.cfg.Host)
-			if err != nil {
-				select {
-				case done <- fmt.Errorf("ошибка создания SMTP клиента: %w", err):
-				case <-stopChan:
-				}
-				return
-			}
+	writeAlternative := func() {
+		altBoundary := c.boundary("alternative", msg.TaskID)
+		m.printf("Content-Type: multipart/alternative; boundary=\"%s\"\r\n", altBoundary)
+		m.writeString("\r\n")
+		m.printf("--%s\r\n", altBoundary)
+		m.writeString("Content-Type: text/plain; charset=UTF-8\r\n")
+		m.writeString(contentLanguageHeader(msg))
+		m.writeString("Content-Transfer-Encoding: 8bit\r\n")
+		m.writeString("\r\n")
+		m.writeString(msg.TextPlain)
+		m.writeString("\r\n")
+		m.printf("--%s\r\n", altBoundary)
+		if len(inline) > 0 {
+			c.writeRelatedPart(m, msg, msg.TextHTML, inline, htmlContentType)
 		} else {
-			// Для других портов (587, 25 и т.д.) используем обычное соединение с STARTTLS
-			// Используем net.DialTimeout для контроля таймаута
-			dialer := &net.Dialer{Timeout: 30 * time.Second}
-			conn, err = dialer.Dial("tcp", addr)
-			if err != nil {
-				select {
-				case done <- fmt.Errorf("ошибка подключения к SMTP: %w", err):
-				case <-stopChan:
-				}
-				return
-			}
-			defer conn.Close()
+			m.printf("Content-Type: %s\r\n", htmlContentType)
+			m.writeString(contentLanguageHeader(msg))
+			m.writeString("Content-Transfer-Encoding: 8bit\r\n")
+			m.writeString("\r\n")
+			m.writeString(msg.TextHTML)
+			m.writeString("\r\n")
+		}
+		m.printf("--%s--\r\n", altBoundary)
+	}
 
-			client, err = smtp.NewClient(conn, c.cfg.Host)
-			if err != nil {
-				select {
-				case done <- fmt.Errorf("ошибка создания SMTP клиента: %w", err):
-				case <-stopChan:
-				}
-				return
-			}
+	hasAttachments := false
+	for _, attach := range regular {
+		if attach.Len() > 0 {
+			hasAttachments = true
+			break
+		}
+	}
+	if !hasAttachments {
+		writeAlternative()
+		return
+	}
+	c.writeMixedBody(m, msg, writeAlternative, regular)
+}
 
-			// Проверяем поддержку STARTTLS
-			if ok, _ := client.Extension("STARTTLS"); ok {
-				if err := client.StartTLS(tlsConfig); err != nil {
-					client.Close()
-					select {
-					case done <- fmt.Errorf("ошибка STARTTLS: %w", err):
-					case <-stopChan:
-					}
-					return
-				}
-			} else if c.cfg.EnableSSL {
-				// Если требуется SSL, но STARTTLS не поддерживается
-				client.Close()
-				select {
-				case done <- fmt.Errorf("сервер не поддерживает STARTTLS, но требуется SSL"):
-				case <-stopChan:
-				}
-				return
+// writeRelatedPart записывает часть multipart/related: HTML тело со встроенными изображениями
+func (c *SMTPClient) writeRelatedPart(m *mimeWriter, msg *EmailMessage, body string, inline []inlineImage, textContentType string) {
+	html := c.embedInlineImages(body, inline, msg.TaskID)
+
+	relatedBoundary := c.boundary("related", msg.TaskID)
+	m.printf("Content-Type: multipart/related; type=\"text/html\"; boundary=\"%s\"\r\n", relatedBoundary)
+	m.writeString("\r\n")
+	m.printf("--%s\r\n", relatedBoundary)
+	m.printf("Content-Type: %s\r\n", textContentType)
+	m.writeString(contentLanguageHeader(msg))
+	m.writeString("Content-Transfer-Encoding: 8bit\r\n")
+	m.writeString("\r\n")
+	m.writeString(html)
+	m.writeString("\r\n\r\n")
+	for _, image := range inline {
+		writeAttachmentPart(m, msg.TaskID, relatedBoundary, image.attach, "inline", image.contentID)
+	}
+	m.printf("--%s--\r\n", relatedBoundary)
+}
+
+// writeMixedBody записывает multipart/mixed: первая часть - тело письма (writeFirst), далее обычные вложения
+func (c *SMTPClient) writeMixedBody(m *mimeWriter, msg *EmailMessage, writeFirst func(), regular []AttachmentData) {
+	boundary := c.boundary("boundary", msg.TaskID)
+	m.printf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary)
+	m.writeString("\r\n")
+	m.printf("--%s\r\n", boundary)
+	writeFirst()
+	m.writeString("\r\n")
+	for _, attach := range regular {
+		if attach.Len() == 0 {
+			if logger.Log != nil {
+				logger.Log.Warn("Пропуск пустого вложения при формировании письма",
+					zap.Int64("taskID", msg.TaskID),
+					zap.String("fileName", attach.FileName))
 			}
+			continue
+		}
+		writeAttachmentPart(m, msg.TaskID, boundary, attach, "attachment", "")
+	}
+	m.printf("--%s--\r\n", boundary)
+}
+
+// embedInlineImages назначает изображениям Content-ID и добавляет их в HTML тело
+// Изображение с Content-ID из очереди и изображение, на которое HTML уже ссылается как
+// cid:<имя файла>, не добавляются; для остальных тег <img> добавляется в конец тела
+// (перед </body>, если он есть)
+func (c *SMTPClient) embedInlineImages(html string, inline []inlineImage, taskID int64) string {
+	var tags strings.Builder
+	for i := range inline {
+		if inline[i].contentID != "" {
+			continue
+		}
+		if strings.Contains(html, "cid:"+inline[i].attach.FileName) {
+			inline[i].contentID = inline[i].attach.FileName
+			continue
 		}
+		inline[i].contentID = fmt.Sprintf("inline%d_%d@%s", taskID, i+1, c.messageIDDomain())
+		fmt.Fprintf(&tags, "<br><img src=\"cid:%s\" alt=\"%s\">", inline[i].contentID, inline[i].attach.FileName)
+	}
+	if tags.Len() == 0 {
+		return html
+	}
 
-		defer client.Close()
+	if idx := strings.LastIndex(strings.ToLower(html), "</body>"); idx != -1 {
+		return html[:idx] + tags.String() + html[idx:]
+	}
+	return html + tags.String()
+}
 
-		// Аутентификация
-		if auth != nil {
-			if err := client.Auth(auth); err != nil {
-				select {
-				case done <- fmt.Errorf("ошибка аутентификации: %w", err):
-				case <-stopChan:
-				}
-				return
+// writeAttachmentPart записывает MIME часть вложения (разделитель boundary, заголовки и данные в Base64)
+// disposition - attachment или inline, contentID задается для встроенных изображений
+// Данные кодируются потоково из памяти или временного файла, не создавая копию вложения в памяти.
+// Вложение, которое не удалось открыть, пропускается; ошибка чтения после начала записи части
+// прерывает формирование письма, так как часть уже частично передана
+func writeAttachmentPart(m *mimeWriter, taskID int64, boundary string, attach AttachmentData, disposition, contentID string) {
+	if m.err != nil {
+		return
+	}
+	src, err := attach.Open()
+	if err != nil {
+		logPartError(taskID, attach, err)
+		return
+	}
+	defer src.Close()
+
+	m.printf("--%s\r\n", boundary)
+	m.printf("Content-Type: %s%s\r\n", attachmentMimeType(attach.FileName), mimeParam("name", attach.FileName))
+	m.printf("Content-Disposition: %s%s\r\n", disposition, mimeParam("filename", attach.FileName))
+	if contentID != "" {
+		m.printf("Content-ID: <%s>\r\n", contentID)
+	}
+	m.writeString("Content-Transfer-Encoding: base64\r\n")
+	m.writeString("\r\n")
+	if m.err != nil {
+		return
+	}
+
+	// Кодируем вложение в Base64 со строками по 76 символов (RFC 2045)
+	lines := &base64LineWriter{dst: m.w}
+	encoder := base64.NewEncoder(base64.StdEncoding, lines)
+	if _, err := io.Copy(encoder, src); err != nil {
+		m.err = fmt.Errorf("ошибка передачи вложения %s: %w", attach.FileName, err)
+		return
+	}
+	if err := encoder.Close(); err != nil {
+		m.err = fmt.Errorf("ошибка передачи вложения %s: %w", attach.FileName, err)
+		return
+	}
+	if err := lines.Flush(); err != nil {
+		m.err = fmt.Errorf("ошибка передачи вложения %s: %w", attach.FileName, err)
+		return
+	}
+	m.writeString("\r\n")
+}
+
+// crlf - конец строки Base64 (срез, а не строка, чтобы запись не выделяла память)
+var crlf = []byte("\r\n")
+
+// base64LineWriter разбивает поток Base64 на строки по 76 символов
+type base64LineWriter struct {
+	dst  io.Writer
+	line int // Количество символов в текущей строке
+}
+
+func (w *base64LineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(76-w.line, len(p))
+		if _, err := w.dst.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		w.line += n
+		p = p[n:]
+		if w.line == 76 {
+			if _, err := w.dst.Write(crlf); err != nil {
+				return written, err
 			}
+			w.line = 0
 		}
+	}
+	return written, nil
+}
 
-		// Устанавливаем отправителя
-		if err := client.Mail(c.cfg.User); err != nil {
+// Flush завершает последнюю неполную строку
+func (w *base64LineWriter) Flush() error {
+	if w.line == 0 {
+		return nil
+	}
+	w.line = 0
+	_, err := w.dst.Write(crlf)
+	return err
+}
+
+// mimeWriter записывает письмо в поток (DATA соединения или подсчет размера)
+// Первая ошибка записи сохраняется, последующие записи пропускаются
+type mimeWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (m *mimeWriter) printf(format string, args ...any) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, args...)
+	}
+}
+
+func (m *mimeWriter) writeString(s string) {
+	if m.err == nil {
+		_, m.err = io.WriteString(m.w, s)
+	}
+}
+
+// countingWriter подсчитывает размер записанных данных, не сохраняя их
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// logPartError логирует вложение, пропущенное из-за ошибки чтения данных
+func logPartError(taskID int64, attach AttachmentData, err error) {
+	if logger.Log != nil {
+		logger.Log.Error("Пропуск вложения: ошибка чтения данных при формировании письма",
+			zap.Int64("taskID", taskID),
+			zap.String("fileName", attach.FileName),
+			zap.Error(err))
+	}
+}
+
+// attachmentMimeType определяет MIME тип вложения по расширению файла
+func attachmentMimeType(fileName string) string {
+	mimeType := mime.TypeByExtension(filepath.Ext(fileName))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return mimeType
+}
+
+// sendWithTLS отправляет email с поддержкой TLS
+// Каждый элемент transactions передается отдельной транзакцией MAIL/RCPT/DATA в одном соединении
+// Возвращает число транзакций (с начала transactions), принятых сервером, и получателей, отклоненных
+// в этих транзакциях; при ошибке принятые транзакции также возвращаются, чтобы повтор их пропустил
+func (c *SMTPClient) sendWithTLS(ctx context.Context, addr string, auth smtp.Auth, tlsConfig *tls.Config, msg *EmailMessage, transactions [][]string, writeBody messageWriter, size int64) (int, []RejectedRecipient, error) {
+	type result struct {
+		committed int
+		rejected  []RejectedRecipient
+		err       error
+	}
+
+	// Создаем канал для результата
+	done := make(chan result, 1)
+
+	// Канал для уведомления горутины об отмене
+	stopChan := make(chan struct{})
+
+	go func() {
+		// Соединение берется из пула (ConnectionPoolSize > 0) или устанавливается заново;
+		// при исчерпании MaxTransactionsPerConnection посреди письма выполняется переподключение
+		var sc *smtpConn
+		var rejected []RejectedRecipient
+		committed := 0
+
+		// Отказ сервера передается как *SMTPReplyError с кодом ответа
+		deliver := func(err error) {
 			select {
-			case done <- fmt.Errorf("ошибка установки отправителя: %w", err):
+			case done <- result{committed: committed, rejected: rejected, err: wrapSMTPReply(err)}:
 			case <-stopChan:
-				return
 			}
-			return
 		}
 
-		// Устанавливаем получателей (To и BCC)
-		for _, recipientEmail := range recipientEmails {
-			if err := client.Rcpt(recipientEmail); err != nil {
-				select {
-				case done <- fmt.Errorf("ошибка установки получателя %s: %w", recipientEmail, err):
-				case <-stopChan:
+		for _, recipientEmails := range transactions {
+			if sc == nil {
+				var err error
+				sc, err = c.acquireConn(addr, auth, tlsConfig, msg.TaskID)
+				if err != nil {
+					deliver(err)
+					return
+				}
+				if err := checkMessageSize(sc.caps, size); err != nil {
+					c.saveTranscript(msg.TaskID, sc.transcript)
+					c.releaseConn(sc)
+					deliver(err)
 					return
 				}
-				return
 			}
-		}
 
-		// Отправляем данные
-		writer, err := client.Data()
-		if err != nil {
-			select {
-			case done <- fmt.Errorf("ошибка начала передачи данных: %w", err):
-			case <-stopChan:
-				return
+			// Передаем письмо: конвейером (PIPELINING), если он включен и поддерживается сервером
+			var txRejected []RejectedRecipient
+			var txErr error
+			if sc.caps.Pipelining && c.cfg.EnablePipelining {
+				txRejected, txErr = c.sendPipelined(sc.client, recipientEmails, writeBody, size)
+			} else {
+				txRejected, txErr = c.sendTransaction(sc.client, recipientEmails, writeBody, size)
 			}
-			return
-		}
-
-		// Записываем тело сообщения
-		if _, err := writer.Write([]byte(body)); err != nil {
-			writer.Close()
-			select {
-			case done <- fmt.Errorf("ошибка записи данных: %w", err):
-			case <-stopChan:
+			if txErr != nil {
+				// Состояние соединения после ошибки транзакции не определено, повторно его не используем
+				c.saveTranscript(msg.TaskID, sc.transcript)
+				sc.close(false)
+				deliver(txErr)
 				return
 			}
-			return
-		}
+			rejected = append(rejected, txRejected...)
+			committed++
+			sc.transactions++
+			sc.lastUsed = c.clock.Now()
 
-		// Закрываем writer
-		if err := writer.Close(); err != nil {
-			select {
-			case done <- fmt.Errorf("ошибка закрытия writer: %w", err):
-			case <-stopChan:
-				return
+			if c.cfg.MaxTransactionsPerConnection > 0 && sc.transactions >= c.cfg.MaxTransactionsPerConnection {
+				c.saveTranscript(msg.TaskID, sc.transcript)
+				c.releaseConn(sc)
+				sc = nil
 			}
-			return
 		}
 
-		// Отправляем QUIT
-		if err := client.Quit(); err != nil {
-			select {
-			case done <- fmt.Errorf("ошибка QUIT: %w", err):
-			case <-stopChan:
-				return
-			}
-			return
+		if sc != nil {
+			c.saveTranscript(msg.TaskID, sc.transcript)
+			// Соединение возвращается в пул до сообщения об успехе, чтобы следующее письмо могло его использовать
+			c.releaseConn(sc)
 		}
-
 		select {
-		case done <- nil:
+		case done <- result{committed: committed, rejected: rejected}:
 		case <-stopChan:
-			return
 		}
 	}()
 
@@ -455,8 +1096,185 @@ func (c *SMTPClient) sendWithTLS(ctx context.Context, addr string, auth smtp.Aut
 	select {
 	case <-ctx.Done():
 		close(stopChan) // Уведомляем горутину об отмене
-		return ctx.Err()
-	case err := <-done:
+		return 0, nil, ctx.Err()
+	case res := <-done:
+		return res.committed, res.rejected, res.err
+	}
+}
+
+// mailCommand формирует команду MAIL FROM с параметрами расширений, объявленных сервером
+// При поддержке SIZE (RFC 1870) передается размер письма, чтобы сервер мог отклонить слишком большое
+// письмо до передачи данных
+func (c *SMTPClient) mailCommand(client *smtp.Client, size int64) string {
+	cmd := fmt.Sprintf("MAIL FROM:<%s>", envelopeFrom(c.cfg))
+	if ok, _ := client.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := client.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	if ok, _ := client.Extension("SIZE"); ok && size > 0 {
+		cmd += fmt.Sprintf(" SIZE=%d", size)
+	}
+	return cmd
+}
+
+// mail отправляет команду MAIL FROM (вместо smtp.Client.Mail, который не передает SIZE)
+func (c *SMTPClient) mail(client *smtp.Client, size int64) error {
+	if strings.ContainsAny(envelopeFrom(c.cfg), "\r\n") {
+		return errors.New("адрес отправителя содержит символы CR или LF")
+	}
+	id, err := client.Text.Cmd("%s", c.mailCommand(client, size))
+	if err != nil {
 		return err
 	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(250)
+	return err
+}
+
+// sendTransaction передает письмо последовательными командами MAIL, RCPT и DATA
+// Получатели, отклоненные сервером, пропускаются и возвращаются списком; письмо передается остальным.
+// Если не принят ни один получатель, транзакция отменяется командой RSET
+// При ошибке записи DATA не завершается точкой, чтобы сервер не принял неполное письмо:
+// соединение закрывается вызывающей стороной
+func (c *SMTPClient) sendTransaction(client *smtp.Client, recipientEmails []string, writeBody messageWriter, size int64) ([]RejectedRecipient, error) {
+	// Устанавливаем отправителя
+	if err := c.mail(client, size); err != nil {
+		return nil, fmt.Errorf("ошибка установки отправителя: %w", err)
+	}
+
+	// Устанавливаем получателей (To и BCC)
+	var rejected []RejectedRecipient
+	for _, recipientEmail := range recipientEmails {
+		if err := client.Rcpt(recipientEmail); err != nil {
+			r, ok := rejectedRecipient(recipientEmail, err)
+			if !ok {
+				return nil, fmt.Errorf("ошибка установки получателя %s: %w", recipientEmail, err)
+			}
+			rejected = append(rejected, r)
+		}
+	}
+	if len(rejected) == len(recipientEmails) {
+		if err := client.Reset(); err != nil {
+			return nil, fmt.Errorf("ошибка отмены транзакции: %w", err)
+		}
+		return rejected, nil
+	}
+
+	// Отправляем данные
+	writer, err := client.Data()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала передачи данных: %w", err)
+	}
+
+	// Записываем тело сообщения
+	if err := writeBody(writer); err != nil {
+		return nil, fmt.Errorf("ошибка записи данных: %w", err)
+	}
+
+	// Закрываем writer
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("ошибка закрытия writer: %w", err)
+	}
+
+	return rejected, nil
+}
+
+// sendPipelined передает письмо по RFC 2920: команды MAIL, RCPT и DATA отправляются без ожидания
+// ответов, затем ответы читаются по порядку. Это сокращает число обменов с сервером для писем
+// с большим количеством получателей
+// Отклоненные получатели обрабатываются так же, как в sendTransaction
+// При ошибке транзакция не завершается: соединение закрывается без отправки данных
+func (c *SMTPClient) sendPipelined(client *smtp.Client, recipientEmails []string, writeBody messageWriter, size int64) ([]RejectedRecipient, error) {
+	text := client.Text
+
+	mailCmd := c.mailCommand(client, size)
+
+	// Отправляем все команды конвейером
+	ids := make([]uint, 0, len(recipientEmails)+2)
+	id, err := text.Cmd("%s", mailCmd)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка установки отправителя: %w", err)
+	}
+	ids = append(ids, id)
+	for _, recipientEmail := range recipientEmails {
+		id, err := text.Cmd("RCPT TO:<%s>", recipientEmail)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка установки получателя %s: %w", recipientEmail, err)
+		}
+		ids = append(ids, id)
+	}
+	id, err = text.Cmd("DATA")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начала передачи данных: %w", err)
+	}
+	ids = append(ids, id)
+
+	// Читаем ответы в порядке отправки команд; все ответы нужно дочитать до конца,
+	// поэтому сохраняем только первую ошибку; ответ на DATA проверяется после подсчета
+	// отклоненных получателей: если не принят ни один, сервер отклоняет и DATA
+	var firstErr, dataErr error
+	var rejected []RejectedRecipient
+	for i, id := range ids {
+		expectCode := 250
+		if i == len(ids)-1 {
+			expectCode = 354
+		}
+
+		text.StartResponse(id)
+		_, _, err := text.ReadResponse(expectCode)
+		text.EndResponse(id)
+
+		if err == nil {
+			continue
+		}
+		switch {
+		case i == 0:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("ошибка установки отправителя: %w", err)
+			}
+		case i == len(ids)-1:
+			dataErr = err
+		default:
+			if r, ok := rejectedRecipient(recipientEmails[i-1], err); ok {
+				rejected = append(rejected, r)
+			} else if firstErr == nil {
+				firstErr = fmt.Errorf("ошибка установки получателя %s: %w", recipientEmails[i-1], err)
+			}
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if dataErr != nil {
+		if len(rejected) == len(recipientEmails) {
+			if err := client.Reset(); err != nil {
+				return nil, fmt.Errorf("ошибка отмены транзакции: %w", err)
+			}
+			return rejected, nil
+		}
+		return nil, fmt.Errorf("ошибка начала передачи данных: %w", dataErr)
+	}
+
+	// Сервер готов принять данные
+	writer := text.DotWriter()
+	if err := writeBody(writer); err != nil {
+		return nil, fmt.Errorf("ошибка записи данных: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("ошибка закрытия writer: %w", err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		return nil, fmt.Errorf("ошибка закрытия writer: %w", err)
+	}
+
+	if logger.Log != nil {
+		logger.Log.Debug("Письмо передано в режиме SMTP PIPELINING",
+			zap.String("host", c.cfg.Host),
+			zap.Int("recipients", len(recipientEmails)))
+	}
+
+	return rejected, nil
 }
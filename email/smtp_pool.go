@@ -0,0 +1,410 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/clock"
+	"email-service/logger"
+)
+
+// smtpConn - установленное и аутентифицированное SMTP соединение
+type smtpConn struct {
+	client       *smtp.Client
+	conn         net.Conn
+	caps         smtpCapabilities
+	transactions int             // Количество переданных писем (транзакций) за время жизни соединения
+	lastUsed     time.Time       // Время последней команды (транзакции или NOOP)
+	transcript   *smtpTranscript // Протокол обмена (nil - запись отключена)
+}
+
+// close завершает соединение: QUIT для исправного соединения, иначе просто закрытие сокета
+func (sc *smtpConn) close(quit bool) {
+	if quit {
+		sc.client.Quit()
+	}
+	sc.client.Close()
+	sc.conn.Close()
+}
+
+// smtpPool - открытые соединения SMTP клиента, ожидающие следующего письма
+// Соединения поддерживаются командой NOOP и закрываются после ConnectionIdleTimeoutSec простоя
+type smtpPool struct {
+	mu     sync.Mutex
+	idle   []*smtpConn
+	closed bool
+
+	keepAliveOnce sync.Once
+	stop          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// ErrGreetingTimeout возвращается, если SMTP сервер принял соединение, но не прислал приветствие 220
+var ErrGreetingTimeout = errors.New("SMTP сервер не прислал приветствие")
+
+// greetingTimeout возвращает время ожидания приветствия сервера (GreetingTimeoutSec, по умолчанию 30 секунд)
+func (c *SMTPClient) greetingTimeout() time.Duration {
+	if c.cfg.GreetingTimeoutSec <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.cfg.GreetingTimeoutSec) * time.Second
+}
+
+// dialTimeout возвращает таймаут установки соединения (SMTPDialTimeoutSec, по умолчанию 30 секунд)
+func (c *SMTPClient) dialTimeout() time.Duration {
+	return secondsOrDefault(c.cfg.SMTPDialTimeoutSec, 30*time.Second)
+}
+
+// commandTimeout возвращает таймаут одной операции чтения или записи (SMTPCommandTimeoutSec, по умолчанию 30 секунд)
+func (c *SMTPClient) commandTimeout() time.Duration {
+	return secondsOrDefault(c.cfg.SMTPCommandTimeoutSec, 30*time.Second)
+}
+
+// timeoutConn ограничивает время каждой операции чтения и записи соединения, чтобы зависший сервер
+// не блокировал отправку: net/smtp не поддерживает таймауты команд
+// Срок чтения, установленный явно через SetReadDeadline (ожидание приветствия), имеет приоритет
+type timeoutConn struct {
+	net.Conn
+	timeout      time.Duration
+	readDeadline time.Time
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.readDeadline.IsZero() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// wrappedTLSAuth сообщает механизму аутентификации, что соединение зашифровано:
+// net/smtp определяет TLS по типу соединения, а TLS соединение на порту 465 обернуто timeoutConn
+type wrappedTLSAuth struct {
+	smtp.Auth
+}
+
+func (a wrappedTLSAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	info := *server
+	info.TLS = true
+	return a.Auth.Start(&info)
+}
+
+// poolEnabled проверяет, включено ли повторное использование соединений (ConnectionPoolSize > 0)
+func (c *SMTPClient) poolEnabled() bool {
+	return c.cfg.ConnectionPoolSize > 0
+}
+
+// dial устанавливает соединение с SMTP сервером: TLS (порт 465) или STARTTLS, аутентификация
+// и чтение расширений сервера (после STARTTLS они могут измениться)
+// Протокол неудачного подключения сохраняется сразу с номером письма taskID
+func (c *SMTPClient) dial(addr string, auth smtp.Auth, tlsConfig *tls.Config, taskID int64) (sc *smtpConn, err error) {
+	var client *smtp.Client
+	var conn net.Conn
+
+	// Порт 465 использует SMTPS (SMTP over SSL) - прямое TLS соединение
+	// Порт 587 использует STARTTLS - сначала обычное соединение, потом переключение на TLS
+	dialer := &net.Dialer{Timeout: c.dialTimeout()}
+	if c.cfg.Port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка подключения к SMTP через TLS (порт 465): %w", err)
+		}
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка подключения к SMTP: %w", err)
+		}
+	}
+
+	conn = &timeoutConn{Conn: conn, timeout: c.commandTimeout()}
+	if c.cfg.Port == 465 && auth != nil {
+		auth = wrappedTLSAuth{Auth: auth}
+	}
+	// Соединение без записи протокола: над ним устанавливается TLS при STARTTLS
+	plainConn := conn
+
+	var transcript *smtpTranscript
+	if c.transcriptEnabled() {
+		transcript = &smtpTranscript{}
+		conn = &transcriptConn{Conn: conn, t: transcript}
+		defer func() {
+			if err != nil {
+				c.saveTranscript(taskID, transcript)
+			}
+		}()
+	}
+
+	// Сервер может принять TCP соединение, но не прислать приветствие (перегруженный relay):
+	// ограничиваем ожидание строки 220, иначе smtp.NewClient ждет без ограничения
+	greetingTimeout := c.greetingTimeout()
+	conn.SetReadDeadline(time.Now().Add(greetingTimeout))
+	client, err = smtp.NewClient(conn, c.cfg.Host)
+	if err != nil {
+		conn.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: нет ответа за %s", ErrGreetingTimeout, greetingTimeout)
+		}
+		return nil, fmt.Errorf("ошибка создания SMTP клиента: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	sc = &smtpConn{client: client, conn: conn, transcript: transcript}
+
+	// EHLO с настроенным именем отправляется до STARTTLS и аутентификации;
+	// без HeloName net/smtp передает локальное имя хоста
+	if c.cfg.HeloName != "" {
+		if err := client.Hello(c.cfg.HeloName); err != nil {
+			sc.close(false)
+			return nil, fmt.Errorf("ошибка EHLO %s: %w", c.cfg.HeloName, err)
+		}
+	}
+
+	if c.cfg.Port != 465 {
+		// Проверяем поддержку STARTTLS
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if transcript != nil {
+				err = c.startTLSWithTranscript(sc, plainConn, tlsConfig)
+				if auth != nil {
+					auth = wrappedTLSAuth{Auth: auth}
+				}
+			} else {
+				err = client.StartTLS(tlsConfig)
+			}
+			if err != nil {
+				sc.close(false)
+				return nil, fmt.Errorf("ошибка STARTTLS: %w", err)
+			}
+			client = sc.client
+		} else if c.cfg.EnableSSL {
+			// Если требуется SSL, но STARTTLS не поддерживается
+			sc.close(false)
+			return nil, fmt.Errorf("сервер не поддерживает STARTTLS, но требуется SSL")
+		}
+	}
+
+	// Аутентификация
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			sc.close(false)
+			return nil, fmt.Errorf("ошибка аутентификации: %w", err)
+		}
+	}
+
+	// Расширения сервера считываются один раз на соединение
+	// и используются для всех транзакций этого соединения
+	sc.caps = readCapabilities(client)
+	c.setCapabilities(sc.caps)
+	sc.lastUsed = c.clock.Now()
+	return sc, nil
+}
+
+// startTLSWithTranscript выполняет STARTTLS при записи протокола обмена
+// smtp.Client.StartTLS устанавливает TLS над соединением с записью протокола, и после STARTTLS в протокол
+// попадали бы только зашифрованные данные. Поэтому TLS устанавливается над plainConn, запись протокола -
+// над TLS, а для зашифрованного соединения создается новый smtp.Client, заменяющий sc.client
+func (c *SMTPClient) startTLSWithTranscript(sc *smtpConn, plainConn net.Conn, tlsConfig *tls.Config) error {
+	text := sc.client.Text
+	id, err := text.Cmd("STARTTLS")
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	_, _, err = text.ReadResponse(220)
+	text.EndResponse(id)
+	if err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(plainConn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return err
+	}
+	conn := &transcriptConn{Conn: tlsConn, t: sc.transcript}
+
+	// smtp.NewClient читает приветствие сервера, которого после STARTTLS нет: подставляем его,
+	// не записывая в протокол
+	greeting := fmt.Sprintf("220 %s\r\n", c.cfg.Host)
+	client, err := smtp.NewClient(&greetingConn{Conn: conn, r: io.MultiReader(strings.NewReader(greeting), conn)}, c.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	// После STARTTLS клиент заново отправляет EHLO (RFC 3207)
+	if c.cfg.HeloName != "" {
+		if err := client.Hello(c.cfg.HeloName); err != nil {
+			client.Close()
+			return err
+		}
+	}
+	sc.client = client
+	sc.conn = conn
+	return nil
+}
+
+// greetingConn передает при чтении данные r (приветствие, затем данные соединения)
+type greetingConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *greetingConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// acquireConn возвращает открытое соединение из пула или устанавливает новое
+// Соединение, простаивавшее дольше интервала NOOP, перед использованием проверяется командой NOOP
+func (c *SMTPClient) acquireConn(addr string, auth smtp.Auth, tlsConfig *tls.Config, taskID int64) (*smtpConn, error) {
+	for c.poolEnabled() {
+		c.pool.mu.Lock()
+		n := len(c.pool.idle)
+		if n == 0 {
+			c.pool.mu.Unlock()
+			break
+		}
+		sc := c.pool.idle[n-1]
+		c.pool.idle = c.pool.idle[:n-1]
+		c.pool.mu.Unlock()
+
+		if clock.Since(c.clock, sc.lastUsed) < c.keepAliveInterval() {
+			return sc, nil
+		}
+		if err := sc.client.Noop(); err != nil {
+			if logger.Log != nil {
+				logger.Log.Debug("Соединение из пула SMTP закрыто сервером, устанавливается новое",
+					zap.String("host", c.cfg.Host),
+					zap.Error(err))
+			}
+			sc.close(false)
+			continue
+		}
+		sc.lastUsed = c.clock.Now()
+		return sc, nil
+	}
+	return c.dial(addr, auth, tlsConfig, taskID)
+}
+
+// releaseConn возвращает исправное соединение в пул или закрывает его (QUIT), если пул отключен
+// или заполнен, клиент закрыт либо исчерпан лимит MaxTransactionsPerConnection
+func (c *SMTPClient) releaseConn(sc *smtpConn) {
+	if c.poolEnabled() &&
+		(c.cfg.MaxTransactionsPerConnection <= 0 || sc.transactions < c.cfg.MaxTransactionsPerConnection) {
+		c.pool.mu.Lock()
+		if !c.pool.closed && len(c.pool.idle) < c.cfg.ConnectionPoolSize {
+			sc.lastUsed = c.clock.Now()
+			c.pool.idle = append(c.pool.idle, sc)
+			c.pool.mu.Unlock()
+			c.pool.keepAliveOnce.Do(c.startKeepAlive)
+			return
+		}
+		c.pool.mu.Unlock()
+	}
+	sc.close(true)
+}
+
+// keepAliveInterval возвращает интервал NOOP для простаивающих соединений
+func (c *SMTPClient) keepAliveInterval() time.Duration {
+	if c.cfg.KeepAliveIntervalSec <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(c.cfg.KeepAliveIntervalSec) * time.Second
+}
+
+// startKeepAlive запускает периодическую проверку простаивающих соединений:
+// соединения отправляют NOOP, чтобы сервер не закрыл их по таймауту, а простаивающие
+// дольше ConnectionIdleTimeoutSec закрываются
+func (c *SMTPClient) startKeepAlive() {
+	c.pool.wg.Add(1)
+	go func() {
+		defer c.pool.wg.Done()
+		ticker := time.NewTicker(c.keepAliveInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.keepAlive()
+			case <-c.pool.stop:
+				return
+			}
+		}
+	}()
+}
+
+// keepAlive проверяет простаивающие соединения
+// Соединения извлекаются из пула на время проверки, чтобы NOOP не пересекался с отправкой
+func (c *SMTPClient) keepAlive() {
+	c.pool.mu.Lock()
+	idle := c.pool.idle
+	c.pool.idle = nil
+	c.pool.mu.Unlock()
+
+	idleTimeout := time.Duration(c.cfg.ConnectionIdleTimeoutSec) * time.Second
+	alive := make([]*smtpConn, 0, len(idle))
+	for _, sc := range idle {
+		if idleTimeout > 0 && clock.Since(c.clock, sc.lastUsed) >= idleTimeout {
+			sc.close(true)
+			continue
+		}
+		if err := sc.client.Noop(); err != nil {
+			sc.close(false)
+			continue
+		}
+		alive = append(alive, sc)
+	}
+
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+	for _, sc := range alive {
+		if c.pool.closed || len(c.pool.idle) >= c.cfg.ConnectionPoolSize {
+			sc.close(true)
+			continue
+		}
+		c.pool.idle = append(c.pool.idle, sc)
+	}
+}
+
+// Close закрывает простаивающие соединения и останавливает их проверку
+// Соединения, занятые отправкой, закрываются после ее завершения
+func (c *SMTPClient) Close() {
+	c.pool.mu.Lock()
+	if c.pool.closed {
+		c.pool.mu.Unlock()
+		return
+	}
+	c.pool.closed = true
+	idle := c.pool.idle
+	c.pool.idle = nil
+	c.pool.mu.Unlock()
+
+	// Запрещаем запуск проверки после закрытия и останавливаем уже запущенную
+	c.pool.keepAliveOnce.Do(func() {})
+	close(c.pool.stop)
+	c.pool.wg.Wait()
+
+	for _, sc := range idle {
+		sc.close(true)
+	}
+	if len(idle) > 0 && logger.Log != nil {
+		logger.Log.Info("Закрыты соединения с SMTP сервером",
+			zap.String("host", c.cfg.Host),
+			zap.Int("connections", len(idle)))
+	}
+}
@@ -0,0 +1,115 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// sendTestMessages отправляет n писем по одному получателю
+func sendTestMessages(t *testing.T, client *SMTPClient, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		msg := &EmailMessage{TaskID: int64(i), Text: "текст"}
+		if err := client.SendEmail(context.Background(), msg, []string{fmt.Sprintf("user%d@example.org", i)}, false, false); err != nil {
+			t.Fatalf("письмо %d: %v", i, err)
+		}
+	}
+}
+
+// waitForCommands ждет, пока сервер получит n команд cmd (соединения закрываются асинхронно)
+func waitForCommands(t *testing.T, server *fakeSMTPServer, cmd string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.commandCount(cmd) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("сервер получил %d команд %s, ожидалось %d", server.commandCount(cmd), cmd, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSMTPPoolReusesConnection(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	client := newTestSMTPClient(server)
+	client.cfg.ConnectionPoolSize = 1
+	defer client.Close()
+
+	// Одно соединение передает несколько писем
+	sendTestMessages(t, client, 3)
+	if got := server.connectionCount(); got != 1 {
+		t.Errorf("установлено %d соединений, ожидалось 1", got)
+	}
+	if got := len(server.acceptedRecipients()); got != 3 {
+		t.Errorf("сервер принял %d писем, ожидалось 3", got)
+	}
+	if got := server.commandCount("QUIT"); got != 0 {
+		t.Errorf("соединение из пула закрыто (%d QUIT) до Close", got)
+	}
+
+	// Close завершает соединения из пула командой QUIT
+	client.Close()
+	waitForCommands(t, server, "QUIT", 1)
+}
+
+func TestSMTPWithoutPoolConnectionPerMessage(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	client := newTestSMTPClient(server)
+
+	sendTestMessages(t, client, 3)
+	if got := server.connectionCount(); got != 3 {
+		t.Errorf("установлено %d соединений, ожидалось 3", got)
+	}
+	waitForCommands(t, server, "QUIT", 3)
+}
+
+func TestSMTPPoolMaxTransactionsPerConnection(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	client := newTestSMTPClient(server)
+	client.cfg.ConnectionPoolSize = 1
+	client.cfg.MaxTransactionsPerConnection = 2
+	defer client.Close()
+
+	// После двух писем соединение закрывается и устанавливается новое
+	sendTestMessages(t, client, 5)
+	if got := server.connectionCount(); got != 3 {
+		t.Errorf("установлено %d соединений, ожидалось 3", got)
+	}
+	waitForCommands(t, server, "QUIT", 2)
+}
+
+func TestSMTPPoolKeepAlive(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	client := newTestSMTPClient(server)
+	client.cfg.ConnectionPoolSize = 1
+	client.cfg.ConnectionIdleTimeoutSec = 60
+	defer client.Close()
+
+	sendTestMessages(t, client, 1)
+
+	// Простаивающее соединение поддерживается командой NOOP
+	client.keepAlive()
+	if got := server.commandCount("NOOP"); got != 1 {
+		t.Errorf("сервер получил %d NOOP, ожидался 1", got)
+	}
+	sendTestMessages(t, client, 1)
+	if got := server.connectionCount(); got != 1 {
+		t.Errorf("установлено %d соединений, ожидалось 1", got)
+	}
+
+	// Соединение, простаивающее дольше ConnectionIdleTimeoutSec, закрывается
+	client.pool.mu.Lock()
+	for _, sc := range client.pool.idle {
+		sc.lastUsed = time.Now().Add(-2 * time.Minute)
+	}
+	client.pool.mu.Unlock()
+	client.keepAlive()
+	waitForCommands(t, server, "QUIT", 1)
+	client.pool.mu.Lock()
+	idle := len(client.pool.idle)
+	client.pool.mu.Unlock()
+	if idle != 0 {
+		t.Errorf("в пуле %d соединений после таймаута простоя", idle)
+	}
+}
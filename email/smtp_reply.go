@@ -0,0 +1,71 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// SMTPReplyError - ошибка отправки, вызванная отказом SMTP сервера; содержит код ответа
+// Текст ошибки не меняется, исходная ошибка доступна через errors.Unwrap
+type SMTPReplyError struct {
+	Code     int    // Код ответа, например 550
+	Enhanced string // Расширенный код ответа (RFC 3463), например 5.1.1; пусто, если сервер его не передал
+	err      error
+}
+
+func (e *SMTPReplyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *SMTPReplyError) Unwrap() error {
+	return e.err
+}
+
+// Permanent проверяет, что отказ постоянный (5xx): повторная отправка того же письма не поможет
+func (e *SMTPReplyError) Permanent() bool {
+	return e.Code >= 500
+}
+
+// Transient проверяет, что отказ временный (4xx): отправку можно повторить позже
+func (e *SMTPReplyError) Transient() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// Status возвращает код ответа для описания статуса письма, например "SMTP 550 5.1.1"
+func (e *SMTPReplyError) Status() string {
+	if e.Enhanced == "" {
+		return fmt.Sprintf("SMTP %d", e.Code)
+	}
+	return fmt.Sprintf("SMTP %d %s", e.Code, e.Enhanced)
+}
+
+// wrapSMTPReply оборачивает ошибку, содержащую ответ SMTP сервера (*textproto.Error от net/smtp),
+// в *SMTPReplyError; остальные ошибки возвращаются без изменений
+func wrapSMTPReply(err error) error {
+	var replyErr *SMTPReplyError
+	if err == nil || errors.As(err, &replyErr) {
+		return err
+	}
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return err
+	}
+	return &SMTPReplyError{Code: protoErr.Code, Enhanced: enhancedStatusCode(protoErr.Msg), err: err}
+}
+
+// enhancedStatusCode извлекает расширенный код (class.subject.detail, RFC 3463) из начала текста ответа
+func enhancedStatusCode(msg string) string {
+	code, _, _ := strings.Cut(strings.TrimSpace(msg), " ")
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return ""
+	}
+	for _, part := range parts[1:] {
+		if part == "" || len(part) > 3 || strings.Trim(part, "0123456789") != "" {
+			return ""
+		}
+	}
+	return code
+}
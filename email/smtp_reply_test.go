@@ -0,0 +1,80 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+)
+
+func TestWrapSMTPReply(t *testing.T) {
+	tests := []struct {
+		code          int
+		msg           string
+		wantEnhanced  string
+		wantStatus    string
+		wantPermanent bool
+	}{
+		{550, "5.1.1 User unknown", "5.1.1", "SMTP 550 5.1.1", true},
+		{552, "5.3.4 Message size exceeds fixed limit", "5.3.4", "SMTP 552 5.3.4", true},
+		{451, "4.7.1 Greylisted, try again later", "4.7.1", "SMTP 451 4.7.1", false},
+		{421, "4.4.2 mx.example.org Error: timeout exceeded", "4.4.2", "SMTP 421 4.4.2", false},
+		{554, "Transaction failed", "", "SMTP 554", true},
+		{550, "5.1 bad", "", "SMTP 550", true},
+		{550, "5.1.1234 bad", "", "SMTP 550", true},
+		{550, "3.1.1 not a class", "", "SMTP 550", true},
+		{450, "", "", "SMTP 450", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %s", tt.code, tt.msg), func(t *testing.T) {
+			protoErr := &textproto.Error{Code: tt.code, Msg: tt.msg}
+			err := wrapSMTPReply(fmt.Errorf("ошибка RCPT TO: %w", protoErr))
+
+			var replyErr *SMTPReplyError
+			if !errors.As(err, &replyErr) {
+				t.Fatalf("ошибка %T не содержит SMTPReplyError", err)
+			}
+			if replyErr.Code != tt.code || replyErr.Enhanced != tt.wantEnhanced {
+				t.Errorf("код %d %q, ожидалось %d %q", replyErr.Code, replyErr.Enhanced, tt.code, tt.wantEnhanced)
+			}
+			if got := replyErr.Status(); got != tt.wantStatus {
+				t.Errorf("Status() = %q, ожидалось %q", got, tt.wantStatus)
+			}
+			if replyErr.Permanent() != tt.wantPermanent || replyErr.Transient() == tt.wantPermanent {
+				t.Errorf("Permanent() = %v, Transient() = %v", replyErr.Permanent(), replyErr.Transient())
+			}
+			// Текст и цепочка исходной ошибки сохраняются
+			if !errors.Is(err, protoErr) || err.Error() != "ошибка RCPT TO: "+protoErr.Error() {
+				t.Errorf("исходная ошибка потеряна: %v", err)
+			}
+		})
+	}
+}
+
+func TestWrapSMTPReplyWithoutReply(t *testing.T) {
+	if err := wrapSMTPReply(nil); err != nil {
+		t.Errorf("wrapSMTPReply(nil) = %v", err)
+	}
+	connErr := errors.New("dial tcp: connection refused")
+	if err := wrapSMTPReply(connErr); err != connErr {
+		t.Errorf("ошибка без ответа сервера изменена: %v", err)
+	}
+	// Повторная обертка не создает вложенных SMTPReplyError
+	wrapped := wrapSMTPReply(&textproto.Error{Code: 550, Msg: "5.7.1 Denied"})
+	if err := wrapSMTPReply(wrapped); err != wrapped {
+		t.Errorf("ошибка обернута повторно: %#v", err)
+	}
+}
+
+func TestSendEmailReturnsReplyCode(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.dataReply = func(int) string { return "554 5.7.1 Message rejected as spam" }
+	client := newTestSMTPClient(server)
+
+	err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false)
+	var replyErr *SMTPReplyError
+	if !errors.As(err, &replyErr) || replyErr.Status() != "SMTP 554 5.7.1" || !replyErr.Permanent() {
+		t.Fatalf("ошибка %v, ожидался постоянный отказ SMTP 554 5.7.1", err)
+	}
+}
@@ -0,0 +1,248 @@
+package email
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer - SMTP сервер для тестов: принимает письма и запоминает получателей принятых транзакций
+type fakeSMTPServer struct {
+	ln        net.Listener
+	tlsConfig *tls.Config // Не nil - сервер поддерживает STARTTLS
+
+	// pipelining - сервер объявляет PIPELINING и откладывает ответы на MAIL и RCPT до команды DATA,
+	// как это разрешает RFC 2920; клиент, ожидающий ответа на каждую команду, фиксируется как stall
+	pipelining bool
+
+	mu          sync.Mutex
+	connections int
+	commands    map[string]int // Количество полученных команд по именам
+	dataCount   int
+	accepted    [][]string               // Получатели транзакций, принятых сервером (ответ 250 на данные)
+	messages    []string                 // Данные писем принятых транзакций
+	batches     [][]string               // Команды, полученные до ответа сервера (только в режиме pipelining)
+	stalls      int                      // Сколько раз клиент ждал ответа на отложенные команды
+	rcptReply   func(addr string) string // Ответ на RCPT, пусто - 250
+	dataReply   func(n int) string       // Ответ на n-е (с 1) завершение DATA, пусто - 250
+
+	// onData вызывается после получения данных письма до ответа сервера (задается до начала отправки)
+	onData func()
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// port возвращает порт, на котором слушает сервер
+func (s *fakeSMTPServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// acceptedRecipients возвращает получателей принятых транзакций
+func (s *fakeSMTPServer) acceptedRecipients() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.accepted...)
+}
+
+// acceptedMessages возвращает данные писем принятых транзакций
+func (s *fakeSMTPServer) acceptedMessages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// connectionCount возвращает количество установленных соединений
+func (s *fakeSMTPServer) connectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// commandCount возвращает количество полученных команд cmd
+func (s *fakeSMTPServer) commandCount(cmd string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[cmd]
+}
+
+// commandBatches возвращает группы команд, полученных конвейером, и число ожиданий клиента
+func (s *fakeSMTPServer) commandBatches() ([][]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.batches...), s.stalls
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			w.WriteString(line + "\r\n")
+		}
+		w.Flush()
+	}
+
+	reply("220 fake.example.com ESMTP")
+	encrypted := false
+	var rcpts, batch, deferred []string
+	for {
+		// Отложенные ответы ждут DATA; если клиент замолчал, он ждет ответа - конвейер не используется
+		if len(deferred) > 0 {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && line == "" {
+				s.mu.Lock()
+				s.stalls++
+				s.mu.Unlock()
+				conn.SetReadDeadline(time.Time{})
+				reply(deferred...)
+				deferred = nil
+				continue
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+		s.mu.Lock()
+		if s.commands == nil {
+			s.commands = make(map[string]int)
+		}
+		s.commands[cmd]++
+		s.mu.Unlock()
+		if s.pipelining {
+			batch = append(batch, cmd)
+		}
+
+		switch cmd {
+		case "EHLO", "HELO":
+			lines := []string{"250-fake.example.com", "250-SIZE 10485760"}
+			if s.pipelining {
+				lines = append(lines, "250-PIPELINING")
+			}
+			if s.tlsConfig != nil && !encrypted {
+				lines = append(lines, "250-STARTTLS")
+			}
+			reply(append(lines, "250 AUTH PLAIN")...)
+			batch = nil
+		case "STARTTLS":
+			reply("220 2.0.0 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, encrypted = tlsConn, true
+			r, w = bufio.NewReader(conn), bufio.NewWriter(conn)
+			batch = nil
+		case "AUTH":
+			reply("235 2.7.0 Authentication successful")
+			batch = nil
+		case "MAIL", "RCPT":
+			resp := "250 2.1.0 Ok"
+			if cmd == "RCPT" {
+				addr := strings.TrimSuffix(strings.TrimPrefix(arg, "TO:<"), ">")
+				resp = "250 2.1.5 Ok"
+				s.mu.Lock()
+				if s.rcptReply != nil {
+					if custom := s.rcptReply(addr); custom != "" {
+						resp = custom
+					}
+				}
+				s.mu.Unlock()
+				if strings.HasPrefix(resp, "2") {
+					rcpts = append(rcpts, addr)
+				}
+			} else {
+				rcpts = nil
+			}
+			if s.pipelining {
+				deferred = append(deferred, resp)
+			} else {
+				reply(resp)
+			}
+		case "DATA":
+			if s.pipelining {
+				s.mu.Lock()
+				s.batches = append(s.batches, batch)
+				s.mu.Unlock()
+				batch = nil
+			}
+			if len(rcpts) == 0 {
+				reply(append(deferred, "554 5.5.1 Error: no valid recipients")...)
+				deferred = nil
+				continue
+			}
+			reply(append(deferred, "354 End data with <CR><LF>.<CR><LF>")...)
+			deferred = nil
+			var data strings.Builder
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			if s.onData != nil {
+				s.onData()
+			}
+			s.mu.Lock()
+			s.dataCount++
+			resp := ""
+			if s.dataReply != nil {
+				resp = s.dataReply(s.dataCount)
+			}
+			if resp == "" {
+				s.accepted = append(s.accepted, rcpts)
+				s.messages = append(s.messages, data.String())
+				resp = "250 2.0.0 Ok: queued"
+			}
+			s.mu.Unlock()
+			reply(resp)
+		case "RSET", "NOOP":
+			rcpts = nil
+			reply(append(deferred, "250 2.0.0 Ok")...)
+			deferred, batch = nil, nil
+		case "QUIT":
+			reply(append(deferred, "221 2.0.0 Bye")...)
+			return
+		default:
+			reply("502 5.5.2 Error: command not recognized")
+			batch = nil
+		}
+	}
+}
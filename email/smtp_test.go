@@ -0,0 +1,573 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"email-service/clock"
+	"email-service/settings"
+)
+
+// updateGolden перезаписывает эталонные файлы testdata/*.golden: go test ./email -run Golden -update
+var updateGolden = flag.Bool("update", false, "перезаписать эталонные файлы testdata/*.golden")
+
+// newTestSMTPClient создает клиент, подключающийся к тестовому серверу
+func newTestSMTPClient(server *fakeSMTPServer) *SMTPClient {
+	return NewSMTPClient(&settings.SMTPConfig{
+		Host: "127.0.0.1",
+		Port: server.port(),
+		User: "sender@example.com",
+	})
+}
+
+func testRecipients(n int) []string {
+	recipients := make([]string, n)
+	for i := range recipients {
+		recipients[i] = fmt.Sprintf("user%d@example.org", i+1)
+	}
+	return recipients
+}
+
+func TestSendEmailPipelinesCommands(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.pipelining = true
+	client := newTestSMTPClient(server)
+	client.cfg.EnablePipelining = true
+
+	recipients := testRecipients(3)
+	if err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Title: "Тест", Text: "текст"}, recipients, false, false); err != nil {
+		t.Fatalf("отправка завершилась ошибкой: %v", err)
+	}
+
+	// MAIL, все RCPT и DATA уходят одной группой, не дожидаясь ответов сервера
+	batches, stalls := server.commandBatches()
+	want := [][]string{{"MAIL", "RCPT", "RCPT", "RCPT", "DATA"}}
+	if !reflect.DeepEqual(batches, want) || stalls != 0 {
+		t.Errorf("команды %v (ожиданий ответа %d), ожидалось %v без ожиданий", batches, stalls, want)
+	}
+	if got := server.acceptedRecipients(); !reflect.DeepEqual(got, [][]string{recipients}) {
+		t.Errorf("сервер принял %v, ожидалось %v", got, [][]string{recipients})
+	}
+}
+
+func TestSendEmailWithoutPipelining(t *testing.T) {
+	tests := []struct {
+		name             string
+		serverPipelining bool
+		clientPipelining bool
+		wantStalls       int
+	}{
+		// Опция выключена: клиент ждет ответа на MAIL и RCPT, хотя сервер поддерживает PIPELINING
+		{"опция выключена", true, false, 2},
+		// Сервер не объявляет PIPELINING: используется обычная последовательная отправка
+		{"сервер без PIPELINING", false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t)
+			server.pipelining = tt.serverPipelining
+			client := newTestSMTPClient(server)
+			client.cfg.EnablePipelining = tt.clientPipelining
+
+			recipients := testRecipients(1)
+			if err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, recipients, false, false); err != nil {
+				t.Fatalf("отправка завершилась ошибкой: %v", err)
+			}
+			if _, stalls := server.commandBatches(); stalls != tt.wantStalls {
+				t.Errorf("ожиданий ответа %d, ожидалось %d", stalls, tt.wantStalls)
+			}
+			if got := server.acceptedRecipients(); !reflect.DeepEqual(got, [][]string{recipients}) {
+				t.Errorf("сервер принял %v, ожидалось %v", got, [][]string{recipients})
+			}
+		})
+	}
+}
+
+func TestSendEmailRecipientRejected(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pipelining=%v", pipelining), func(t *testing.T) {
+			server := newFakeSMTPServer(t)
+			server.pipelining = pipelining
+			server.rcptReply = func(addr string) string {
+				if addr == "user2@example.org" {
+					return "550 5.1.1 User unknown"
+				}
+				return ""
+			}
+			client := newTestSMTPClient(server)
+			client.cfg.EnablePipelining = pipelining
+
+			err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(3), false, false)
+			var rejectedErr *RecipientsRejectedError
+			if !errors.As(err, &rejectedErr) || !errors.Is(err, ErrPartialDelivery) {
+				t.Fatalf("ошибка %v, ожидалась частичная доставка", err)
+			}
+			want := []RejectedRecipient{{Address: "user2@example.org", Code: 550, Message: "5.1.1 User unknown"}}
+			if !reflect.DeepEqual(rejectedErr.Rejected, want) || rejectedErr.Accepted != 2 {
+				t.Errorf("отклонены %+v (принято %d), ожидалось %+v", rejectedErr.Rejected, rejectedErr.Accepted, want)
+			}
+			// Письмо доставлено остальным получателям
+			if got := server.acceptedRecipients(); !reflect.DeepEqual(got, [][]string{{"user1@example.org", "user3@example.org"}}) {
+				t.Errorf("сервер принял %v", got)
+			}
+		})
+	}
+}
+
+func TestSendEmailRunsInParallel(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	server.onData = func() {
+		arrived <- struct{}{}
+		<-release
+	}
+	client := newTestSMTPClient(server)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := &EmailMessage{TaskID: int64(i), Text: "текст"}
+			errs <- client.SendEmail(context.Background(), msg, []string{fmt.Sprintf("user%d@example.org", i)}, false, false)
+		}(i)
+	}
+
+	// Обе отправки должны одновременно дойти до передачи данных: первая ждет ответа сервера,
+	// и если бы клиент держал блокировку на время отправки, вторая не началась бы
+	for i := 0; i < 2; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			close(release)
+			t.Fatalf("одновременно передаются данные только %d писем из 2: отправки выполняются последовательно", i)
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("отправка завершилась ошибкой: %v", err)
+		}
+	}
+
+	// Время отправки по адресам обновлено для обоих писем
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for _, addr := range []string{"user1@example.org", "user2@example.org"} {
+		if client.lastEmailTime[addr].IsZero() {
+			t.Errorf("время отправки для %s не сохранено", addr)
+		}
+	}
+}
+
+func TestWaitSendSlotSpacesParallelSends(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	client := NewSMTPClient(&settings.SMTPConfig{MinSendIntervalMsec: int(interval / time.Millisecond)})
+
+	// Параллельные отправки через один клиент начинаются не чаще одной за интервал
+	const senders = 4
+	begin := time.Now()
+	var mu sync.Mutex
+	var starts []time.Time
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.waitSendSlot(context.Background()); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i, start := range starts {
+		// Таймер не срабатывает раньше срока, поэтому i-я отправка начинается не раньше i интервалов
+		if elapsed := start.Sub(begin); elapsed < time.Duration(i)*interval {
+			t.Errorf("отправка %d началась через %v, ожидалось не раньше %v", i, elapsed, time.Duration(i)*interval)
+		}
+	}
+
+	// Ожидание слота прерывается отменой контекста
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client.mu.Lock()
+	client.lastSendTime = time.Now().Add(time.Hour)
+	client.mu.Unlock()
+	if err := client.waitSendSlot(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ошибка %v, ожидалась context.Canceled", err)
+	}
+}
+
+// mimeStructure возвращает структуру MIME частей письма, например
+// "multipart/mixed[multipart/alternative[text/plain,text/html],application/pdf]"
+func mimeStructure(t *testing.T, body string) string {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("письмо не разбирается: %v", err)
+	}
+	return mimePartStructure(t, msg.Header.Get("Content-Type"), msg.Body)
+}
+
+func mimePartStructure(t *testing.T, contentType string, body io.Reader) string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("некорректный Content-Type %q: %v", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return mediaType
+	}
+	if params["boundary"] == "" {
+		t.Fatalf("нет boundary в %q", contentType)
+	}
+
+	var parts []string
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ошибка чтения части %s: %v", mediaType, err)
+		}
+		parts = append(parts, mimePartStructure(t, part.Header.Get("Content-Type"), part))
+	}
+	return mediaType + "[" + strings.Join(parts, ",") + "]"
+}
+
+func TestBuildAlternativeBodyStructure(t *testing.T) {
+	const html = "<p>Счет <b>оплачен</b></p><img src=\"cid:logo.png\">"
+	pdf := AttachmentData{FileName: "счет.pdf", Data: []byte("%PDF-1.4")}
+	logo := AttachmentData{FileName: "logo.png", Data: []byte("\x89PNG")}
+
+	tests := []struct {
+		name        string
+		attachments []AttachmentData
+		inlineSize  int
+		want        string
+	}{
+		{"без вложений", nil, 0, "multipart/alternative[text/plain,text/html]"},
+		{"с вложением", []AttachmentData{pdf}, 0, "multipart/mixed[multipart/alternative[text/plain,text/html],application/pdf]"},
+		{"со встроенным изображением", []AttachmentData{logo}, 1024, "multipart/alternative[text/plain,multipart/related[text/html,image/png]]"},
+		{"с изображением и вложением", []AttachmentData{logo, pdf}, 1024,
+			"multipart/mixed[multipart/alternative[text/plain,multipart/related[text/html,image/png]],application/pdf]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", User: "sender@example.com"})
+			client.SetInlineImageMaxSize(tt.inlineSize)
+			msg := &EmailMessage{
+				TaskID:      1,
+				Title:       "Счет",
+				TextPlain:   htmlToPlainText(html),
+				TextHTML:    html,
+				Attachments: tt.attachments,
+			}
+			body := client.GetEmailBody(msg, []string{"user@example.org"}, true, false)
+
+			// text/plain идет перед text/html: по RFC 2046 последней указывается предпочтительная версия
+			if got := mimeStructure(t, body); got != tt.want {
+				t.Errorf("структура письма %s, ожидалось %s", got, tt.want)
+			}
+			if !strings.Contains(body, "\r\nСчет оплачен\r\n") {
+				t.Error("текстовая версия не содержит текста из HTML")
+			}
+		})
+	}
+}
+
+func TestBuildEmailMessageWithoutAlternative(t *testing.T) {
+	// Без обеих версий тела письмо формируется из Text, как и раньше
+	client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", User: "sender@example.com"})
+	msg := &EmailMessage{TaskID: 1, Text: "<p>Текст</p>", TextHTML: "<p>Текст</p>"}
+	body := client.GetEmailBody(msg, []string{"user@example.org"}, true, false)
+	if got := mimeStructure(t, body); got != "text/html" {
+		t.Errorf("структура письма %s, ожидалось text/html", got)
+	}
+}
+
+func TestBatchRecipients(t *testing.T) {
+	recipients := testRecipients(7)
+	tests := []struct {
+		name           string
+		perTransaction int
+		perConnection  int
+		want           [][]int // Число получателей в каждой транзакции по соединениям
+	}{
+		{"без ограничений", 0, 0, [][]int{{7}}},
+		{"по транзакциям", 3, 0, [][]int{{3, 3, 1}}},
+		{"по соединениям", 3, 2, [][]int{{3, 3}, {1}}},
+		{"по одной транзакции", 2, 1, [][]int{{2}, {2}, {2}, {1}}},
+		{"лимит больше списка", 10, 5, [][]int{{7}}},
+		{"отрицательные лимиты", -1, -1, [][]int{{7}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connections := batchRecipients(recipients, tt.perTransaction, tt.perConnection)
+			var got [][]int
+			var flat []string
+			for _, transactions := range connections {
+				var sizes []int
+				for _, batch := range transactions {
+					sizes = append(sizes, len(batch))
+					flat = append(flat, batch...)
+				}
+				got = append(got, sizes)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("разбиение %v, ожидалось %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(flat, recipients) {
+				t.Errorf("получатели после разбиения %v, ожидалось %v", flat, recipients)
+			}
+		})
+	}
+
+	if connections := batchRecipients(nil, 3, 2); len(connections) != 0 {
+		t.Errorf("пустой список разбит на %d соединений", len(connections))
+	}
+}
+
+func TestSendEmailBatchesTransactionsAndConnections(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	client := newTestSMTPClient(server)
+	client.cfg.MaxRecipientsPerTransaction = 2
+	client.cfg.MaxTransactionsPerConnection = 2
+
+	recipients := testRecipients(5)
+	msg := &EmailMessage{TaskID: 1, Title: "Отчет", Text: "Текст"}
+	if err := client.SendEmail(context.Background(), msg, recipients, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{recipients[0:2], recipients[2:4], recipients[4:5]}
+	if got := server.acceptedRecipients(); !reflect.DeepEqual(got, want) {
+		t.Errorf("транзакции %v, ожидалось %v", got, want)
+	}
+	if connections := server.connectionCount(); connections != 2 {
+		t.Errorf("соединений: %d, ожидалось 2 (не более 2 транзакций на соединение)", connections)
+	}
+}
+
+func TestSendEmailRetryResendsOnlyFailedTransactions(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	// Вторая транзакция первой попытки получает временный отказ
+	server.dataReply = func(n int) string {
+		if n == 2 {
+			return "451 4.3.0 Temporary local problem"
+		}
+		return ""
+	}
+	client := newTestSMTPClient(server)
+	client.cfg.MaxRecipientsPerTransaction = 1
+	client.cfg.SMTPMaxRetries = 2
+
+	recipients := testRecipients(3)
+	msg := &EmailMessage{TaskID: 2, Title: "Отчет", Text: "Текст"}
+	if err := client.SendEmail(context.Background(), msg, recipients, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Первая транзакция, принятая до отказа, при повторе не передается
+	want := [][]string{{recipients[0]}, {recipients[1]}, {recipients[2]}}
+	if got := server.acceptedRecipients(); !reflect.DeepEqual(got, want) {
+		t.Errorf("транзакции %v, ожидалось %v (каждый получатель ровно один раз)", got, want)
+	}
+}
+
+func TestSendEmailPartialDeliveryAfterRetries(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	// Все транзакции, кроме первой, получают временный отказ
+	server.dataReply = func(n int) string {
+		if n > 1 {
+			return "451 4.3.0 Temporary local problem"
+		}
+		return ""
+	}
+	client := newTestSMTPClient(server)
+	client.cfg.MaxRecipientsPerTransaction = 1
+	client.cfg.SMTPMaxRetries = 1
+
+	recipients := testRecipients(2)
+	msg := &EmailMessage{TaskID: 3, Title: "Отчет", Text: "Текст"}
+	err := client.SendEmail(context.Background(), msg, recipients, false, false)
+	if err == nil || !strings.Contains(err.Error(), "1 из 2") {
+		t.Fatalf("ошибка %v, ожидалась частичная доставка 1 из 2", err)
+	}
+	if got := server.acceptedRecipients(); len(got) != 1 {
+		t.Errorf("принято транзакций: %d, ожидалась 1", len(got))
+	}
+}
+
+// fixedBoundary - генератор boundary без зависимости от времени для сравнения письма с эталоном
+func fixedBoundary(kind string, taskID int64) string {
+	return fmt.Sprintf("%s_%d_fixed", kind, taskID)
+}
+
+func TestWriteEmailBodyGolden(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        *EmailMessage
+		isBodyHTML bool
+	}{
+		{
+			name: "simple",
+			msg:  &EmailMessage{TaskID: 10, Title: "Отчет за день", Text: "Текст письма"},
+		},
+		{
+			name: "mixed",
+			msg: &EmailMessage{
+				TaskID: 11,
+				Title:  "Report",
+				Text:   "См. вложение",
+				Attachments: []AttachmentData{
+					{FileName: "report.pdf", Data: []byte("%PDF-1.4 test")},
+				},
+			},
+		},
+		{
+			name: "alternative_related_mixed",
+			msg: &EmailMessage{
+				TaskID:    12,
+				Title:     "Рассылка",
+				TextPlain: "Текстовая версия",
+				TextHTML:  "<html><body><p>HTML версия</p></body></html>",
+				Language:  "ru",
+				Attachments: []AttachmentData{
+					{FileName: "logo.png", Data: []byte("\x89PNG test"), Inline: true},
+					{FileName: "report.pdf", Data: []byte("%PDF-1.4 test")},
+				},
+			},
+			isBodyHTML: true,
+		},
+	}
+
+	client := NewSMTPClient(&settings.SMTPConfig{
+		Host:        "smtp.example.com",
+		Port:        587,
+		User:        "sender@example.com",
+		DisplayName: "Рассылка",
+	})
+	client.SetBoundaryGenerator(fixedBoundary)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			recipients := []string{"user@example.org"}
+			if err := client.WriteEmailBody(&buf, tt.msg, recipients, tt.isBodyHTML, false); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("эталон не найден (go test ./email -run Golden -update): %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("письмо отличается от %s:\n%s", golden, buf.String())
+			}
+
+			// Повторное формирование дает то же письмо
+			var again bytes.Buffer
+			if err := client.WriteEmailBody(&again, tt.msg, recipients, tt.isBodyHTML, false); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+				t.Error("повторное формирование письма дает другой результат")
+			}
+		})
+	}
+}
+
+func TestSetBoundaryGeneratorDefault(t *testing.T) {
+	client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", User: "sender@example.com"})
+	client.SetBoundaryGenerator(fixedBoundary)
+	client.SetBoundaryGenerator(nil)
+	if got := client.boundary("boundary", 1); !strings.HasPrefix(got, "boundary_1_") || strings.HasSuffix(got, "_fixed") {
+		t.Errorf("boundary = %q, ожидался генератор по умолчанию", got)
+	}
+}
+
+func TestWaitSendSlotFakeClock(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC))
+	client := NewSMTPClient(&settings.SMTPConfig{Host: "smtp.example.com", MinSendIntervalMsec: 1000})
+	client.SetClock(clk)
+	ctx := context.Background()
+
+	// Первая отправка начинается сразу
+	if err := client.waitSendSlot(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Две следующие резервируют интервалы 1 и 2 секунды от первой
+	results := make(chan error, 2)
+	for range 2 {
+		go func() { results <- client.waitSendSlot(ctx) }()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for clk.Waiters() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("таймеров: %d, ожидалось 2", clk.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clk.Advance(999 * time.Millisecond)
+	select {
+	case <-results:
+		t.Fatal("отправка началась раньше MinSendIntervalMsec")
+	default:
+	}
+	clk.Advance(time.Millisecond)
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-results:
+		t.Fatal("вторая ожидающая отправка началась раньше своего интервала")
+	default:
+	}
+	clk.Advance(time.Second)
+	if err := <-results; err != nil {
+		t.Fatal(err)
+	}
+
+	// Отмена контекста прерывает ожидание
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := client.waitSendSlot(cancelCtx); err == nil {
+		t.Error("ожидание не прервано отменой контекста")
+	}
+}
@@ -0,0 +1,244 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+)
+
+// Режимы записи протокола обмена с SMTP сервером (параметр SMTPTranscript секции [Mode])
+const (
+	// SMTPTranscriptOff - протокол не записывается
+	SMTPTranscriptOff = "off"
+	// SMTPTranscriptLog - протокол записывается в лог
+	SMTPTranscriptLog = "log"
+	// SMTPTranscriptFile - протокол записывается в файл письма в каталоге SMTPTranscriptDir
+	SMTPTranscriptFile = "file"
+)
+
+const (
+	transcriptMaxLine = 512       // Строки протокола длиннее обрезаются
+	transcriptMaxSize = 64 * 1024 // Максимальный размер протокола одного письма
+)
+
+// normalizeSMTPTranscript приводит режим записи протокола SMTP к каноническому виду и проверяет его
+func normalizeSMTPTranscript(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return SMTPTranscriptOff, nil
+	case SMTPTranscriptOff, SMTPTranscriptLog, SMTPTranscriptFile:
+		return mode, nil
+	}
+	return "", fmt.Errorf("неизвестный режим SMTPTranscript %q (допустимо: %s, %s, %s)",
+		mode, SMTPTranscriptOff, SMTPTranscriptLog, SMTPTranscriptFile)
+}
+
+// SetTranscript включает запись протокола обмена с SMTP сервером (mode - SMTPTranscriptOff, Log или File,
+// dir - каталог файлов протокола для SMTPTranscriptFile)
+func (c *SMTPClient) SetTranscript(mode, dir string) {
+	c.transcriptMode = mode
+	c.transcriptDir = dir
+}
+
+// transcriptEnabled проверяет, включена ли запись протокола
+func (c *SMTPClient) transcriptEnabled() bool {
+	return c.transcriptMode == SMTPTranscriptLog || c.transcriptMode == SMTPTranscriptFile
+}
+
+// smtpTranscript записывает команды клиента и ответы SMTP сервера для отладки
+// Учетные данные AUTH заменяются на ***, вместо данных письма записывается их размер.
+// Протокол записывается над TLS: на порту 465 и после STARTTLS (startTLSWithTranscript) команды видны
+// в открытом виде
+type smtpTranscript struct {
+	mu        sync.Mutex
+	lines     bytes.Buffer
+	truncated bool
+
+	clientLine []byte // Неполная строка клиента
+	serverLine []byte // Неполная строка сервера
+	lastCmd    string // Последняя команда клиента (MAIL, DATA, STARTTLS...)
+	redactNext bool   // Следующая строка клиента - ответ на запрос AUTH (334), содержит учетные данные
+	inData     bool   // Клиент передает данные письма
+	dataSize   int
+	dataTail   []byte // Последние байты данных для поиска завершающей строки "."
+}
+
+// client обрабатывает данные, отправленные клиентом
+func (t *smtpTranscript) client(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(p) > 0 {
+		if t.inData {
+			p = t.consumeData(p)
+			continue
+		}
+		line, rest, ok := bytes.Cut(p, []byte("\n"))
+		t.clientLine = append(t.clientLine, line...)
+		if !ok {
+			return
+		}
+		t.clientCommand(strings.TrimRight(string(t.clientLine), "\r"))
+		t.clientLine = t.clientLine[:0]
+		p = rest
+	}
+}
+
+// consumeData считает данные письма до завершающей строки "." и возвращает данные после нее
+func (t *smtpTranscript) consumeData(p []byte) []byte {
+	joined := append(t.dataTail, p...)
+	if idx := bytes.Index(joined, []byte("\r\n.\r\n")); idx >= 0 {
+		end := idx + 5 - len(t.dataTail)
+		t.dataSize += end
+		t.add("C", fmt.Sprintf("<данные письма: %d байт>", t.dataSize-3))
+		t.add("C", ".")
+		t.inData = false
+		return p[end:]
+	}
+	t.dataSize += len(p)
+	if len(joined) > 4 {
+		joined = joined[len(joined)-4:]
+	}
+	t.dataTail = append(t.dataTail[:0], joined...)
+	return nil
+}
+
+// clientCommand записывает команду клиента, скрывая учетные данные
+func (t *smtpTranscript) clientCommand(line string) {
+	if t.redactNext {
+		t.redactNext = false
+		t.add("C", "***")
+		return
+	}
+	cmd, args, _ := strings.Cut(line, " ")
+	t.lastCmd = strings.ToUpper(cmd)
+	if t.lastCmd == "AUTH" {
+		mechanism, initial, _ := strings.Cut(args, " ")
+		if initial != "" {
+			line = cmd + " " + mechanism + " ***"
+		}
+	}
+	t.add("C", line)
+}
+
+// server обрабатывает данные, полученные от сервера
+func (t *smtpTranscript) server(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(p) > 0 {
+		line, rest, ok := bytes.Cut(p, []byte("\n"))
+		t.serverLine = append(t.serverLine, line...)
+		if !ok {
+			return
+		}
+		t.serverReply(strings.TrimRight(string(t.serverLine), "\r"))
+		t.serverLine = t.serverLine[:0]
+		p = rest
+	}
+}
+
+// serverReply записывает строку ответа сервера и отслеживает переходы протокола
+func (t *smtpTranscript) serverReply(line string) {
+	t.add("S", line)
+	if len(line) < 3 || (len(line) > 3 && line[3] == '-') {
+		return
+	}
+	switch code := line[:3]; {
+	case code == "334":
+		t.redactNext = true
+	case code == "354" && t.lastCmd == "DATA":
+		t.inData = true
+		t.dataSize = 0
+		t.dataTail = append(t.dataTail[:0], "\r\n"...)
+	case code == "220" && t.lastCmd == "STARTTLS":
+		t.add("*", "STARTTLS: дальнейший обмен записывается после расшифровки")
+	}
+}
+
+// add добавляет строку в протокол с учетом ограничений размера
+func (t *smtpTranscript) add(direction, line string) {
+	if t.truncated {
+		return
+	}
+	if len(line) > transcriptMaxLine {
+		line = line[:transcriptMaxLine] + "..."
+	}
+	if t.lines.Len()+len(line) > transcriptMaxSize {
+		t.lines.WriteString("* протокол обрезан\n")
+		t.truncated = true
+		return
+	}
+	fmt.Fprintf(&t.lines, "%s: %s\n", direction, line)
+}
+
+// take возвращает накопленный протокол и начинает новый
+func (t *smtpTranscript) take() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	text := t.lines.String()
+	t.lines.Reset()
+	t.truncated = false
+	return text
+}
+
+// transcriptConn передает данные соединения в протокол
+type transcriptConn struct {
+	net.Conn
+	t *smtpTranscript
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.t.server(p[:n])
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	c.t.client(p)
+	return c.Conn.Write(p)
+}
+
+// saveTranscript записывает протокол обмена по письму в лог или в файл <SMTPTranscriptDir>/smtp_<taskID>.log
+func (c *SMTPClient) saveTranscript(taskID int64, t *smtpTranscript) {
+	text := t.take()
+	if text == "" {
+		return
+	}
+
+	if c.transcriptMode == SMTPTranscriptLog {
+		if logger.Log != nil {
+			logger.Log.Info("Протокол обмена с SMTP сервером",
+				zap.Int64("taskID", taskID),
+				zap.String("host", c.cfg.Host),
+				zap.String("transcript", text))
+		}
+		return
+	}
+
+	path := filepath.Join(c.transcriptDir, fmt.Sprintf("smtp_%d.log", taskID))
+	header := fmt.Sprintf("=== %s %s:%d\n", c.clock.Now().Format("2006-01-02 15:04:05"), c.cfg.Host, c.cfg.Port)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err == nil {
+		_, err = f.WriteString(header + text)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil && logger.Log != nil {
+		logger.Log.Warn("Не удалось записать протокол обмена с SMTP сервером",
+			zap.Int64("taskID", taskID),
+			zap.String("path", path),
+			zap.Error(err))
+	}
+}
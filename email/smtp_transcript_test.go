@@ -0,0 +1,153 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"email-service/settings"
+)
+
+func TestSMTPTranscriptRedactsAuth(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("\x00sender@example.com\x00p@ssw0rd"))
+	tr := &smtpTranscript{}
+
+	tr.server([]byte("220 mx.example.com ESMTP\r\n"))
+	tr.client([]byte("EHLO client.example.com\r\n"))
+	tr.server([]byte("250-mx.example.com\r\n250 AUTH PLAIN LOGIN\r\n"))
+	// Начальный ответ AUTH PLAIN в той же строке
+	tr.client([]byte("AUTH PLAIN " + secret + "\r\n"))
+	tr.server([]byte("235 2.7.0 Authentication successful\r\n"))
+	// AUTH LOGIN: учетные данные передаются в ответ на 334, в том числе частями
+	tr.client([]byte("AUTH LOGIN\r\n"))
+	tr.server([]byte("334 VXNlcm5hbWU6\r\n"))
+	tr.client([]byte("c2VuZGVy"))
+	tr.client([]byte("QGV4YW1wbGUuY29t\r\n"))
+	tr.server([]byte("334 UGFzc3dvcmQ6\r\n"))
+	tr.client([]byte("cEBzc3cwcmQ=\r\n"))
+	tr.server([]byte("235 2.7.0 Authentication successful\r\n"))
+
+	text := tr.take()
+	for _, leaked := range []string{secret, "c2VuZGVyQGV4YW1wbGUuY29t", "cEBzc3cwcmQ="} {
+		if strings.Contains(text, leaked) {
+			t.Errorf("учетные данные %q попали в протокол:\n%s", leaked, text)
+		}
+	}
+	for _, want := range []string{"C: EHLO client.example.com", "C: AUTH PLAIN ***", "C: AUTH LOGIN", "C: ***", "S: 235 2.7.0"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("протокол не содержит %q:\n%s", want, text)
+		}
+	}
+	if tr.take() != "" {
+		t.Error("take не очистил протокол")
+	}
+}
+
+func TestSMTPTranscriptDataSize(t *testing.T) {
+	tr := &smtpTranscript{}
+	tr.client([]byte("DATA\r\n"))
+	tr.server([]byte("354 End data with <CR><LF>.<CR><LF>\r\n"))
+	// Данные письма и завершающая точка приходят несколькими частями
+	tr.client([]byte("Subject: secret\r\n\r\nline one\r"))
+	tr.client([]byte("\nline two\r\n."))
+	tr.client([]byte("\r\nQUIT\r\n"))
+	tr.server([]byte("250 2.0.0 Ok: queued\r\n"))
+
+	text := tr.take()
+	if strings.Contains(text, "secret") || strings.Contains(text, "line one") {
+		t.Errorf("текст письма попал в протокол:\n%s", text)
+	}
+	for _, want := range []string{"C: <данные письма: 39 байт>", "C: .", "C: QUIT", "S: 250 2.0.0 Ok: queued"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("протокол не содержит %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestSendEmailTranscriptAfterStartTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	server := newFakeSMTPServer(t)
+	server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	dir := t.TempDir()
+	client := NewSMTPClient(&settings.SMTPConfig{
+		Host:       "127.0.0.1",
+		Port:       server.port(),
+		User:       "sender@example.com",
+		Password:   "p@ssw0rd",
+		EnableSSL:  true,
+		HeloName:   "client.example.com",
+		TLSRootCAs: pool,
+	})
+	client.SetTranscript(SMTPTranscriptFile, dir)
+
+	msg := &EmailMessage{TaskID: 77, Title: "Отчет", Text: "Текст письма"}
+	if err := client.SendEmail(context.Background(), msg, []string{"user@example.org"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.acceptedRecipients(); len(got) != 1 {
+		t.Fatalf("принято транзакций: %d, ожидалась 1", len(got))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "smtp_77.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+
+	// Команды после STARTTLS записываются в открытом виде
+	want := []string{
+		"C: EHLO client.example.com",
+		"C: STARTTLS",
+		"S: 220 2.0.0 Ready to start TLS",
+		"C: AUTH PLAIN ***",
+		"C: MAIL FROM:<sender@example.com>",
+		"C: RCPT TO:<user@example.org>",
+		"C: DATA",
+		"S: 250 2.0.0 Ok: queued",
+	}
+	pos := 0
+	for _, line := range want {
+		idx := strings.Index(text[pos:], line)
+		if idx < 0 {
+			t.Fatalf("протокол не содержит %q после предыдущих строк:\n%s", line, text)
+		}
+		pos += idx + len(line)
+	}
+	if strings.Count(text, "C: EHLO client.example.com") != 2 {
+		t.Errorf("EHLO должен быть отправлен до и после STARTTLS:\n%s", text)
+	}
+	if strings.Contains(text, base64.StdEncoding.EncodeToString([]byte("\x00sender@example.com\x00p@ssw0rd"))) {
+		t.Errorf("учетные данные попали в протокол:\n%s", text)
+	}
+	if strings.Contains(text, "220 127.0.0.1") {
+		t.Errorf("подставленное приветствие попало в протокол:\n%s", text)
+	}
+}
+
+func TestSendEmailStartTLSWithoutTranscript(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	server := newFakeSMTPServer(t)
+	server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	client := NewSMTPClient(&settings.SMTPConfig{
+		Host:       "127.0.0.1",
+		Port:       server.port(),
+		User:       "sender@example.com",
+		Password:   "p@ssw0rd",
+		EnableSSL:  true,
+		TLSRootCAs: pool,
+	})
+
+	msg := &EmailMessage{TaskID: 78, Title: "Отчет", Text: "Текст письма"}
+	if err := client.SendEmail(context.Background(), msg, []string{"user@example.org"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.acceptedRecipients(); len(got) != 1 {
+		t.Errorf("принято транзакций: %d, ожидалась 1", len(got))
+	}
+}
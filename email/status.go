@@ -0,0 +1,52 @@
+package email
+
+import "email-service/settings"
+
+// Status - статус письма. Числовой код для записи в БД определяется секцией [Status] конфигурации (Code)
+type Status int
+
+const (
+	// StatusNone - статус не определен (например, bounce для письма не найден в папке)
+	StatusNone Status = iota
+	// StatusSent - письмо отправлено
+	StatusSent
+	// StatusFailed - ошибка отправки или доставки
+	StatusFailed
+	// StatusDelivered - письмо доставлено (bounce не найден)
+	StatusDelivered
+	// StatusPartial - письмо отправлено, но часть получателей отклонена SMTP сервером
+	StatusPartial
+)
+
+// String возвращает название статуса для логов
+func (st Status) String() string {
+	switch st {
+	case StatusSent:
+		return "sent"
+	case StatusFailed:
+		return "failed"
+	case StatusDelivered:
+		return "delivered"
+	case StatusPartial:
+		return "partial"
+	default:
+		return "none"
+	}
+}
+
+// Code возвращает числовой код статуса для записи в БД
+// Для StatusNone возвращается 0: такой статус в БД не записывается
+func (st Status) Code(codes settings.StatusConfig) int {
+	switch st {
+	case StatusSent:
+		return codes.Sent
+	case StatusFailed:
+		return codes.Failed
+	case StatusDelivered:
+		return codes.Delivered
+	case StatusPartial:
+		return codes.Partial
+	default:
+		return 0
+	}
+}
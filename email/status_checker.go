@@ -8,6 +8,7 @@ import (
 
 	"go.uber.org/zap"
 
+	"email-service/clock"
 	"email-service/logger"
 	"email-service/settings"
 )
@@ -23,15 +24,25 @@ type SentEmailInfo struct {
 // StatusUpdateCallback функция для обновления статуса письма
 // statusDesc - описание статуса для логирования
 // errorText - текст ошибки для записи в error_text (может быть пустым)
-type StatusUpdateCallback func(taskID int64, status int, statusDesc string, errorText string)
+// eventTime - время события доставки по данным bounce message (нулевое - используется время обработки)
+type StatusUpdateCallback func(taskID int64, status Status, statusDesc string, errorText string, eventTime time.Time)
 
 // StatusChecker отвечает за проверку статуса отправленных писем через IMAP
 type StatusChecker struct {
 	cfg                  *settings.Config
 	statusCheckChan      chan *SentEmailInfo
 	statusUpdateCallback StatusUpdateCallback
-	sentEmails           map[int64]*SentEmailInfo // Ключ - taskID
+	sentEmails           map[int64]*SentEmailInfo // Последняя отправка письма, ожидающая проверки (ключ - taskID)
 	sentEmailsMu         sync.RWMutex
+	wg                   sync.WaitGroup // Горутина проверки и запланированные проверки статусов
+	clock                clock.Clock    // Источник времени для задержки перед проверкой
+	bounceCache          *bounceCache   // Просмотренные bounce messages, общие для всех проверок
+
+	// Письма, для которых наступило время проверки, по SmtpID: проверяются пакетом в одном сеансе IMAP
+	due       map[int][]*SentEmailInfo
+	checking  map[int]bool // SmtpID, пакет которых проверяется сейчас
+	dueMu     sync.Mutex
+	dueSignal chan struct{}
 }
 
 // NewStatusChecker создает новый checker статусов
@@ -41,12 +52,63 @@ func NewStatusChecker(cfg *settings.Config, statusCallback StatusUpdateCallback)
 		statusCheckChan:      make(chan *SentEmailInfo, 2000),
 		statusUpdateCallback: statusCallback,
 		sentEmails:           make(map[int64]*SentEmailInfo),
+		clock:                clock.Real,
+		bounceCache:          newBounceCache(),
+		due:                  make(map[int][]*SentEmailInfo),
+		checking:             make(map[int]bool),
+		dueSignal:            make(chan struct{}, 1),
+	}
+}
+
+// SetClock устанавливает источник времени (nil - системные часы)
+func (sc *StatusChecker) SetClock(clk clock.Clock) {
+	if clk == nil {
+		clk = clock.Real
 	}
+	sc.clock = clk
 }
 
-// Start запускает горутину для проверки статусов
+// Start запускает горутины планирования и пакетной проверки статусов, а также сеансы IMAP IDLE
+// для SMTP серверов с IMAPUseIdle
 func (sc *StatusChecker) Start(ctx context.Context) {
-	go sc.statusChecker(ctx)
+	sc.wg.Add(2)
+	go func() {
+		defer sc.wg.Done()
+		sc.statusChecker(ctx)
+	}()
+	go func() {
+		defer sc.wg.Done()
+		sc.batchChecker(ctx)
+	}()
+
+	for i := range sc.cfg.SMTP {
+		smtpCfg := &sc.cfg.SMTP[i]
+		if !smtpCfg.IMAPUseIdle || smtpCfg.IMAPHost == "" {
+			continue
+		}
+		sc.wg.Add(1)
+		go func(smtpID int) {
+			defer sc.wg.Done()
+			sc.idleWatcher(ctx, smtpID, smtpCfg)
+		}(i)
+	}
+}
+
+// Wait дожидается завершения горутины проверки и всех запущенных проверок статусов
+// после отмены контекста, переданного в Start. Возвращает false, если истек timeout
+func (sc *StatusChecker) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		sc.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 // ScheduleCheck планирует проверку статуса письма через 30 секунд после отправки
@@ -62,6 +124,12 @@ func (sc *StatusChecker) ScheduleCheck(sentInfo *SentEmailInfo) {
 	select {
 	case sc.statusCheckChan <- sentInfo:
 	default:
+		// Очередь проверок переполнена: проверка не выполняется, отправку не храним
+		sc.sentEmailsMu.Lock()
+		if sc.sentEmails[sentInfo.TaskID] == sentInfo {
+			delete(sc.sentEmails, sentInfo.TaskID)
+		}
+		sc.sentEmailsMu.Unlock()
 	}
 }
 
@@ -83,101 +151,264 @@ func (sc *StatusChecker) statusChecker(ctx context.Context) {
 					zap.Duration("delay", 30*time.Second))
 			}
 
+			sc.wg.Add(1)
 			go func(info *SentEmailInfo) {
+				defer sc.wg.Done()
 				select {
 				case <-ctx.Done():
 					return
-				case <-time.After(30 * time.Second):
+				case <-sc.clock.After(30 * time.Second):
 					if logger.Log != nil {
 						logger.Log.Debug("Начало проверки статуса письма",
 							zap.Int64("taskID", info.TaskID),
 							zap.String("messageID", info.MessageID))
 					}
-					sc.checkEmailStatus(ctx, info)
+					if !sc.isLatest(info) {
+						sc.logStaleCheck(info)
+						return
+					}
+					sc.addDue(info)
 				}
 			}(sentInfo)
 		}
 	}
 }
 
-// checkEmailStatus проверяет статус письма через IMAP
-func (sc *StatusChecker) checkEmailStatus(ctx context.Context, sentInfo *SentEmailInfo) {
-	if sentInfo == nil {
-		if logger.Log != nil {
-			logger.Log.Warn("checkEmailStatus вызван с nil sentInfo")
+// addDue добавляет письмо в пакет проверки его SMTP сервера
+func (sc *StatusChecker) addDue(sentInfo *SentEmailInfo) {
+	sc.dueMu.Lock()
+	sc.due[sentInfo.SmtpID] = append(sc.due[sentInfo.SmtpID], sentInfo)
+	sc.dueMu.Unlock()
+
+	select {
+	case sc.dueSignal <- struct{}{}:
+	default:
+	}
+}
+
+// takeDue забирает накопленные пакеты SMTP серверов, пакет которых сейчас не проверяется,
+// и отмечает эти серверы занятыми до finishBatch
+func (sc *StatusChecker) takeDue() map[int][]*SentEmailInfo {
+	sc.dueMu.Lock()
+	defer sc.dueMu.Unlock()
+	batches := make(map[int][]*SentEmailInfo)
+	for smtpID, batch := range sc.due {
+		if sc.checking[smtpID] {
+			continue
 		}
-		return
+		batches[smtpID] = batch
+		sc.checking[smtpID] = true
+		delete(sc.due, smtpID)
 	}
+	return batches
+}
 
-	if sentInfo.SmtpID < 0 || sentInfo.SmtpID >= len(sc.cfg.SMTP) {
-		if logger.Log != nil {
-			logger.Log.Warn("Некорректный SmtpID для проверки статуса",
-				zap.Int64("taskID", sentInfo.TaskID),
-				zap.Int("smtpID", sentInfo.SmtpID),
-				zap.Int("smtpCount", len(sc.cfg.SMTP)))
+// finishBatch снимает отметку проверки с SMTP сервера
+// Письма, накопившиеся за время проверки, проверяются следующим пакетом
+func (sc *StatusChecker) finishBatch(smtpID int) {
+	sc.dueMu.Lock()
+	delete(sc.checking, smtpID)
+	pending := len(sc.due[smtpID]) > 0
+	sc.dueMu.Unlock()
+
+	if pending {
+		select {
+		case sc.dueSignal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// batchChecker проверяет письма, для которых наступило время проверки
+// Письма одного SMTP сервера, накопившиеся к началу проверки, проверяются в одном сеансе IMAP;
+// пакеты разных серверов проверяются параллельно, чтобы недоступный IMAP сервер не задерживал остальные
+func (sc *StatusChecker) batchChecker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sc.dueSignal:
+			for smtpID, batch := range sc.takeDue() {
+				if ctx.Err() != nil {
+					return
+				}
+				sc.wg.Add(1)
+				go func(smtpID int, batch []*SentEmailInfo) {
+					defer sc.wg.Done()
+					defer sc.finishBatch(smtpID)
+					sc.checkBatch(ctx, smtpID, batch)
+				}(smtpID, batch)
+			}
+		}
+	}
+}
+
+// checkBatch проверяет статусы писем одного SMTP сервера через IMAP
+// Соединение и аутентификация выполняются один раз на пакет; после ошибки проверки или таймаута
+// команды SEARCH/FETCH сеанс закрывается и для следующего письма открывается заново. Если не удалось подключиться
+// или войти, остальные письма пакета получают ту же ошибку без повторных попыток
+func (sc *StatusChecker) checkBatch(ctx context.Context, smtpID int, batch []*SentEmailInfo) {
+	if smtpID < 0 || smtpID >= len(sc.cfg.SMTP) {
+		for _, sentInfo := range batch {
+			if logger.Log != nil {
+				logger.Log.Warn("Некорректный SmtpID для проверки статуса",
+					zap.Int64("taskID", sentInfo.TaskID),
+					zap.Int("smtpID", sentInfo.SmtpID),
+					zap.Int("smtpCount", len(sc.cfg.SMTP)))
+			}
+			sc.reportStatus(sentInfo, StatusFailed, "Некорректный SmtpID", "Некорректный SmtpID")
 		}
-		sc.updateEmailStatus(sentInfo.TaskID, 3, "Некорректный SmtpID", "Некорректный SmtpID")
 		return
 	}
-	smtpCfg := &sc.cfg.SMTP[sentInfo.SmtpID]
+	smtpCfg := &sc.cfg.SMTP[smtpID]
 
 	if smtpCfg.IMAPHost == "" {
-		if logger.Log != nil {
-			logger.Log.Debug("IMAP не настроен для проверки статуса",
-				zap.Int64("taskID", sentInfo.TaskID),
-				zap.Int("smtpID", sentInfo.SmtpID))
+		for _, sentInfo := range batch {
+			if logger.Log != nil {
+				logger.Log.Debug("IMAP не настроен для проверки статуса",
+					zap.Int64("taskID", sentInfo.TaskID),
+					zap.Int("smtpID", sentInfo.SmtpID))
+			}
+			// Если IMAP не настроен, считаем письмо доставленным
+			sc.reportStatus(sentInfo, StatusDelivered, "IMAP не настроен, статус не проверяется", "")
 		}
-		// Если IMAP не настроен, считаем письмо успешно отправленным (статус 4)
-		sc.updateEmailStatus(sentInfo.TaskID, 4, "IMAP не настроен, статус не проверяется", "")
 		return
 	}
 
 	imapClient := NewIMAPClient(smtpCfg)
-	status, statusDesc, err := imapClient.CheckEmailStatus(ctx, sentInfo.MessageID)
+	imapClient.SetUnknownDSNActionAsFailure(sc.cfg.Mode.UnknownDSNActionAsFailure)
+	imapClient.SetBounceCache(sc.bounceCache)
+	defer imapClient.Logout()
+
+	if logger.Log != nil && len(batch) > 1 {
+		logger.Log.Debug("Пакетная проверка статусов писем в одном сеансе IMAP",
+			zap.Int("smtpID", smtpID),
+			zap.Int("count", len(batch)))
+	}
+
+	var connErr error // Ошибка подключения или входа: сервер недоступен до конца пакета
+	for _, sentInfo := range batch {
+		if ctx.Err() != nil {
+			return
+		}
+		if !sc.isLatest(sentInfo) {
+			sc.logStaleCheck(sentInfo)
+			continue
+		}
+
+		if connErr == nil && !imapClient.Connected() {
+			connErr = imapClient.Connect()
+			if connErr == nil {
+				if connErr = imapClient.Login(); connErr != nil {
+					imapClient.Logout()
+				}
+			}
+		}
+		if connErr != nil {
+			sc.handleCheckResult(sentInfo, imapClient, StatusDelivered, "", time.Time{}, connErr)
+			continue
+		}
+
+		status, statusDesc, eventTime, err := imapClient.CheckEmailStatus(ctx, sentInfo.MessageID)
+		if err != nil || imapClient.interrupted {
+			// Состояние сеанса после ошибки или прерванной по таймауту команды не определено,
+			// повторно его не используем
+			imapClient.Logout()
+		}
+		sc.handleCheckResult(sentInfo, imapClient, status, statusDesc, eventTime, err)
+		// Статус уже записан, поэтому ошибка действия с bounce его не затрагивает
+		imapClient.applyBounceActions()
+	}
+}
+
+// handleCheckResult записывает результат проверки статуса письма через IMAP
+func (sc *StatusChecker) handleCheckResult(sentInfo *SentEmailInfo, imapClient *IMAPClient, status Status, statusDesc string, eventTime time.Time, err error) {
 	if err != nil {
 		// Проверяем, является ли ошибка таймаутом
 		if err == context.DeadlineExceeded || err == context.Canceled {
-			// При таймауте оставляем статус 2 (отправлено), но записываем сообщение в error_text
-			timeoutMsg := fmt.Sprintf("Не уложились в таймаут проверки статуса через IMAP сервер (35 секунд): %v", err)
+			// При таймауте оставляем статус "отправлено", но записываем сообщение в error_text
+			timeoutMsg := fmt.Sprintf("Не уложились в таймаут проверки статуса через IMAP сервер (%s): %v", imapClient.operationTimeout(), err)
 			if logger.Log != nil {
 				logger.Log.Warn("Таймаут проверки статуса через IMAP",
 					zap.Int64("taskID", sentInfo.TaskID),
 					zap.String("messageID", sentInfo.MessageID),
 					zap.Error(err))
 			}
-			sc.updateEmailStatus(sentInfo.TaskID, 2, "Проверка статуса не завершена из-за таймаута", timeoutMsg)
+			sc.reportStatus(sentInfo, StatusSent, "Проверка статуса не завершена из-за таймаута", timeoutMsg)
 			return
 		}
 
-		// Для других ошибок устанавливаем статус 3 (ошибка)
+		// Для других ошибок устанавливаем статус ошибки
 		if logger.Log != nil {
 			logger.Log.Error("Ошибка проверки статуса через IMAP",
 				zap.Int64("taskID", sentInfo.TaskID),
 				zap.String("messageID", sentInfo.MessageID),
 				zap.Error(err))
 		}
-		sc.updateEmailStatus(sentInfo.TaskID, 3, fmt.Sprintf("Ошибка проверки статуса через IMAP: %v", err), fmt.Sprintf("Ошибка проверки статуса через IMAP: %v", err))
+		sc.reportStatus(sentInfo, StatusFailed, fmt.Sprintf("Ошибка проверки статуса через IMAP: %v", err), fmt.Sprintf("Ошибка проверки статуса через IMAP: %v", err))
 		return
 	}
 
 	if logger.Log != nil {
 		logger.Log.Info("Статус письма проверен",
 			zap.Int64("taskID", sentInfo.TaskID),
-			zap.Int("status", status),
+			zap.Stringer("status", status),
 			zap.String("statusDesc", statusDesc))
 	}
 
-	// Для успешных проверок errorText пустой (заполняется только при статусе 3)
+	// Для успешных проверок errorText пустой (заполняется только при статусе ошибки)
 	errorText := ""
-	if status == 3 {
+	if status == StatusFailed {
 		errorText = statusDesc
 	}
-	sc.updateEmailStatus(sentInfo.TaskID, status, statusDesc, errorText)
+	sc.reportStatusAt(sentInfo, status, statusDesc, errorText, eventTime)
+}
+
+// isLatest проверяет, что проверка относится к последней отправке письма
+// Если письмо отправлено повторно до завершения проверки, результат проверки более ранней
+// отправки не записывается. Сравнивается сама отправка, а не только Message-ID:
+// Message-ID формируется из taskID и при повторной отправке совпадает
+func (sc *StatusChecker) isLatest(sentInfo *SentEmailInfo) bool {
+	sc.sentEmailsMu.RLock()
+	defer sc.sentEmailsMu.RUnlock()
+	return sc.sentEmails[sentInfo.TaskID] == sentInfo
+}
+
+// reportStatus записывает результат проверки последней отправки письма на время обработки
+func (sc *StatusChecker) reportStatus(sentInfo *SentEmailInfo, status Status, statusDesc string, errorText string) {
+	sc.reportStatusAt(sentInfo, status, statusDesc, errorText, time.Time{})
+}
+
+// reportStatusAt записывает результат проверки последней отправки письма с временем события eventTime
+// и удаляет ее из ожидающих; результат устаревшей проверки отбрасывается
+func (sc *StatusChecker) reportStatusAt(sentInfo *SentEmailInfo, status Status, statusDesc string, errorText string, eventTime time.Time) {
+	sc.sentEmailsMu.Lock()
+	latest := sc.sentEmails[sentInfo.TaskID] == sentInfo
+	if latest {
+		delete(sc.sentEmails, sentInfo.TaskID)
+	}
+	sc.sentEmailsMu.Unlock()
+
+	if !latest {
+		sc.logStaleCheck(sentInfo)
+		return
+	}
+	sc.updateEmailStatus(sentInfo.TaskID, status, statusDesc, errorText, eventTime)
+}
+
+// logStaleCheck логирует отброшенную проверку статуса более ранней отправки письма
+func (sc *StatusChecker) logStaleCheck(sentInfo *SentEmailInfo) {
+	if logger.Log != nil {
+		logger.Log.Debug("Проверка статуса отброшена: письмо отправлено повторно или bounce уже найден",
+			zap.Int64("taskID", sentInfo.TaskID),
+			zap.String("messageID", sentInfo.MessageID),
+			zap.Time("sendTime", sentInfo.SendTime))
+	}
 }
 
 // updateEmailStatus обновляет статус письма в БД через callback
-func (sc *StatusChecker) updateEmailStatus(taskID int64, status int, statusDesc string, errorText string) {
+func (sc *StatusChecker) updateEmailStatus(taskID int64, status Status, statusDesc string, errorText string, eventTime time.Time) {
 	if sc.statusUpdateCallback != nil {
-		sc.statusUpdateCallback(taskID, status, statusDesc, errorText)
+		sc.statusUpdateCallback(taskID, status, statusDesc, errorText, eventTime)
 	}
 }
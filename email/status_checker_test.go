@@ -0,0 +1,364 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"email-service/clock"
+	"email-service/settings"
+)
+
+// statusResult - результат проверки статуса, переданный в StatusUpdateCallback
+type statusResult struct {
+	status    Status
+	errorText string
+	eventTime time.Time
+}
+
+// statusRecorder собирает результаты проверки статусов по taskID
+type statusRecorder struct {
+	mu      sync.Mutex
+	results map[int64]statusResult
+}
+
+func newStatusRecorder() *statusRecorder {
+	return &statusRecorder{results: make(map[int64]statusResult)}
+}
+
+func (r *statusRecorder) callback(taskID int64, status Status, statusDesc string, errorText string, eventTime time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[taskID] = statusResult{status: status, errorText: errorText, eventTime: eventTime}
+}
+
+func (r *statusRecorder) get(taskID int64) (statusResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, ok := r.results[taskID]
+	return result, ok
+}
+
+// scheduleTestChecks регистрирует отправки писем с taskID для сервера smtpID и возвращает их
+func scheduleTestChecks(sc *StatusChecker, smtpID int, taskIDs ...int64) []*SentEmailInfo {
+	infos := make([]*SentEmailInfo, 0, len(taskIDs))
+	for _, taskID := range taskIDs {
+		info := &SentEmailInfo{TaskID: taskID, SmtpID: smtpID, MessageID: testMessageID(taskID)}
+		sc.ScheduleCheck(info)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// testMessageID возвращает Message-ID тестового письма
+func testMessageID(taskID int64) string {
+	return fmt.Sprintf("<task%d@example.com>", taskID)
+}
+
+func TestCheckBatchUsesOneIMAPSession(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	server.addMailbox("Junk", imap.JunkAttr)
+	server.addMessage("Junk", testBounceMessage(testMessageID(2), "missing@example.org"))
+
+	recorder := newStatusRecorder()
+	sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{server.smtpConfig()}}, recorder.callback)
+	batch := scheduleTestChecks(sc, 0, 1, 2, 3)
+
+	sc.checkBatch(context.Background(), 0, batch)
+
+	if got := server.loginCount(); got != 1 {
+		t.Errorf("выполнено %d входов на IMAP сервер, ожидался 1 на пакет", got)
+	}
+	for taskID, want := range map[int64]Status{1: StatusDelivered, 2: StatusFailed, 3: StatusDelivered} {
+		result, ok := recorder.get(taskID)
+		if !ok || result.status != want {
+			t.Errorf("задача %d: статус %v (записан: %v), ожидался %v", taskID, result.status, ok, want)
+		}
+	}
+	if result, _ := recorder.get(2); result.errorText == "" || !result.eventTime.Equal(testBounceTime) {
+		t.Errorf("недоставленное письмо: описание %q, время %v; ожидалось время из DSN %v", result.errorText, result.eventTime, testBounceTime)
+	}
+}
+
+func TestCheckBatchSkipsStaleChecks(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	recorder := newStatusRecorder()
+	sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{server.smtpConfig()}}, recorder.callback)
+	stale := scheduleTestChecks(sc, 0, 1)
+	// Повторная отправка письма до проверки: результат первой отправки не записывается
+	scheduleTestChecks(sc, 0, 1)
+
+	sc.checkBatch(context.Background(), 0, stale)
+
+	if _, ok := recorder.get(1); ok {
+		t.Error("записан результат проверки устаревшей отправки")
+	}
+	if got := server.loginCount(); got != 0 {
+		t.Errorf("для устаревшей проверки выполнено %d входов", got)
+	}
+}
+
+func TestCheckBatchStopsAfterLoginFailure(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	cfg := server.smtpConfig()
+	cfg.Password = "wrong"
+
+	recorder := newStatusRecorder()
+	sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{cfg}}, recorder.callback)
+	sc.checkBatch(context.Background(), 0, scheduleTestChecks(sc, 0, 1, 2, 3))
+
+	if got := server.loginAttempts(); got != 1 {
+		t.Errorf("выполнено %d попыток входа, ожидалась 1 на пакет", got)
+	}
+	for taskID := int64(1); taskID <= 3; taskID++ {
+		result, ok := recorder.get(taskID)
+		if !ok || result.status != StatusFailed || !strings.Contains(result.errorText, "Ошибка проверки статуса через IMAP") {
+			t.Errorf("задача %d: статус %v (записан: %v), ошибка %q; ожидалась ошибка входа", taskID, result.status, ok, result.errorText)
+		}
+	}
+}
+
+func TestCheckBatchDropsSessionAfterCommandTimeout(t *testing.T) {
+	for _, cmd := range []string{"SEARCH", "FETCH BODY"} {
+		t.Run(cmd, func(t *testing.T) {
+			server := newFakeIMAPServer(t)
+			server.addMessage("INBOX", testBounceMessage(testMessageID(1), "missing@example.org"))
+			server.stallCommand(t, cmd)
+			cfg := server.smtpConfig()
+			cfg.IMAPFolderTimeoutSec = 1
+			cfg.IMAPFetchTimeoutSec = 1
+
+			recorder := newStatusRecorder()
+			sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{cfg}}, recorder.callback)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				sc.checkBatch(context.Background(), 0, scheduleTestChecks(sc, 0, 1, 2))
+			}()
+			// Закрытие сеанса не ждет ответа на LOGOUT от сервера, занятого прерванной командой
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("пакетная проверка не завершилась после таймаута команды")
+			}
+
+			// После таймаута команды сеанс не используется повторно: второе письмо проверяется в новом
+			if got := server.loginCount(); got != 2 {
+				t.Errorf("выполнено %d входов, ожидалось 2 (новый сеанс после таймаута)", got)
+			}
+			for taskID := int64(1); taskID <= 2; taskID++ {
+				if _, ok := recorder.get(taskID); !ok {
+					t.Errorf("задача %d: статус не записан", taskID)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchCheckerChecksServersInParallel(t *testing.T) {
+	// IMAP сервер, который принимает соединение и не отвечает
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	var connsMu sync.Mutex
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			conns = append(conns, conn)
+			connsMu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		stalled.Close()
+		connsMu.Lock()
+		defer connsMu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	server := newFakeIMAPServer(t)
+	stalledCfg := server.smtpConfig()
+	stalledCfg.IMAPPort = stalled.Addr().(*net.TCPAddr).Port
+	stalledCfg.IMAPConnectTimeoutSec = 3
+
+	recorder := newStatusRecorder()
+	sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{stalledCfg, server.smtpConfig()}}, recorder.callback)
+	clk := clock.NewFake(time.Now())
+	sc.SetClock(clk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc.Start(ctx)
+	scheduleTestChecks(sc, 0, 1)
+	scheduleTestChecks(sc, 1, 2)
+	waitFor(t, 5*time.Second, "таймеры проверок", func() bool { return clk.Waiters() == 2 })
+	clk.Advance(30 * time.Second)
+
+	// Проверка второго сервера не ждет таймаута подключения к первому
+	waitFor(t, 2*time.Second, "статус задачи второго сервера", func() bool {
+		_, ok := recorder.get(2)
+		return ok
+	})
+	if _, ok := recorder.get(1); ok {
+		t.Error("статус задачи недоступного сервера записан до таймаута подключения")
+	}
+	waitFor(t, 10*time.Second, "статус задачи недоступного сервера", func() bool {
+		_, ok := recorder.get(1)
+		return ok
+	})
+
+	cancel()
+	if !sc.Wait(5 * time.Second) {
+		t.Error("Wait не дождался завершения проверок после отмены")
+	}
+}
+
+func TestCheckEmailStatusStandalone(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	server.addMessage("INBOX", testBounceMessage(testMessageID(1), "missing@example.org"))
+	cfg := server.smtpConfig()
+	client := NewIMAPClient(&cfg)
+
+	// Без открытого сеанса каждая проверка открывает и закрывает свой
+	for _, tt := range []struct {
+		taskID int64
+		want   Status
+	}{{1, StatusFailed}, {2, StatusDelivered}} {
+		status, _, _, err := client.CheckEmailStatus(context.Background(), testMessageID(tt.taskID))
+		if err != nil || status != tt.want {
+			t.Errorf("задача %d: статус %v, ошибка %v; ожидался %v", tt.taskID, status, err, tt.want)
+		}
+		if client.Connected() {
+			t.Error("сеанс не закрыт после отдельной проверки")
+		}
+	}
+	if got := server.loginCount(); got != 2 {
+		t.Errorf("выполнено %d входов, ожидалось 2", got)
+	}
+}
+
+func TestCheckEmailStatusSearchesInReplyTo(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	// Bounce не от mailer-daemon находится по In-Reply-To
+	bounce := strings.NewReplacer(
+		"From: Mail Delivery System <MAILER-DAEMON@mx.example.org>", "From: Postmaster <postmaster@mx.example.org>",
+		"Subject: Undelivered Mail Returned to Sender", "Subject: Delivery Status Notification (Failure)",
+	).Replace(testBounceMessage(testMessageID(1), "missing@example.org"))
+	server.addMessage("INBOX", bounce)
+	// Обычный ответ получателя с тем же In-Reply-To bounce не считается
+	server.addMessage("INBOX", "From: Ivan <ivan@example.org>\nSubject: Re: Счет\nIn-Reply-To: "+testMessageID(2)+"\n\nСпасибо, получил.\n")
+	// Bounce от mailer-daemon для другого письма
+	server.addMessage("INBOX", testBounceMessage(testMessageID(3), "other@example.org"))
+
+	cfg := server.smtpConfig()
+	client := NewIMAPClient(&cfg)
+	for _, tt := range []struct {
+		taskID int64
+		want   Status
+	}{{1, StatusFailed}, {2, StatusDelivered}, {4, StatusDelivered}} {
+		status, desc, _, err := client.CheckEmailStatus(context.Background(), testMessageID(tt.taskID))
+		if err != nil || status != tt.want {
+			t.Errorf("задача %d: статус %v (%s), ошибка %v; ожидался %v", tt.taskID, status, desc, err, tt.want)
+		}
+	}
+}
+
+// waitFor ждет выполнения условия cond не дольше timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("не дождались: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIdleWatcherReportsBounce(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	cfg := server.smtpConfig()
+	cfg.IMAPUseIdle = true
+
+	recorder := newStatusRecorder()
+	sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{cfg}}, recorder.callback)
+	// Плановая проверка через 30 секунд не наступает: статус может прийти только из IDLE
+	sc.SetClock(clock.NewFake(time.Now()))
+	scheduleTestChecks(sc, 0, 1, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc.Start(ctx)
+
+	waitFor(t, 5*time.Second, "выбор INBOX сеансом IDLE", func() bool { return server.selectCount() > 0 })
+	server.addMessage("INBOX", testBounceMessage(testMessageID(1), "missing@example.org"))
+	// Уведомление повторяется: первое может прийти до того, как сервер отметит ящик выбранным
+	waitFor(t, 5*time.Second, "статус задачи 1 из IDLE", func() bool {
+		server.notify("INBOX")
+		_, ok := recorder.get(1)
+		return ok
+	})
+
+	if result, _ := recorder.get(1); result.status != StatusFailed || !result.eventTime.Equal(testBounceTime) {
+		t.Errorf("задача 1: статус %v, время %v; ожидался StatusFailed со временем из DSN %v", result.status, result.eventTime, testBounceTime)
+	}
+	if result, ok := recorder.get(2); ok {
+		t.Errorf("задача 2 без bounce получила статус %v", result.status)
+	}
+	if got := server.loginCount(); got != 1 {
+		t.Errorf("выполнено %d входов, ожидался один сеанс IDLE", got)
+	}
+
+	cancel()
+	if !sc.Wait(5 * time.Second) {
+		t.Error("Wait не дождался завершения сеанса IDLE после отмены")
+	}
+}
+
+func TestIdleWatcherReconnectsAfterFetchTimeout(t *testing.T) {
+	server := newFakeIMAPServer(t)
+	server.stallCommand(t, "FETCH BODY")
+	cfg := server.smtpConfig()
+	cfg.IMAPUseIdle = true
+	cfg.IMAPFetchTimeoutSec = 1
+
+	recorder := newStatusRecorder()
+	sc := NewStatusChecker(&settings.Config{SMTP: []settings.SMTPConfig{cfg}}, recorder.callback)
+	clk := clock.NewFake(time.Now())
+	sc.SetClock(clk)
+	scheduleTestChecks(sc, 0, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc.Start(ctx)
+
+	waitFor(t, 5*time.Second, "выбор INBOX сеансом IDLE", func() bool { return server.selectCount() > 0 })
+	server.addMessage("INBOX", testBounceMessage(testMessageID(1), "missing@example.org"))
+	// После таймаута загрузки письма сеанс закрывается и ждет повторного подключения:
+	// к таймеру плановой проверки добавляется таймер idleRetryDelay
+	waitFor(t, 10*time.Second, "закрытие сеанса IDLE после таймаута FETCH", func() bool {
+		server.notify("INBOX")
+		return clk.Waiters() == 2
+	})
+	if got := server.loginCount(); got != 1 {
+		t.Errorf("выполнено %d входов до повторного подключения, ожидался 1", got)
+	}
+
+	cancel()
+	if !sc.Wait(5 * time.Second) {
+		t.Error("Wait не дождался завершения сеанса IDLE после отмены")
+	}
+}
@@ -0,0 +1,86 @@
+package email
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+	"email-service/settings"
+)
+
+// tlsVersions - допустимые значения TLSMinVersion секции SMTP
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSMinVersion возвращает минимальную версию TLS (0 - значение по умолчанию crypto/tls, TLS 1.2)
+func parseTLSMinVersion(version string) (uint16, error) {
+	version = strings.TrimSpace(version)
+	if version == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("неизвестное значение TLSMinVersion %q (допустимо: 1.0, 1.1, 1.2, 1.3)", version)
+	}
+	return v, nil
+}
+
+// checkTLSSettings проверяет TLS параметры SMTP сервера при запуске
+// Отключенная проверка сертификата записывается в лог, так как соединение становится уязвимым для подмены сервера
+func checkTLSSettings(cfg *settings.SMTPConfig) error {
+	if _, err := parseTLSMinVersion(cfg.TLSMinVersion); err != nil {
+		return fmt.Errorf("SMTP %s: %w", cfg.Host, err)
+	}
+	if cfg.TLSInsecureSkipVerify && logger.Log != nil {
+		logger.Log.Warn("Проверка TLS сертификата отключена (TLSInsecureSkipVerify), используйте только для внутренних серверов",
+			zap.String("host", cfg.Host),
+			zap.String("imapHost", cfg.IMAPHost))
+	}
+	return nil
+}
+
+// newTLSConfig формирует TLS конфигурацию SMTP или IMAP соединения по параметрам секции SMTP
+// serverName используется для SNI и проверки сертификата
+func newTLSConfig(cfg *settings.SMTPConfig, serverName string) *tls.Config {
+	// Значение проверено checkTLSSettings при создании сервиса
+	minVersion, _ := parseTLSMinVersion(cfg.TLSMinVersion)
+	return &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+		RootCAs:            cfg.TLSRootCAs,
+	}
+}
+
+// applyClientCertificate добавляет в TLS конфигурацию клиентский сертификат (mTLS), если он задан
+// Сертификат загружается из TLSClientCertFile и TLSClientKeyFile при первой отправке и кешируется;
+// при ошибке загрузки попытка повторяется со следующим письмом
+func (c *SMTPClient) applyClientCertificate(tlsConfig *tls.Config) error {
+	if c.cfg.TLSClientCertFile == "" {
+		return nil
+	}
+
+	c.clientCertMu.Lock()
+	defer c.clientCertMu.Unlock()
+	if c.clientCert == nil {
+		cert, err := tls.LoadX509KeyPair(c.cfg.TLSClientCertFile, c.cfg.TLSClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("ошибка загрузки клиентского сертификата %s: %w", c.cfg.TLSClientCertFile, err)
+		}
+		c.clientCert = &cert
+		if logger.Log != nil {
+			logger.Log.Info("Загружен клиентский сертификат SMTP (mTLS)",
+				zap.String("host", c.cfg.Host),
+				zap.String("certFile", c.cfg.TLSClientCertFile))
+		}
+	}
+	tlsConfig.Certificates = []tls.Certificate{*c.clientCert}
+	return nil
+}
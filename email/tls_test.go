@@ -0,0 +1,275 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"email-service/settings"
+)
+
+// newTestCertificate создает самоподписанный сертификат для 127.0.0.1 и пул с ним для проверки сертификата
+// Сертификат подходит и для сервера, и для клиента (mTLS)
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// newTestCA создает удостоверяющий центр и подписанный им сертификат сервера для 127.0.0.1
+// Возвращает сертификат сервера и сертификат центра в PEM
+func newTestCA(t *testing.T) (tls.Certificate, []byte) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Private CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caPEM
+}
+
+// writeTestCertificateFiles сохраняет сертификат и ключ в PEM файлы во временном каталоге теста
+func writeTestCertificateFiles(t *testing.T, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestParseTLSMinVersion(t *testing.T) {
+	for in, want := range map[string]uint16{"": 0, "1.0": tls.VersionTLS10, " 1.2 ": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		if got, err := parseTLSMinVersion(in); err != nil || got != want {
+			t.Errorf("parseTLSMinVersion(%q) = %x, %v; ожидалось %x", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"1.4", "TLS1.2", "1"} {
+		if _, err := parseTLSMinVersion(in); err == nil {
+			t.Errorf("parseTLSMinVersion(%q) без ошибки", in)
+		}
+	}
+	if err := checkTLSSettings(&settings.SMTPConfig{Host: "smtp.example.com", TLSMinVersion: "1.5"}); err == nil {
+		t.Error("checkTLSSettings принял неизвестную версию TLS")
+	}
+}
+
+func TestSendEmailSelfSignedCertificate(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+
+	t.Run("проверка сертификата", func(t *testing.T) {
+		server := newFakeSMTPServer(t)
+		server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		client := newTestSMTPClient(server)
+
+		err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false)
+		if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+			t.Fatalf("ошибка %v, ожидался отказ STARTTLS из-за самоподписанного сертификата", err)
+		}
+		if got := server.acceptedRecipients(); len(got) != 0 {
+			t.Errorf("письмо отправлено без проверки сертификата: %v", got)
+		}
+	})
+
+	t.Run("TLSInsecureSkipVerify", func(t *testing.T) {
+		server := newFakeSMTPServer(t)
+		server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		client := newTestSMTPClient(server)
+		client.cfg.TLSInsecureSkipVerify = true
+
+		if err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false); err != nil {
+			t.Fatalf("отправка с отключенной проверкой сертификата: %v", err)
+		}
+		if got := server.acceptedRecipients(); len(got) != 1 {
+			t.Errorf("сервер принял %d писем, ожидалось 1", len(got))
+		}
+	})
+
+	t.Run("TLSMinVersion", func(t *testing.T) {
+		server := newFakeSMTPServer(t)
+		server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}
+		client := newTestSMTPClient(server)
+		client.cfg.TLSInsecureSkipVerify = true
+		client.cfg.TLSMinVersion = "1.3"
+
+		err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false)
+		if err == nil {
+			t.Fatal("соединение с сервером TLS 1.2 установлено при TLSMinVersion 1.3")
+		}
+	})
+}
+
+func TestSendEmailClientCertificate(t *testing.T) {
+	serverCert, _ := newTestCertificate(t)
+	clientCert, clientPool := newTestCertificate(t)
+	certFile, keyFile := writeTestCertificateFiles(t, clientCert)
+
+	// newMTLSServer создает сервер, требующий клиентский сертификат, подписанный clientPool
+	newMTLSServer := func(t *testing.T) *fakeSMTPServer {
+		server := newFakeSMTPServer(t)
+		server.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientPool,
+		}
+		return server
+	}
+
+	t.Run("без сертификата", func(t *testing.T) {
+		server := newMTLSServer(t)
+		client := newTestSMTPClient(server)
+		client.cfg.TLSInsecureSkipVerify = true
+
+		if err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false); err == nil {
+			t.Fatal("сервер принял соединение без клиентского сертификата")
+		}
+		if got := server.acceptedRecipients(); len(got) != 0 {
+			t.Errorf("письмо отправлено без клиентского сертификата: %v", got)
+		}
+	})
+
+	t.Run("с сертификатом", func(t *testing.T) {
+		server := newMTLSServer(t)
+		client := newTestSMTPClient(server)
+		client.cfg.TLSInsecureSkipVerify = true
+		client.cfg.TLSClientCertFile = certFile
+		client.cfg.TLSClientKeyFile = keyFile
+
+		for i := 1; i <= 2; i++ {
+			if err := client.SendEmail(context.Background(), &EmailMessage{TaskID: int64(i), Text: "текст"}, testRecipients(1), false, false); err != nil {
+				t.Fatalf("отправка %d с клиентским сертификатом: %v", i, err)
+			}
+		}
+		if got := server.acceptedRecipients(); len(got) != 2 {
+			t.Errorf("сервер принял %d писем, ожидалось 2", len(got))
+		}
+		// Сертификат загружается один раз и кешируется
+		if client.clientCert == nil {
+			t.Error("клиентский сертификат не закеширован")
+		}
+	})
+
+	t.Run("ошибка загрузки", func(t *testing.T) {
+		server := newMTLSServer(t)
+		client := newTestSMTPClient(server)
+		client.cfg.TLSClientCertFile = filepath.Join(t.TempDir(), "missing.crt")
+		client.cfg.TLSClientKeyFile = keyFile
+
+		err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false)
+		if err == nil || !strings.Contains(err.Error(), "missing.crt") {
+			t.Fatalf("ошибка %v, ожидалась ошибка загрузки сертификата", err)
+		}
+		if server.connectionCount() != 0 {
+			t.Error("соединение установлено без загруженного сертификата")
+		}
+	})
+}
+
+func TestSendEmailPrivateCA(t *testing.T) {
+	serverCert, caPEM := newTestCA(t)
+
+	t.Run("системное хранилище", func(t *testing.T) {
+		server := newFakeSMTPServer(t)
+		server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+		client := newTestSMTPClient(server)
+
+		err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false)
+		if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+			t.Fatalf("ошибка %v, ожидался отказ STARTTLS для сертификата частного центра", err)
+		}
+	})
+
+	t.Run("TLSRootCAs", func(t *testing.T) {
+		server := newFakeSMTPServer(t)
+		server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+		client := newTestSMTPClient(server)
+		client.cfg.TLSRootCAs = x509.NewCertPool()
+		client.cfg.TLSRootCAs.AppendCertsFromPEM(caPEM)
+
+		if err := client.SendEmail(context.Background(), &EmailMessage{TaskID: 1, Text: "текст"}, testRecipients(1), false, false); err != nil {
+			t.Fatalf("сертификат, подписанный частным центром, не принят: %v", err)
+		}
+		if got := server.acceptedRecipients(); len(got) != 1 {
+			t.Errorf("сервер принял %d писем, ожидалось 1", len(got))
+		}
+	})
+}
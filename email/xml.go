@@ -1,11 +1,19 @@
 package email
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
 )
 
 // ParsedEmailMessage представляет распарсенное email сообщение
@@ -16,8 +24,64 @@ type ParsedEmailMessage struct {
 	Title          string
 	Text           string
 	Schedule       bool
+	BypassSchedule bool // Срочное письмо: отправляется и вне окна расписания (sending_schedule)
 	DateActiveFrom string
 	Attachments    []Attachment
+
+	Bulk            bool   // Массовая рассылка (добавляются заголовки List-Unsubscribe)
+	ListUnsubscribe string // Адреса отписки из очереди (URL и/или mailto через запятую)
+
+	// Срок актуальности письма (expires_at), нулевое значение - не ограничен
+	// Письмо, которое не удалось отправить до этого момента, не отправляется (например, одноразовые коды)
+	ExpiresAt time.Time
+
+	// Часовой пояс получателей (recipient_timezone), nil - не задан
+	// Окна расписания для такого письма проверяются по местному времени получателя
+	RecipientTimezone *time.Location
+
+	// Дополнительные заголовки письма из очереди (имя в написании из очереди -> значение)
+	CustomHeaders map[string]string
+
+	// Язык тела письма (language), пусто - не задан
+	Language string
+
+	// Текстовая и HTML версии тела (email_text_plain, email_text_html), пусто - не заданы
+	// Если задана HTML версия, письмо формируется как multipart/alternative; текстовая версия
+	// без HTML версии дополняет HTML тело email_text при Mode.IsBodyHTML = True
+	TextPlain string
+	TextHTML  string
+}
+
+// expiresAtFormats - допустимые форматы expires_at (без часового пояса - локальное время)
+var expiresAtFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// Expired проверяет, истек ли срок актуальности письма
+func (m *ParsedEmailMessage) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// RecipientLocation возвращает часовой пояс получателей: recipient_timezone из очереди, иначе пояс домена
+// первого адреса, для которого он задан в domainZones (поддомены относятся к домену); nil - пояс не известен
+func (m *ParsedEmailMessage) RecipientLocation(domainZones map[string]*time.Location) *time.Location {
+	if m.RecipientTimezone != nil {
+		return m.RecipientTimezone
+	}
+	if len(domainZones) == 0 {
+		return nil
+	}
+	for _, address := range strings.FieldsFunc(m.EmailAddress, func(r rune) bool { return r == ',' || r == ';' }) {
+		for domain := addressDomain(address); domain != ""; {
+			if loc, ok := domainZones[domain]; ok {
+				return loc
+			}
+			_, domain, _ = strings.Cut(domain, ".")
+		}
+	}
+	return nil
 }
 
 // Attachment представляет вложение
@@ -31,6 +95,12 @@ type Attachment struct {
 	DbLogin      string
 	DbPass       string
 	AttachParams map[string]string
+	ChecksumAlgo string // Алгоритм ожидаемой контрольной суммы (md5, sha256), пусто - не задана
+	Checksum     string // Ожидаемая контрольная сумма в hex (нижний регистр)
+	Required     bool   // Обязательное вложение: без него письмо не отправляется (email_attach_required="1")
+	Inline       bool   // Встроенное изображение HTML тела (email_attach_inline="1")
+	ContentID    string // Content-ID встроенного изображения для ссылок cid: (email_attach_content_id)
+	EmptyPolicy  string // Поведение при пустом отчете Crystal Reports (email_attach_empty), пусто - из конфигурации
 }
 
 // ParseEmailMessage парсит данные из map в ParsedEmailMessage
@@ -77,19 +147,88 @@ func ParseEmailMessage(data map[string]interface{}) (*ParsedEmailMessage, error)
 		return nil, fmt.Errorf("email_text не указан")
 	}
 
+	// Парсим текстовую и HTML версии тела (необязательные)
+	if textPlain, ok := data["email_text_plain"].(string); ok {
+		msg.TextPlain = strings.TrimSpace(textPlain)
+	}
+	if textHTML, ok := data["email_text_html"].(string); ok {
+		msg.TextHTML = strings.TrimSpace(textHTML)
+	}
+
 	// Парсим sending_schedule
 	if scheduleStr, ok := data["sending_schedule"].(string); ok {
 		msg.Schedule = scheduleStr == "1"
 	}
+	if bypassStr, ok := data["bypass_schedule"].(string); ok {
+		msg.BypassSchedule = strings.TrimSpace(bypassStr) == "1"
+	}
 
 	// Парсим date_active_from
 	if dateActiveFrom, ok := data["date_active_from"].(string); ok {
 		msg.DateActiveFrom = strings.TrimSpace(dateActiveFrom)
 	}
 
+	// Парсим признак массовой рассылки и адреса отписки
+	if bulkStr, ok := data["bulk"].(string); ok {
+		msg.Bulk = strings.TrimSpace(bulkStr) == "1"
+	}
+	if listUnsubscribe, ok := data["list_unsubscribe"].(string); ok {
+		msg.ListUnsubscribe = strings.TrimSpace(listUnsubscribe)
+	}
+
+	// Парсим срок актуальности письма
+	if expiresAtStr, ok := data["expires_at"].(string); ok && strings.TrimSpace(expiresAtStr) != "" {
+		expiresAt, err := parseExpiresAt(strings.TrimSpace(expiresAtStr))
+		if err != nil {
+			return nil, err
+		}
+		msg.ExpiresAt = expiresAt
+	}
+
+	// Парсим часовой пояс получателей
+	if zone, ok := data["recipient_timezone"].(string); ok && strings.TrimSpace(zone) != "" {
+		loc, err := time.LoadLocation(strings.TrimSpace(zone))
+		if err != nil {
+			return nil, fmt.Errorf("неверный часовой пояс recipient_timezone %q: %w", zone, err)
+		}
+		msg.RecipientTimezone = loc
+	}
+
+	// Парсим язык тела письма; недопустимое значение отбрасывается, письмо отправляется без Content-Language
+	if language, ok := data["language"].(string); ok && strings.TrimSpace(language) != "" {
+		var err error
+		msg.Language, err = parseContentLanguage(language)
+		if err != nil && logger.Log != nil {
+			logger.Log.Warn("Недопустимый язык из очереди, заголовок Content-Language не будет добавлен",
+				zap.Int64("taskID", msg.TaskID),
+				zap.Error(err))
+		}
+	}
+
+	// Парсим дополнительные заголовки; недопустимые (служебные, с управляющими символами) отбрасываются
+	if headers, ok := data["custom_headers"].(map[string]string); ok {
+		var rejected []string
+		msg.CustomHeaders, rejected = parseCustomHeaders(headers)
+		if len(rejected) > 0 && logger.Log != nil {
+			logger.Log.Warn("Недопустимые заголовки из очереди не будут добавлены в письмо",
+				zap.Int64("taskID", msg.TaskID),
+				zap.Strings("rejected", rejected))
+		}
+	}
+
 	return msg, nil
 }
 
+// parseExpiresAt разбирает срок актуальности письма в одном из форматов expiresAtFormats
+func parseExpiresAt(value string) (time.Time, error) {
+	for _, format := range expiresAtFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("неверный формат expires_at: %q", value)
+}
+
 // ParseAttachments парсит вложения из XML
 // Вложения находятся внутри body элемента в CDATA секции: <email><attachs><attach>...</attach></attachs></email>
 func ParseAttachments(xmlPayload string, taskID int64) ([]Attachment, error) {
@@ -103,6 +242,11 @@ func ParseAttachments(xmlPayload string, taskID int64) ([]Attachment, error) {
 		EmailAttachFile    string `xml:"email_attach_file,attr"`
 		DbLogin            string `xml:"db_login,attr"`
 		DbPass             string `xml:"db_pass,attr"`
+		Checksum           string `xml:"email_attach_checksum,attr"`
+		Required           string `xml:"email_attach_required,attr"`
+		Inline             string `xml:"email_attach_inline,attr"`
+		ContentID          string `xml:"email_attach_content_id,attr"`
+		Empty              string `xml:"email_attach_empty,attr"`
 		InnerXML           string `xml:",innerxml"`
 	}
 
@@ -156,6 +300,22 @@ func ParseAttachments(xmlPayload string, taskID int64) ([]Attachment, error) {
 		attach := Attachment{
 			ReportType: reportType,
 			FileName:   attachElem.EmailAttachName,
+			Required:   strings.TrimSpace(attachElem.Required) == "1",
+			Inline:     strings.TrimSpace(attachElem.Inline) == "1",
+			ContentID:  strings.Trim(strings.TrimSpace(attachElem.ContentID), "<>"),
+		}
+		// Content-ID задается только для встроенных изображений
+		if attach.ContentID != "" {
+			attach.Inline = true
+		}
+
+		if attachElem.Checksum != "" {
+			algo, sum, err := parseChecksum(attachElem.Checksum)
+			if err != nil {
+				return nil, fmt.Errorf("неверный формат email_attach_checksum: %w", err)
+			}
+			attach.ChecksumAlgo = algo
+			attach.Checksum = sum
 		}
 
 		switch reportType {
@@ -190,6 +350,13 @@ func ParseAttachments(xmlPayload string, taskID int64) ([]Attachment, error) {
 			attach.FileName = attachElem.EmailAttachName
 			attach.DbLogin = attachElem.DbLogin
 			attach.DbPass = attachElem.DbPass
+			if attachElem.Empty != "" {
+				policy, err := normalizeEmptyReportPolicy(attachElem.Empty)
+				if err != nil {
+					return nil, fmt.Errorf("неверное значение email_attach_empty: %w", err)
+				}
+				attach.EmptyPolicy = policy
+			}
 
 			// Парсим параметры вложений
 			if attachElem.InnerXML != "" {
@@ -212,6 +379,42 @@ func ParseAttachments(xmlPayload string, taskID int64) ([]Attachment, error) {
 	return attachments, nil
 }
 
+// parseChecksum разбирает контрольную сумму вложения в формате "алгоритм:hex" (md5, sha256)
+// Без префикса алгоритм определяется по длине значения
+func parseChecksum(value string) (string, string, error) {
+	algo, sum, ok := strings.Cut(strings.TrimSpace(value), ":")
+	if !ok {
+		sum = algo
+		switch len(sum) {
+		case hex.EncodedLen(md5.Size):
+			algo = "md5"
+		case hex.EncodedLen(sha256.Size):
+			algo = "sha256"
+		default:
+			return "", "", fmt.Errorf("не удалось определить алгоритм по длине значения (%d)", len(sum))
+		}
+	}
+
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	sum = strings.ToLower(strings.TrimSpace(sum))
+
+	var size int
+	switch algo {
+	case "md5":
+		size = md5.Size
+	case "sha256":
+		size = sha256.Size
+	default:
+		return "", "", fmt.Errorf("неподдерживаемый алгоритм: %s", algo)
+	}
+
+	if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != size {
+		return "", "", fmt.Errorf("значение не является %s в hex: %s", algo, truncateString(sum, 100))
+	}
+
+	return algo, sum, nil
+}
+
 // parseAttachParams парсит параметры вложений из XML
 // Структура: <attach><attach_params><attach_param .../></attach_params></attach>
 func parseAttachParams(xmlStr string) (map[string]string, error) {
@@ -0,0 +1,28 @@
+package email
+
+import "testing"
+
+func TestParseEmailMessageAlternativeBodies(t *testing.T) {
+	data := map[string]interface{}{
+		"email_task_id":    "1",
+		"email_address":    "user@example.org",
+		"email_title":      "Счет",
+		"email_text":       "текст",
+		"email_text_plain": " Текстовая версия ",
+		"email_text_html":  "<p>HTML</p>\n",
+	}
+	msg, err := ParseEmailMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.TextPlain != "Текстовая версия" || msg.TextHTML != "<p>HTML</p>" {
+		t.Errorf("TextPlain = %q, TextHTML = %q", msg.TextPlain, msg.TextHTML)
+	}
+
+	// Версии тела необязательны
+	delete(data, "email_text_plain")
+	delete(data, "email_text_html")
+	if msg, err = ParseEmailMessage(data); err != nil || msg.TextPlain != "" || msg.TextHTML != "" {
+		t.Errorf("без версий тела: %+v, ошибка %v", msg, err)
+	}
+}
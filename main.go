@@ -7,31 +7,88 @@ import (
 	"email-service/logger"
 	"email-service/service"
 	"email-service/settings"
+	"flag"
+	"math/rand/v2"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"sync"
 	"syscall"
 	"time"
+	// База часовых поясов в исполняемом файле: на серверах без системной базы (Windows)
+	// иначе не загружаются пояса получателей (Schedule.DomainTimezones, recipient_timezone)
+	_ "time/tzdata"
 
 	"go.uber.org/zap"
 )
 
-const shutdownTimeout = 10 * time.Second
+// responseDrainTimeout - время на запись накопленных результатов в БД перед закрытием соединения
+const responseDrainTimeout = 30 * time.Second
+
+// shutdownOutcome - итог graceful shutdown
+type shutdownOutcome int
+
+const (
+	shutdownClean   shutdownOutcome = iota // Все обработчики и операции с БД завершены
+	shutdownPartial                        // Обработчики завершены, но остались незавершенные операции с БД
+	shutdownForced                         // Обработчики не завершились до истечения таймаута
+)
+
+// String возвращает название итога для логов
+func (o shutdownOutcome) String() string {
+	switch o {
+	case shutdownClean:
+		return "clean"
+	case shutdownPartial:
+		return "partial"
+	default:
+		return "forced"
+	}
+}
+
+// shutdownResult содержит итог graceful shutdown
+type shutdownResult struct {
+	Outcome             shutdownOutcome
+	RemainingOperations int32 // Незавершенные операции с БД на момент остановки сервисов
+	HandlersCompleted   bool  // Все обработчики сообщений завершились
+}
+
+// newShutdownResult определяет итог по результатам ожидания обработчиков и операций с БД
+func newShutdownResult(handlersCompleted bool, remainingOperations int32) shutdownResult {
+	result := shutdownResult{
+		Outcome:             shutdownClean,
+		RemainingOperations: remainingOperations,
+		HandlersCompleted:   handlersCompleted,
+	}
+	switch {
+	case !handlersCompleted:
+		result.Outcome = shutdownForced
+	case remainingOperations > 0:
+		result.Outcome = shutdownPartial
+	}
+	return result
+}
 
 func main() {
+	once := flag.Bool("once", false, "обработать сообщения из очереди и завершить работу (режим OneShot)")
+	flag.Parse()
+
 	cfg := initializeConfig()
 	defer logger.Log.Sync()
+	if *once {
+		cfg.Mode.OneShot = true
+	}
 
 	logger.Log.Info("Запуск email сервиса")
 
+	// Соединение с БД закрывается последним в stopServices
 	dbConn := initializeDatabase(cfg)
-	defer dbConn.CloseConnection()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	shutdownRequested := setupSignalHandling()
+	shutdownRequested := setupSignalHandling(shutdownTimeout(cfg))
 
 	logger.Log.Info("Инициализация QueueReader...")
 	queueReader := initializeQueueReader(dbConn)
@@ -44,11 +101,36 @@ func main() {
 
 	var allHandlersWg sync.WaitGroup
 	logger.Log.Info("Запуск основного сервиса...")
-	startMainService(ctx, mainService, &allHandlersWg)
+	serviceDone := startMainService(ctx, mainService, &allHandlersWg)
+	healthServer := startHealthServer(cfg, mainService)
 	logger.Log.Info("Основной сервис запущен, ожидание сигнала завершения...")
 
-	<-shutdownRequested
+	// Работа завершается также после окончания основного цикла: в режиме OneShot
+	// или при превышении числа авто-рестартов (MaxAutoRestarts)
+	if cfg.Mode.OneShot {
+		logger.Log.Info("Режим OneShot: работа завершится после обработки очереди",
+			zap.Int("emptyCycles", cfg.Mode.OneShotEmptyCycles))
+	}
+
+	restartLimitExceeded := false
+	select {
+	case <-shutdownRequested:
+	case <-serviceDone:
+		if mainService.RestartLimitExceeded() {
+			restartLimitExceeded = true
+			logger.Log.Error("Основной цикл остановлен из-за превышения числа авто-рестартов, завершение работы с ошибкой")
+		} else if cfg.Mode.OneShot {
+			logger.Log.Info("Режим OneShot: очередь обработана, завершение работы")
+		} else {
+			logger.Log.Warn("Основной цикл обработки завершился, завершение работы")
+		}
+	}
+	stopHealthServer(healthServer)
 	shutdown(ctx, cancel, mainService, emailService, cfg, dbConn, &allHandlersWg)
+	if restartLimitExceeded {
+		_ = logger.Log.Sync()
+		os.Exit(1)
+	}
 }
 
 // initializeConfig загружает конфигурацию и инициализирует логгер
@@ -74,41 +156,100 @@ func initializeDatabase(cfg *settings.Config) *db.DBConnection {
 		logger.Log.Fatal("Ошибка создания подключения к БД", zap.Error(err))
 	}
 
-	maxRetries := cfg.Oracle.DBConnectRetryAttempts
-	if maxRetries <= 0 {
-		maxRetries = 1
+	policy := newDBRetryPolicy(cfg.Oracle)
+	if attempts, err := connectWithRetry(dbConn.OpenConnection, policy, time.Now, time.Sleep); err != nil {
+		logger.Log.Fatal("Не удалось подключиться к БД после всех попыток",
+			zap.Int("attempts", attempts),
+			zap.Error(err))
+	}
+
+	logger.Log.Info("Успешно подключено к Oracle базе данных")
+	dbConn.StartPeriodicReconnect()
+
+	return dbConn
+}
+
+// dbRetryPolicy - параметры повторных попыток подключения к БД при старте
+type dbRetryPolicy struct {
+	maxRetries  int           // Общее количество попыток, -1 - без ограничения
+	interval    time.Duration // Пауза после первой неудачной попытки
+	maxInterval time.Duration // Максимальная пауза между попытками
+	maxWait     time.Duration // Общее время попыток, 0 - без ограничения
+}
+
+// newDBRetryPolicy формирует параметры повторных попыток из конфигурации
+func newDBRetryPolicy(cfg settings.OracleConfig) dbRetryPolicy {
+	p := dbRetryPolicy{
+		maxRetries:  cfg.DBConnectRetryAttempts,
+		interval:    time.Duration(cfg.DBConnectRetryIntervalSec) * time.Second,
+		maxInterval: time.Duration(cfg.DBConnectRetryMaxIntervalSec) * time.Second,
+		maxWait:     time.Duration(cfg.DBConnectRetryMaxWaitSec) * time.Second,
+	}
+	// Без ограничения попытки продолжаются только при явном -1, 0 означает одну попытку без повторов
+	if p.maxRetries < 0 {
+		p.maxRetries = -1
+	} else if p.maxRetries == 0 {
+		p.maxRetries = 1
+	}
+	if p.interval <= 0 {
+		p.interval = 5 * time.Second
+	}
+	if p.maxInterval < p.interval {
+		p.maxInterval = p.interval
 	}
-	retryInterval := time.Duration(cfg.Oracle.DBConnectRetryIntervalSec) * time.Second
-	if retryInterval <= 0 {
-		retryInterval = 5 * time.Second
+	return p
+}
+
+// connectWithRetry вызывает connect до успешного подключения с экспоненциальной паузой между попытками
+// Возвращает количество выполненных попыток и последнюю ошибку, если попытки или время исчерпаны
+// now и sleep передаются параметрами, чтобы время ожидания можно было проверить в тестах
+func connectWithRetry(connect func() error, policy dbRetryPolicy, now func() time.Time, sleep func(time.Duration)) (int, error) {
+	var deadline time.Time
+	if policy.maxWait > 0 {
+		deadline = now().Add(policy.maxWait)
 	}
 
-	for i := 0; i < maxRetries; i++ {
-		if err := dbConn.OpenConnection(); err != nil {
-			if i == maxRetries-1 {
-				logger.Log.Fatal("Не удалось подключиться к БД после всех попыток",
-					zap.Int("attempts", maxRetries),
-					zap.Error(err))
-			}
-			logger.Log.Warn("Ошибка подключения к БД, повторная попытка...",
-				zap.Int("attempt", i+1),
-				zap.Int("maxRetries", maxRetries),
-				zap.Duration("nextRetryIn", retryInterval),
-				zap.Error(err))
-			time.Sleep(retryInterval)
-			continue
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return attempt, nil
+		}
+
+		delay := connectBackoff(attempt, policy.interval, policy.maxInterval)
+		if (policy.maxRetries >= 0 && attempt >= policy.maxRetries) ||
+			(!deadline.IsZero() && now().Add(delay).After(deadline)) {
+			return attempt, err
 		}
-		break
+		logger.Log.Warn("Ошибка подключения к БД, повторная попытка...",
+			zap.Int("attempt", attempt),
+			zap.Int("maxRetries", policy.maxRetries),
+			zap.Duration("nextRetryIn", delay),
+			zap.Error(err))
+		sleep(delay)
 	}
+}
 
-	logger.Log.Info("Успешно подключено к Oracle базе данных")
-	dbConn.StartPeriodicReconnect()
+// connectBackoff возвращает паузу перед следующей попыткой подключения к БД:
+// base удваивается с каждой неудачной попыткой до maxDelay, к результату добавляется случайный разброс
+// до 20% в меньшую сторону, чтобы несколько экземпляров сервиса не подключались одновременно
+func connectBackoff(attempt int, base, maxDelay time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay - time.Duration(rand.Int64N(int64(delay)/5+1))
+}
 
-	return dbConn
+// shutdownTimeout возвращает время ожидания завершения обработчиков и операций с БД при остановке (Mode.ShutdownTimeoutSec)
+func shutdownTimeout(cfg *settings.Config) time.Duration {
+	return time.Duration(cfg.Mode.ShutdownTimeoutSec) * time.Second
 }
 
 // setupSignalHandling настраивает обработку сигналов для graceful shutdown
-func setupSignalHandling() chan struct{} {
+func setupSignalHandling(timeout time.Duration) chan struct{} {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	if runtime.GOOS != "windows" {
@@ -120,7 +261,7 @@ func setupSignalHandling() chan struct{} {
 		sig := <-sigChan
 		logger.Log.Info("Получен сигнал, инициируется graceful shutdown",
 			zap.String("signal", sig.String()),
-			zap.Duration("shutdownTimeout", shutdownTimeout))
+			zap.Duration("shutdownTimeout", timeout))
 		close(shutdownRequested)
 	}()
 
@@ -136,7 +277,8 @@ func initializeQueueReader(dbConn *db.DBConnection) *db.QueueReader {
 
 	logger.Log.Info("Настройки очереди",
 		zap.String("queue", queueReader.GetQueueName()),
-		zap.String("consumer", queueReader.GetConsumerName()))
+		zap.String("consumer", queueReader.GetConsumerName()),
+		zap.String("navigation", queueReader.GetNavigation()))
 
 	queueReader.SetWaitTimeout(10) // 10 секунд (аналогично smsSender)
 
@@ -153,14 +295,50 @@ func initializeEmailService(cfg *settings.Config, dbConn *db.DBConnection, statu
 }
 
 // startMainService запускает основной цикл обработки сообщений
-func startMainService(ctx context.Context, mainService *service.Service, wg *sync.WaitGroup) {
+// Возвращаемый канал закрывается при выходе из Run
+func startMainService(ctx context.Context, mainService *service.Service, wg *sync.WaitGroup) <-chan struct{} {
 	logger.Log.Info("Запуск горутины основного сервиса...")
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		logger.Log.Info("Горутина основного сервиса запущена, вызов Run()...")
 		mainService.Run(ctx, wg)
 		logger.Log.Info("Горутина основного сервиса завершена")
 	}()
 	logger.Log.Info("Горутина основного сервиса запущена (асинхронно)")
+	return done
+}
+
+// startHealthServer запускает HTTP endpoint состояния сервиса, если задан Health.Listen
+func startHealthServer(cfg *settings.Config, mainService *service.Service) *http.Server {
+	if cfg.Health.Listen == "" {
+		return nil
+	}
+
+	server := &http.Server{
+		Addr:              cfg.Health.Listen,
+		Handler:           mainService.HealthHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		logger.Log.Info("Запуск health endpoint", zap.String("listen", cfg.Health.Listen))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Log.Error("Ошибка health endpoint", zap.Error(err))
+		}
+	}()
+	return server
+}
+
+// stopHealthServer останавливает HTTP endpoint состояния сервиса
+func stopHealthServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Log.Warn("Ошибка остановки health endpoint", zap.Error(err))
+	}
 }
 
 // shutdown выполняет graceful shutdown приложения
@@ -173,21 +351,29 @@ func shutdown(
 	dbConn *db.DBConnection,
 	allHandlersWg *sync.WaitGroup,
 ) {
+	timeout := shutdownTimeout(cfg)
 	logger.Log.Info("Начало graceful shutdown с таймаутом",
-		zap.Duration("timeout", shutdownTimeout))
+		zap.Duration("timeout", timeout))
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
 	defer shutdownCancel()
 
 	cancel()
 
-	waitForOperationsCompletion(shutdownCtx, allHandlersWg, dbConn)
-	performGracefulShutdown(shutdownCtx, mainService, emailService, cfg, dbConn, allHandlersWg)
+	waitForOperationsCompletion(shutdownCtx, timeout, allHandlersWg, dbConn)
+	result := performGracefulShutdown(shutdownCtx, mainService, emailService, cfg, dbConn, allHandlersWg)
+
+	// Единая итоговая запись для супервизора и мониторинга логов
+	logger.Log.Info("Итог завершения работы",
+		zap.String("shutdownOutcome", result.Outcome.String()),
+		zap.Bool("handlersCompleted", result.HandlersCompleted),
+		zap.Int32("remainingOperations", result.RemainingOperations))
 }
 
 // waitForOperationsCompletion ждет завершения всех операций с таймаутом
 func waitForOperationsCompletion(
 	shutdownCtx context.Context,
+	timeout time.Duration,
 	allHandlersWg *sync.WaitGroup,
 	dbConn *db.DBConnection,
 ) {
@@ -202,12 +388,12 @@ func waitForOperationsCompletion(
 		logger.Log.Info("Все операции завершены до истечения таймаута")
 	case <-shutdownCtx.Done():
 		logger.Log.Warn("Таймаут graceful shutdown истек, принудительное завершение",
-			zap.Duration("timeout", shutdownTimeout),
+			zap.Duration("timeout", timeout),
 			zap.Int32("activeOperations", dbConn.GetActiveOperationsCount()))
 	}
 }
 
-// performGracefulShutdown выполняет корректное завершение всех операций
+// performGracefulShutdown выполняет корректное завершение всех операций и возвращает итог
 func performGracefulShutdown(
 	ctx context.Context,
 	mainService *service.Service,
@@ -215,27 +401,35 @@ func performGracefulShutdown(
 	cfg *settings.Config,
 	dbConn *db.DBConnection,
 	allHandlersWg *sync.WaitGroup,
-) {
+) shutdownResult {
 	logger.Log.Info("Завершение graceful shutdown...")
 
-	waitForActiveDatabaseOperations(ctx, dbConn)
-	waitForMessageHandlers(ctx, allHandlersWg)
-	stopServices(emailService, cfg, dbConn)
+	remainingOps := waitForActiveDatabaseOperations(ctx, shutdownTimeout(cfg), dbConn)
+	handlersCompleted := waitForMessageHandlers(ctx, allHandlersWg)
+	stopServices(mainService, emailService, cfg, dbConn)
 
-	logger.Log.Info("Graceful shutdown завершен успешно")
+	result := newShutdownResult(handlersCompleted, remainingOps)
+	if result.Outcome == shutdownClean {
+		logger.Log.Info("Graceful shutdown завершен успешно")
+	} else {
+		logger.Log.Warn("Graceful shutdown завершен не полностью",
+			zap.String("shutdownOutcome", result.Outcome.String()))
+	}
+	return result
 }
 
 // waitForActiveDatabaseOperations ждет завершения активных операций с БД
-func waitForActiveDatabaseOperations(ctx context.Context, dbConn *db.DBConnection) {
+// Возвращает количество операций, не завершившихся до истечения таймаута
+func waitForActiveDatabaseOperations(ctx context.Context, timeout time.Duration, dbConn *db.DBConnection) int32 {
 	activeOps := dbConn.GetActiveOperationsCount()
 	if activeOps == 0 {
-		return
+		return 0
 	}
 
 	logger.Log.Info("Ожидание завершения активных операций с БД",
 		zap.Int32("activeOperations", activeOps))
 
-	checkCtx, checkCancel := context.WithTimeout(ctx, shutdownTimeout)
+	checkCtx, checkCancel := context.WithTimeout(ctx, timeout)
 	defer checkCancel()
 
 	ticker := time.NewTicker(500 * time.Millisecond)
@@ -244,20 +438,22 @@ func waitForActiveDatabaseOperations(ctx context.Context, dbConn *db.DBConnectio
 	for {
 		select {
 		case <-checkCtx.Done():
+			remaining := dbConn.GetActiveOperationsCount()
 			logger.Log.Warn("Таймаут ожидания активных операций истек",
-				zap.Int32("remainingOperations", dbConn.GetActiveOperationsCount()))
-			return
+				zap.Int32("remainingOperations", remaining))
+			return remaining
 		case <-ticker.C:
 			if dbConn.GetActiveOperationsCount() == 0 {
 				logger.Log.Info("Все активные операции с БД завершены")
-				return
+				return 0
 			}
 		}
 	}
 }
 
 // waitForMessageHandlers ждет завершения всех обработчиков сообщений
-func waitForMessageHandlers(ctx context.Context, allHandlersWg *sync.WaitGroup) {
+// Возвращает false, если обработчики не завершились до истечения таймаута
+func waitForMessageHandlers(ctx context.Context, allHandlersWg *sync.WaitGroup) bool {
 	logger.Log.Info("Ожидание завершения всех обработчиков сообщений...")
 	done := make(chan struct{})
 	go func() {
@@ -268,13 +464,16 @@ func waitForMessageHandlers(ctx context.Context, allHandlersWg *sync.WaitGroup)
 	select {
 	case <-done:
 		logger.Log.Info("Все обработчики сообщений завершены")
+		return true
 	case <-ctx.Done():
 		logger.Log.Warn("Таймаут ожидания обработчиков истек, принудительное завершение")
+		return false
 	}
 }
 
 // stopServices останавливает все сервисы
-func stopServices(emailService *email.Service, cfg *settings.Config, dbConn *db.DBConnection) {
+// Порядок: email сервис (больше нет новых статусов), запись очереди результатов, затем соединение с БД
+func stopServices(mainService *service.Service, emailService *email.Service, cfg *settings.Config, dbConn *db.DBConnection) {
 	logger.Log.Info("Остановка горутины обновления расписания...")
 	cfg.Stop()
 
@@ -285,4 +484,15 @@ func stopServices(emailService *email.Service, cfg *settings.Config, dbConn *db.
 	if err := emailService.Close(); err != nil {
 		logger.Log.Error("Ошибка при закрытии email сервиса", zap.Error(err))
 	}
+
+	logger.Log.Info("Запись оставшихся результатов в БД...")
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), responseDrainTimeout)
+	mainService.CloseResponseQueue(drainCtx)
+	drainCancel()
+
+	// Отчет записывается после остановки проверки статусов, чтобы учесть результаты доставки
+	mainService.WriteReport()
+
+	logger.Log.Info("Закрытие соединения с БД...")
+	dbConn.CloseConnection()
 }
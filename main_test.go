@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/db"
+	"email-service/logger"
+	"email-service/settings"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+func TestConnectBackoffGrowth(t *testing.T) {
+	base, maxDelay := 5*time.Second, 60*time.Second
+
+	// Пауза удваивается с каждой попыткой до maxDelay; разброс уменьшает ее не более чем на 20%
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 60 * time.Second, 60 * time.Second}
+	for i, upper := range want {
+		attempt := i + 1
+		for n := 0; n < 50; n++ {
+			got := connectBackoff(attempt, base, maxDelay)
+			if got > upper || got < upper-upper/5 {
+				t.Fatalf("попытка %d: пауза %v вне диапазона [%v, %v]", attempt, got, upper-upper/5, upper)
+			}
+		}
+	}
+}
+
+// fakeRetryClock - время для connectWithRetry: sleep сдвигает now без реального ожидания
+type fakeRetryClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeRetryClock) Now() time.Time { return c.now }
+
+func (c *fakeRetryClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func TestConnectWithRetryTimeBound(t *testing.T) {
+	clk := &fakeRetryClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	start := clk.now
+	policy := dbRetryPolicy{maxRetries: -1, interval: time.Second, maxInterval: 8 * time.Second, maxWait: 30 * time.Second}
+
+	errDown := errors.New("ORA-12541: TNS:no listener")
+	calls := 0
+	attempts, err := connectWithRetry(func() error { calls++; return errDown }, policy, clk.Now, clk.Sleep)
+	if !errors.Is(err, errDown) {
+		t.Fatalf("ошибка %v, ожидалась последняя ошибка подключения", err)
+	}
+	if attempts != calls {
+		t.Errorf("attempts = %d, выполнено попыток %d", attempts, calls)
+	}
+
+	// Попытки прекращаются, не превышая общего времени ожидания
+	if elapsed := clk.now.Sub(start); elapsed > policy.maxWait {
+		t.Errorf("попытки заняли %v, ограничение %v", elapsed, policy.maxWait)
+	}
+	// Паузы растут и ограничены maxInterval
+	for i, d := range clk.sleeps {
+		if d > policy.maxInterval {
+			t.Errorf("пауза %d = %v больше maxInterval", i, d)
+		}
+		if i > 0 && d < clk.sleeps[i-1] && clk.sleeps[i-1] < policy.maxInterval*4/5 {
+			t.Errorf("пауза %d = %v меньше предыдущей %v", i, d, clk.sleeps[i-1])
+		}
+	}
+	if len(clk.sleeps) < 3 {
+		t.Errorf("выполнено %d пауз, ожидалось несколько попыток в пределах %v", len(clk.sleeps), policy.maxWait)
+	}
+}
+
+func TestConnectWithRetryAttempts(t *testing.T) {
+	clk := &fakeRetryClock{now: time.Now()}
+	policy := dbRetryPolicy{maxRetries: 3, interval: time.Second, maxInterval: time.Minute}
+
+	calls := 0
+	attempts, err := connectWithRetry(func() error { calls++; return errors.New("down") }, policy, clk.Now, clk.Sleep)
+	if err == nil || attempts != 3 || calls != 3 || len(clk.sleeps) != 2 {
+		t.Errorf("attempts = %d, calls = %d, пауз %d, err = %v; ожидалось 3 попытки и 2 паузы", attempts, calls, len(clk.sleeps), err)
+	}
+
+	// Успешное подключение прекращает попытки
+	calls = 0
+	attempts, err = connectWithRetry(func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("down")
+		}
+		return nil
+	}, policy, clk.Now, clk.Sleep)
+	if err != nil || attempts != 2 {
+		t.Errorf("attempts = %d, err = %v; ожидалось подключение со второй попытки", attempts, err)
+	}
+}
+
+func TestNewDBRetryPolicyDefaults(t *testing.T) {
+	p := newDBRetryPolicy(settings.OracleConfig{DBConnectRetryAttempts: 10, DBConnectRetryMaxIntervalSec: 1})
+	if p.interval != 5*time.Second || p.maxInterval != 5*time.Second || p.maxRetries != 10 || p.maxWait != 0 {
+		t.Errorf("параметры %+v", p)
+	}
+
+	// Без ограничения - только явное -1, ноль означает одну попытку
+	for attempts, want := range map[int]int{-1: -1, -5: -1, 0: 1, 1: 1, 3: 3} {
+		if got := newDBRetryPolicy(settings.OracleConfig{DBConnectRetryAttempts: attempts}).maxRetries; got != want {
+			t.Errorf("DBConnectRetryAttempts = %d: maxRetries = %d, ожидалось %d", attempts, got, want)
+		}
+	}
+}
+
+func TestConnectWithRetryZeroAttemptsIsSingleAttempt(t *testing.T) {
+	clk := &fakeRetryClock{now: time.Now()}
+	policy := newDBRetryPolicy(settings.OracleConfig{DBConnectRetryAttempts: 0})
+
+	calls := 0
+	attempts, err := connectWithRetry(func() error { calls++; return errors.New("down") }, policy, clk.Now, clk.Sleep)
+	if err == nil || attempts != 1 || calls != 1 || len(clk.sleeps) != 0 {
+		t.Errorf("attempts = %d, calls = %d, пауз %d, err = %v; ожидалась одна попытка без пауз", attempts, calls, len(clk.sleeps), err)
+	}
+}
+
+func TestConnectWithRetryUnlimited(t *testing.T) {
+	clk := &fakeRetryClock{now: time.Now()}
+	policy := newDBRetryPolicy(settings.OracleConfig{DBConnectRetryAttempts: -1, DBConnectRetryIntervalSec: 1})
+
+	// При -1 попытки продолжаются до успешного подключения
+	calls := 0
+	attempts, err := connectWithRetry(func() error {
+		calls++
+		if calls < 50 {
+			return errors.New("down")
+		}
+		return nil
+	}, policy, clk.Now, clk.Sleep)
+	if err != nil || attempts != 50 || len(clk.sleeps) != 49 {
+		t.Errorf("attempts = %d, пауз %d, err = %v; ожидалось подключение с 50-й попытки", attempts, len(clk.sleeps), err)
+	}
+}
+
+// newShutdownConfig возвращает конфигурацию с ShutdownTimeoutSec = sec
+func newShutdownConfig(sec int) *settings.Config {
+	cfg := &settings.Config{}
+	cfg.Mode.ShutdownTimeoutSec = sec
+	return cfg
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	if got := shutdownTimeout(newShutdownConfig(45)); got != 45*time.Second {
+		t.Errorf("shutdownTimeout = %v, ожидалось 45s", got)
+	}
+}
+
+func TestWaitForOperationsCompletionHonorsTimeout(t *testing.T) {
+	cfg := newShutdownConfig(1)
+	dbConn, err := db.NewDBConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Обработчик не завершается: ожидание длится ShutdownTimeoutSec, а не дольше
+	var handlers sync.WaitGroup
+	handlers.Add(1)
+	defer handlers.Done()
+
+	timeout := shutdownTimeout(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	waitForOperationsCompletion(ctx, timeout, &handlers, dbConn)
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+2*time.Second {
+		t.Errorf("ожидание обработчиков длилось %v, ожидалось %v", elapsed, timeout)
+	}
+	if waitForMessageHandlers(ctx, &handlers) {
+		t.Error("незавершенный обработчик считается завершенным")
+	}
+}
+
+func TestWaitForOperationsCompletionReturnsEarly(t *testing.T) {
+	cfg := newShutdownConfig(30)
+	dbConn, err := db.NewDBConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handlers sync.WaitGroup
+	handlers.Add(1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		handlers.Done()
+	}()
+
+	timeout := shutdownTimeout(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	waitForOperationsCompletion(ctx, timeout, &handlers, dbConn)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ожидание завершенных обработчиков длилось %v", elapsed)
+	}
+	if !waitForMessageHandlers(ctx, &handlers) {
+		t.Error("завершенные обработчики не обнаружены")
+	}
+}
+
+func TestWaitForActiveDatabaseOperationsHonorsTimeout(t *testing.T) {
+	cfg := newShutdownConfig(1)
+	dbConn, err := db.NewDBConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbConn.BeginOperation(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbConn.EndOperation()
+
+	timeout := shutdownTimeout(cfg)
+	start := time.Now()
+	remaining := waitForActiveDatabaseOperations(context.Background(), timeout, dbConn)
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > timeout+2*time.Second {
+		t.Errorf("ожидание операций с БД длилось %v, ожидалось %v", elapsed, timeout)
+	}
+	if remaining != 1 {
+		t.Errorf("незавершенных операций: %d, ожидалась 1", remaining)
+	}
+	if result := newShutdownResult(true, remaining); result.Outcome != shutdownPartial {
+		t.Errorf("итог %s, ожидался partial", result.Outcome)
+	}
+}
+
+func TestNewShutdownResult(t *testing.T) {
+	tests := []struct {
+		handlersCompleted bool
+		remaining         int32
+		want              shutdownOutcome
+	}{
+		{true, 0, shutdownClean},
+		{true, 3, shutdownPartial},
+		{false, 0, shutdownForced},
+		{false, 3, shutdownForced},
+	}
+	for _, tt := range tests {
+		if got := newShutdownResult(tt.handlersCompleted, tt.remaining).Outcome; got != tt.want {
+			t.Errorf("newShutdownResult(%v, %d) = %s, ожидалось %s", tt.handlersCompleted, tt.remaining, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+)
+
+// digestSendTimeout - таймаут отправки сводки ошибок
+const digestSendTimeout = 2 * time.Minute
+
+// digestFailure - одна ошибка отправки, попавшая в сводку
+type digestFailure struct {
+	taskID     int64
+	title      string
+	recipients string
+	errorText  string
+	at         time.Time
+}
+
+// failureDigest накапливает ошибки отправки для сводки операторам
+type failureDigest struct {
+	mu          sync.Mutex
+	failures    []digestFailure // Не более maxItems ошибок, перечисляемых поименно
+	total       int             // Общее количество ошибок за период
+	byError     map[string]int  // Количество ошибок по тексту ошибки
+	periodStart time.Time
+	maxItems    int
+	threshold   int
+	notify      chan struct{} // Сигнал о достижении порога
+}
+
+// digestReport - сводка ошибок за период, подготовленная к отправке
+type digestReport struct {
+	periodStart time.Time
+	periodEnd   time.Time
+	total       int
+	byError     map[string]int
+	failures    []digestFailure
+}
+
+// newFailureDigest создает накопитель ошибок для сводки
+func newFailureDigest(threshold, maxItems int) *failureDigest {
+	return &failureDigest{
+		byError:   make(map[string]int),
+		maxItems:  maxItems,
+		threshold: threshold,
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// add добавляет ошибку в сводку и сигнализирует о достижении порога
+func (d *failureDigest) add(f digestFailure) {
+	d.mu.Lock()
+	if d.total == 0 {
+		d.periodStart = f.at
+	}
+	d.total++
+	d.byError[digestErrorKey(f.errorText)]++
+	if len(d.failures) < d.maxItems {
+		d.failures = append(d.failures, f)
+	}
+	reached := d.threshold > 0 && d.total >= d.threshold
+	d.mu.Unlock()
+
+	if reached {
+		select {
+		case d.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take забирает накопленные ошибки и начинает новый период
+// Возвращает nil, если ошибок не было
+func (d *failureDigest) take(now time.Time) *digestReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.total == 0 {
+		return nil
+	}
+	report := &digestReport{
+		periodStart: d.periodStart,
+		periodEnd:   now,
+		total:       d.total,
+		byError:     d.byError,
+		failures:    d.failures,
+	}
+	d.failures = nil
+	d.total = 0
+	d.byError = make(map[string]int)
+	return report
+}
+
+// digestErrorKey приводит текст ошибки к ключу группировки (без длинных хвостов с адресами и ответами сервера)
+func digestErrorKey(errorText string) string {
+	return truncateRunes(strings.TrimSpace(errorText), 150)
+}
+
+// subject формирует тему письма со сводкой
+func (r *digestReport) subject() string {
+	return fmt.Sprintf("Email Sender: %d ошибок отправки с %s", r.total, r.periodStart.Format("2006-01-02 15:04"))
+}
+
+// text формирует текст письма со сводкой
+func (r *digestReport) text() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Период: %s - %s\r\n", r.periodStart.Format("2006-01-02 15:04:05"), r.periodEnd.Format("2006-01-02 15:04:05"))
+	fmt.Fprintf(&b, "Всего ошибок отправки: %d\r\n\r\n", r.total)
+
+	// Группы ошибок по убыванию количества
+	keys := make([]string, 0, len(r.byError))
+	for key := range r.byError {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if r.byError[keys[i]] != r.byError[keys[j]] {
+			return r.byError[keys[i]] > r.byError[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	b.WriteString("Ошибки по типам:\r\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "  %d x %s\r\n", r.byError[key], key)
+	}
+
+	fmt.Fprintf(&b, "\r\nОшибки (первые %d):\r\n", len(r.failures))
+	for _, f := range r.failures {
+		fmt.Fprintf(&b, "  %s taskID=%d [%s] %s: %s\r\n",
+			f.at.Format("15:04:05"), f.taskID,
+			truncateRunes(f.recipients, maxSummaryRecipientsLen),
+			truncateRunes(f.title, maxSummarySubjectLen),
+			truncateRunes(f.errorText, 500))
+	}
+	if r.total > len(r.failures) {
+		fmt.Fprintf(&b, "  ... и еще %d\r\n", r.total-len(r.failures))
+	}
+
+	return b.String()
+}
+
+// recordFailure добавляет ошибку отправки в сводку для операторов (если сводка включена)
+func (s *Service) recordFailure(taskID int64, title, recipients, errorText string) {
+	if s.digest == nil {
+		return
+	}
+	s.digest.add(digestFailure{
+		taskID:     taskID,
+		title:      title,
+		recipients: recipients,
+		errorText:  errorText,
+		at:         s.clock.Now(),
+	})
+}
+
+// digestWorker отправляет сводку ошибок по расписанию (Digest.IntervalMin) или по достижении порога (Digest.Threshold)
+func (s *Service) digestWorker(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	interval := time.Duration(s.cfg.Digest.IntervalMin) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Отправляем накопленное перед завершением
+			s.sendDigest()
+			return
+		case <-ticker.C:
+			s.sendDigest()
+		case <-s.digest.notify:
+			s.sendDigest()
+		}
+	}
+}
+
+// sendDigest отправляет накопленную сводку ошибок операторам
+// Ошибка отправки сводки только логируется и не попадает в следующую сводку
+func (s *Service) sendDigest() {
+	report := s.digest.take(s.clock.Now())
+	if report == nil || s.emailService == nil {
+		return
+	}
+
+	// Контекст не связан с контекстом сервиса, чтобы сводка ушла и при остановке
+	ctx, cancel := context.WithTimeout(context.Background(), digestSendTimeout)
+	defer cancel()
+
+	if err := s.emailService.SendNotification(ctx, s.cfg.Digest.SmtpID, s.cfg.Digest.Email, report.subject(), report.text()); err != nil {
+		logger.Log.Error("Ошибка отправки сводки ошибок операторам",
+			zap.Error(err),
+			zap.Int("failures", report.total))
+		return
+	}
+
+	logger.Log.Info("Сводка ошибок отправлена операторам",
+		zap.String("email", s.cfg.Digest.Email),
+		zap.Int("failures", report.total))
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+)
+
+// failureKind - категория ошибки обработки письма
+// Ошибки разных категорий считаются отдельно, чтобы всплеск ошибок Crystal Reports
+// не выглядел как проблема SMTP сервера, и рестарт по каждой категории настраивается отдельно
+type failureKind int
+
+const (
+	// failureParse - ошибка разбора сообщения из очереди (пустой payload, некорректный XML)
+	failureParse failureKind = iota
+	// failureAttachment - ошибка получения вложения (CLOB, файл, CIFS шара, Crystal Reports)
+	failureAttachment
+	// failureSend - критическая ошибка отправки (isCriticalError)
+	failureSend
+
+	failureKindCount
+)
+
+// String возвращает название категории для логов и health endpoint
+func (k failureKind) String() string {
+	switch k {
+	case failureParse:
+		return "parse"
+	case failureAttachment:
+		return "attachment"
+	case failureSend:
+		return "send"
+	default:
+		return "unknown"
+	}
+}
+
+// failureCounters - счетчики ошибок по категориям с момента запуска или последнего рестарта по категории
+type failureCounters struct {
+	counts [failureKindCount]atomic.Int32
+}
+
+// add увеличивает счетчик категории
+func (f *failureCounters) add(kind failureKind) {
+	f.counts[kind].Add(1)
+}
+
+// load возвращает значение счетчика категории
+func (f *failureCounters) load(kind failureKind) int32 {
+	return f.counts[kind].Load()
+}
+
+// reset обнуляет счетчики всех категорий
+func (f *failureCounters) reset() {
+	for i := range f.counts {
+		f.counts[i].Store(0)
+	}
+}
+
+// failureStats - значения счетчиков ошибок для health endpoint и статистики
+type failureStats struct {
+	Parse      int32 `json:"parse"`
+	Attachment int32 `json:"attachment"`
+	Send       int32 `json:"send"`
+}
+
+// snapshot возвращает текущие значения счетчиков
+func (f *failureCounters) snapshot() failureStats {
+	return failureStats{
+		Parse:      f.load(failureParse),
+		Attachment: f.load(failureAttachment),
+		Send:       f.load(failureSend),
+	}
+}
+
+// failureThreshold возвращает порог авто-рестарта для категории (0 - категория рестарт не вызывает)
+func (s *Service) failureThreshold(kind failureKind) int {
+	switch kind {
+	case failureParse:
+		return s.cfg.Mode.MaxParseErrorsForAutoRestart
+	case failureAttachment:
+		return s.cfg.Mode.MaxAttachmentErrorsForAutoRestart
+	case failureSend:
+		return s.cfg.Mode.MaxSendErrorsForAutoRestart
+	default:
+		return 0
+	}
+}
+
+// checkFailureThresholds проверяет пороги авто-рестарта по каждой категории независимо
+// Счетчик категории, превысившей порог, обнуляется; остальные счетчики не затрагиваются
+func (s *Service) checkFailureThresholds() {
+	for kind := failureKind(0); kind < failureKindCount; kind++ {
+		limit := s.failureThreshold(kind)
+		if limit <= 0 {
+			continue
+		}
+		count := s.failures.load(kind)
+		if count <= int32(limit) {
+			continue
+		}
+		logger.Log.Warn("Превышение числа ошибок, инициируется рестарт",
+			zap.Stringer("category", kind),
+			zap.Int32("errorCount", count),
+			zap.Int("maxErrorCount", limit))
+		s.failures.counts[kind].Store(0)
+		s.needRestart.Store(true)
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"email-service/db"
+	"email-service/settings"
+)
+
+func TestFailureKindsCountedSeparately(t *testing.T) {
+	s := NewService(&settings.Config{}, nil, &db.QueueReader{})
+
+	// Ошибки разбора сообщений из очереди увеличивают только счетчик parse
+	s.enqueueRequest(&db.QueueMessage{MessageID: "empty", EmptyPayload: true})
+	s.enqueueRequest(&db.QueueMessage{MessageID: "broken", XMLPayload: "<root><body>"})
+	s.enqueueRequest(&db.QueueMessage{MessageID: "no-task", XMLPayload: `<root><head></head><body><email smtp_id="0"/></body></root>`})
+
+	s.failures.add(failureAttachment)
+	s.failures.add(failureSend)
+	s.failures.add(failureSend)
+
+	want := failureStats{Parse: 3, Attachment: 1, Send: 2}
+	if got := s.failures.snapshot(); got != want {
+		t.Errorf("счетчики %+v, ожидалось %+v", got, want)
+	}
+
+	// Счетчики по категориям отдаются health endpoint
+	rec := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var status healthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("ответ не JSON: %v", err)
+	}
+	if status.Failures != want {
+		t.Errorf("/health вернул счетчики %+v, ожидалось %+v", status.Failures, want)
+	}
+
+	s.failures.reset()
+	if got := s.failures.snapshot(); got != (failureStats{}) {
+		t.Errorf("после сброса счетчики %+v", got)
+	}
+}
+
+func TestFailureThresholdsIndependent(t *testing.T) {
+	cfg := &settings.Config{}
+	cfg.Mode.MaxParseErrorsForAutoRestart = 2
+	cfg.Mode.MaxAttachmentErrorsForAutoRestart = 0
+	cfg.Mode.MaxSendErrorsForAutoRestart = 5
+	s := NewService(cfg, nil, nil)
+
+	// Ошибки вложений при выключенном пороге рестарт не вызывают, сколько бы их ни было
+	for i := 0; i < 100; i++ {
+		s.failures.add(failureAttachment)
+	}
+	// Ошибки отправки ниже своего порога, хотя их больше, чем порог разбора
+	for i := 0; i < 4; i++ {
+		s.failures.add(failureSend)
+	}
+	s.checkFailureThresholds()
+	if s.needRestart.Load() {
+		t.Fatal("рестарт без превышения порогов")
+	}
+
+	// Превышение порога разбора вызывает рестарт и обнуляет только счетчик разбора
+	for i := 0; i < 3; i++ {
+		s.failures.add(failureParse)
+	}
+	s.checkFailureThresholds()
+	if !s.needRestart.Load() {
+		t.Fatal("превышение порога разбора не вызвало рестарт")
+	}
+	want := failureStats{Parse: 0, Attachment: 100, Send: 4}
+	if got := s.failures.snapshot(); got != want {
+		t.Errorf("счетчики после рестарта %+v, ожидалось %+v", got, want)
+	}
+
+	// Порог отправки срабатывает по своему счетчику
+	s.needRestart.Store(false)
+	s.failures.add(failureSend)
+	s.checkFailureThresholds()
+	if s.needRestart.Load() {
+		t.Fatal("рестарт при 5 ошибках отправки и пороге 5")
+	}
+	s.failures.add(failureSend)
+	s.checkFailureThresholds()
+	if !s.needRestart.Load() || s.failures.load(failureSend) != 0 {
+		t.Errorf("превышение порога отправки: рестарт %v, счетчик %d", s.needRestart.Load(), s.failures.load(failureSend))
+	}
+}
+
+func TestFailureThresholdsDisabledByDefault(t *testing.T) {
+	// Нулевые пороги - значения по умолчанию в settings.loadModeConfig
+	s := NewService(&settings.Config{}, nil, nil)
+
+	for kind := failureKind(0); kind < failureKindCount; kind++ {
+		for i := 0; i < 1000; i++ {
+			s.failures.add(kind)
+		}
+	}
+	s.checkFailureThresholds()
+	if s.needRestart.Load() {
+		t.Error("рестарт при порогах по умолчанию")
+	}
+	if want := (failureStats{Parse: 1000, Attachment: 1000, Send: 1000}); s.failures.snapshot() != want {
+		t.Errorf("счетчики %+v, ожидалось %+v", s.failures.snapshot(), want)
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"email-service/db"
+	"email-service/logger"
+)
+
+// healthStatus - состояние сервиса, возвращаемое /health
+type healthStatus struct {
+	Status        string       `json:"status"`
+	RequestQueue  int          `json:"requestQueue"`
+	LanesPending  int          `json:"lanesPending"`
+	ResponseQueue int          `json:"responseQueue"`
+	Failures      failureStats `json:"failures"`
+}
+
+// HealthHandler возвращает HTTP обработчик состояния сервиса:
+// /health - размеры очередей и счетчики ошибок по категориям,
+// /health/recent - последние обработанные письма (если задан Health.RecentMessages),
+// POST /reconnect-db - внеплановое переподключение к БД (с токеном Health.ReconnectToken
+// или, если токен не задан, только с локального адреса)
+func (s *Service) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		s.requestDirMu.RLock()
+		queueSize := len(s.requestDir)
+		s.requestDirMu.RUnlock()
+
+		writeJSON(w, http.StatusOK, healthStatus{
+			Status:        "ok",
+			RequestQueue:  queueSize,
+			LanesPending:  s.lanesPending(),
+			ResponseQueue: len(s.responseQueue),
+			Failures:      s.failures.snapshot(),
+		})
+	})
+	mux.HandleFunc("/health/recent", func(w http.ResponseWriter, r *http.Request) {
+		if s.recent == nil {
+			http.Error(w, "буфер последних писем отключен (Health.RecentMessages = 0)", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.recent.snapshot())
+	})
+	mux.HandleFunc("/reconnect-db", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "используйте POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if code, msg := s.authorizeReconnect(r); code != http.StatusOK {
+			logger.Log.Warn("Отклонена команда переподключения к БД",
+				zap.String("remoteAddr", r.RemoteAddr), zap.String("reason", msg))
+			http.Error(w, msg, code)
+			return
+		}
+
+		if s.reconnector == nil {
+			http.Error(w, "подключение к БД не настроено", http.StatusServiceUnavailable)
+			return
+		}
+
+		logger.Log.Info("Получена команда переподключения к БД", zap.String("remoteAddr", r.RemoteAddr))
+		if err := s.reconnector.ReconnectNow(); err != nil {
+			logger.Log.Error("Ошибка переподключения к БД по команде оператора", zap.Error(err))
+			code := http.StatusInternalServerError
+			if errors.Is(err, db.ErrReconnectInProgress) {
+				code = http.StatusConflict
+			}
+			writeJSON(w, code, reconnectResult{Status: "error", Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, reconnectResult{Status: "ok", Generation: s.reconnector.Generation()})
+	})
+	return mux
+}
+
+// authorizeReconnect проверяет право на вызов /reconnect-db
+// При заданном Health.ReconnectToken требуется заголовок "Authorization: Bearer <токен>",
+// без токена принимаются только запросы с loopback адреса
+func (s *Service) authorizeReconnect(r *http.Request) (int, string) {
+	if token := s.cfg.Health.ReconnectToken; token != "" {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return http.StatusUnauthorized, "неверный или отсутствующий токен"
+		}
+		return http.StatusOK, ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return http.StatusForbidden, "без Health.ReconnectToken команда принимается только с локального адреса"
+	}
+	return http.StatusOK, ""
+}
+
+// dbReconnector - внеплановое переподключение к БД (реализуется *db.DBConnection)
+type dbReconnector interface {
+	ReconnectNow() error
+	Generation() uint64
+}
+
+// reconnectResult - результат переподключения к БД, возвращаемый /reconnect-db
+type reconnectResult struct {
+	Status     string `json:"status"`
+	Generation uint64 `json:"generation,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// writeJSON записывает ответ в формате JSON с кодом статуса code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Log.Warn("Ошибка записи ответа health endpoint", zap.Error(err))
+	}
+}
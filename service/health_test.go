@@ -0,0 +1,166 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/ini.v1"
+
+	"email-service/db"
+	"email-service/settings"
+)
+
+// fakeReconnector - переподключение к БД для тестов /reconnect-db
+type fakeReconnector struct {
+	err        error
+	calls      int
+	generation uint64
+}
+
+func (f *fakeReconnector) ReconnectNow() error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	f.generation++
+	return nil
+}
+
+func (f *fakeReconnector) Generation() uint64 {
+	return f.generation
+}
+
+// postReconnect выполняет запрос к /reconnect-db с локального адреса и разбирает ответ
+func postReconnect(t *testing.T, s *Service, method string) (int, reconnectResult) {
+	t.Helper()
+	req := httptest.NewRequest(method, "/reconnect-db", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	return serveReconnect(t, s, req)
+}
+
+// serveReconnect выполняет запрос req к /reconnect-db и разбирает ответ
+func serveReconnect(t *testing.T, s *Service, req *http.Request) (int, reconnectResult) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(rec, req)
+	var result reconnectResult
+	if rec.Code != http.StatusMethodNotAllowed && rec.Code != http.StatusServiceUnavailable &&
+		rec.Code != http.StatusUnauthorized && rec.Code != http.StatusForbidden {
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("ответ не JSON: %v (%s)", err, rec.Body.String())
+		}
+	}
+	return rec.Code, result
+}
+
+func TestReconnectDBEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   int
+		wantStatus string
+	}{
+		{"успешное переподключение", nil, http.StatusOK, "ok"},
+		{"ошибка подключения", errors.New("ORA-12541: TNS:no listener"), http.StatusInternalServerError, "error"},
+		{"переподключение уже выполняется", db.ErrReconnectInProgress, http.StatusConflict, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(&settings.Config{}, nil, nil)
+			reconnector := &fakeReconnector{err: tt.err, generation: 3}
+			s.reconnector = reconnector
+
+			code, result := postReconnect(t, s, http.MethodPost)
+			if reconnector.calls != 1 {
+				t.Errorf("переподключение вызвано %d раз", reconnector.calls)
+			}
+			if code != tt.wantCode || result.Status != tt.wantStatus {
+				t.Errorf("ответ %d %+v, ожидалось %d со статусом %s", code, result, tt.wantCode, tt.wantStatus)
+			}
+			if tt.err == nil && result.Generation != 4 {
+				t.Errorf("поколение пула %d, ожидалось 4", result.Generation)
+			}
+			if tt.err != nil && result.Error != tt.err.Error() {
+				t.Errorf("текст ошибки %q, ожидалось %q", result.Error, tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestReconnectDBEndpointRequiresPost(t *testing.T) {
+	s := NewService(&settings.Config{}, nil, nil)
+	reconnector := &fakeReconnector{}
+	s.reconnector = reconnector
+
+	if code, _ := postReconnect(t, s, http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET вернул %d, ожидалось %d", code, http.StatusMethodNotAllowed)
+	}
+	if reconnector.calls != 0 {
+		t.Error("GET запрос выполнил переподключение")
+	}
+}
+
+func TestReconnectDBEndpointAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		auth       string
+		wantCode   int
+	}{
+		{"без токена с IPv4 loopback", "", "127.0.0.1:40000", "", http.StatusOK},
+		{"без токена с IPv6 loopback", "", "[::1]:40000", "", http.StatusOK},
+		{"без токена с внешнего адреса", "", "192.0.2.1:1234", "", http.StatusForbidden},
+		{"верный токен с внешнего адреса", "s3cret", "192.0.2.1:1234", "Bearer s3cret", http.StatusOK},
+		{"неверный токен", "s3cret", "127.0.0.1:40000", "Bearer wrong", http.StatusUnauthorized},
+		{"токен не передан", "s3cret", "127.0.0.1:40000", "", http.StatusUnauthorized},
+		{"токен без схемы Bearer", "s3cret", "127.0.0.1:40000", "s3cret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &settings.Config{}
+			cfg.Health.ReconnectToken = tt.token
+			s := NewService(cfg, nil, nil)
+			reconnector := &fakeReconnector{}
+			s.reconnector = reconnector
+
+			req := httptest.NewRequest(http.MethodPost, "/reconnect-db", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			code, _ := serveReconnect(t, s, req)
+			if code != tt.wantCode {
+				t.Errorf("ответ %d, ожидалось %d", code, tt.wantCode)
+			}
+			wantCalls := 0
+			if tt.wantCode == http.StatusOK {
+				wantCalls = 1
+			}
+			if reconnector.calls != wantCalls {
+				t.Errorf("переподключение вызвано %d раз, ожидалось %d", reconnector.calls, wantCalls)
+			}
+		})
+	}
+}
+
+func TestReconnectDBEndpointReportsConnectionError(t *testing.T) {
+	// Без параметров подключения в конфигурации новое соединение создать нельзя
+	cfg := &settings.Config{File: ini.Empty()}
+	dbConn, err := db.NewDBConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewService(cfg, dbConn, nil)
+
+	code, result := postReconnect(t, s, http.MethodPost)
+	if code != http.StatusInternalServerError || result.Status != "error" || result.Error == "" {
+		t.Errorf("ответ %d %+v, ожидалась ошибка переподключения", code, result)
+	}
+	if dbConn.Generation() != 0 {
+		t.Errorf("поколение пула изменилось после неудачного переподключения: %d", dbConn.Generation())
+	}
+}
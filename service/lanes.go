@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/clock"
+	"email-service/db"
+	"email-service/logger"
+)
+
+// smtpLane - независимая очередь отправки для одного SMTP сервера
+// Медленный или недоступный сервер блокирует только свою очередь, не задерживая остальные
+type smtpLane struct {
+	smtpIndex int
+	queue     chan *db.QueueMessage // Ограниченная очередь сообщений на отправку
+	pending   atomic.Int32          // Сообщения в очереди и в обработке
+
+	interval time.Duration // Минимальный интервал между отправками через очередь (0 - без ограничения)
+	rateMu   sync.Mutex
+	nextSend time.Time // Время, раньше которого следующая отправка не начинается
+}
+
+// waitRate ждет, пока ограничение частоты очереди разрешит следующую отправку
+// Интервал резервируется под блокировкой, поэтому несколько обработчиков очереди вместе не превышают лимит.
+// Возвращает false, если ожидание прервано отменой контекста
+func (l *smtpLane) waitRate(ctx context.Context, clk clock.Clock) bool {
+	if l.interval <= 0 {
+		return true
+	}
+
+	l.rateMu.Lock()
+	now := clk.Now()
+	start := l.nextSend
+	if start.Before(now) {
+		start = now
+	}
+	l.nextSend = start.Add(l.interval)
+	l.rateMu.Unlock()
+
+	wait := start.Sub(now)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-clk.After(wait):
+		return true
+	}
+}
+
+// startLanes создает очереди отправки для каждого SMTP сервера и запускает их обработчики
+func (s *Service) startLanes(ctx context.Context, wg *sync.WaitGroup) {
+	queueSize := s.cfg.Mode.SMTPLaneQueueSize
+	if queueSize <= 0 {
+		queueSize = portion
+	}
+	workers := s.cfg.Mode.SMTPLaneWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	var interval time.Duration
+	if perMinute := s.cfg.Mode.SMTPLaneMaxPerMinute; perMinute > 0 {
+		interval = time.Minute / time.Duration(perMinute)
+	}
+
+	s.lanes = make([]*smtpLane, len(s.cfg.SMTP))
+	for i := range s.lanes {
+		lane := &smtpLane{
+			smtpIndex: i,
+			queue:     make(chan *db.QueueMessage, queueSize),
+			interval:  interval,
+		}
+		s.lanes[i] = lane
+
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go s.laneWorker(ctx, wg, lane)
+		}
+	}
+
+	logger.Log.Info("Запущены очереди отправки по SMTP серверам",
+		zap.Int("lanes", len(s.lanes)),
+		zap.Int("queueSize", queueSize),
+		zap.Int("workersPerLane", workers),
+		zap.Int("maxPerMinute", s.cfg.Mode.SMTPLaneMaxPerMinute))
+}
+
+// stopLanes закрывает очереди отправки; обработчики завершаются после отправки уже принятых сообщений
+func (s *Service) stopLanes() {
+	for _, lane := range s.lanes {
+		close(lane.queue)
+	}
+}
+
+// laneWorker последовательно отправляет сообщения из очереди SMTP сервера
+func (s *Service) laneWorker(ctx context.Context, wg *sync.WaitGroup, lane *smtpLane) {
+	defer wg.Done()
+
+	for msg := range lane.queue {
+		// При отмене контекста сообщение все равно передается в sendMessage: принятые сообщения не теряются
+		lane.waitRate(ctx, s.clock)
+		s.sendMessage(ctx, msg)
+		lane.pending.Add(-1)
+	}
+}
+
+// laneIndex определяет очередь отправки сообщения по smtp_id
+// Некорректный smtp_id направляется в очередь первого сервера (как и при выборе SMTP клиента)
+func (s *Service) laneIndex(msg *db.QueueMessage) int {
+	parsed, err := s.queueReader.ParseXMLMessage(msg)
+	if err != nil {
+		return 0
+	}
+	smtpIDStr, _ := parsed["smtp_id"].(string)
+	smtpID, err := strconv.Atoi(strings.TrimSpace(smtpIDStr))
+	if err != nil || smtpID < 0 || smtpID >= len(s.lanes) {
+		return 0
+	}
+	return smtpID
+}
+
+// lanesPending возвращает количество сообщений, принятых очередями SMTP серверов, но еще не обработанных
+func (s *Service) lanesPending() int {
+	total := 0
+	for _, lane := range s.lanes {
+		total += int(lane.pending.Load())
+	}
+	return total
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"email-service/clock"
+	"email-service/db"
+	"email-service/settings"
+)
+
+// newLaneTestService создает сервис с очередями SMTP серверов без обработчиков:
+// тест сам решает, какая очередь разбирается, а какая "зависла"
+func newLaneTestService(t *testing.T, servers, queueSize int) *Service {
+	t.Helper()
+	cfg := &settings.Config{}
+	cfg.SMTP = make([]settings.SMTPConfig, servers)
+	s := NewService(cfg, nil, &db.QueueReader{})
+	s.lanes = make([]*smtpLane, servers)
+	for i := range s.lanes {
+		s.lanes[i] = &smtpLane{smtpIndex: i, queue: make(chan *db.QueueMessage, queueSize)}
+	}
+	return s
+}
+
+func laneTestMessage(taskID, smtpID int) *db.QueueMessage {
+	return &db.QueueMessage{
+		MessageID: fmt.Sprintf("msg-%d", taskID),
+		XMLPayload: fmt.Sprintf(`<root><head></head><body><email email_task_id="%d" smtp_id="%d" email_address="u%d@example.org"/></body></root>`,
+			taskID, smtpID, taskID),
+	}
+}
+
+func TestStalledLaneDoesNotBlockOtherServers(t *testing.T) {
+	s := newLaneTestService(t, 2, 2)
+
+	// Сообщения для зависшего сервера 0 идут первыми и перемежаются с сообщениями для сервера 1
+	const perServer = 20
+	for i := 0; i < perServer; i++ {
+		s.enqueueRequest(laneTestMessage(1000+i, 0))
+		s.enqueueRequest(laneTestMessage(2000+i, 1))
+	}
+
+	// Обработчик сервера 1 разбирает свою очередь между циклами распределения,
+	// обработчик сервера 0 не отвечает
+	var delivered []string
+	for cycle := 0; len(delivered) < perServer; cycle++ {
+		if cycle > perServer {
+			t.Fatalf("сервер 1 получил %d из %d сообщений: зависший сервер 0 блокирует отправку", len(delivered), perServer)
+		}
+		s.processRequestQueue()
+		for len(s.lanes[1].queue) > 0 {
+			msg := <-s.lanes[1].queue
+			s.lanes[1].pending.Add(-1)
+			delivered = append(delivered, msg.MessageID)
+		}
+	}
+	for i, id := range delivered {
+		if want := fmt.Sprintf("msg-%d", 2000+i); id != want {
+			t.Fatalf("сервер 1 получил %s, ожидалось %s (нарушен порядок)", id, want)
+		}
+	}
+
+	// Очередь сервера 0 заполнена, остальные его сообщения ждут во внутренней очереди в исходном порядке
+	if n := len(s.lanes[0].queue); n != 2 {
+		t.Errorf("в очереди сервера 0 %d сообщений, ожидалось 2", n)
+	}
+	s.requestDirMu.RLock()
+	defer s.requestDirMu.RUnlock()
+	if len(s.requestDir) != perServer-2 {
+		t.Fatalf("во внутренней очереди %d сообщений, ожидалось %d", len(s.requestDir), perServer-2)
+	}
+	for i, msg := range s.requestDir {
+		if want := fmt.Sprintf("msg-%d", 1002+i); msg.MessageID != want {
+			t.Errorf("requestDir[%d] = %s, ожидалось %s", i, msg.MessageID, want)
+		}
+	}
+	if s.requestDirMap["1001"] || !s.requestDirMap["1002"] {
+		t.Error("мапа дубликатов не соответствует внутренней очереди")
+	}
+}
+
+func TestLaneIndexInvalidSmtpID(t *testing.T) {
+	s := newLaneTestService(t, 2, 1)
+
+	cases := []struct {
+		smtpID string
+		want   int
+	}{
+		{"1", 1},
+		{" 1 ", 1},
+		{"5", 0},
+		{"-1", 0},
+		{"abc", 0},
+	}
+	for _, tc := range cases {
+		msg := &db.QueueMessage{XMLPayload: `<root><head></head><body><email email_task_id="1" smtp_id="` + tc.smtpID + `"/></body></root>`}
+		if got := s.laneIndex(msg); got != tc.want {
+			t.Errorf("laneIndex(smtp_id=%q) = %d, ожидалось %d", tc.smtpID, got, tc.want)
+		}
+	}
+}
+
+func TestLaneRateLimitIsPerLane(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	limited := &smtpLane{interval: time.Second}
+	other := &smtpLane{interval: time.Second}
+	ctx := context.Background()
+
+	// Первая отправка через очередь не ждет
+	if !limited.waitRate(ctx, clk) {
+		t.Fatal("первая отправка прервана")
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		limited.waitRate(ctx, clk)
+		close(sent)
+	}()
+	waitForWaiters(t, clk, 1)
+
+	// Ожидание в одной очереди не задерживает отправку через другую
+	if !other.waitRate(ctx, clk) {
+		t.Fatal("отправка через другую очередь прервана")
+	}
+	select {
+	case <-sent:
+		t.Fatal("вторая отправка не дождалась интервала очереди")
+	default:
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("вторая отправка не выполнена после интервала")
+	}
+}
+
+func TestLaneRateLimitCancel(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	lane := &smtpLane{interval: time.Minute}
+	lane.waitRate(context.Background(), clk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if lane.waitRate(ctx, clk) {
+		t.Error("ожидание интервала не прервано отменой контекста")
+	}
+
+	// Без лимита ожидания нет
+	if !(&smtpLane{}).waitRate(ctx, clk) {
+		t.Error("очередь без лимита ждет отправку")
+	}
+}
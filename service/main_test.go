@@ -0,0 +1,15 @@
+package service
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = zap.NewNop()
+	os.Exit(m.Run())
+}
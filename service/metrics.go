@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/db"
+	"email-service/email"
+	"email-service/logger"
+)
+
+// metricsKey - ключ счетчика отправок: час, SMTP сервер и статус
+type metricsKey struct {
+	hour     time.Time
+	smtpID   int
+	statusID int
+}
+
+// sendMetrics накапливает почасовые счетчики результатов отправки до записи в БД
+type sendMetrics struct {
+	mu     sync.Mutex
+	counts map[metricsKey]int
+}
+
+// newSendMetrics создает пустой набор счетчиков
+func newSendMetrics() *sendMetrics {
+	return &sendMetrics{counts: make(map[metricsKey]int)}
+}
+
+// add увеличивает счетчик для часа, SMTP сервера и статуса
+func (m *sendMetrics) add(at time.Time, smtpID, statusID, n int) {
+	key := metricsKey{hour: at.Truncate(time.Hour), smtpID: smtpID, statusID: statusID}
+	m.mu.Lock()
+	m.counts[key] += n
+	m.mu.Unlock()
+}
+
+// take забирает накопленные счетчики, обнуляя их
+func (m *sendMetrics) take() map[metricsKey]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.counts) == 0 {
+		return nil
+	}
+	counts := m.counts
+	m.counts = make(map[metricsKey]int)
+	return counts
+}
+
+// recordSendMetric учитывает результат отправки в счетчиках (если запись метрик включена)
+// Счетчики ведутся по кодам статусов БД из секции [Status]
+func (s *Service) recordSendMetric(smtpID int, status email.Status) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.add(s.clock.Now(), smtpID, status.Code(s.cfg.Status), 1)
+}
+
+// metricsWorker периодически записывает счетчики отправок в БД
+func (s *Service) metricsWorker(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	interval := time.Duration(s.cfg.Mode.MetricsFlushIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Записываем накопленное перед завершением
+			s.flushMetrics(context.Background())
+			return
+		case <-ticker.C:
+			s.flushMetrics(ctx)
+		}
+	}
+}
+
+// flushMetrics записывает накопленные счетчики в БД
+// Счетчики, которые не удалось записать, возвращаются и будут записаны при следующем сбросе
+func (s *Service) flushMetrics(ctx context.Context) {
+	counts := s.metrics.take()
+	if len(counts) == 0 {
+		return
+	}
+
+	failed := 0
+	for key, count := range counts {
+		err := s.dbConn.SaveEmailMetrics(ctx, db.SaveEmailMetricsParams{
+			PeriodStart: key.hour,
+			SmtpID:      key.smtpID,
+			StatusID:    key.statusID,
+			Count:       count,
+		})
+		if err != nil {
+			s.metrics.add(key.hour, key.smtpID, key.statusID, count)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		logger.Log.Warn("Не удалось записать часть метрик отправки в БД, запись будет повторена",
+			zap.Int("failed", failed),
+			zap.Int("total", len(counts)))
+		return
+	}
+	logger.Log.Debug("Метрики отправки записаны в БД", zap.Int("rows", len(counts)))
+}
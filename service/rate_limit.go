@@ -0,0 +1,79 @@
+package service
+
+import (
+	"container/list"
+	"time"
+)
+
+// rateLimitEntry хранит время, до которого отправка на адрес ограничена
+type rateLimitEntry struct {
+	address string
+	until   time.Time
+}
+
+// rateLimitMap - LRU-кеш ограничений частоты отправки на email адреса
+// При превышении maxSize вытесняются записи, которые дольше всего не использовались
+// Не потокобезопасен: доступ защищается Service.sendEmailMu
+type rateLimitMap struct {
+	entries map[string]*list.Element // Ключ - email адрес
+	lru     *list.List               // Начало списка - самые свежие записи
+	maxSize int
+	evicted int64 // Общее количество вытесненных записей
+}
+
+// newRateLimitMap создает LRU-кеш ограничений с указанным максимальным размером
+// maxSize <= 0 означает отсутствие ограничения
+func newRateLimitMap(maxSize int) *rateLimitMap {
+	return &rateLimitMap{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		maxSize: maxSize,
+	}
+}
+
+// get возвращает время ограничения для адреса и отмечает запись как использованную
+func (m *rateLimitMap) get(address string) (time.Time, bool) {
+	elem, ok := m.entries[address]
+	if !ok {
+		return time.Time{}, false
+	}
+	m.lru.MoveToFront(elem)
+	return elem.Value.(*rateLimitEntry).until, true
+}
+
+// set устанавливает время ограничения для адреса
+// Возвращает количество записей, вытесненных для соблюдения лимита размера
+func (m *rateLimitMap) set(address string, until time.Time) int {
+	if elem, ok := m.entries[address]; ok {
+		elem.Value.(*rateLimitEntry).until = until
+		m.lru.MoveToFront(elem)
+		return 0
+	}
+
+	m.entries[address] = m.lru.PushFront(&rateLimitEntry{address: address, until: until})
+
+	evicted := 0
+	for m.maxSize > 0 && m.lru.Len() > m.maxSize {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.entries, oldest.Value.(*rateLimitEntry).address)
+		evicted++
+	}
+	m.evicted += int64(evicted)
+	return evicted
+}
+
+// cleanup удаляет записи, время ограничения которых уже истекло
+func (m *rateLimitMap) cleanup(now time.Time) {
+	for address, elem := range m.entries {
+		if elem.Value.(*rateLimitEntry).until.Before(now) {
+			m.lru.Remove(elem)
+			delete(m.entries, address)
+		}
+	}
+}
+
+// size возвращает текущее количество записей
+func (m *rateLimitMap) size() int {
+	return len(m.entries)
+}
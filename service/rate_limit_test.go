@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"email-service/email"
+	"email-service/settings"
+)
+
+func TestRateLimitMapEvictsOldest(t *testing.T) {
+	m := newRateLimitMap(100)
+	until := time.Now().Add(time.Hour)
+
+	// Поток уникальных адресов не увеличивает кеш сверх maxSize
+	evicted := 0
+	for i := 0; i < 10000; i++ {
+		evicted += m.set(fmt.Sprintf("user%d@example.org", i), until)
+	}
+	if m.size() != 100 || m.lru.Len() != 100 {
+		t.Fatalf("размер кеша %d (список %d), ожидалось 100", m.size(), m.lru.Len())
+	}
+	if evicted != 9900 || m.evicted != 9900 {
+		t.Errorf("вытеснено %d (всего %d), ожидалось 9900", evicted, m.evicted)
+	}
+	// Остаются последние адреса
+	if _, ok := m.get("user9999@example.org"); !ok {
+		t.Error("последний адрес вытеснен")
+	}
+	if _, ok := m.get("user9900@example.org"); !ok {
+		t.Error("адрес из последних 100 вытеснен")
+	}
+	if _, ok := m.get("user9899@example.org"); ok {
+		t.Error("адрес старше последних 100 не вытеснен")
+	}
+}
+
+func TestRateLimitMapEvictsLeastRecentlyUsed(t *testing.T) {
+	m := newRateLimitMap(3)
+	until := time.Now().Add(time.Hour)
+	m.set("a@example.org", until)
+	m.set("b@example.org", until)
+	m.set("c@example.org", until)
+
+	// Обращение к a делает ее самой свежей: вытесняется b
+	m.get("a@example.org")
+	if evicted := m.set("d@example.org", until); evicted != 1 {
+		t.Fatalf("вытеснено %d, ожидалась 1 запись", evicted)
+	}
+	if _, ok := m.get("b@example.org"); ok {
+		t.Error("b не вытеснен")
+	}
+	for _, address := range []string{"a@example.org", "c@example.org", "d@example.org"} {
+		if _, ok := m.get(address); !ok {
+			t.Errorf("%s вытеснен", address)
+		}
+	}
+
+	// Обновление существующей записи не вытесняет другие
+	if evicted := m.set("c@example.org", until.Add(time.Minute)); evicted != 0 {
+		t.Errorf("обновление записи вытеснило %d записей", evicted)
+	}
+}
+
+func TestRateLimitMapCleanup(t *testing.T) {
+	m := newRateLimitMap(10)
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		m.set(fmt.Sprintf("expired%d@example.org", i), now.Add(-time.Second))
+		m.set(fmt.Sprintf("active%d@example.org", i), now.Add(time.Minute))
+	}
+
+	m.cleanup(now)
+	if m.size() != 5 || m.lru.Len() != 5 {
+		t.Fatalf("после очистки %d записей (список %d), ожидалось 5", m.size(), m.lru.Len())
+	}
+	if _, ok := m.get("expired0@example.org"); ok {
+		t.Error("истекшая запись не удалена")
+	}
+	if _, ok := m.get("active0@example.org"); !ok {
+		t.Error("действующая запись удалена")
+	}
+
+	// Освобожденные места занимаются без вытеснения действующих записей
+	for i := 0; i < 5; i++ {
+		if evicted := m.set(fmt.Sprintf("new%d@example.org", i), now.Add(time.Minute)); evicted != 0 {
+			t.Fatalf("после очистки вытеснено %d записей", evicted)
+		}
+	}
+}
+
+func TestRateLimitMapUnbounded(t *testing.T) {
+	m := newRateLimitMap(0)
+	until := time.Now().Add(time.Hour)
+	for i := 0; i < 1000; i++ {
+		m.set(fmt.Sprintf("user%d@example.org", i), until)
+	}
+	if m.size() != 1000 || m.evicted != 0 {
+		t.Errorf("без ограничения: размер %d, вытеснено %d", m.size(), m.evicted)
+	}
+}
+
+func TestCheckAndUpdateRateLimitsCapsMap(t *testing.T) {
+	cfg := &settings.Config{}
+	cfg.Mode.MaxRateLimitEntries = 50
+	cfg.SMTP = []settings.SMTPConfig{{Host: "smtp.example.com", SMTPMinSendEmailIntervalMsec: 60000}}
+	s := NewService(cfg, nil, nil)
+
+	for i := 0; i < 500; i++ {
+		msg := &email.ParsedEmailMessage{EmailAddress: fmt.Sprintf("user%d@example.org", i)}
+		if err := s.checkAndUpdateRateLimits(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, evicted := s.GetRateLimitMapSize()
+	if size != 50 || evicted != 450 {
+		t.Errorf("размер кеша %d, вытеснено %d; ожидалось 50 и 450", size, evicted)
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"email-service/email"
+)
+
+// recentMessage - результат обработки письма для просмотра последней активности
+type recentMessage struct {
+	TaskID     int64     `json:"taskId"`
+	Recipients string    `json:"recipients"`
+	Status     string    `json:"status"`
+	Time       time.Time `json:"time"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// recentMessages - кольцевой буфер последних обработанных писем
+// При заполнении новые записи вытесняют самые старые
+type recentMessages struct {
+	mu      sync.Mutex
+	entries []recentMessage
+	next    int // Позиция следующей записи
+	count   int // Количество заполненных записей
+}
+
+// newRecentMessages создает буфер на size записей
+func newRecentMessages(size int) *recentMessages {
+	return &recentMessages{entries: make([]recentMessage, size)}
+}
+
+// add добавляет запись, вытесняя самую старую при заполнении буфера
+func (r *recentMessages) add(m recentMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = m
+	r.next = (r.next + 1) % len(r.entries)
+	if r.count < len(r.entries) {
+		r.count++
+	}
+}
+
+// snapshot возвращает копию записей, начиная с самой новой
+func (r *recentMessages) snapshot() []recentMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]recentMessage, 0, r.count)
+	for i := 1; i <= r.count; i++ {
+		idx := (r.next - i + len(r.entries)) % len(r.entries)
+		result = append(result, r.entries[idx])
+	}
+	return result
+}
+
+// recordRecent сохраняет результат обработки письма в буфере последней активности (если он включен)
+func (s *Service) recordRecent(taskID int64, recipients string, status email.Status, errorText string) {
+	if s.recent == nil {
+		return
+	}
+	s.recent.add(recentMessage{
+		TaskID:     taskID,
+		Recipients: recipients,
+		Status:     status.String(),
+		Time:       s.clock.Now(),
+		Error:      errorText,
+	})
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"email-service/email"
+	"email-service/settings"
+)
+
+func TestRecentMessagesEvictsOldest(t *testing.T) {
+	r := newRecentMessages(3)
+	if got := r.snapshot(); len(got) != 0 {
+		t.Fatalf("пустой буфер вернул %d записей", len(got))
+	}
+
+	for id := int64(1); id <= 5; id++ {
+		r.add(recentMessage{TaskID: id})
+	}
+
+	// Остаются три последних письма, начиная с самого нового
+	got := r.snapshot()
+	want := []int64{5, 4, 3}
+	if len(got) != len(want) {
+		t.Fatalf("в буфере %d записей, ожидалось %d", len(got), len(want))
+	}
+	for i, m := range got {
+		if m.TaskID != want[i] {
+			t.Errorf("запись %d: taskID %d, ожидалось %d", i, m.TaskID, want[i])
+		}
+	}
+}
+
+func TestHealthRecentReflectsSends(t *testing.T) {
+	cfg := &settings.Config{}
+	cfg.Health.Listen = "127.0.0.1:0"
+	cfg.Health.RecentMessages = 2
+	s := NewService(cfg, nil, nil)
+
+	s.recordRecent(1, "a@example.org", email.StatusSent, "")
+	s.recordRecent(2, "b@example.org", email.StatusFailed, "550 User unknown")
+	s.recordRecent(3, "c@example.org", email.StatusSent, "")
+
+	rec := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/recent", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("код ответа %d", rec.Code)
+	}
+	var got []recentMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("ответ не JSON: %v", err)
+	}
+	if len(got) != 2 || got[0].TaskID != 3 || got[1].TaskID != 2 {
+		t.Fatalf("последние письма %+v, ожидались задачи 3 и 2", got)
+	}
+	if got[1].Status != "failed" || got[1].Error != "550 User unknown" || got[1].Recipients != "b@example.org" {
+		t.Errorf("запись об ошибке %+v", got[1])
+	}
+}
+
+func TestHealthRecentDisabled(t *testing.T) {
+	s := NewService(&settings.Config{}, nil, nil)
+	s.recordRecent(1, "a@example.org", email.StatusSent, "")
+
+	rec := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/recent", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("код ответа %d, ожидалось %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/email"
+	"email-service/logger"
+)
+
+// reportTask - итог обработки письма в отчете о работе
+type reportTask struct {
+	TaskID     int64     `json:"taskId"`
+	Recipients string    `json:"recipients"`
+	Status     string    `json:"status"`
+	StatusCode int       `json:"statusCode"` // Код статуса для БД из секции [Status]
+	Time       time.Time `json:"time"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// reportFile - содержимое файла отчета (Mode.ReportFile)
+type reportFile struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Total    int            `json:"total"`
+	Statuses map[string]int `json:"statuses"` // Количество писем по статусам
+	Tasks    []reportTask   `json:"tasks"`
+}
+
+// runReport накапливает итоги обработки писем за время работы сервиса
+// Для каждого taskID хранится одна запись: повторная обработка и проверка статуса доставки ее обновляют
+type runReport struct {
+	mu      sync.Mutex
+	started time.Time
+	tasks   []reportTask
+	index   map[int64]int // taskID -> позиция в tasks
+}
+
+// newRunReport создает отчет о работе, начатой в started
+func newRunReport(started time.Time) *runReport {
+	return &runReport{started: started, index: make(map[int64]int)}
+}
+
+// set добавляет или обновляет запись письма
+func (r *runReport) set(task reportTask) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i, ok := r.index[task.TaskID]; ok {
+		if task.Recipients == "" {
+			task.Recipients = r.tasks[i].Recipients
+		}
+		r.tasks[i] = task
+		return
+	}
+	r.index[task.TaskID] = len(r.tasks)
+	r.tasks = append(r.tasks, task)
+}
+
+// build формирует содержимое файла отчета
+func (r *runReport) build(finished time.Time) reportFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := reportFile{
+		Started:  r.started,
+		Finished: finished,
+		Total:    len(r.tasks),
+		Statuses: make(map[string]int),
+		Tasks:    append([]reportTask(nil), r.tasks...),
+	}
+	for _, task := range r.tasks {
+		report.Statuses[task.Status]++
+	}
+	return report
+}
+
+// recordReport учитывает результат обработки письма в отчете о работе (если отчет включен)
+func (s *Service) recordReport(taskID int64, recipients string, status email.Status, errorText string) {
+	if s.report == nil || status == email.StatusNone {
+		return
+	}
+	s.report.set(reportTask{
+		TaskID:     taskID,
+		Recipients: recipients,
+		Status:     status.String(),
+		StatusCode: status.Code(s.cfg.Status),
+		Time:       s.clock.Now(),
+		Error:      errorText,
+	})
+}
+
+// WriteReport записывает отчет о работе в JSON файл Mode.ReportFile (если он задан)
+// Вызывается при завершении работы после остановки проверки статусов, чтобы в отчет попали
+// результаты проверки доставки. Файл записывается через временный файл и заменяется целиком
+func (s *Service) WriteReport() {
+	if s.report == nil {
+		return
+	}
+	report := s.report.build(s.clock.Now())
+	if err := writeReportFile(s.cfg.Mode.ReportFile, report); err != nil {
+		logger.Log.Error("Ошибка записи отчета о работе",
+			zap.String("path", s.cfg.Mode.ReportFile),
+			zap.Error(err))
+		return
+	}
+	logger.Log.Info("Отчет о работе записан",
+		zap.String("path", s.cfg.Mode.ReportFile),
+		zap.Int("tasks", report.Total))
+}
+
+// writeReportFile записывает отчет в path через временный файл
+func writeReportFile(path string, report reportFile) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка формирования JSON: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
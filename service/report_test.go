@@ -0,0 +1,81 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"email-service/email"
+	"email-service/settings"
+)
+
+func TestWriteReport(t *testing.T) {
+	cfg := &settings.Config{}
+	cfg.Mode.ReportFile = filepath.Join(t.TempDir(), "report.json")
+	cfg.Status = settings.StatusConfig{Sent: 3, Failed: 4, Delivered: 5, Partial: 6}
+	s := NewService(cfg, nil, nil)
+
+	s.recordReport(1, "a@example.org", email.StatusSent, "")
+	s.recordReport(2, "b@example.org", email.StatusFailed, "SMTP 550 5.1.1: User unknown")
+	s.recordReport(3, "c@example.org; d@example.org", email.StatusPartial, "d@example.org (550)")
+	// Результат проверки доставки обновляет запись письма, сохраняя получателей
+	s.recordReport(1, "", email.StatusDelivered, "")
+	// Неопределенный статус в отчет не попадает
+	s.recordReport(4, "e@example.org", email.StatusNone, "")
+
+	s.WriteReport()
+
+	data, err := os.ReadFile(cfg.Mode.ReportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report reportFile
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("отчет не JSON: %v\n%s", err, data)
+	}
+
+	if report.Total != 3 || len(report.Tasks) != 3 {
+		t.Fatalf("в отчете %d писем (%d записей), ожидалось 3", report.Total, len(report.Tasks))
+	}
+	want := []struct {
+		taskID     int64
+		recipients string
+		status     string
+		code       int
+	}{
+		{1, "a@example.org", "delivered", 5},
+		{2, "b@example.org", "failed", 4},
+		{3, "c@example.org; d@example.org", "partial", 6},
+	}
+	for i, w := range want {
+		task := report.Tasks[i]
+		if task.TaskID != w.taskID || task.Recipients != w.recipients || task.Status != w.status || task.StatusCode != w.code {
+			t.Errorf("запись %d: %+v, ожидалось %+v", i, task, w)
+		}
+	}
+	if report.Tasks[1].Error != "SMTP 550 5.1.1: User unknown" {
+		t.Errorf("текст ошибки %q", report.Tasks[1].Error)
+	}
+	if wantStatuses := map[string]int{"delivered": 1, "failed": 1, "partial": 1}; !reflect.DeepEqual(report.Statuses, wantStatuses) {
+		t.Errorf("статусы %v, ожидалось %v", report.Statuses, wantStatuses)
+	}
+	if report.Finished.Before(report.Started) {
+		t.Errorf("время завершения %v раньше начала %v", report.Finished, report.Started)
+	}
+
+	// Временный файл после записи не остается
+	if _, err := os.Stat(cfg.Mode.ReportFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("временный файл отчета не удален: %v", err)
+	}
+}
+
+func TestWriteReportDisabled(t *testing.T) {
+	s := NewService(&settings.Config{}, nil, nil)
+	s.recordReport(1, "a@example.org", email.StatusSent, "")
+	if s.report != nil {
+		t.Fatal("отчет включен без Mode.ReportFile")
+	}
+	s.WriteReport()
+}
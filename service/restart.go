@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+)
+
+// Действия при превышении числа авто-рестартов (параметр AutoRestartLimitAction секции [Mode])
+const (
+	// restartLimitExit - основной цикл завершается, сервис выходит с кодом 1
+	restartLimitExit = "exit"
+	// restartLimitCooldown - обработка приостанавливается на AutoRestartCooldownMin минут
+	restartLimitCooldown = "cooldown"
+)
+
+// restartLimiter считает авто-рестарты цикла обработки в скользящем окне
+// Используется только горутиной Run, поэтому синхронизация не нужна
+type restartLimiter struct {
+	max    int
+	window time.Duration
+	times  []time.Time
+}
+
+// newRestartLimiter создает счетчик рестартов (max <= 0 - без ограничения)
+func newRestartLimiter(max int, window time.Duration) *restartLimiter {
+	return &restartLimiter{max: max, window: window}
+}
+
+// allow регистрирует рестарт и возвращает false, если число рестартов за окно превысило лимит,
+// а также количество рестартов в окне с учетом текущего
+func (l *restartLimiter) allow(now time.Time) (bool, int) {
+	cutoff := now.Add(-l.window)
+	kept := l.times[:0]
+	for _, t := range l.times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	l.times = append(kept, now)
+	if l.max <= 0 {
+		return true, len(l.times)
+	}
+	return len(l.times) <= l.max, len(l.times)
+}
+
+// reset очищает историю рестартов (после паузы cooldown отсчет начинается заново)
+func (l *restartLimiter) reset() {
+	l.times = l.times[:0]
+}
+
+// RestartLimitExceeded сообщает, что основной цикл завершился из-за превышения MaxAutoRestarts
+// В этом случае сервис должен завершить работу с ненулевым кодом
+func (s *Service) RestartLimitExceeded() bool {
+	return s.restartLimitExceeded.Load()
+}
+
+// confirmRestart выдерживает паузу AutoRestartGraceSec перед авто-рестартом и проверяет соединение с БД
+// Выборка из очереди в этой итерации уже прошла без ошибок; если после паузы БД недоступна, рестарт
+// откладывается: цикл продолжает работу (переподключение выполняется в начале итерации), а подтверждение
+// повторяется, пока рестарт еще требуется
+func (s *Service) confirmRestart(ctx context.Context) bool {
+	grace := time.Duration(s.cfg.Mode.AutoRestartGraceSec) * time.Second
+	if grace <= 0 {
+		return true
+	}
+
+	logger.Log.Info("Пауза перед авто-рестартом цикла обработки", zap.Duration("grace", grace))
+	if !s.sleepWithContext(ctx, grace) {
+		return false
+	}
+	if !s.checkDB() {
+		logger.Log.Warn("Авто-рестарт отложен: БД недоступна, подтверждение будет повторено",
+			zap.Duration("grace", grace))
+		return false
+	}
+	return true
+}
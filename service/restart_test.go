@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/clock"
+	"email-service/logger"
+)
+
+// confirmRestartAsync запускает confirmRestart и возвращает канал с его результатом
+func confirmRestartAsync(ctx context.Context, s *Service) <-chan bool {
+	result := make(chan bool, 1)
+	go func() { result <- s.confirmRestart(ctx) }()
+	return result
+}
+
+func TestConfirmRestartWithoutGrace(t *testing.T) {
+	s := newTestService(t, clock.NewFake(time.Now()))
+	checks := 0
+	s.checkDB = func() bool { checks++; return false }
+
+	if !s.confirmRestart(context.Background()) {
+		t.Error("без AutoRestartGraceSec рестарт должен выполняться сразу")
+	}
+	if checks != 0 {
+		t.Errorf("без AutoRestartGraceSec выполнено %d проверок БД", checks)
+	}
+}
+
+func TestConfirmRestartDeferredWhileDBUnreachable(t *testing.T) {
+	logger.Log = zap.NewNop()
+	clk := clock.NewFake(time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC))
+	s := newTestService(t, clk)
+	s.cfg.Mode.AutoRestartGraceSec = 30
+
+	dbUp := make(chan bool, 1)
+	checks := make(chan struct{}, 10)
+	s.checkDB = func() bool {
+		checks <- struct{}{}
+		return <-dbUp
+	}
+
+	// БД кратковременно недоступна: рестарт откладывается
+	result := confirmRestartAsync(context.Background(), s)
+	waitForWaiters(t, clk, 1)
+	clk.Advance(29 * time.Second)
+	select {
+	case <-checks:
+		t.Fatal("БД проверена до окончания паузы AutoRestartGraceSec")
+	default:
+	}
+	dbUp <- false
+	clk.Advance(time.Second)
+	if <-result {
+		t.Fatal("рестарт подтвержден при недоступной БД")
+	}
+
+	// Следующая итерация: БД снова доступна, рестарт выполняется после паузы
+	result = confirmRestartAsync(context.Background(), s)
+	waitForWaiters(t, clk, 1)
+	dbUp <- true
+	clk.Advance(30 * time.Second)
+	if !<-result {
+		t.Fatal("рестарт не подтвержден при доступной БД")
+	}
+	if len(checks) != 2 {
+		t.Errorf("проверок БД: %d, ожидалось 2", len(checks))
+	}
+}
+
+func TestConfirmRestartCanceled(t *testing.T) {
+	logger.Log = zap.NewNop()
+	clk := clock.NewFake(time.Now())
+	s := newTestService(t, clk)
+	s.cfg.Mode.AutoRestartGraceSec = 30
+	checks := 0
+	s.checkDB = func() bool { checks++; return true }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := confirmRestartAsync(ctx, s)
+	waitForWaiters(t, clk, 1)
+	cancel()
+	if <-result {
+		t.Error("рестарт подтвержден после отмены контекста")
+	}
+	if checks != 0 {
+		t.Errorf("после отмены выполнено %d проверок БД", checks)
+	}
+}
+
+func TestRestartLimiter(t *testing.T) {
+	start := time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC)
+	limiter := newRestartLimiter(2, time.Hour)
+
+	for i, want := range []bool{true, true, false} {
+		if allowed, count := limiter.allow(start.Add(time.Duration(i) * time.Minute)); allowed != want || count != i+1 {
+			t.Errorf("рестарт %d: allowed=%v count=%d, ожидалось %v и %d", i+1, allowed, count, want, i+1)
+		}
+	}
+	// Рестарты за пределами окна не учитываются
+	if allowed, count := limiter.allow(start.Add(time.Hour + 3*time.Minute)); !allowed || count != 1 {
+		t.Errorf("после окна: allowed=%v count=%d, ожидалось true и 1", allowed, count)
+	}
+	limiter.reset()
+	if allowed, count := limiter.allow(start.Add(2 * time.Hour)); !allowed || count != 1 {
+		t.Errorf("после reset: allowed=%v count=%d", allowed, count)
+	}
+}
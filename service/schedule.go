@@ -0,0 +1,185 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"email-service/logger"
+	"email-service/settings"
+)
+
+// scheduleRetryInterval - интервал повторной загрузки расписания из БД после ошибки
+const scheduleRetryInterval = time.Minute
+
+// scheduleWindow - окно расписания отправки (учитываются только часы и минуты)
+type scheduleWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// today возвращает границы окна на текущую дату
+// Если время окончания раньше времени начала, окончание переносится на следующий день
+func (w scheduleWindow) today(now time.Time) (time.Time, time.Time) {
+	todayStart := time.Date(now.Year(), now.Month(), now.Day(),
+		w.start.Hour(), w.start.Minute(), w.start.Second(), 0, now.Location())
+	todayEnd := time.Date(now.Year(), now.Month(), now.Day(),
+		w.end.Hour(), w.end.Minute(), w.end.Second(), 0, now.Location())
+	if todayEnd.Before(todayStart) {
+		todayEnd = todayEnd.Add(24 * time.Hour)
+	}
+	return todayStart, todayEnd
+}
+
+// contains проверяет, попадает ли момент t в окно (по часам и минутам в часовом поясе t)
+// Учитывается и окно предыдущего дня, переходящее через полночь
+func (w scheduleWindow) contains(t time.Time) bool {
+	start, end := w.today(t)
+	if !t.Before(start) && !t.After(end) {
+		return true
+	}
+	start, end = start.AddDate(0, 0, -1), end.AddDate(0, 0, -1)
+	return !t.Before(start) && !t.After(end)
+}
+
+// nextWindowStart возвращает ближайшее после now начало окна расписания в часовом поясе now
+func nextWindowStart(windows []scheduleWindow, now time.Time) time.Time {
+	var next time.Time
+	for _, window := range windows {
+		start, _ := window.today(now)
+		if !start.After(now) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// recipientScheduleError - письмо вне окна расписания по местному времени получателя
+type recipientScheduleError struct {
+	local   time.Time // Время получателя на момент проверки
+	until   time.Time // Начало ближайшего окна, до которого письмо можно отложить
+	windows string
+}
+
+func (e *recipientScheduleError) Error() string {
+	return fmt.Sprintf("попытка отправки вне графика по времени получателя %s [%s], ближайшее окно %s",
+		e.local.Format("2006-01-02 15:04:05 MST"), e.windows, e.until.Format("2006-01-02 15:04 MST"))
+}
+
+// scheduleProvider возвращает окна расписания отправки
+// При Schedule.UseDB окна загружаются из БД и кешируются на Schedule.DBTTLSec; пустое расписание из БД
+// означает закрытый день и тоже кешируется. При ошибке загрузки используется расписание из конфигурации
+type scheduleProvider struct {
+	cfg   *settings.Config
+	fetch func() (string, error) // Загрузка расписания из БД
+
+	mu       sync.Mutex
+	cached   []scheduleWindow // Пусто - в день загрузки отправка закрыта
+	loaded   bool
+	loadedAt time.Time
+	retryAt  time.Time // После ошибки загрузки БД не опрашивается до этого момента
+}
+
+// newScheduleProvider создает провайдер расписания
+func newScheduleProvider(cfg *settings.Config, fetch func() (string, error)) *scheduleProvider {
+	return &scheduleProvider{
+		cfg:   cfg,
+		fetch: fetch,
+	}
+}
+
+// windows возвращает актуальные окна расписания
+func (p *scheduleProvider) windows(now time.Time) []scheduleWindow {
+	static := []scheduleWindow{{start: p.cfg.Schedule.TimeStart, end: p.cfg.Schedule.TimeEnd}}
+	if !p.cfg.Schedule.UseDB {
+		return static
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ttl := time.Duration(p.cfg.Schedule.DBTTLSec) * time.Second
+	// Расписание из БД действует только в пределах дня, в который было загружено
+	if p.loaded && now.Sub(p.loadedAt) < ttl && sameDay(now, p.loadedAt) {
+		return p.cached
+	}
+	if now.Before(p.retryAt) {
+		return static
+	}
+
+	raw, err := p.fetch()
+	if err == nil {
+		var windows []scheduleWindow
+		windows, err = parseScheduleWindows(raw)
+		if err == nil {
+			p.cached = windows
+			p.loaded = true
+			p.loadedAt = now
+			if logger.Log != nil {
+				logger.Log.Info("Расписание отправки загружено из БД",
+					zap.String("schedule", formatScheduleWindows(windows, now)))
+			}
+			return windows
+		}
+	}
+
+	// Повторяем попытку не чаще раза в минуту, чтобы не нагружать недоступную БД
+	p.retryAt = now.Add(scheduleRetryInterval)
+	if logger.Log != nil {
+		logger.Log.Warn("Не удалось получить расписание из БД, используется расписание из конфигурации",
+			zap.Error(err))
+	}
+	return static
+}
+
+// parseScheduleWindows разбирает окна расписания в формате "HH:mm-HH:mm;HH:mm-HH:mm"
+// Пустая строка - окон нет (отправка закрыта), возвращается пустой список без ошибки
+func parseScheduleWindows(raw string) ([]scheduleWindow, error) {
+	var windows []scheduleWindow
+	for _, item := range strings.FieldsFunc(raw, func(r rune) bool { return r == ';' || r == ',' }) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		startStr, endStr, ok := strings.Cut(item, "-")
+		if !ok {
+			return nil, fmt.Errorf("неверный формат окна расписания: %q", item)
+		}
+		start, err := time.Parse("15:04", strings.TrimSpace(startStr))
+		if err != nil {
+			return nil, fmt.Errorf("неверное время начала окна %q: %w", item, err)
+		}
+		end, err := time.Parse("15:04", strings.TrimSpace(endStr))
+		if err != nil {
+			return nil, fmt.Errorf("неверное время окончания окна %q: %w", item, err)
+		}
+		windows = append(windows, scheduleWindow{start: start, end: end})
+	}
+	return windows, nil
+}
+
+// formatScheduleWindows форматирует окна расписания для сообщений об ошибках и логов
+func formatScheduleWindows(windows []scheduleWindow, now time.Time) string {
+	if len(windows) == 0 {
+		return "отправка закрыта"
+	}
+	parts := make([]string, 0, len(windows))
+	for _, window := range windows {
+		start, end := window.today(now)
+		parts = append(parts, fmt.Sprintf("%s - %s", start.Format("15:04"), end.Format("15:04")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// sameDay проверяет, что оба момента относятся к одной календарной дате
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
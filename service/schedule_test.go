@@ -0,0 +1,223 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"email-service/settings"
+)
+
+func mustClock(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestParseScheduleWindows(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{raw: "09:00-18:00", want: []string{"09:00-18:00"}},
+		{raw: " 08:00 - 12:00 ; 13:00-17:30 ", want: []string{"08:00-12:00", "13:00-17:30"}},
+		{raw: "08:00-12:00,22:00-02:00;", want: []string{"08:00-12:00", "22:00-02:00"}},
+		{raw: "", want: nil},
+		{raw: " ; ", want: nil},
+		{raw: "09:00", wantErr: true},
+		{raw: "9-18", wantErr: true},
+		{raw: "09:00-25:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		windows, err := parseScheduleWindows(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseScheduleWindows(%q): ожидалась ошибка", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseScheduleWindows(%q): %v", tt.raw, err)
+			continue
+		}
+		if len(windows) != len(tt.want) {
+			t.Errorf("parseScheduleWindows(%q) = %d окон, ожидалось %d", tt.raw, len(windows), len(tt.want))
+			continue
+		}
+		for i, window := range windows {
+			got := window.start.Format("15:04") + "-" + window.end.Format("15:04")
+			if got != tt.want[i] {
+				t.Errorf("parseScheduleWindows(%q)[%d] = %s, ожидалось %s", tt.raw, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestScheduleWindowContainsOvernight(t *testing.T) {
+	window := scheduleWindow{start: mustClock(t, "22:00"), end: mustClock(t, "02:00")}
+	day := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at   string
+		want bool
+	}{
+		{"21:59", false},
+		{"22:00", true},
+		{"23:30", true},
+		{"01:30", true}, // Окно предыдущего дня, переходящее через полночь
+		{"02:00", true},
+		{"02:01", false},
+		{"12:00", false},
+	}
+	for _, tt := range tests {
+		at := mustClock(t, tt.at)
+		now := day.Add(time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute)
+		if got := window.contains(now); got != tt.want {
+			t.Errorf("contains(%s) = %v, ожидалось %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestNextWindowStart(t *testing.T) {
+	windows := []scheduleWindow{
+		{start: mustClock(t, "09:00"), end: mustClock(t, "12:00")},
+		{start: mustClock(t, "14:00"), end: mustClock(t, "18:00")},
+	}
+	tests := []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{time.Date(2026, 1, 15, 7, 0, 0, 0, time.UTC), time.Date(2026, 1, 15, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 1, 15, 12, 30, 0, 0, time.UTC), time.Date(2026, 1, 15, 14, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 1, 15, 19, 0, 0, 0, time.UTC), time.Date(2026, 1, 16, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := nextWindowStart(windows, tt.now); !got.Equal(tt.want) {
+			t.Errorf("nextWindowStart(%v) = %v, ожидалось %v", tt.now, got, tt.want)
+		}
+	}
+	if got := nextWindowStart(nil, time.Now()); !got.IsZero() {
+		t.Errorf("nextWindowStart без окон = %v, ожидалось нулевое время", got)
+	}
+}
+
+// fakeScheduleDB имитирует pcsystem.PKG_EMAIL.GET_SEND_SCHEDULE() и считает обращения
+type fakeScheduleDB struct {
+	schedule string
+	err      error
+	calls    int
+}
+
+func (db *fakeScheduleDB) fetch() (string, error) {
+	db.calls++
+	return db.schedule, db.err
+}
+
+func newTestScheduleProvider(t *testing.T, db *fakeScheduleDB) *scheduleProvider {
+	cfg := &settings.Config{}
+	cfg.Schedule.TimeStart = mustClock(t, "08:00")
+	cfg.Schedule.TimeEnd = mustClock(t, "20:00")
+	cfg.Schedule.UseDB = true
+	cfg.Schedule.DBTTLSec = 300
+	return newScheduleProvider(cfg, db.fetch)
+}
+
+func formatWindows(windows []scheduleWindow) string {
+	return formatScheduleWindows(windows, time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC))
+}
+
+func TestScheduleProviderCache(t *testing.T) {
+	db := &fakeScheduleDB{schedule: "10:00-12:00"}
+	provider := newTestScheduleProvider(t, db)
+	now := time.Date(2026, 1, 15, 9, 0, 0, 0, time.UTC)
+
+	if got := formatWindows(provider.windows(now)); got != "10:00 - 12:00" {
+		t.Fatalf("окна = %q", got)
+	}
+
+	// В пределах DBTTLSec используется кеш
+	db.schedule = "11:00-13:00"
+	provider.windows(now.Add(299 * time.Second))
+	if db.calls != 1 {
+		t.Fatalf("обращений к БД: %d, ожидалось 1", db.calls)
+	}
+
+	// После DBTTLSec расписание загружается заново
+	if got := formatWindows(provider.windows(now.Add(300 * time.Second))); got != "11:00 - 13:00" {
+		t.Errorf("окна после TTL = %q", got)
+	}
+	if db.calls != 2 {
+		t.Errorf("обращений к БД: %d, ожидалось 2", db.calls)
+	}
+
+	// Расписание действует только в день загрузки, даже если TTL не истек
+	provider.cfg.Schedule.DBTTLSec = 86400
+	db.schedule = "09:00-10:00"
+	nextDay := time.Date(2026, 1, 16, 0, 1, 0, 0, time.UTC)
+	if got := formatWindows(provider.windows(nextDay)); got != "09:00 - 10:00" {
+		t.Errorf("окна следующего дня = %q", got)
+	}
+}
+
+func TestScheduleProviderClosedDay(t *testing.T) {
+	db := &fakeScheduleDB{schedule: ""}
+	provider := newTestScheduleProvider(t, db)
+	now := time.Date(2026, 1, 17, 10, 0, 0, 0, time.UTC)
+
+	// Пустое расписание - закрытый день, а не ошибка: окна из конфигурации не используются
+	if windows := provider.windows(now); len(windows) != 0 {
+		t.Fatalf("окна закрытого дня = %q, ожидалось отсутствие окон", formatWindows(windows))
+	}
+	// Закрытый день кешируется так же, как обычное расписание
+	provider.windows(now.Add(time.Minute))
+	if db.calls != 1 {
+		t.Errorf("обращений к БД: %d, ожидалось 1", db.calls)
+	}
+}
+
+func TestScheduleProviderFallback(t *testing.T) {
+	db := &fakeScheduleDB{err: errors.New("ORA-03113: end-of-file on communication channel")}
+	provider := newTestScheduleProvider(t, db)
+	now := time.Date(2026, 1, 15, 9, 0, 0, 0, time.UTC)
+
+	if got := formatWindows(provider.windows(now)); got != "08:00 - 20:00" {
+		t.Fatalf("при ошибке БД окна = %q, ожидалось расписание из конфигурации", got)
+	}
+
+	// До истечения scheduleRetryInterval БД не опрашивается повторно
+	db.err = nil
+	db.schedule = "10:00-11:00"
+	if got := formatWindows(provider.windows(now.Add(scheduleRetryInterval - time.Second))); got != "08:00 - 20:00" {
+		t.Errorf("окна до повтора = %q", got)
+	}
+	if db.calls != 1 {
+		t.Errorf("обращений к БД: %d, ожидалось 1", db.calls)
+	}
+
+	if got := formatWindows(provider.windows(now.Add(scheduleRetryInterval))); got != "10:00 - 11:00" {
+		t.Errorf("окна после восстановления БД = %q", got)
+	}
+
+	// Неверный формат расписания - ошибка, а не закрытый день
+	db.schedule = "10:00"
+	provider.cfg.Schedule.DBTTLSec = 0
+	if got := formatWindows(provider.windows(now.Add(2 * scheduleRetryInterval))); got != "08:00 - 20:00" {
+		t.Errorf("при неверном формате окна = %q, ожидалось расписание из конфигурации", got)
+	}
+}
+
+func TestScheduleProviderStatic(t *testing.T) {
+	db := &fakeScheduleDB{schedule: "10:00-11:00"}
+	provider := newTestScheduleProvider(t, db)
+	provider.cfg.Schedule.UseDB = false
+
+	if got := formatWindows(provider.windows(time.Now())); got != "08:00 - 20:00" {
+		t.Errorf("окна = %q", got)
+	}
+	if db.calls != 0 {
+		t.Errorf("без UseDB выполнено %d обращений к БД", db.calls)
+	}
+}
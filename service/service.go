@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -10,6 +11,7 @@ import (
 
 	"go.uber.org/zap"
 
+	"email-service/clock"
 	"email-service/db"
 	"email-service/email"
 	"email-service/logger"
@@ -18,6 +20,11 @@ import (
 
 const (
 	portion = 20 // Количество сообщений для обработки за цикл
+
+	// Ограничения сводки о письме в error_text
+	maxErrorTextLen         = 2000 // Максимальная длина error_text вместе со сводкой (в символах)
+	maxSummarySubjectLen    = 200  // Максимальная длина темы в сводке
+	maxSummaryRecipientsLen = 300  // Максимальная длина списка получателей в сводке
 )
 
 // Service представляет основной сервис обработки сообщений
@@ -31,22 +38,60 @@ type Service struct {
 	requestDir    []*db.QueueMessage // Слайс для сохранения порядка (FIFO)
 	requestDirMap map[string]bool    // Мапа для быстрого поиска дубликатов (ключ - taskID)
 	requestDirMu  sync.RWMutex
+	// Сообщения, отложенные до окна расписания получателя (время, раньше которого они не отправляются)
+	requestNotBefore map[*db.QueueMessage]time.Time
+	deferClosed      bool // Сервис останавливается, новые письма не откладываются
 
 	// Очередь результатов (responseQueue)
-	responseQueue   chan db.SaveEmailResponseParams
-	responseQueueWg sync.WaitGroup
+	// Запись результатов останавливается отдельно от основного цикла (CloseResponseQueue),
+	// чтобы статусы от StatusChecker успели записаться до закрытия соединения с БД
+	responseQueue     chan db.SaveEmailResponseParams
+	responseQueueWg   sync.WaitGroup
+	responseStop      chan struct{}
+	responseStopOnce  sync.Once
+	responseStartOnce sync.Once
+	responsesClosed   atomic.Bool
 
 	// Ограничение частоты отправки на email адрес (sendEmail)
-	sendEmailMap map[string]time.Time // Ключ - email адрес
-	sendEmailMu  sync.RWMutex
+	sendEmailMap      *rateLimitMap // LRU-кеш с ограничением размера
+	sendEmailMu       sync.RWMutex
+	lastEvictionAlert time.Time // Время последнего предупреждения о вытеснении записей
+
+	// Автоматический рестарт (пороги задаются отдельно для каждой категории ошибок)
+	failures             failureCounters
+	needRestart          atomic.Bool
+	restartLimitExceeded atomic.Bool
 
-	// Автоматический рестарт
-	criticalErrorCount atomic.Int32
-	needRestart        atomic.Bool
+	// Очереди отправки по SMTP серверам (индекс - SmtpID)
+	lanes []*smtpLane
 
 	// Периодическая выборка всех сообщений
 	nextDequeueAll time.Time
 	dequeueAllMu   sync.Mutex
+
+	// Расписание отправки из БД (при Schedule.UseDB)
+	schedule *scheduleProvider
+
+	// Сводка ошибок отправки для операторов (nil - отключена)
+	digest *failureDigest
+
+	// Почасовые счетчики отправок для записи в БД (nil - отключены)
+	metrics *sendMetrics
+
+	// Последние обработанные письма для /health/recent (nil - отключено)
+	recent *recentMessages
+
+	// Переподключение к БД по команде POST /reconnect-db (nil - БД не подключена)
+	reconnector dbReconnector
+
+	// Итоги обработки писем для отчета о работе Mode.ReportFile (nil - отключен)
+	report *runReport
+
+	// Источник времени для расписания, ограничений частоты и сроков актуальности писем
+	clock clock.Clock
+
+	// Проверка соединения с БД перед авто-рестартом (dbConn.CheckConnection)
+	checkDB func() bool
 }
 
 // NewService создает новый сервис
@@ -56,16 +101,46 @@ func NewService(cfg *settings.Config, dbConn *db.DBConnection, queueReader *db.Q
 		dbConn:      dbConn,
 		queueReader: queueReader,
 
-		requestDir:     make([]*db.QueueMessage, 0),
-		requestDirMap:  make(map[string]bool),
-		responseQueue:  make(chan db.SaveEmailResponseParams, 10000), // Буферизованный канал
-		sendEmailMap:   make(map[string]time.Time),
-		nextDequeueAll: time.Now(), // Сразу при запуске
+		requestDir:       make([]*db.QueueMessage, 0),
+		requestDirMap:    make(map[string]bool),
+		requestNotBefore: make(map[*db.QueueMessage]time.Time),
+		responseQueue:    make(chan db.SaveEmailResponseParams, 10000), // Буферизованный канал
+		responseStop:     make(chan struct{}),
+		sendEmailMap:     newRateLimitMap(cfg.Mode.MaxRateLimitEntries),
+		nextDequeueAll:   time.Now(), // Сразу при запуске
+		clock:            clock.Real,
+	}
+	s.schedule = newScheduleProvider(cfg, dbConn.GetSendSchedule)
+	s.checkDB = dbConn.CheckConnection
+	if cfg.Digest.Email != "" {
+		s.digest = newFailureDigest(cfg.Digest.Threshold, cfg.Digest.MaxItems)
+	}
+	if cfg.Mode.SaveMetricsToDB {
+		s.metrics = newSendMetrics()
+	}
+	if cfg.Health.Listen != "" && cfg.Health.RecentMessages > 0 {
+		s.recent = newRecentMessages(cfg.Health.RecentMessages)
+	}
+	if dbConn != nil {
+		s.reconnector = dbConn
+	}
+	if cfg.Mode.ReportFile != "" {
+		s.report = newRunReport(time.Now())
 	}
 
 	return s
 }
 
+// SetClock устанавливает источник времени (nil - системные часы)
+// Вызывается до Run; часы email сервиса и соединения с БД устанавливаются отдельно
+func (s *Service) SetClock(clk clock.Clock) {
+	if clk == nil {
+		clk = clock.Real
+	}
+	s.clock = clk
+	s.nextDequeueAll = clk.Now()
+}
+
 // Run запускает основной цикл обработки сообщений
 func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 	logger.Log.Info("Запуск основного цикла обработки сообщений")
@@ -74,14 +149,76 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 	wg.Add(1)
 	defer wg.Done()
 
-	// Запускаем горутину для записи результатов в БД с контекстом для graceful shutdown
-	s.responseQueueWg.Add(1)
-	go s.responseQueueWriter(ctx)
+	// Запускаем горутину для записи результатов в БД (останавливается через CloseResponseQueue)
+	s.responseStartOnce.Do(func() {
+		s.responseQueueWg.Add(1)
+		go s.responseQueueWriter()
+	})
+
+	// Запускаем независимые очереди отправки для каждого SMTP сервера
+	s.startLanes(ctx, wg)
+	defer s.stopLanes()
+
+	// Запускаем отправку сводки ошибок операторам
+	if s.digest != nil {
+		wg.Add(1)
+		go s.digestWorker(ctx, wg)
+	}
+
+	// Запускаем запись метрик отправки в БД
+	if s.metrics != nil {
+		wg.Add(1)
+		go s.metricsWorker(ctx, wg)
+	}
+
+	// Перезапускаем цикл обработки при превышении порогов ошибок, но не чаще MaxAutoRestarts за окно
+	restarts := newRestartLimiter(s.cfg.Mode.MaxAutoRestarts,
+		time.Duration(s.cfg.Mode.AutoRestartWindowMin)*time.Minute)
+	for s.processLoop(ctx, wg) {
+		allowed, count := restarts.allow(s.clock.Now())
+		if allowed {
+			logger.Log.Warn("Перезапуск цикла обработки", zap.Int("restartsInWindow", count))
+			continue
+		}
+		if s.cfg.Mode.AutoRestartLimitAction != restartLimitCooldown {
+			logger.Log.Error("Превышено максимальное число авто-рестартов, сервис завершает работу",
+				zap.Int("restartsInWindow", count),
+				zap.Int("maxAutoRestarts", s.cfg.Mode.MaxAutoRestarts),
+				zap.Int("windowMin", s.cfg.Mode.AutoRestartWindowMin))
+			s.restartLimitExceeded.Store(true)
+			break
+		}
+		cooldown := time.Duration(s.cfg.Mode.AutoRestartCooldownMin) * time.Minute
+		logger.Log.Error("Превышено максимальное число авто-рестартов, обработка приостановлена",
+			zap.Int("restartsInWindow", count),
+			zap.Int("maxAutoRestarts", s.cfg.Mode.MaxAutoRestarts),
+			zap.Int("windowMin", s.cfg.Mode.AutoRestartWindowMin),
+			zap.Duration("cooldown", cooldown))
+		if !s.sleepWithContext(ctx, cooldown) {
+			break
+		}
+		restarts.reset()
+		logger.Log.Warn("Пауза после превышения числа авто-рестартов завершена, перезапуск цикла обработки")
+	}
+
+	// Отложенные сообщения уже удалены из AQ: записываем для них ошибку, чтобы они не потерялись
+	s.failDeferredRequests()
 
-	// Сбрасываем счетчик критических ошибок
-	s.criticalErrorCount.Store(0)
+	// Логируем статистику при завершении
+	s.logStatistics()
+	logger.Log.Info("Цикл обработки остановлен")
+}
+
+// processLoop читает сообщения из очереди и передает их на отправку до остановки сервиса
+// Возвращает true, если цикл прерван для авто-рестарта по порогам ошибок
+func (s *Service) processLoop(ctx context.Context, wg *sync.WaitGroup) bool {
+	// Сбрасываем счетчики ошибок
+	s.failures.reset()
 	s.needRestart.Store(false)
 
+	// В режиме OneShot цикл завершается после OneShotEmptyCycles подряд пустых выборок
+	emptyCycles := 0
+
 	// Бесконечный цикл чтения из очереди (аналогично smsSender: while True)
 	for {
 		// Проверяем контекст перед началом итерации
@@ -90,14 +227,8 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 			break
 		}
 
-		// Проверяем необходимость рестарта из-за критических ошибок
-		if s.criticalErrorCount.Load() > int32(s.cfg.Mode.MaxErrorCountForAutoRestart) {
-			logger.Log.Warn("Превышение числа критических ошибок, инициируется рестарт",
-				zap.Int32("criticalErrorCount", s.criticalErrorCount.Load()),
-				zap.Int("maxErrorCount", s.cfg.Mode.MaxErrorCountForAutoRestart))
-			s.criticalErrorCount.Store(0)
-			s.needRestart.Store(true)
-		}
+		// Проверяем необходимость рестарта из-за ошибок
+		s.checkFailureThresholds()
 
 		// Создаем новый канал для сигнала на каждой итерации
 		iterationSignalChan := make(chan struct{})
@@ -137,7 +268,7 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 				logger.Log.Error("Ошибка переподключения", zap.Error(err))
 				// Используем таймаут подключения (10 секунд) вместо короткой паузы
 				if !s.sleepWithContext(ctx, 10*time.Second) {
-					return
+					return false
 				}
 				continue
 			}
@@ -160,7 +291,7 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 			logger.Log.Error("Ошибка при выборке сообщений", zap.Error(err))
 			logger.Log.Info("Ошибка соединения, ожидание перед повтором...")
 			if !s.sleepWithContext(ctx, 5*time.Second) {
-				return
+				return false
 			}
 			// Мы НЕ вызываем Reconnect здесь, так как он будет вызван в начале следующей итерации
 			// через CheckConnection -> Reconnect
@@ -190,17 +321,30 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 			logger.Log.Debug("Очередь пуста, ожидание следующей попытки...")
 		}
 
-		// 2. Отправляем сообщения провайдеру
-		s.processRequestQueue(ctx)
+		// 2. Передаем сообщения в очереди отправки SMTP серверов
+		s.processRequestQueue()
 
 		// 3. Записываем статусы отправки в базу (через канал responseQueue)
 
 		// 4. Записываем подтверждения отправки в базу (через канал responseQueue)
 
-		// Перезапустить сервис если все отправлено и записано в базу
-		if s.needRestart.Load() && s.isRequestQueueEmpty() {
-			logger.Log.Warn("Перезапуск цикла обработки")
-			break
+		// Перезапустить цикл если все отправлено и записано в базу
+		if s.needRestart.Load() && s.isRequestQueueEmpty() && s.confirmRestart(ctx) {
+			return true
+		}
+
+		// Режим OneShot: выходим, когда очередь AQ пуста несколько циклов подряд и все письма отправлены
+		if s.cfg.Mode.OneShot {
+			if len(messages) == 0 && s.isRequestQueueEmpty() {
+				emptyCycles++
+			} else {
+				emptyCycles = 0
+			}
+			if emptyCycles >= s.cfg.Mode.OneShotEmptyCycles {
+				logger.Log.Info("Режим OneShot: очередь пуста, завершение обработки",
+					zap.Int("emptyCycles", emptyCycles))
+				break
+			}
 		}
 
 		// При graceful shutdown: выходим после обработки вычитанных сообщений
@@ -213,13 +357,11 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup) {
 		// где main_circle_pause = 0.5 секунд
 		// Используем select для возможности прерывания во время задержки
 		if !s.sleepWithContext(ctx, 500*time.Millisecond) {
-			return
+			return false
 		}
 	}
 
-	// Логируем статистику при завершении
-	s.logStatistics()
-	logger.Log.Info("Цикл обработки остановлен")
+	return false
 }
 
 // sleepWithContext выполняет задержку с возможностью прерывания через контекст
@@ -228,7 +370,7 @@ func (s *Service) sleepWithContext(ctx context.Context, duration time.Duration)
 	select {
 	case <-ctx.Done():
 		return false
-	case <-time.After(duration):
+	case <-s.clock.After(duration):
 		return true
 	}
 }
@@ -239,16 +381,28 @@ func (s *Service) enqueueRequest(msg *db.QueueMessage) {
 		return
 	}
 
+	// Сообщение с пустым payload уже удалено из AQ, но taskID в нем нет, поэтому статус в БД
+	// записать невозможно: фиксируем msgid как критическую ошибку для ручного разбора
+	if msg.EmptyPayload {
+		logger.Log.Error("Сообщение из очереди без payload не может быть обработано, задача потеряна",
+			zap.String("messageID", msg.MessageID),
+			zap.Time("dequeueTime", msg.DequeueTime))
+		s.failures.add(failureParse)
+		return
+	}
+
 	// Парсим taskID из XML
 	parsed, err := s.queueReader.ParseXMLMessage(msg)
 	if err != nil {
 		logger.Log.Error("Ошибка парсинга XML при добавлении в очередь", zap.Error(err))
+		s.failures.add(failureParse)
 		return
 	}
 
 	taskIDStr, ok := parsed["email_task_id"].(string)
 	if !ok || taskIDStr == "" {
 		logger.Log.Error("TaskId не распарсен при добавлении в очередь")
+		s.failures.add(failureParse)
 		return
 	}
 
@@ -274,41 +428,179 @@ func (s *Service) enqueueRequest(msg *db.QueueMessage) {
 		zap.Int("queueSize", len(s.requestDir)))
 }
 
-// isRequestQueueEmpty проверяет, пуста ли внутренняя очередь
+// isRequestQueueEmpty проверяет, пуста ли внутренняя очередь и очереди SMTP серверов
+// Сообщения, отложенные до окна расписания получателя, не учитываются: рестарт цикла их не теряет
 func (s *Service) isRequestQueueEmpty() bool {
 	s.requestDirMu.RLock()
 	defer s.requestDirMu.RUnlock()
-	return len(s.requestDir) == 0
+	return len(s.requestDir) == len(s.requestNotBefore) && s.lanesPending() == 0
 }
 
-// processRequestQueue обрабатывает сообщения из внутренней очереди
-func (s *Service) processRequestQueue(ctx context.Context) {
-	for i := 0; i < portion; i++ {
-		// Получаем сообщение из очереди
-		msg := s.dequeueRequest()
-		if msg == nil {
-			break
+// processRequestQueue распределяет сообщения из внутренней очереди по очередям SMTP серверов
+// Сообщения для серверов с заполненной очередью остаются во внутренней очереди (порядок сохраняется),
+// поэтому задержка на одном сервере не мешает отправке через остальные
+func (s *Service) processRequestQueue() {
+	s.requestDirMu.Lock()
+	defer s.requestDirMu.Unlock()
+
+	maxAge := time.Duration(s.cfg.Mode.RequestMaxAgeSec) * time.Second
+	now := s.clock.Now()
+
+	dispatched := 0
+	full := make(map[*smtpLane]bool)
+	remaining := s.requestDir[:0]
+	for _, msg := range s.requestDir {
+		// Отложенное сообщение ждет окна расписания получателя, лимит RequestMaxAgeSec к нему не применяется
+		if until, ok := s.requestNotBefore[msg]; ok {
+			if now.Before(until) {
+				remaining = append(remaining, msg)
+				continue
+			}
+		} else if maxAge > 0 && now.Sub(msg.DequeueTime) > maxAge {
+			// Сообщение, слишком долго ожидающее отправки, завершаем с ошибкой
+			s.expireRequestLocked(msg, now.Sub(msg.DequeueTime))
+			continue
 		}
 
-		// Обрабатываем сообщение
-		s.sendMessage(ctx, msg)
+		if dispatched >= portion {
+			remaining = append(remaining, msg)
+			continue
+		}
+
+		lane := s.lanes[s.laneIndex(msg)]
+		if full[lane] {
+			// Очередь заполнилась раньше в этом цикле: более поздние сообщения не обгоняют ожидающие
+			remaining = append(remaining, msg)
+			continue
+		}
+		lane.pending.Add(1)
+		select {
+		case lane.queue <- msg:
+			s.forgetRequestLocked(msg)
+			delete(s.requestNotBefore, msg)
+			dispatched++
+		default:
+			// Очередь сервера заполнена - сообщение ждет следующего цикла
+			lane.pending.Add(-1)
+			full[lane] = true
+			remaining = append(remaining, msg)
+		}
+	}
+
+	// Обнуляем хвост, чтобы не удерживать ссылки на отправленные сообщения
+	for i := len(remaining); i < len(s.requestDir); i++ {
+		s.requestDir[i] = nil
 	}
+	s.requestDir = remaining
 }
 
-// dequeueRequest извлекает одно сообщение из внутренней очереди (FIFO)
-func (s *Service) dequeueRequest() *db.QueueMessage {
+// expireRequestLocked удаляет из внутренней очереди сообщение, превысившее Mode.RequestMaxAgeSec,
+// и записывает для него статус ошибки
+// Вызывается под блокировкой requestDirMu
+func (s *Service) expireRequestLocked(msg *db.QueueMessage, age time.Duration) {
+	s.forgetRequestLocked(msg)
+	errorText := fmt.Sprintf("сообщение слишком долго ожидало отправки (%s, лимит %d сек)",
+		age.Round(time.Second), s.cfg.Mode.RequestMaxAgeSec)
+	s.failRequestLocked(msg, errorText, "Сообщение слишком долго ожидало отправки и удалено из очереди",
+		zap.Duration("age", age))
+}
+
+// deferRequest возвращает сообщение во внутреннюю очередь до момента until (окно расписания получателя)
+// Возвращает false, если сервис останавливается и сообщение отложить нельзя
+func (s *Service) deferRequest(msg *db.QueueMessage, until time.Time) bool {
 	s.requestDirMu.Lock()
 	defer s.requestDirMu.Unlock()
+	if s.deferClosed {
+		return false
+	}
 
-	if len(s.requestDir) == 0 {
-		return nil
+	parsed, err := s.queueReader.ParseXMLMessage(msg)
+	if err == nil {
+		if taskIDStr, ok := parsed["email_task_id"].(string); ok {
+			s.requestDirMap[strings.TrimSpace(taskIDStr)] = true
+		}
 	}
+	s.requestDir = append(s.requestDir, msg)
+	s.requestNotBefore[msg] = until
+	return true
+}
+
+// failDeferredRequests удаляет из внутренней очереди отложенные сообщения и записывает для них
+// статус ошибки (вызывается при остановке: сообщения уже удалены из AQ и иначе были бы потеряны)
+func (s *Service) failDeferredRequests() {
+	s.requestDirMu.Lock()
+	defer s.requestDirMu.Unlock()
+	s.deferClosed = true
 
-	// Берем первое сообщение из слайса (FIFO)
-	msg := s.requestDir[0]
+	remaining := s.requestDir[:0]
+	for _, msg := range s.requestDir {
+		until, ok := s.requestNotBefore[msg]
+		if !ok {
+			remaining = append(remaining, msg)
+			continue
+		}
+		delete(s.requestNotBefore, msg)
+		s.forgetRequestLocked(msg)
+		errorText := fmt.Sprintf("письмо отложено до %s по расписанию получателя и не отправлено: сервис остановлен",
+			until.Format("2006-01-02 15:04:05 MST"))
+		s.failRequestLocked(msg, errorText, "Отложенное письмо не отправлено из-за остановки сервиса",
+			zap.Time("until", until))
+	}
+	for i := len(remaining); i < len(s.requestDir); i++ {
+		s.requestDir[i] = nil
+	}
+	s.requestDir = remaining
+}
 
-	// Удаляем taskID из мапы для быстрого поиска дубликатов
-	// Парсим taskID из сообщения
+// failRequestLocked записывает статус ошибки для сообщения, удаленного из внутренней очереди без отправки
+// Вызывается под блокировкой requestDirMu
+func (s *Service) failRequestLocked(msg *db.QueueMessage, errorText, logMessage string, fields ...zap.Field) {
+	parsed, err := s.queueReader.ParseXMLMessage(msg)
+	if err != nil {
+		logger.Log.Error(logMessage+", taskID не распарсен",
+			append(fields, zap.Error(err), zap.String("messageID", msg.MessageID))...)
+		return
+	}
+	emailMsg, err := email.ParseEmailMessage(parsed)
+	if err != nil {
+		logger.Log.Error(logMessage+", taskID не распарсен",
+			append(fields, zap.Error(err), zap.String("messageID", msg.MessageID))...)
+		return
+	}
+
+	logger.Log.Warn(logMessage, append([]zap.Field{zap.Int64("taskID", emailMsg.TaskID)}, fields...)...)
+
+	statusText := errorText
+	if s.cfg.Mode.IncludeMessageSummaryInErrorText {
+		statusText = s.appendMessageSummary(statusText, emailMsg)
+	}
+	s.enqueueResponse(emailMsg.TaskID, email.StatusFailed, statusText)
+	s.recordSendMetric(s.smtpIndex(emailMsg.SmtpID), email.StatusFailed)
+	s.recordRecent(emailMsg.TaskID, emailMsg.EmailAddress, email.StatusFailed, errorText)
+	s.recordReport(emailMsg.TaskID, emailMsg.EmailAddress, email.StatusFailed, errorText)
+	s.recordFailure(emailMsg.TaskID, emailMsg.Title, emailMsg.EmailAddress, errorText)
+}
+
+// invalidSMTPIndex - индекс для писем без корректного SMTP сервера: метрики таких писем
+// учитываются отдельно и не приписываются ни одному настроенному серверу
+const invalidSMTPIndex = -1
+
+// smtpIndex возвращает индекс SMTP сервера, через который отправляется письмо
+// SmtpID вне диапазона соответствует первому серверу только при Mode.SMTPIDFallback
+// (как и при выборе SMTP клиента), иначе возвращается invalidSMTPIndex
+func (s *Service) smtpIndex(smtpID int) int {
+	if smtpID >= 0 && smtpID < len(s.cfg.SMTP) {
+		return smtpID
+	}
+	if s.cfg.Mode.SMTPIDFallback && len(s.cfg.SMTP) > 0 {
+		return 0
+	}
+	return invalidSMTPIndex
+}
+
+// forgetRequestLocked удаляет taskID сообщения из мапы дубликатов
+// Вызывается под блокировкой requestDirMu
+func (s *Service) forgetRequestLocked(msg *db.QueueMessage) {
 	parsed, err := s.queueReader.ParseXMLMessage(msg)
 	if err == nil {
 		if taskIDStr, ok := parsed["email_task_id"].(string); ok {
@@ -316,33 +608,56 @@ func (s *Service) dequeueRequest() *db.QueueMessage {
 			delete(s.requestDirMap, taskIDStr)
 		}
 	}
-
-	// Удаляем первый элемент, сдвигая слайс
-	s.requestDir = s.requestDir[1:]
-	return msg
 }
 
 // sendMessage отправляет одно сообщение
 func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
-	var status int = 2 // Sended по умолчанию
+	status := email.StatusSent // Отправлено по умолчанию
 	var statusDesc string
 
 	taskID := int64(-1)
+	var emailMsg *email.ParsedEmailMessage
+	deferred := false // Письмо отложено до окна расписания получателя, статус будет записан после отправки
 	defer func() {
+		if deferred {
+			return
+		}
 		// Сохраняем результат в очередь результатов
-		// В error_text попадают только сообщения об ошибках (статус 3)
+		// В error_text попадают только сообщения об ошибках (StatusFailed) и отклоненные адреса (StatusPartial)
 		if taskID > 0 {
 			errorText := ""
-			if status == 3 {
+			if status == email.StatusFailed || status == email.StatusPartial {
 				errorText = statusDesc
+				if s.cfg.Mode.IncludeMessageSummaryInErrorText {
+					errorText = s.appendMessageSummary(errorText, emailMsg)
+				}
 			}
 			s.enqueueResponse(taskID, status, errorText)
+
+			var recipients string
+			if emailMsg != nil {
+				recipients = emailMsg.EmailAddress
+			}
+			s.recordRecent(taskID, recipients, status, statusDesc)
+			s.recordReport(taskID, recipients, status, errorText)
+		}
+		smtpID := invalidSMTPIndex
+		if emailMsg != nil {
+			smtpID = s.smtpIndex(emailMsg.SmtpID)
+		}
+		s.recordSendMetric(smtpID, status)
+		if status == email.StatusFailed {
+			var title, recipients string
+			if emailMsg != nil {
+				title, recipients = emailMsg.Title, emailMsg.EmailAddress
+			}
+			s.recordFailure(taskID, title, recipients, statusDesc)
 		}
 	}()
 
 	if msg == nil {
 		logger.Log.Error("Пустое сообщение во внутренней очереди")
-		status = 3 // Failed
+		status = email.StatusFailed
 		statusDesc = "Пустое сообщение"
 		return
 	}
@@ -351,7 +666,8 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 	parsed, err := s.queueReader.ParseXMLMessage(msg)
 	if err != nil {
 		logger.Log.Error("Ошибка парсинга XML", zap.Error(err))
-		status = 3 // Failed
+		s.failures.add(failureParse)
+		status = email.StatusFailed
 		statusDesc = fmt.Sprintf("Ошибка парсинга XML: %v", err)
 		return
 	}
@@ -365,10 +681,11 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 		zap.String("xmlPreview", xmlPreview))
 
 	// Преобразуем в ParsedEmailMessage
-	emailMsg, err := email.ParseEmailMessage(parsed)
+	emailMsg, err = email.ParseEmailMessage(parsed)
 	if err != nil {
 		logger.Log.Error("Ошибка преобразования в ParsedEmailMessage", zap.Error(err))
-		status = 3 // Failed
+		s.failures.add(failureParse)
+		status = email.StatusFailed
 		statusDesc = fmt.Sprintf("Ошибка преобразования: %v", err)
 		return
 	}
@@ -386,10 +703,44 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 		// Продолжаем отправку, но логируем предупреждение
 	}
 
+	// Просроченное письмо не отправляем (задержка из-за ограничения частоты, очереди или недоступности БД)
+	if err := s.checkExpired(emailMsg); err != nil {
+		status = email.StatusFailed
+		statusDesc = err.Error()
+		logger.Log.Warn("Срок актуальности письма истек, письмо не отправляется",
+			zap.Int64("taskID", taskID),
+			zap.Time("expiresAt", emailMsg.ExpiresAt))
+		return
+	}
+
 	// Проверяем расписание отправки
+	// Срочное письмо (bypass_schedule="1") отправляется вне окна расписания, каждый такой случай записывается в лог
+	// Если часовой пояс получателя известен, окна проверяются по его местному времени, а письмо вне окна
+	// откладывается до начала ближайшего окна
 	if emailMsg.Schedule {
-		if err := s.checkSchedule(emailMsg); err != nil {
-			status = 3 // Failed
+		var err error
+		if loc := emailMsg.RecipientLocation(s.cfg.Schedule.DomainTimezones); loc != nil {
+			err = s.checkRecipientSchedule(loc)
+		} else {
+			err = s.checkSchedule(emailMsg)
+		}
+		var recipientErr *recipientScheduleError
+		if err != nil && emailMsg.BypassSchedule {
+			logger.Log.Warn("Письмо отправляется вне графика по признаку bypass_schedule",
+				zap.Int64("taskID", taskID),
+				zap.String("emailAddress", emailMsg.EmailAddress),
+				zap.String("title", emailMsg.Title),
+				zap.String("reason", err.Error()))
+		} else if errors.As(err, &recipientErr) && s.canDefer(emailMsg, recipientErr.until) &&
+			s.deferRequest(msg, recipientErr.until) {
+			deferred = true
+			logger.Log.Info("Письмо отложено до окна расписания по местному времени получателя",
+				zap.Int64("taskID", taskID),
+				zap.Time("recipientTime", recipientErr.local),
+				zap.Time("until", recipientErr.until))
+			return
+		} else if err != nil {
+			status = email.StatusFailed
 			statusDesc = err.Error()
 			logger.Log.Warn("Попытка отправки вне графика",
 				zap.Int64("taskID", taskID),
@@ -408,19 +759,44 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 			zap.Int("attachmentsCount", len(attachments)))
 	}
 
-	// Обрабатываем вложения
-	attachmentData := make([]email.AttachmentData, 0, len(attachments))
-
 	// Проверяем, что emailService инициализирован
 	if s.emailService == nil {
 		logger.Log.Error("emailService не инициализирован",
 			zap.Int64("taskID", taskID))
-		status = 3 // Failed
+		status = email.StatusFailed
 		statusDesc = "emailService не инициализирован"
 		return
 	}
 
+	// Общий лимит времени на подготовку всех вложений письма (отдельно от таймаута отправки)
+	attachCtx := ctx
+	if s.cfg.Mode.AttachmentsTimeoutSec > 0 {
+		var attachCancel context.CancelFunc
+		attachCtx, attachCancel = context.WithTimeout(ctx, time.Duration(s.cfg.Mode.AttachmentsTimeoutSec)*time.Second)
+		defer attachCancel()
+	}
+
+	// Раскрываем шаблоны имен файлов (например, dir\*.pdf) в отдельные вложения
+	attachments = s.expandAttachments(attachCtx, attachments, emailMsg.TaskID)
+
+	// Обрабатываем вложения
+	attachmentData := make([]email.AttachmentData, 0, len(attachments))
+	// Временные файлы вложений удаляются после отправки, в том числе при ошибке
+	defer func() {
+		email.ReleaseAttachments(attachmentData)
+	}()
+
+	// Вложения, которые не удалось получить (при PartialAttachments письмо отправляется без них с пометкой)
+	var failedAttachments []string
+	var pendingAttachments []email.Attachment
+	// Пустые отчеты Crystal Reports, вместо которых в текст письма добавляется пометка
+	var emptyReports []string
 	for i, attach := range attachments {
+		if s.attachmentsTimedOut(ctx, attachCtx) {
+			pendingAttachments = attachments[i:]
+			break
+		}
+
 		logger.Log.Debug("Обработка вложения",
 			zap.Int64("taskID", emailMsg.TaskID),
 			zap.Int("index", i+1),
@@ -428,13 +804,28 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 			zap.Int("reportType", attach.ReportType),
 			zap.String("fileName", attach.FileName))
 
-		attachData, err := s.emailService.ProcessAttachment(ctx, &attach, emailMsg.TaskID)
+		attachData, err := s.emailService.ProcessAttachment(attachCtx, &attach, emailMsg.TaskID)
+		if errors.Is(err, email.ErrEmptyReport) && s.emailService.EmptyReportAllowed(&attach) {
+			logger.Log.Warn("Отчет Crystal Reports пуст, письмо будет отправлено без него с пометкой",
+				zap.Int64("taskID", emailMsg.TaskID),
+				zap.String("file", attach.File))
+			emptyReports = append(emptyReports, attachmentName(attach))
+			continue
+		}
 		if err != nil {
 			logger.Log.Error("Ошибка обработки вложения",
 				zap.Error(err),
 				zap.Int64("taskID", emailMsg.TaskID),
 				zap.Int("reportType", attach.ReportType),
 				zap.String("fileName", attach.FileName))
+			s.failures.add(failureAttachment)
+			// Без обязательного вложения письмо не отправляется
+			if attach.Required {
+				status = email.StatusFailed
+				statusDesc = fmt.Sprintf("не удалось получить обязательное вложение %s: %v", attachmentName(attach), err)
+				return
+			}
+			failedAttachments = append(failedAttachments, attachmentName(attach))
 			// Продолжаем обработку остальных вложений
 			continue
 		}
@@ -448,7 +839,7 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 			continue
 		}
 
-		if len(attachData.Data) == 0 {
+		if attachData.Len() == 0 {
 			logger.Log.Warn("Вложение обработано, но данные пустые (размер 0 байт)",
 				zap.Int64("taskID", emailMsg.TaskID),
 				zap.Int("reportType", attach.ReportType),
@@ -460,11 +851,38 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 		logger.Log.Debug("Вложение успешно обработано",
 			zap.Int64("taskID", emailMsg.TaskID),
 			zap.String("fileName", attachData.FileName),
-			zap.Int("dataSize", len(attachData.Data)))
+			zap.Int("dataSize", attachData.Len()))
 
+		attachData.Inline = attach.Inline
+		attachData.ContentID = attach.ContentID
 		attachmentData = append(attachmentData, *attachData)
 	}
 
+	// При превышении общего лимита письмо не отправляется с неполным набором вложений,
+	// а при PartialAttachments - отправляется с полученными, если среди неполученных нет обязательных
+	if s.attachmentsTimedOut(ctx, attachCtx) {
+		s.failures.add(failureAttachment)
+		if !s.cfg.Mode.PartialAttachments || hasRequiredAttachment(pendingAttachments) {
+			status = email.StatusFailed
+			statusDesc = fmt.Sprintf("превышено время обработки вложений (%d сек): обработано %d из %d",
+				s.cfg.Mode.AttachmentsTimeoutSec, len(attachmentData), len(attachments))
+			logger.Log.Error("Превышено время обработки вложений",
+				zap.Int64("taskID", emailMsg.TaskID),
+				zap.Int("timeoutSec", s.cfg.Mode.AttachmentsTimeoutSec),
+				zap.Int("processed", len(attachmentData)),
+				zap.Int("total", len(attachments)))
+			return
+		}
+		for _, attach := range pendingAttachments {
+			failedAttachments = append(failedAttachments, attachmentName(attach))
+		}
+		logger.Log.Warn("Превышено время обработки вложений, письмо будет отправлено с полученными вложениями",
+			zap.Int64("taskID", emailMsg.TaskID),
+			zap.Int("timeoutSec", s.cfg.Mode.AttachmentsTimeoutSec),
+			zap.Int("processed", len(attachmentData)),
+			zap.Int("total", len(attachments)))
+	}
+
 	// Логируем итоговую статистику по вложениям
 	skippedCount := len(attachments) - len(attachmentData)
 	if skippedCount > 0 {
@@ -491,39 +909,186 @@ func (s *Service) sendMessage(ctx context.Context, msg *db.QueueMessage) {
 			zap.Int("attachmentsCount", len(attachmentData)))
 	}
 
+	// Срок актуальности мог истечь за время обработки вложений
+	if err := s.checkExpired(emailMsg); err != nil {
+		status = email.StatusFailed
+		statusDesc = err.Error()
+		logger.Log.Warn("Срок актуальности письма истек, письмо не отправляется",
+			zap.Int64("taskID", taskID),
+			zap.Time("expiresAt", emailMsg.ExpiresAt))
+		return
+	}
+
+	// Сообщаем получателю о вложениях, которые не удалось приложить
+	// Текстовая и HTML версии тела из очереди получают ту же заметку в своем формате
+	text, textPlain, textHTML := emailMsg.Text, emailMsg.TextPlain, emailMsg.TextHTML
+	addNote := func(appendNote func(string, bool, []string) string, names []string) {
+		text = appendNote(text, s.cfg.Mode.IsBodyHTML, names)
+		if textPlain != "" {
+			textPlain = appendNote(textPlain, false, names)
+		}
+		if textHTML != "" {
+			textHTML = appendNote(textHTML, true, names)
+		}
+	}
+	if s.cfg.Mode.PartialAttachments && len(failedAttachments) > 0 {
+		addNote(email.AppendAttachmentNote, failedAttachments)
+	}
+	if len(emptyReports) > 0 {
+		addNote(email.AppendEmptyReportNote, emptyReports)
+	}
+
 	// Отправляем email
 	emailMsgForSend := &email.EmailMessage{
 		TaskID:       emailMsg.TaskID,
 		SmtpID:       emailMsg.SmtpID,
 		EmailAddress: emailMsg.EmailAddress,
 		Title:        emailMsg.Title,
-		Text:         emailMsg.Text,
+		Text:         text,
+		TextPlain:    textPlain,
+		TextHTML:     textHTML,
 		Attachments:  attachmentData,
+
+		Bulk:            emailMsg.Bulk,
+		ListUnsubscribe: emailMsg.ListUnsubscribe,
+		CustomHeaders:   emailMsg.CustomHeaders,
+		Language:        emailMsg.Language,
 	}
 
 	err = s.emailService.SendEmail(ctx, emailMsgForSend)
-	if err != nil {
-		status = 3 // Failed
+	var rejectedErr *email.RecipientsRejectedError
+	if errors.As(err, &rejectedErr) && rejectedErr.Accepted > 0 {
+		// Письмо отправлено принятым получателям, отклоненные адреса с кодами ответа - в описании статуса
+		status = email.StatusPartial
+		statusDesc = rejectedErr.Error()
+		logger.Log.Warn("Email отправлен не всем получателям", zap.Error(err), zap.Int64("taskID", taskID))
+	} else if err != nil {
+		status = email.StatusFailed
 		statusDesc = err.Error()
+		// Код ответа SMTP сервера в начале описания для разбора ошибок операторами
+		var replyErr *email.SMTPReplyError
+		if errors.As(err, &replyErr) {
+			statusDesc = replyErr.Status() + ": " + statusDesc
+		}
 
-		// Для ошибок неверного email адреса логируем на уровне WARN
-		if s.isInvalidEmailError(err) {
+		// Ограничение частоты и ошибки неверного email адреса логируем на уровне WARN
+		var rateErr *email.RateLimitedError
+		switch {
+		case errors.As(err, &rateErr):
+			logger.Log.Warn("Ошибка отправки email: SMTP сервер ограничил частоту отправки", zap.Error(err), zap.Int64("taskID", taskID))
+		case s.isInvalidEmailError(err):
 			logger.Log.Warn("Ошибка отправки email: неверный адрес", zap.Error(err), zap.Int64("taskID", taskID))
-		} else {
-			logger.Log.Error("Ошибка отправки email", zap.Error(err), zap.Int64("taskID", taskID))
+		default:
+			logger.Log.Error("Ошибка отправки email", zap.Error(err), zap.Int64("taskID", taskID),
+				zap.String("errorClass", sendErrorClass(err)))
 		}
 
 		// Проверяем на критические ошибки
 		if s.isCriticalError(err) {
-			s.criticalErrorCount.Add(1)
+			s.failures.add(failureSend)
 		}
 	} else {
-		status = 2      // Sended
+		status = email.StatusSent
 		statusDesc = "" // Для успешной отправки error_text должен быть пустым
 		logger.Log.Info("Email успешно отправлен", zap.Int64("taskID", taskID))
 	}
 }
 
+// checkExpired проверяет срок актуальности письма (expires_at) перед подключением к SMTP серверу
+// Для просроченного письма возвращается ошибка с префиксом "expired" для error_text
+func (s *Service) checkExpired(emailMsg *email.ParsedEmailMessage) error {
+	now := s.clock.Now()
+	if !emailMsg.Expired(now) {
+		return nil
+	}
+	return fmt.Errorf("expired: срок актуальности письма истек %s (опоздание %s)",
+		emailMsg.ExpiresAt.Format("2006-01-02 15:04:05"), now.Sub(emailMsg.ExpiresAt).Round(time.Second))
+}
+
+// attachmentName возвращает имя вложения для пометки в письме и логов
+func attachmentName(attach email.Attachment) string {
+	switch {
+	case attach.FileName != "":
+		return attach.FileName
+	case attach.File != "":
+		return attach.File
+	default:
+		return attach.ReportFile
+	}
+}
+
+// hasRequiredAttachment проверяет, есть ли среди вложений обязательные (email_attach_required="1")
+func hasRequiredAttachment(attachments []email.Attachment) bool {
+	for _, attach := range attachments {
+		if attach.Required {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentsTimedOut проверяет, истек ли общий лимит времени на обработку вложений
+// Отмена родительского контекста (остановка сервиса) лимитом не считается
+func (s *Service) attachmentsTimedOut(ctx, attachCtx context.Context) bool {
+	return ctx.Err() == nil && errors.Is(attachCtx.Err(), context.DeadlineExceeded)
+}
+
+// expandAttachments раскрывает шаблоны имен файлов во вложениях
+// Вложение, шаблон которого не удалось раскрыть, пропускается, как и при ошибке обработки
+func (s *Service) expandAttachments(ctx context.Context, attachments []email.Attachment, taskID int64) []email.Attachment {
+	expanded := make([]email.Attachment, 0, len(attachments))
+	for i := range attachments {
+		files, err := s.emailService.ExpandAttachment(ctx, &attachments[i])
+		if err != nil {
+			logger.Log.Error("Ошибка раскрытия шаблона вложения",
+				zap.Error(err),
+				zap.Int64("taskID", taskID),
+				zap.String("reportFile", attachments[i].ReportFile))
+			continue
+		}
+		expanded = append(expanded, files...)
+	}
+	return expanded
+}
+
+// appendMessageSummary дополняет текст ошибки краткой сводкой о письме (тема, получатели, SMTP сервер)
+// Длина сводки и итогового текста ограничена, чтобы уложиться в поле error_text
+func (s *Service) appendMessageSummary(errorText string, emailMsg *email.ParsedEmailMessage) string {
+	if emailMsg == nil {
+		return errorText
+	}
+
+	// Для некорректного smtp_id сервер не указывается: письмо через него не отправлялось
+	smtpPart := ""
+	if index := s.smtpIndex(emailMsg.SmtpID); index != invalidSMTPIndex {
+		smtpPart = "; SMTP: " + s.cfg.SMTP[index].Host
+	}
+
+	summary := fmt.Sprintf(" [Тема: %s; Получатели: %s%s]",
+		truncateRunes(emailMsg.Title, maxSummarySubjectLen),
+		truncateRunes(emailMsg.EmailAddress, maxSummaryRecipientsLen),
+		smtpPart)
+
+	// Сводка добавляется в конец, поэтому при нехватке места обрезается текст ошибки
+	available := maxErrorTextLen - len([]rune(summary))
+	if available < 0 {
+		available = 0
+	}
+	return truncateRunes(errorText, available) + summary
+}
+
+// truncateRunes обрезает строку до указанного количества символов (не байт)
+func truncateRunes(s string, maxLen int) string {
+	runes := []rune(s)
+	if len(runes) <= maxLen {
+		return s
+	}
+	if maxLen <= 3 {
+		return string(runes[:maxLen])
+	}
+	return string(runes[:maxLen-3]) + "..."
+}
+
 // checkSchedule проверяет, соответствует ли время отправки расписанию
 func (s *Service) checkSchedule(emailMsg *email.ParsedEmailMessage) error {
 	if !emailMsg.Schedule {
@@ -548,52 +1113,66 @@ func (s *Service) checkSchedule(emailMsg *email.ParsedEmailMessage) error {
 		}
 		if err != nil {
 			// Если не удалось распарсить, используем текущее время
-			activeDate = time.Now()
+			activeDate = s.clock.Now()
 		}
 	} else {
-		activeDate = time.Now()
+		activeDate = s.clock.Now()
 	}
 
-	// Получаем время начала и окончания из конфигурации
-	now := time.Now()
-	timeStart := s.cfg.Schedule.TimeStart
-	timeEnd := s.cfg.Schedule.TimeEnd
+	// Получаем окна расписания (из БД или из конфигурации)
+	now := s.clock.Now()
+	windows := s.schedule.windows(now)
 
-	// Обновляем дату для timeStart и timeEnd на текущую дату
-	todayStart := time.Date(now.Year(), now.Month(), now.Day(),
-		timeStart.Hour(), timeStart.Minute(), timeStart.Second(), 0, now.Location())
-	todayEnd := time.Date(now.Year(), now.Month(), now.Day(),
-		timeEnd.Hour(), timeEnd.Minute(), timeEnd.Second(), 0, now.Location())
+	// Проверяем, что activeDate находится в пределах одного из окон расписания
+	activeTime := time.Date(activeDate.Year(), activeDate.Month(), activeDate.Day(),
+		activeDate.Hour(), activeDate.Minute(), activeDate.Second(), 0, activeDate.Location())
 
-	// Если время окончания раньше времени начала, это может означать, что окончание на следующий день
-	if todayEnd.Before(todayStart) {
-		todayEnd = todayEnd.Add(24 * time.Hour)
+	for _, window := range windows {
+		// Обновляем дату для начала и окончания окна на текущую дату
+		todayStart, todayEnd := window.today(now)
+		if !activeTime.Before(todayStart) && !activeTime.After(todayEnd) {
+			return nil
+		}
 	}
 
-	// Проверяем, что activeDate находится в пределах расписания
-	activeTime := time.Date(activeDate.Year(), activeDate.Month(), activeDate.Day(),
-		activeDate.Hour(), activeDate.Minute(), activeDate.Second(), 0, activeDate.Location())
+	return fmt.Errorf("попытка отправки вне графика %s [%s]",
+		activeTime.Format("2006-01-02 15:04:05"),
+		formatScheduleWindows(windows, now))
+}
 
-	if activeTime.Before(todayStart) || activeTime.After(todayEnd) {
-		return fmt.Errorf("попытка отправки вне графика %s [%s - %s]",
-			activeTime.Format("2006-01-02 15:04:05"),
-			todayStart.Format("15:04"),
-			todayEnd.Format("15:04"))
+// checkRecipientSchedule проверяет, что текущее время получателя (часовой пояс loc) попадает в окно расписания
+// Вне окна возвращается *recipientScheduleError с началом ближайшего окна по времени получателя
+func (s *Service) checkRecipientSchedule(loc *time.Location) error {
+	now := s.clock.Now()
+	windows := s.schedule.windows(now)
+	local := now.In(loc)
+	for _, window := range windows {
+		if window.contains(local) {
+			return nil
+		}
 	}
+	return &recipientScheduleError{
+		local:   local,
+		until:   nextWindowStart(windows, local),
+		windows: formatScheduleWindows(windows, local),
+	}
+}
 
-	return nil
+// canDefer проверяет, можно ли отложить письмо до момента until: в режиме OneShot сервис завершится
+// раньше, а письмо с истекающим до этого момента expires_at отправлять будет поздно
+func (s *Service) canDefer(emailMsg *email.ParsedEmailMessage, until time.Time) bool {
+	if s.cfg.Mode.OneShot || until.IsZero() {
+		return false
+	}
+	return emailMsg.ExpiresAt.IsZero() || until.Before(emailMsg.ExpiresAt)
 }
 
 // checkAndUpdateRateLimits проверяет и обновляет ограничения частоты отправки
 func (s *Service) checkAndUpdateRateLimits(emailMsg *email.ParsedEmailMessage) error {
 	// Очищаем устаревшие записи
-	now := time.Now()
+	now := s.clock.Now()
 	s.sendEmailMu.Lock()
-	for address, lastTime := range s.sendEmailMap {
-		if lastTime.Before(now) {
-			delete(s.sendEmailMap, address)
-		}
-	}
+	s.sendEmailMap.cleanup(now)
 	s.sendEmailMu.Unlock()
 
 	// Обрабатываем множественные адреса (разделители ; и ,)
@@ -613,27 +1192,23 @@ func (s *Service) checkAndUpdateRateLimits(emailMsg *email.ParsedEmailMessage) e
 		}
 
 		s.sendEmailMu.Lock()
-		lastTime, exists := s.sendEmailMap[address]
+		lastTime, exists := s.sendEmailMap.get(address)
 		if exists {
 			// Проверяем, не превышен ли лимит
 			interval := time.Duration(smtpCfg.SMTPMinSendEmailIntervalMsec) * time.Millisecond
 			if now.Before(lastTime.Add(interval)) {
-				// Ждем, пока не пройдет интервал (максимум 300 итераций по 50 мс = 15 секунд)
-				waitUntil := lastTime.Add(interval)
+				// Ждем, пока не пройдет интервал (максимум 15 секунд)
+				wait := min(lastTime.Add(interval).Sub(s.clock.Now()), 15*time.Second)
 				s.sendEmailMu.Unlock()
 
-				waitCount := 0
-				for time.Now().Before(waitUntil) && waitCount < 300 {
-					time.Sleep(50 * time.Millisecond)
-					waitCount++
-				}
+				clock.Sleep(s.clock, wait)
 				s.sendEmailMu.Lock()
 			}
-			// Обновляем время последней отправки
-			s.sendEmailMap[address] = now.Add(time.Duration(smtpCfg.SMTPMinSendEmailIntervalMsec) * time.Millisecond)
-		} else {
-			// Добавляем новую запись
-			s.sendEmailMap[address] = now.Add(time.Duration(smtpCfg.SMTPMinSendEmailIntervalMsec) * time.Millisecond)
+		}
+		// Обновляем (или добавляем) время последней отправки
+		evicted := s.sendEmailMap.set(address, now.Add(time.Duration(smtpCfg.SMTPMinSendEmailIntervalMsec)*time.Millisecond))
+		if evicted > 0 {
+			s.alertRateLimitEviction(evicted)
 		}
 		s.sendEmailMu.Unlock()
 	}
@@ -641,12 +1216,44 @@ func (s *Service) checkAndUpdateRateLimits(emailMsg *email.ParsedEmailMessage) e
 	return nil
 }
 
+// alertRateLimitEviction предупреждает о вытеснении записей из кеша ограничений частоты
+// Предупреждение выводится не чаще раза в минуту, чтобы не засорять логи при потоке уникальных адресов
+// Вызывается под блокировкой sendEmailMu
+func (s *Service) alertRateLimitEviction(evicted int) {
+	if clock.Since(s.clock, s.lastEvictionAlert) < time.Minute {
+		return
+	}
+	s.lastEvictionAlert = s.clock.Now()
+
+	logger.Log.Warn("Кеш ограничений частоты отправки переполнен, старые записи вытесняются",
+		zap.Int("evicted", evicted),
+		zap.Int64("totalEvicted", s.sendEmailMap.evicted),
+		zap.Int("size", s.sendEmailMap.size()),
+		zap.Int("maxSize", s.sendEmailMap.maxSize))
+}
+
+// GetRateLimitMapSize возвращает текущий размер кеша ограничений частоты и общее число вытесненных записей
+func (s *Service) GetRateLimitMapSize() (size int, evicted int64) {
+	s.sendEmailMu.RLock()
+	defer s.sendEmailMu.RUnlock()
+	return s.sendEmailMap.size(), s.sendEmailMap.evicted
+}
+
 // isInvalidEmailError проверяет, является ли ошибка ошибкой неверного email адреса
 func (s *Service) isInvalidEmailError(err error) bool {
 	if err == nil {
 		return false
 	}
 
+	if errors.Is(err, email.ErrNoValidRecipients) || errors.Is(err, email.ErrRecipientDomainNotFound) {
+		return true
+	}
+	// SMTP сервер отклонил все адреса получателей
+	var rejectedErr *email.RecipientsRejectedError
+	if errors.As(err, &rejectedErr) {
+		return true
+	}
+
 	errStr := strings.ToLower(err.Error())
 	// Проверяем типичные ошибки неверного email адреса
 	invalidEmailPatterns := []string{
@@ -682,6 +1289,16 @@ func (s *Service) isCriticalError(err error) bool {
 	if strings.Contains(errStr, "25263") || strings.Contains(errStr, "ora-25263") {
 		return true
 	}
+	// Ограничение частоты отправки - не сбой сервера, рестарт обработки не поможет
+	var rateErr *email.RateLimitedError
+	if errors.As(err, &rateErr) {
+		return false
+	}
+	// Временный отказ SMTP сервера (4xx) говорит о проблемах сервера, постоянный (5xx) - о проблеме письма
+	var replyErr *email.SMTPReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Transient()
+	}
 	// SMTP "4.3.2 Please try again later"
 	if strings.Contains(errStr, "4.3.2") && strings.Contains(errStr, "please try again later") {
 		return true
@@ -690,12 +1307,49 @@ func (s *Service) isCriticalError(err error) bool {
 	return false
 }
 
-// enqueueResponse добавляет результат в очередь результатов
-func (s *Service) enqueueResponse(taskID int64, statusID int, errorText string) {
+// sendErrorClass возвращает класс ошибки отправки для логов: transient, permanent, rate_limited
+// или пустую строку, если ошибка не классифицирована (например, отмена контекста)
+func sendErrorClass(err error) string {
+	var transientErr *email.TransientError
+	var permanentErr *email.PermanentError
+	var rateErr *email.RateLimitedError
+	switch {
+	case errors.As(err, &rateErr):
+		return "rate_limited"
+	case errors.As(err, &permanentErr):
+		return "permanent"
+	case errors.As(err, &transientErr):
+		return "transient"
+	}
+	return ""
+}
+
+// enqueueResponse добавляет результат в очередь результатов с текущим временем
+// Числовой код статуса для БД определяется секцией [Status] конфигурации
+func (s *Service) enqueueResponse(taskID int64, status email.Status, errorText string) {
+	s.enqueueResponseAt(taskID, status, errorText, time.Time{})
+}
+
+// enqueueResponseAt добавляет результат в очередь результатов с временем события eventTime
+// (например, время из DSN bounce message); нулевое eventTime заменяется текущим временем
+func (s *Service) enqueueResponseAt(taskID int64, status email.Status, errorText string, eventTime time.Time) {
+	if eventTime.IsZero() {
+		eventTime = s.clock.Now()
+	} else {
+		// Дата в DSN записана в часовом поясе MTA, P_DATE_RESPONSE хранится в локальном времени
+		eventTime = eventTime.Local()
+	}
+	if s.responsesClosed.Load() {
+		logger.Log.Warn("Очередь результатов закрыта, результат не будет записан в БД",
+			zap.Int64("taskID", taskID),
+			zap.Stringer("status", status))
+		return
+	}
+
 	params := db.SaveEmailResponseParams{
 		TaskID:       taskID,
-		StatusID:     statusID,
-		ResponseDate: time.Now(),
+		StatusID:     status.Code(s.cfg.Status),
+		ResponseDate: eventTime,
 		ErrorText:    errorText,
 	}
 
@@ -710,7 +1364,7 @@ func (s *Service) enqueueResponse(taskID int64, statusID int, errorText string)
 }
 
 // responseQueueWriter записывает результаты из очереди в БД
-func (s *Service) responseQueueWriter(ctx context.Context) {
+func (s *Service) responseQueueWriter() {
 	defer s.responseQueueWg.Done()
 
 	batch := make([]db.SaveEmailResponseParams, 0, 10000)
@@ -719,8 +1373,17 @@ func (s *Service) responseQueueWriter(ctx context.Context) {
 
 	for {
 		select {
-		case <-ctx.Done():
-			// Записываем оставшиеся результаты перед завершением
+		case <-s.responseStop:
+			// Забираем из канала все, что успели поставить в очередь, и записываем перед завершением
+			for {
+				select {
+				case params := <-s.responseQueue:
+					batch = append(batch, params)
+					continue
+				default:
+				}
+				break
+			}
 			if len(batch) > 0 {
 				s.writeResponseBatch(batch)
 			}
@@ -744,6 +1407,32 @@ func (s *Service) responseQueueWriter(ctx context.Context) {
 	}
 }
 
+// CloseResponseQueue прекращает прием результатов и дожидается записи накопленных результатов в БД
+// Вызывается при завершении работы после остановки email сервиса и до закрытия соединения с БД
+// Возвращает false, если запись не завершилась до истечения контекста
+func (s *Service) CloseResponseQueue(ctx context.Context) bool {
+	s.responsesClosed.Store(true)
+	s.responseStopOnce.Do(func() {
+		close(s.responseStop)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.responseQueueWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Log.Info("Очередь результатов записана в БД и закрыта")
+		return true
+	case <-ctx.Done():
+		logger.Log.Warn("Таймаут записи очереди результатов в БД",
+			zap.Int("pending", len(s.responseQueue)))
+		return false
+	}
+}
+
 // writeResponseBatch записывает батч результатов в БД
 func (s *Service) writeResponseBatch(batch []db.SaveEmailResponseParams) {
 	// Используем контекст с таймаутом для каждой записи
@@ -763,8 +1452,9 @@ func (s *Service) writeResponseBatch(batch []db.SaveEmailResponseParams) {
 
 // GetStatusUpdateCallback возвращает callback для обновления статуса письма
 func (s *Service) GetStatusUpdateCallback() email.StatusUpdateCallback {
-	return func(taskID int64, status int, statusDesc string, errorText string) {
-		s.enqueueResponse(taskID, status, errorText)
+	return func(taskID int64, status email.Status, statusDesc string, errorText string, eventTime time.Time) {
+		s.enqueueResponseAt(taskID, status, errorText, eventTime)
+		s.recordReport(taskID, "", status, errorText)
 	}
 }
 
@@ -779,7 +1469,15 @@ func (s *Service) logStatistics() {
 	queueSize := len(s.requestDir)
 	s.requestDirMu.RUnlock()
 
+	rateLimitSize, rateLimitEvicted := s.GetRateLimitMapSize()
+	failures := s.failures.snapshot()
+
 	logger.Log.Info("Статистика при завершении",
 		zap.Int("неотправленных Email", queueSize),
-		zap.Int32("критических ошибок", s.criticalErrorCount.Load()))
+		zap.Int("в очередях SMTP серверов", s.lanesPending()),
+		zap.Int32("ошибок разбора сообщений", failures.Parse),
+		zap.Int32("ошибок получения вложений", failures.Attachment),
+		zap.Int32("критических ошибок отправки", failures.Send),
+		zap.Int("размер кеша ограничений частоты", rateLimitSize),
+		zap.Int64("вытеснено из кеша ограничений частоты", rateLimitEvicted))
 }
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"email-service/clock"
+	"email-service/email"
+	"email-service/settings"
+)
+
+// newTestService создает сервис без БД и очереди с часами clk и окном расписания 09:00-18:00
+func newTestService(t *testing.T, clk clock.Clock) *Service {
+	t.Helper()
+	cfg := &settings.Config{}
+	cfg.Schedule.TimeStart = mustClock(t, "09:00")
+	cfg.Schedule.TimeEnd = mustClock(t, "18:00")
+	cfg.SMTP = []settings.SMTPConfig{{Host: "smtp.example.com", SMTPMinSendEmailIntervalMsec: 5000}}
+	s := NewService(cfg, nil, nil)
+	s.SetClock(clk)
+	return s
+}
+
+func TestCheckScheduleFakeClock(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 15, 8, 59, 0, 0, time.Local))
+	s := newTestService(t, clk)
+	msg := &email.ParsedEmailMessage{Schedule: true}
+
+	if err := s.checkSchedule(msg); err == nil {
+		t.Error("в 08:59 письмо не должно отправляться")
+	}
+	clk.Advance(time.Minute)
+	if err := s.checkSchedule(msg); err != nil {
+		t.Errorf("в 09:00: %v", err)
+	}
+	clk.Set(time.Date(2026, 1, 15, 18, 0, 1, 0, time.Local))
+	if err := s.checkSchedule(msg); err == nil {
+		t.Error("в 18:00:01 письмо не должно отправляться")
+	}
+
+	// Письмо без sending_schedule отправляется в любое время
+	if err := s.checkSchedule(&email.ParsedEmailMessage{}); err != nil {
+		t.Errorf("письмо без расписания: %v", err)
+	}
+}
+
+func TestCheckRecipientScheduleFakeClock(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*3600)
+	// 01:00 UTC - 10:00 в Токио
+	clk := clock.NewFake(time.Date(2026, 1, 15, 1, 0, 0, 0, time.UTC))
+	s := newTestService(t, clk)
+
+	if err := s.checkRecipientSchedule(tokyo); err != nil {
+		t.Errorf("10:00 по времени получателя: %v", err)
+	}
+
+	// 10:00 UTC - 19:00 в Токио, ближайшее окно - 09:00 следующего дня по времени получателя
+	clk.Advance(9 * time.Hour)
+	err := s.checkRecipientSchedule(tokyo)
+	var scheduleErr *recipientScheduleError
+	if !errors.As(err, &scheduleErr) {
+		t.Fatalf("ошибка %v, ожидалась *recipientScheduleError", err)
+	}
+	want := time.Date(2026, 1, 16, 9, 0, 0, 0, tokyo)
+	if !scheduleErr.until.Equal(want) {
+		t.Errorf("until = %v, ожидалось %v", scheduleErr.until, want)
+	}
+}
+
+func TestRateLimitFakeClock(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 1, 15, 10, 0, 0, 0, time.UTC))
+	s := newTestService(t, clk)
+	msg := &email.ParsedEmailMessage{EmailAddress: "user@example.org"}
+
+	// Первое письмо на адрес отправляется без ожидания
+	if err := s.checkAndUpdateRateLimits(msg); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := s.GetRateLimitMapSize(); size != 1 {
+		t.Fatalf("записей ограничений: %d, ожидалась 1", size)
+	}
+
+	// Письмо на другой адрес не ждет
+	if err := s.checkAndUpdateRateLimits(&email.ParsedEmailMessage{EmailAddress: "other@example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if clk.Waiters() != 0 {
+		t.Fatal("письмо на другой адрес ожидает интервал")
+	}
+
+	// Повторное письмо на тот же адрес ждет, пока часы не будут переведены
+	done := make(chan struct{})
+	go func() {
+		s.checkAndUpdateRateLimits(msg)
+		close(done)
+	}()
+	waitForWaiters(t, clk, 1)
+	select {
+	case <-done:
+		t.Fatal("повторное письмо отправлено без ожидания интервала")
+	default:
+	}
+	// Ожидание ограничено 15 секундами
+	clk.Advance(15 * time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ожидание не завершилось после перевода часов")
+	}
+
+	// После истечения ограничений устаревшие записи удаляются
+	clk.Advance(time.Hour)
+	if err := s.checkAndUpdateRateLimits(&email.ParsedEmailMessage{EmailAddress: "third@example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := s.GetRateLimitMapSize(); size != 1 {
+		t.Errorf("записей ограничений после очистки: %d, ожидалась 1", size)
+	}
+}
+
+// waitForWaiters ждет, пока на часах clk не будет зарегистрировано n таймеров
+func waitForWaiters(t *testing.T, clk *clock.Fake, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clk.Waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("таймеров: %d, ожидалось %d", clk.Waiters(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInvalidSmtpIDNotAttributedToFirstServer(t *testing.T) {
+	tests := []struct {
+		name      string
+		fallback  bool
+		smtpID    int
+		wantIndex int
+		wantHost  string
+	}{
+		{"корректный smtp_id", false, 1, 1, "smtp2.example.com"},
+		{"вне диапазона", false, 5, invalidSMTPIndex, ""},
+		{"отрицательный", false, -1, invalidSMTPIndex, ""},
+		// С SMTPIDFallback письмо действительно отправляется через первый сервер
+		{"вне диапазона с SMTPIDFallback", true, 5, 0, "smtp1.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &settings.Config{}
+			cfg.SMTP = []settings.SMTPConfig{{Host: "smtp1.example.com"}, {Host: "smtp2.example.com"}}
+			cfg.Mode.SMTPIDFallback = tt.fallback
+			s := NewService(cfg, nil, nil)
+			s.metrics = newSendMetrics()
+
+			if got := s.smtpIndex(tt.smtpID); got != tt.wantIndex {
+				t.Errorf("smtpIndex(%d) = %d, ожидалось %d", tt.smtpID, got, tt.wantIndex)
+			}
+
+			// Метрика попадает в счетчик сервера или в отдельный счетчик некорректных smtp_id
+			s.recordSendMetric(s.smtpIndex(tt.smtpID), email.StatusFailed)
+			counts := s.metrics.take()
+			if len(counts) != 1 {
+				t.Fatalf("записано %d счетчиков метрик, ожидался 1", len(counts))
+			}
+			for key := range counts {
+				if key.smtpID != tt.wantIndex {
+					t.Errorf("метрика записана для smtp_id %d, ожидалось %d", key.smtpID, tt.wantIndex)
+				}
+			}
+
+			summary := s.appendMessageSummary("ошибка", &email.ParsedEmailMessage{SmtpID: tt.smtpID, Title: "Счет", EmailAddress: "a@example.org"})
+			if tt.wantHost == "" {
+				if strings.Contains(summary, "SMTP") || strings.Contains(summary, "smtp1.example.com") {
+					t.Errorf("сводка %q указывает SMTP сервер для некорректного smtp_id", summary)
+				}
+			} else if !strings.Contains(summary, "SMTP: "+tt.wantHost+"]") {
+				t.Errorf("сводка %q, ожидался сервер %s", summary, tt.wantHost)
+			}
+		})
+	}
+}
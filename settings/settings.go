@@ -1,7 +1,12 @@
 package settings
 
 import (
+	"crypto/x509"
 	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/ini.v1"
@@ -16,7 +21,13 @@ type Config struct {
 	Schedule     ScheduleConfig
 	Log          LogConfig
 	Share        ShareConfig
+	Digest       DigestConfig
+	Status       StatusConfig
+	Health       HealthConfig
+	Bounce       BounceConfig
+	scheduleMu   sync.Mutex
 	scheduleStop chan struct{} // Канал для остановки горутины обновления расписания
+	scheduleDone chan struct{} // Закрывается при завершении горутины обновления расписания
 }
 
 // OracleConfig представляет конфигурацию Oracle
@@ -27,6 +38,10 @@ type OracleConfig struct {
 	DSN                       string
 	DBConnectRetryAttempts    int
 	DBConnectRetryIntervalSec int
+	// Экспоненциальная пауза между попытками ограничена DBConnectRetryMaxIntervalSec,
+	// общее время попыток - DBConnectRetryMaxWaitSec (0 - без ограничения)
+	DBConnectRetryMaxIntervalSec int
+	DBConnectRetryMaxWaitSec     int
 }
 
 // SMTPConfig представляет конфигурацию SMTP сервера
@@ -41,22 +56,241 @@ type SMTPConfig struct {
 	SMTPMinSendEmailIntervalMsec int
 	IMAPHost                     string // IMAP сервер для проверки bounce-сообщений
 	IMAPPort                     int    // IMAP порт (обычно 993 для SSL)
+	EnablePipelining             bool   // Использовать SMTP PIPELINING, если сервер его поддерживает
+	HideInternalHost             bool   // Не раскрывать хост SMTP сервера в Message-ID и служебных заголовках
+	PublicDomain                 string // Внешний домен для Message-ID при HideInternalHost (по умолчанию - домен User)
+	MaxRecipientsPerTransaction  int    // Максимум получателей в одной SMTP транзакции (0 - без ограничения)
+	MaxTransactionsPerConnection int    // Максимум SMTP транзакций за одно соединение (0 - без ограничения)
+	TLSServerName                string // Имя для SNI и проверки сертификата (пусто - Host)
+	ConnectionPoolSize           int    // Открытых соединений для повторного использования (0 - соединение на каждое письмо)
+	ConnectionIdleTimeoutSec     int    // Время простоя, после которого соединение из пула закрывается
+	KeepAliveIntervalSec         int    // Интервал NOOP для простаивающих соединений пула
+	GreetingTimeoutSec           int    // Время ожидания приветствия 220 после подключения
+	EnvelopeFrom                 string // Адрес для MAIL FROM и Return-Path (пусто - User)
+	// Повтор отправки при временных ошибках (0 повторов - одна попытка)
+	SMTPMaxRetries       int
+	SMTPRetryBackoffMsec int
+	SMTPRetryExponential bool     // Удваивать паузу с каждой попыткой (иначе пауза растет линейно)
+	SMTPRetryJitter      bool     // Случайно уменьшать паузу до 50%
+	SMTPRetryErrors      []string // Подстроки текста ошибки, при которых отправка повторяется
+	HeloName             string   // Имя в EHLO/HELO (пусто - локальное имя хоста)
+	// Таймауты проверки bounce через IMAP в секундах
+	IMAPTimeoutSec        int // Общий таймаут проверки статуса письма
+	IMAPConnectTimeoutSec int // Подключение и приветствие сервера
+	IMAPFolderTimeoutSec  int // Проверка одной папки
+	IMAPFetchTimeoutSec   int // Одна команда FETCH
+	// Таймауты SMTP в секундах (0 - 30 секунд)
+	SMTPDialTimeoutSec    int // Установка TCP/TLS соединения
+	SMTPCommandTimeoutSec int // Чтение ответа или запись команды (данных письма) без продвижения
+	// TLS для SMTP и IMAP: минимальная версия (1.0-1.3, пусто - 1.2) и отключение проверки сертификата
+	TLSMinVersion         string
+	TLSInsecureSkipVerify bool
+	// Клиентский сертификат и ключ в PEM для SMTP серверов, требующих mTLS (задаются вместе)
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+	// Сертификаты частного удостоверяющего центра в PEM для проверки SMTP и IMAP серверов (пусто - системные)
+	TLSCAFile  string
+	TLSRootCAs *x509.CertPool // Загружается из TLSCAFile при чтении конфигурации, nil - системное хранилище
+	// Признаки bounce-сообщений для проверки через IMAP: секция [Bounce] с переопределениями секции SMTP
+	Bounce BounceConfig
+	// Отслеживать новые письма в INBOX через IMAP IDLE для быстрого обнаружения bounce
+	IMAPUseIdle bool
+	// Адрес User не принимает ответы: в письма добавляются X-Auto-Response-Suppress и Reply-To: SupportReplyTo
+	NoReplySender  bool
+	SupportReplyTo string // Адрес поддержки для ответов на письма (пусто - Reply-To не добавляется)
+	// Папки IMAP для поиска bounce (имена или шаблоны path.Match), пусто - INBOX, корзина и спам по LIST
+	IMAPBounceFolders []string
+	// Действие с bounce после записи статуса: none, seen, move или delete; папка для move
+	IMAPBounceAction     string
+	IMAPBounceMoveFolder string
+	// Просмотр найденных в папке bounce: не более IMAPScanMaxMessages последних писем, страницами
+	// по IMAPScanPageSize от новых к старым; просмотр останавливается на первом bounce письма
+	IMAPScanMaxMessages int
+	IMAPScanPageSize    int
 }
 
+// defaultSMTPRetryErrors - признаки временных ошибок SMTP по умолчанию
+var defaultSMTPRetryErrors = []string{
+	"smtp command timeout",
+	"connection reset",
+	"eof",
+	"broken pipe",
+	"temporary failure",
+}
+
+// Признаки bounce-сообщений по умолчанию (английские и русские формулировки распространенных MTA)
+var (
+	defaultBounceFromKeywords = []string{
+		"mailer-daemon",
+		"postmaster",
+		"mail delivery subsystem",
+		"mailer@",
+		"noreply@",
+	}
+	defaultBounceSubjectKeywords = []string{
+		"delivery status notification",
+		"mail delivery failed",
+		"undelivered mail",
+		"returned mail",
+		"mail delivery subsystem",
+		"delivery failure",
+		"failure notice",
+		"недоставленное сообщение",
+		"недоставленное письмо",
+		"ошибка доставки",
+		"возврат письма",
+		"не может быть отправлено",
+	}
+	defaultBounceErrorPatterns = []BouncePattern{
+		{"550", "Адрес получателя не существует (550)"},
+		{"551", "Пользователь не найден (551)"},
+		{"552", "Превышен лимит почтового ящика (552)"},
+		{"553", "Адрес получателя неверен (553)"},
+		{"user unknown", "Пользователь не найден"},
+		{"mailbox full", "Почтовый ящик переполнен"},
+		{"address rejected", "Адрес отклонен"},
+		{"relay denied", "Ретрансляция запрещена"},
+		{"host or domain name not found", "Домен или хост не найден"},
+		{"host not found", "Хост не найден"},
+		{"name service error", "Ошибка службы имен"},
+		{"не существует", "Адрес не существует"},
+		{"не найден", "Пользователь не найден"},
+		{"переполнен", "Почтовый ящик переполнен"},
+		{"не может быть отправлено", "Письмо не может быть отправлено"},
+	}
+)
+
 // ModeConfig представляет режимы работы
 type ModeConfig struct {
 	Debug                       bool
 	SendHiddenCopyToSelf        bool
 	IsBodyHTML                  bool
-	MaxErrorCountForAutoRestart int
+	MaxErrorCountForAutoRestart int // Устарел: пороги авто-рестарта задаются по категориям ошибок
 	MaxAttachmentSizeMB         int
 	CrystalReportsTimeoutSec    int
+	MaxRateLimitEntries         int  // Максимальный размер кеша ограничений частоты отправки на адрес
+	DropInvalidRecipients       bool // Исключать синтаксически некорректные адреса вместо ошибки всего письма
+	UnknownDSNActionAsFailure   bool // Считать нестандартный Action в bounce (DSN) ошибкой доставки
+	SMTPLaneQueueSize           int  // Размер очереди отправки каждого SMTP сервера
+	SMTPLaneWorkers             int  // Количество обработчиков очереди каждого SMTP сервера
+	SMTPLaneMaxPerMinute        int  // Лимит отправок в минуту для очереди каждого SMTP сервера (0 - без ограничения)
+	// Добавлять в error_text неудачных отправок сводку: тема, получатели, SMTP сервер
+	IncludeMessageSummaryInErrorText bool
+	// Проверять контрольные суммы вложений, переданные в очереди (email_attach_checksum)
+	VerifyAttachmentChecksums bool
+	InlineImageMaxSizeKB      int // Изображения не больше этого размера встраиваются в HTML тело (0 - не встраивать)
+	MaxGlobAttachments        int // Максимум файлов, прикладываемых по шаблону имени во вложении типа 3
+	AttachmentsTimeoutSec     int // Общий лимит времени на подготовку всех вложений письма (0 - без ограничения)
+	// Адреса отписки для массовых рассылок, если они не переданы в очереди (list_unsubscribe)
+	ListUnsubscribeURL    string
+	ListUnsubscribeMailto string
+	RequestMaxAgeSec      int // Максимальное время ожидания сообщения во внутренней очереди (0 - без ограничения)
+	// Запись почасовых счетчиков отправок в БД (pcsystem.pkg_email.save_email_metrics)
+	SaveMetricsToDB         bool
+	MetricsFlushIntervalSec int
+	HTMLSanitizePolicy      string // Обработка HTML тела по списку разрешенных элементов: off, sanitize, reject
+	// Таймауты получения вложения по источникам в секундах (0 - без отдельного ограничения)
+	CLOBFetchTimeoutSec int
+	FileFetchTimeoutSec int
+	UNCFetchTimeoutSec  int
+	// Проверка MX (или A) записей доменов получателей перед отправкой
+	VerifyRecipientMX  bool
+	MXCacheTTLSec      int // Время кеширования результата проверки домена
+	MXLookupTimeoutSec int // Таймаут DNS запросов проверки домена
+	// Режим однократного запуска (например, из cron): обработать очередь и завершить работу
+	OneShot            bool
+	OneShotEmptyCycles int // Количество подряд пустых выборок, после которого работа завершается
+	// Буферизация вложений во временные файлы до отправки (пусто - вложения хранятся в памяти)
+	AttachmentStagingDir       string
+	AttachmentStagingMinSizeKB int
+	AutoSubmittedHeaders       string // Заголовки Precedence: bulk и Auto-Submitted: off, bulk или all
+	// Пороги авто-рестарта по категориям ошибок (0 - категория рестарт не вызывает)
+	MaxParseErrorsForAutoRestart      int
+	MaxAttachmentErrorsForAutoRestart int
+	MaxSendErrorsForAutoRestart       int
+	// Перенаправление всех писем на заданные адреса через запятую (тестовые стенды), пусто - отключено
+	RedirectAllTo string
+	// Отправлять письма с несуществующим smtp_id через первый сервер вместо ошибки ErrInvalidSMTPID
+	SMTPIDFallback bool
+	// Добавлять к HTML телу текстовую версию (multipart/alternative)
+	PlainTextAlternative bool
+	// Проверка выравнивания доменов From и envelope-from для DMARC: off, warn или enforce
+	DMARCAlignment string
+	// Отправлять письмо без вложений, которые не удалось получить, с пометкой в тексте
+	PartialAttachments bool
+	// Значение заголовка X-Mailer, например email-service/1.2.3 (пусто - заголовок не добавляется)
+	XMailer string
+	// Отправка через резервные SMTP серверы, если выбранный недоступен; порядок - номера секций через запятую
+	SMTPFailover      bool
+	SMTPFailoverOrder string
+	// Запись протокола обмена с SMTP сервером в Debug режиме: off, log или file (в каталог SMTPTranscriptDir)
+	SMTPTranscript    string
+	SMTPTranscriptDir string
+	// JSON файл с итогом обработки каждого письма, записываемый при завершении работы (пусто - не записывается)
+	ReportFile string
+	// Ограничение числа авто-рестартов цикла обработки за окно AutoRestartWindowMin (0 - без ограничения)
+	MaxAutoRestarts        int
+	AutoRestartWindowMin   int
+	AutoRestartLimitAction string // Действие при превышении: exit или cooldown
+	AutoRestartCooldownMin int    // Пауза перед следующим рестартом для AutoRestartLimitAction = cooldown
+	// Домены через запятую, письма на которые в Debug режиме доставляются без перенаправления на тестовый адрес
+	DebugKeepDomains string
+	// Поведение при пустом (0 байт) отчете Crystal Reports: fail - ошибка вложения, note - отправка без отчета с пометкой
+	CrystalReportsEmptyPolicy string
+	// Адреса тестовых получателей через запятую, которым в Debug режиме письмо доставляется без перенаправления
+	TestRecipients string
+	// Пауза перед авто-рестартом, после которой рестарт выполняется только при доступной БД (0 - рестарт сразу)
+	AutoRestartGraceSec int
+	// Время ожидания завершения обработчиков и операций с БД при graceful shutdown
+	ShutdownTimeoutSec int
 }
 
 // ScheduleConfig представляет расписание отправки
 type ScheduleConfig struct {
 	TimeStart time.Time
 	TimeEnd   time.Time
+	UseDB     bool // Получать окна расписания из БД (pcsystem.PKG_EMAIL.GET_SEND_SCHEDULE)
+	DBTTLSec  int  // Время кеширования расписания из БД в секундах
+	// Часовые пояса получателей по доменам адресов (ключ - домен в нижнем регистре), пусто - не заданы
+	DomainTimezones map[string]*time.Location
+}
+
+// DigestConfig представляет конфигурацию сводки ошибок отправки для операторов
+type DigestConfig struct {
+	Email       string // Адрес(а) операторов, пусто - сводка отключена
+	SmtpID      int    // SMTP сервер для отправки сводки
+	Threshold   int    // Количество ошибок, после которого сводка отправляется сразу
+	IntervalMin int    // Периодичность отправки сводки в минутах (при наличии ошибок)
+	MaxItems    int    // Максимум ошибок, перечисляемых в сводке поименно
+}
+
+// StatusConfig представляет числовые коды статусов писем, записываемые в БД
+type StatusConfig struct {
+	Sent      int // Письмо отправлено
+	Failed    int // Ошибка отправки или доставки
+	Delivered int // Письмо доставлено (bounce не найден)
+	Partial   int // Письмо отправлено, но часть получателей отклонена SMTP сервером
+}
+
+// HealthConfig представляет конфигурацию HTTP endpoint состояния сервиса
+type HealthConfig struct {
+	Listen         string // Адрес HTTP сервера (например, 127.0.0.1:8081), пусто - endpoint отключен
+	RecentMessages int    // Размер буфера последних обработанных писем для /health/recent (0 - отключен)
+	ReconnectToken string // Токен для POST /reconnect-db (пусто - команда принимается только с loopback адреса)
+}
+
+// BounceConfig представляет признаки bounce-сообщений, по которым IMAP клиент находит отчеты о недоставке
+// Ключевые слова хранятся в нижнем регистре и ищутся как подстроки
+type BounceConfig struct {
+	FromKeywords    []string        // Фрагменты адреса отправителя bounce-сообщения
+	SubjectKeywords []string        // Фрагменты темы bounce-сообщения
+	ErrorPatterns   []BouncePattern // Фрагменты текста bounce-сообщения с описанием ошибки
+}
+
+// BouncePattern сопоставляет фрагмент текста bounce-сообщения с описанием ошибки для error_text
+type BouncePattern struct {
+	Pattern string
+	Desc    string
 }
 
 // LogConfig представляет конфигурацию логирования
@@ -73,6 +307,8 @@ type ShareConfig struct {
 	Port            string
 	PathReplaceFrom string // Строка для замены в пути (например: "192.168.87.31:shares$:esig_docs")
 	PathReplaceTo   string // Замена на (например: "\\\\sto-s\\Applic\\Xchange\\EDS")
+	ReadBufferKB    int    // Размер буфера чтения файла с шары в КБ (больше - меньше запросов на медленных каналах)
+	DirWorkers      int    // Количество параллельных запросов Stat при чтении папки на шаре
 }
 
 // LoadConfig загружает конфигурацию из INI файла
@@ -91,6 +327,11 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("ошибка загрузки конфигурации Oracle: %w", err)
 	}
 
+	// Загружаем признаки bounce-сообщений (до SMTP: секции SMTP могут их переопределить)
+	if err := config.loadBounceConfig(); err != nil {
+		return nil, fmt.Errorf("ошибка загрузки конфигурации Bounce: %w", err)
+	}
+
 	// Загружаем конфигурацию SMTP
 	if err := config.loadSMTPConfig(); err != nil {
 		return nil, fmt.Errorf("ошибка загрузки конфигурации SMTP: %w", err)
@@ -108,14 +349,31 @@ func LoadConfig(path string) (*Config, error) {
 
 	// Загружаем конфигурацию логирования
 	if err := config.loadLogConfig(); err != nil {
+		config.Stop()
 		return nil, fmt.Errorf("ошибка загрузки конфигурации логирования: %w", err)
 	}
 
 	// Загружаем конфигурацию CIFS/SMB шары
 	if err := config.loadShareConfig(); err != nil {
+		config.Stop()
 		return nil, fmt.Errorf("ошибка загрузки конфигурации Share: %w", err)
 	}
 
+	// Загружаем конфигурацию сводки ошибок
+	if err := config.loadDigestConfig(); err != nil {
+		config.Stop()
+		return nil, fmt.Errorf("ошибка загрузки конфигурации Digest: %w", err)
+	}
+
+	// Загружаем коды статусов писем
+	if err := config.loadStatusConfig(); err != nil {
+		config.Stop()
+		return nil, fmt.Errorf("ошибка загрузки конфигурации Status: %w", err)
+	}
+
+	// Загружаем конфигурацию health endpoint
+	config.loadHealthConfig()
+
 	return config, nil
 }
 
@@ -133,6 +391,8 @@ func (c *Config) loadOracleConfig() error {
 		// Параметры повторного подключения при старте
 		c.Oracle.DBConnectRetryAttempts = mainSec.Key("DBConnectRetryAttempts").MustInt(10)
 		c.Oracle.DBConnectRetryIntervalSec = mainSec.Key("DBConnectRetryIntervalSec").MustInt(5)
+		c.Oracle.DBConnectRetryMaxIntervalSec = mainSec.Key("DBConnectRetryMaxIntervalSec").MustInt(60)
+		c.Oracle.DBConnectRetryMaxWaitSec = mainSec.Key("DBConnectRetryMaxWaitSec").MustInt(0)
 	}
 
 	// Также проверяем секцию [ORACLE] для Instance (совместимость с C# версией)
@@ -185,6 +445,72 @@ func (c *Config) loadSMTPConfig() error {
 
 		imapHost := sec.Key("IMAPHost").String()
 		imapPort := sec.Key("IMAPPort").MustInt(993) // По умолчанию 993 для SSL
+		enablePipelining := sec.Key("EnablePipelining").MustBool(false)
+		hideInternalHost := sec.Key("HideInternalHost").MustBool(false)
+		publicDomain := sec.Key("PublicDomain").String()
+		maxRecipientsPerTransaction := sec.Key("MaxRecipientsPerTransaction").MustInt(0)
+		maxTransactionsPerConnection := sec.Key("MaxTransactionsPerConnection").MustInt(0)
+		tlsServerName := sec.Key("TLSServerName").String()
+		connectionPoolSize := sec.Key("ConnectionPoolSize").MustInt(0)
+		connectionIdleTimeoutSec := sec.Key("ConnectionIdleTimeoutSec").MustInt(300)
+		keepAliveIntervalSec := sec.Key("KeepAliveIntervalSec").MustInt(60)
+		greetingTimeoutSec := sec.Key("GreetingTimeoutSec").MustInt(30)
+		envelopeFrom := sec.Key("EnvelopeFrom").String()
+		smtpMaxRetries := sec.Key("SMTPMaxRetries").MustInt(2)
+		smtpRetryBackoffMsec := sec.Key("SMTPRetryBackoffMsec").MustInt(1000)
+		smtpRetryExponential := sec.Key("SMTPRetryExponential").MustBool(false)
+		smtpRetryJitter := sec.Key("SMTPRetryJitter").MustBool(false)
+		smtpRetryErrors := defaultSMTPRetryErrors
+		if sec.HasKey("SMTPRetryErrors") {
+			smtpRetryErrors = sec.Key("SMTPRetryErrors").Strings(",")
+		}
+		heloName := sec.Key("HeloName").String()
+		imapTimeoutSec := sec.Key("IMAPTimeoutSec").MustInt(60)
+		imapConnectTimeoutSec := sec.Key("IMAPConnectTimeoutSec").MustInt(15)
+		imapFolderTimeoutSec := sec.Key("IMAPFolderTimeoutSec").MustInt(30)
+		imapFetchTimeoutSec := sec.Key("IMAPFetchTimeoutSec").MustInt(15)
+		smtpDialTimeoutSec := sec.Key("SMTPDialTimeoutSec").MustInt(30)
+		smtpCommandTimeoutSec := sec.Key("SMTPCommandTimeoutSec").MustInt(30)
+		tlsMinVersion := sec.Key("TLSMinVersion").String()
+		tlsInsecureSkipVerify := sec.Key("TLSInsecureSkipVerify").MustBool(false)
+		tlsClientCertFile := sec.Key("TLSClientCertFile").String()
+		tlsClientKeyFile := sec.Key("TLSClientKeyFile").String()
+		if (tlsClientCertFile == "") != (tlsClientKeyFile == "") {
+			return fmt.Errorf("в секции %s TLSClientCertFile и TLSClientKeyFile должны быть заданы вместе", sectionName)
+		}
+		tlsCAFile := sec.Key("TLSCAFile").String()
+		tlsRootCAs, err := loadCertPool(tlsCAFile)
+		if err != nil {
+			return fmt.Errorf("в секции %s: %w", sectionName, err)
+		}
+		imapUseIdle := sec.Key("IMAPUseIdle").MustBool(false)
+		noReplySender := sec.Key("NoReplySender").MustBool(false)
+		supportReplyTo := strings.TrimSpace(sec.Key("SupportReplyTo").String())
+		var imapBounceFolders []string
+		for _, pattern := range sec.Key("IMAPBounceFolders").Strings(",") {
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("в секции %s некорректный шаблон IMAPBounceFolders %q: %w", sectionName, pattern, err)
+			}
+			imapBounceFolders = append(imapBounceFolders, pattern)
+		}
+		bounce, err := readBounceConfig(sec, "Bounce", c.Bounce)
+		if err != nil {
+			return fmt.Errorf("в секции %s: %w", sectionName, err)
+		}
+
+		imapBounceAction := sec.Key("IMAPBounceAction").MustString("none")
+		imapBounceMoveFolder := strings.TrimSpace(sec.Key("IMAPBounceMoveFolder").String())
+		imapScanMaxMessages := sec.Key("IMAPScanMaxMessages").MustInt(20)
+		if imapScanMaxMessages < 1 {
+			imapScanMaxMessages = 20
+		}
+		imapScanPageSize := sec.Key("IMAPScanPageSize").MustInt(20)
+		if imapScanPageSize < 1 || imapScanPageSize > imapScanMaxMessages {
+			imapScanPageSize = imapScanMaxMessages
+		}
 
 		c.SMTP = append(c.SMTP, SMTPConfig{
 			Host:                         host,
@@ -197,6 +523,44 @@ func (c *Config) loadSMTPConfig() error {
 			SMTPMinSendEmailIntervalMsec: minSendEmailIntervalMsec,
 			IMAPHost:                     imapHost,
 			IMAPPort:                     imapPort,
+			EnablePipelining:             enablePipelining,
+			HideInternalHost:             hideInternalHost,
+			PublicDomain:                 publicDomain,
+			MaxRecipientsPerTransaction:  maxRecipientsPerTransaction,
+			MaxTransactionsPerConnection: maxTransactionsPerConnection,
+			TLSServerName:                tlsServerName,
+			ConnectionPoolSize:           connectionPoolSize,
+			ConnectionIdleTimeoutSec:     connectionIdleTimeoutSec,
+			KeepAliveIntervalSec:         keepAliveIntervalSec,
+			GreetingTimeoutSec:           greetingTimeoutSec,
+			EnvelopeFrom:                 envelopeFrom,
+			SMTPMaxRetries:               smtpMaxRetries,
+			SMTPRetryBackoffMsec:         smtpRetryBackoffMsec,
+			SMTPRetryExponential:         smtpRetryExponential,
+			SMTPRetryJitter:              smtpRetryJitter,
+			SMTPRetryErrors:              smtpRetryErrors,
+			HeloName:                     heloName,
+			IMAPTimeoutSec:               imapTimeoutSec,
+			IMAPConnectTimeoutSec:        imapConnectTimeoutSec,
+			IMAPFolderTimeoutSec:         imapFolderTimeoutSec,
+			IMAPFetchTimeoutSec:          imapFetchTimeoutSec,
+			SMTPDialTimeoutSec:           smtpDialTimeoutSec,
+			SMTPCommandTimeoutSec:        smtpCommandTimeoutSec,
+			TLSMinVersion:                tlsMinVersion,
+			TLSInsecureSkipVerify:        tlsInsecureSkipVerify,
+			TLSClientCertFile:            tlsClientCertFile,
+			TLSClientKeyFile:             tlsClientKeyFile,
+			TLSCAFile:                    tlsCAFile,
+			TLSRootCAs:                   tlsRootCAs,
+			Bounce:                       bounce,
+			IMAPUseIdle:                  imapUseIdle,
+			NoReplySender:                noReplySender,
+			SupportReplyTo:               supportReplyTo,
+			IMAPBounceFolders:            imapBounceFolders,
+			IMAPBounceAction:             imapBounceAction,
+			IMAPBounceMoveFolder:         imapBounceMoveFolder,
+			IMAPScanMaxMessages:          imapScanMaxMessages,
+			IMAPScanPageSize:             imapScanPageSize,
 		})
 	}
 
@@ -207,16 +571,99 @@ func (c *Config) loadSMTPConfig() error {
 	return nil
 }
 
+// loadCertPool загружает сертификаты удостоверяющих центров из PEM файла (пустой путь - nil, системное хранилище)
+func loadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения TLSCAFile: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("TLSCAFile %s не содержит сертификатов в формате PEM", path)
+	}
+	return pool, nil
+}
+
 func (c *Config) loadModeConfig() error {
 	sec := c.File.Section("Mode")
 	c.Mode.Debug = sec.Key("Debug").MustBool(false)
 	c.Mode.SendHiddenCopyToSelf = sec.Key("SendHiddenCopyToSelf").MustBool(false)
 	c.Mode.IsBodyHTML = sec.Key("IsBodyHTML").MustBool(false)
 	c.Mode.MaxErrorCountForAutoRestart = sec.Key("MaxErrorCountForAutoRestart").MustInt(50)
+	// Пороги по категориям по умолчанию выключены: рестарт включается явно для нужной категории
+	c.Mode.MaxParseErrorsForAutoRestart = sec.Key("MaxParseErrorsForAutoRestart").MustInt(0)
+	c.Mode.MaxAttachmentErrorsForAutoRestart = sec.Key("MaxAttachmentErrorsForAutoRestart").MustInt(0)
+	c.Mode.MaxSendErrorsForAutoRestart = sec.Key("MaxSendErrorsForAutoRestart").MustInt(0)
+	c.Mode.RedirectAllTo = sec.Key("RedirectAllTo").String()
+	c.Mode.SMTPIDFallback = sec.Key("SMTPIDFallback").MustBool(false)
+	c.Mode.PlainTextAlternative = sec.Key("PlainTextAlternative").MustBool(false)
+	c.Mode.DMARCAlignment = sec.Key("DMARCAlignment").MustString("warn")
+	c.Mode.PartialAttachments = sec.Key("PartialAttachments").MustBool(false)
+	c.Mode.XMailer = sec.Key("XMailer").String()
+	c.Mode.SMTPFailover = sec.Key("SMTPFailover").MustBool(false)
+	c.Mode.SMTPFailoverOrder = sec.Key("SMTPFailoverOrder").String()
+	c.Mode.SMTPTranscript = sec.Key("SMTPTranscript").MustString("off")
+	c.Mode.SMTPTranscriptDir = sec.Key("SMTPTranscriptDir").String()
+	c.Mode.ReportFile = sec.Key("ReportFile").String()
+	c.Mode.MaxAutoRestarts = sec.Key("MaxAutoRestarts").MustInt(0)
+	c.Mode.AutoRestartWindowMin = sec.Key("AutoRestartWindowMin").MustInt(60)
+	c.Mode.AutoRestartLimitAction = strings.ToLower(strings.TrimSpace(sec.Key("AutoRestartLimitAction").MustString("exit")))
+	c.Mode.AutoRestartCooldownMin = sec.Key("AutoRestartCooldownMin").MustInt(30)
+	c.Mode.DebugKeepDomains = sec.Key("DebugKeepDomains").String()
+	c.Mode.CrystalReportsEmptyPolicy = sec.Key("CrystalReportsEmptyPolicy").MustString("fail")
+	c.Mode.TestRecipients = sec.Key("TestRecipients").String()
+	c.Mode.AutoRestartGraceSec = sec.Key("AutoRestartGraceSec").MustInt(0)
+	if c.Mode.AutoRestartGraceSec < 0 {
+		c.Mode.AutoRestartGraceSec = 0
+	}
+	c.Mode.ShutdownTimeoutSec = sec.Key("ShutdownTimeoutSec").MustInt(10)
+	if c.Mode.ShutdownTimeoutSec < 1 {
+		c.Mode.ShutdownTimeoutSec = 10
+	}
+	if c.Mode.AutoRestartLimitAction != "exit" && c.Mode.AutoRestartLimitAction != "cooldown" {
+		return fmt.Errorf("неизвестное значение AutoRestartLimitAction %q (допустимо: exit, cooldown)", c.Mode.AutoRestartLimitAction)
+	}
+	if c.Mode.AutoRestartWindowMin < 1 {
+		c.Mode.AutoRestartWindowMin = 1
+	}
 
 	// Новые параметры надежности
 	c.Mode.MaxAttachmentSizeMB = sec.Key("MaxAttachmentSizeMB").MustInt(100)
 	c.Mode.CrystalReportsTimeoutSec = sec.Key("CrystalReportsTimeoutSec").MustInt(60)
+	c.Mode.MaxRateLimitEntries = sec.Key("MaxRateLimitEntries").MustInt(100000)
+	c.Mode.DropInvalidRecipients = sec.Key("DropInvalidRecipients").MustBool(false)
+	c.Mode.UnknownDSNActionAsFailure = sec.Key("UnknownDSNActionAsFailure").MustBool(false)
+	c.Mode.SMTPLaneQueueSize = sec.Key("SMTPLaneQueueSize").MustInt(20)
+	c.Mode.SMTPLaneWorkers = sec.Key("SMTPLaneWorkers").MustInt(1)
+	c.Mode.SMTPLaneMaxPerMinute = sec.Key("SMTPLaneMaxPerMinute").MustInt(0)
+	c.Mode.IncludeMessageSummaryInErrorText = sec.Key("IncludeMessageSummaryInErrorText").MustBool(false)
+	c.Mode.VerifyAttachmentChecksums = sec.Key("VerifyAttachmentChecksums").MustBool(true)
+	c.Mode.InlineImageMaxSizeKB = sec.Key("InlineImageMaxSizeKB").MustInt(0)
+	c.Mode.MaxGlobAttachments = sec.Key("MaxGlobAttachments").MustInt(20)
+	c.Mode.AttachmentsTimeoutSec = sec.Key("AttachmentsTimeoutSec").MustInt(0)
+	c.Mode.ListUnsubscribeURL = sec.Key("ListUnsubscribeURL").String()
+	c.Mode.ListUnsubscribeMailto = sec.Key("ListUnsubscribeMailto").String()
+	c.Mode.RequestMaxAgeSec = sec.Key("RequestMaxAgeSec").MustInt(0)
+	c.Mode.SaveMetricsToDB = sec.Key("SaveMetricsToDB").MustBool(false)
+	c.Mode.MetricsFlushIntervalSec = sec.Key("MetricsFlushIntervalSec").MustInt(300)
+	c.Mode.HTMLSanitizePolicy = sec.Key("HTMLSanitizePolicy").MustString("off")
+	c.Mode.CLOBFetchTimeoutSec = sec.Key("CLOBFetchTimeoutSec").MustInt(0)
+	c.Mode.FileFetchTimeoutSec = sec.Key("FileFetchTimeoutSec").MustInt(0)
+	c.Mode.UNCFetchTimeoutSec = sec.Key("UNCFetchTimeoutSec").MustInt(0)
+	c.Mode.VerifyRecipientMX = sec.Key("VerifyRecipientMX").MustBool(false)
+	c.Mode.MXCacheTTLSec = sec.Key("MXCacheTTLSec").MustInt(3600)
+	c.Mode.MXLookupTimeoutSec = sec.Key("MXLookupTimeoutSec").MustInt(5)
+	c.Mode.OneShot = sec.Key("OneShot").MustBool(false)
+	c.Mode.OneShotEmptyCycles = sec.Key("OneShotEmptyCycles").MustInt(3)
+	c.Mode.AttachmentStagingDir = sec.Key("AttachmentStagingDir").String()
+	c.Mode.AttachmentStagingMinSizeKB = sec.Key("AttachmentStagingMinSizeKB").MustInt(1024)
+	c.Mode.AutoSubmittedHeaders = sec.Key("AutoSubmittedHeaders").MustString("off")
+	if c.Mode.OneShotEmptyCycles < 1 {
+		c.Mode.OneShotEmptyCycles = 1
+	}
 
 	return nil
 }
@@ -225,6 +672,13 @@ func (c *Config) loadScheduleConfig() error {
 	sec := c.File.Section("Schedule")
 	timeStartStr := sec.Key("TimeStart").String()
 	timeEndStr := sec.Key("TimeEnd").String()
+	c.Schedule.UseDB = sec.Key("UseDB").MustBool(false)
+	c.Schedule.DBTTLSec = sec.Key("DBTTLSec").MustInt(300)
+	domainTimezones, err := parseDomainTimezones(sec.Key("DomainTimezones").String())
+	if err != nil {
+		return fmt.Errorf("неверный формат DomainTimezones: %w", err)
+	}
+	c.Schedule.DomainTimezones = domainTimezones
 
 	// Парсим время в формате HH:MM
 	now := time.Now()
@@ -254,13 +708,31 @@ func (c *Config) loadScheduleConfig() error {
 	}
 
 	// Обновляем время каждый день
-	c.scheduleStop = make(chan struct{})
+	c.startScheduleUpdater(timeStartStr, timeEndStr)
+
+	return nil
+}
+
+// startScheduleUpdater запускает горутину ежечасного обновления даты в расписании
+// Повторный вызов (например, при перезагрузке расписания) останавливает предыдущую горутину
+func (c *Config) startScheduleUpdater(timeStartStr, timeEndStr string) {
+	c.scheduleMu.Lock()
+	defer c.scheduleMu.Unlock()
+
+	c.stopScheduleUpdaterLocked()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	c.scheduleStop = stop
+	c.scheduleDone = done
+
 	go func() {
+		defer close(done)
 		ticker := time.NewTicker(1 * time.Hour)
 		defer ticker.Stop()
 		for {
 			select {
-			case <-c.scheduleStop:
+			case <-stop:
 				return
 			case <-ticker.C:
 				now := time.Now()
@@ -277,10 +749,153 @@ func (c *Config) loadScheduleConfig() error {
 			}
 		}
 	}()
+}
+
+// stopScheduleUpdaterLocked останавливает горутину обновления расписания и дожидается ее завершения
+// Вызывается под блокировкой scheduleMu
+func (c *Config) stopScheduleUpdaterLocked() {
+	if c.scheduleStop == nil {
+		return
+	}
+	close(c.scheduleStop)
+	<-c.scheduleDone
+	c.scheduleStop = nil
+	c.scheduleDone = nil
+}
+
+func (c *Config) loadDigestConfig() error {
+	// Секция не обязательна, по умолчанию сводка отключена
+	sec := c.File.Section("Digest")
+	c.Digest.Email = sec.Key("Email").String()
+	c.Digest.SmtpID = sec.Key("SmtpID").MustInt(0)
+	c.Digest.Threshold = sec.Key("Threshold").MustInt(50)
+	c.Digest.IntervalMin = sec.Key("IntervalMin").MustInt(60)
+	c.Digest.MaxItems = sec.Key("MaxItems").MustInt(50)
+
+	if c.Digest.Email != "" && (c.Digest.SmtpID < 0 || c.Digest.SmtpID >= len(c.SMTP)) {
+		return fmt.Errorf("SmtpID %d вне диапазона настроенных SMTP серверов (0-%d)", c.Digest.SmtpID, len(c.SMTP)-1)
+	}
+
+	return nil
+}
 
+func (c *Config) loadStatusConfig() error {
+	// Секция не обязательна, по умолчанию используются коды схемы pcsystem
+	sec := c.File.Section("Status")
+	c.Status.Sent = sec.Key("Sent").MustInt(2)
+	c.Status.Failed = sec.Key("Failed").MustInt(3)
+	c.Status.Delivered = sec.Key("Delivered").MustInt(4)
+	// По умолчанию частичная отправка записывается с кодом Sent, отклоненные адреса - в error_text
+	c.Status.Partial = sec.Key("Partial").MustInt(c.Status.Sent)
+
+	if c.Status.Sent == c.Status.Failed || c.Status.Sent == c.Status.Delivered || c.Status.Failed == c.Status.Delivered {
+		return fmt.Errorf("коды статусов должны различаться (Sent=%d, Failed=%d, Delivered=%d)",
+			c.Status.Sent, c.Status.Failed, c.Status.Delivered)
+	}
+
+	return nil
+}
+
+func (c *Config) loadBounceConfig() error {
+	// Секция не обязательна, по умолчанию используются встроенные признаки
+	bounce, err := readBounceConfig(c.File.Section("Bounce"), "", BounceConfig{
+		FromKeywords:    defaultBounceFromKeywords,
+		SubjectKeywords: defaultBounceSubjectKeywords,
+		ErrorPatterns:   defaultBounceErrorPatterns,
+	})
+	if err != nil {
+		return err
+	}
+	c.Bounce = bounce
 	return nil
 }
 
+// readBounceConfig читает признаки bounce-сообщений из ключей prefix+FromKeywords, prefix+SubjectKeywords
+// и prefix+ErrorPatterns секции; отсутствующие ключи берутся из base
+func readBounceConfig(sec *ini.Section, prefix string, base BounceConfig) (BounceConfig, error) {
+	bounce := base
+	if sec.HasKey(prefix + "FromKeywords") {
+		bounce.FromKeywords = lowerStrings(sec.Key(prefix + "FromKeywords").Strings(","))
+	}
+	if sec.HasKey(prefix + "SubjectKeywords") {
+		bounce.SubjectKeywords = lowerStrings(sec.Key(prefix + "SubjectKeywords").Strings(","))
+	}
+	if sec.HasKey(prefix + "ErrorPatterns") {
+		patterns, err := parseBouncePatterns(sec.Key(prefix + "ErrorPatterns").String())
+		if err != nil {
+			return BounceConfig{}, fmt.Errorf("%sErrorPatterns: %w", prefix, err)
+		}
+		bounce.ErrorPatterns = patterns
+	}
+	return bounce, nil
+}
+
+// parseBouncePatterns разбирает список "фрагмент: описание | фрагмент: описание"
+// Фрагмент отделяется от описания первым двоеточием и хранится в нижнем регистре
+func parseBouncePatterns(value string) ([]BouncePattern, error) {
+	var patterns []BouncePattern
+	for _, item := range strings.Split(value, "|") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pattern, desc, ok := strings.Cut(item, ":")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		desc = strings.TrimSpace(desc)
+		if !ok || pattern == "" || desc == "" {
+			return nil, fmt.Errorf("ожидается \"фрагмент: описание\", получено %q", item)
+		}
+		patterns = append(patterns, BouncePattern{Pattern: pattern, Desc: desc})
+	}
+	return patterns, nil
+}
+
+// parseDomainTimezones разбирает часовые пояса доменов получателей в формате "домен: пояс, домен: пояс"
+// (пояс - имя IANA, например Europe/Berlin)
+func parseDomainTimezones(value string) (map[string]*time.Location, error) {
+	var zones map[string]*time.Location
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		domain, zone, ok := strings.Cut(item, ":")
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), ".@"))
+		zone = strings.TrimSpace(zone)
+		if !ok || domain == "" || zone == "" {
+			return nil, fmt.Errorf("ожидается \"домен: часовой пояс\", получено %q", item)
+		}
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("неизвестный часовой пояс %q: %w", zone, err)
+		}
+		if zones == nil {
+			zones = make(map[string]*time.Location)
+		}
+		zones[domain] = loc
+	}
+	return zones, nil
+}
+
+// lowerStrings приводит значения к нижнему регистру и отбрасывает пустые
+func lowerStrings(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (c *Config) loadHealthConfig() {
+	// Секция не обязательна, по умолчанию endpoint отключен
+	sec := c.File.Section("Health")
+	c.Health.Listen = sec.Key("Listen").String()
+	c.Health.RecentMessages = sec.Key("RecentMessages").MustInt(100)
+	c.Health.ReconnectToken = sec.Key("ReconnectToken").String()
+}
+
 func (c *Config) loadLogConfig() error {
 	sec := c.File.Section("Log")
 	c.Log.LogLevel = sec.Key("LogLevel").MustInt(4) // По умолчанию Info
@@ -293,6 +908,8 @@ func (c *Config) loadShareConfig() error {
 	if !c.File.HasSection("share") {
 		// Секция не обязательна, используем значения по умолчанию
 		c.Share.Port = "445"
+		c.Share.ReadBufferKB = 256
+		c.Share.DirWorkers = 64
 		return nil
 	}
 
@@ -303,18 +920,28 @@ func (c *Config) loadShareConfig() error {
 	c.Share.Port = sec.Key("CIFSPORT").String()
 	c.Share.PathReplaceFrom = sec.Key("PathReplaceFrom").String()
 	c.Share.PathReplaceTo = sec.Key("PathReplaceTo").String()
+	c.Share.ReadBufferKB = sec.Key("ReadBufferKB").MustInt(256)
+	c.Share.DirWorkers = sec.Key("DirWorkers").MustInt(64)
 
 	// Значение по умолчанию для порта
 	if c.Share.Port == "" {
 		c.Share.Port = "445"
 	}
+	if c.Share.ReadBufferKB <= 0 {
+		c.Share.ReadBufferKB = 256
+	}
+	if c.Share.DirWorkers <= 0 {
+		c.Share.DirWorkers = 64
+	}
 
 	return nil
 }
 
 // Stop останавливает фоновые горутины Config (для graceful shutdown)
+// Безопасен для повторного вызова
 func (c *Config) Stop() {
-	if c.scheduleStop != nil {
-		close(c.scheduleStop)
-	}
+	c.scheduleMu.Lock()
+	defer c.scheduleMu.Unlock()
+
+	c.stopScheduleUpdaterLocked()
 }
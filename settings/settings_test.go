@@ -0,0 +1,209 @@
+package settings
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// writeTestCAFile создает сертификат удостоверяющего центра и сохраняет его в PEM файл
+func writeTestCAFile(t *testing.T) (string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Private CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, cert
+}
+
+// loadTestSMTPConfig загружает секцию [SMTP] с дополнительными параметрами extra
+func loadTestSMTPConfig(t *testing.T, extra string) (*Config, error) {
+	t.Helper()
+	f, err := ini.Load([]byte("[SMTP]\nHost = smtp.example.com\nUser = sender@example.com\n" + extra + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{File: f}
+	return c, c.loadSMTPConfig()
+}
+
+func TestLoadSMTPConfigTLSCAFile(t *testing.T) {
+	caFile, caCert := writeTestCAFile(t)
+
+	c, err := loadTestSMTPConfig(t, "TLSCAFile = "+caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := c.SMTP[0].TLSRootCAs
+	if pool == nil {
+		t.Fatal("TLSRootCAs не загружен")
+	}
+	if _, err := caCert.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("сертификат центра не входит в TLSRootCAs: %v", err)
+	}
+
+	// Без TLSCAFile используется системное хранилище
+	c, err = loadTestSMTPConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SMTP[0].TLSRootCAs != nil {
+		t.Error("TLSRootCAs задан без TLSCAFile")
+	}
+}
+
+func TestLoadSMTPConfigTLSCAFileErrors(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("не сертификат"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(t.TempDir(), "missing.pem"), notPEM} {
+		_, err := loadTestSMTPConfig(t, "TLSCAFile = "+path)
+		if err == nil || !strings.Contains(err.Error(), "в секции SMTP") {
+			t.Errorf("TLSCAFile %s: ошибка %v, ожидалась ошибка с именем секции", path, err)
+		}
+	}
+}
+
+func TestLoadBounceConfig(t *testing.T) {
+	f, err := ini.Load([]byte(`[Bounce]
+SubjectKeywords = Undeliverable, Возврат
+ErrorPatterns = mailbox full: Ящик переполнен | user unknown: Адрес не существует
+
+[SMTP]
+Host = smtp.example.com
+BounceFromKeywords = Bounce@Relay.example.org
+
+[SMTP1]
+Host = smtp2.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{File: f}
+	if err := c.loadBounceConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.loadSMTPConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ключ секции [Bounce] заменяет встроенный список, отсутствующий ключ оставляет его
+	if want := []string{"undeliverable", "возврат"}; !reflect.DeepEqual(c.Bounce.SubjectKeywords, want) {
+		t.Errorf("SubjectKeywords = %q, ожидалось %q", c.Bounce.SubjectKeywords, want)
+	}
+	if !reflect.DeepEqual(c.Bounce.FromKeywords, defaultBounceFromKeywords) {
+		t.Errorf("FromKeywords = %q, ожидался список по умолчанию", c.Bounce.FromKeywords)
+	}
+	wantPatterns := []BouncePattern{{"mailbox full", "Ящик переполнен"}, {"user unknown", "Адрес не существует"}}
+	if !reflect.DeepEqual(c.Bounce.ErrorPatterns, wantPatterns) {
+		t.Errorf("ErrorPatterns = %+v, ожидалось %+v", c.Bounce.ErrorPatterns, wantPatterns)
+	}
+
+	// Параметры секции SMTP переопределяют [Bounce] только для своего сервера
+	if want := []string{"bounce@relay.example.org"}; !reflect.DeepEqual(c.SMTP[0].Bounce.FromKeywords, want) {
+		t.Errorf("SMTP: FromKeywords = %q, ожидалось %q", c.SMTP[0].Bounce.FromKeywords, want)
+	}
+	if !reflect.DeepEqual(c.SMTP[0].Bounce.SubjectKeywords, c.Bounce.SubjectKeywords) {
+		t.Errorf("SMTP: SubjectKeywords = %q, ожидались значения [Bounce]", c.SMTP[0].Bounce.SubjectKeywords)
+	}
+	if !reflect.DeepEqual(c.SMTP[1].Bounce, c.Bounce) {
+		t.Errorf("SMTP1: %+v, ожидались значения [Bounce]", c.SMTP[1].Bounce)
+	}
+}
+
+func TestParseBouncePatternsInvalid(t *testing.T) {
+	for _, value := range []string{"mailbox full", ": описание", "фрагмент:"} {
+		if _, err := parseBouncePatterns(value); err == nil {
+			t.Errorf("parseBouncePatterns(%q) без ошибки", value)
+		}
+	}
+}
+
+func TestLoadModeConfigShutdownTimeout(t *testing.T) {
+	tests := []struct {
+		mode string
+		want int
+	}{
+		{"", 10},
+		{"ShutdownTimeoutSec = 120", 120},
+		{"ShutdownTimeoutSec = 1", 1},
+		// Нулевое и отрицательное значение - значение по умолчанию, а не остановка без ожидания
+		{"ShutdownTimeoutSec = 0", 10},
+		{"ShutdownTimeoutSec = -5", 10},
+		{"ShutdownTimeoutSec = abc", 10},
+	}
+	for _, tt := range tests {
+		f, err := ini.Load([]byte("[Mode]\n" + tt.mode + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{File: f}
+		if err := c.loadModeConfig(); err != nil {
+			t.Fatalf("%q: %v", tt.mode, err)
+		}
+		if c.Mode.ShutdownTimeoutSec != tt.want {
+			t.Errorf("%q: ShutdownTimeoutSec = %d, ожидалось %d", tt.mode, c.Mode.ShutdownTimeoutSec, tt.want)
+		}
+	}
+}
+
+func TestLoadModeConfigFailureThresholds(t *testing.T) {
+	tests := []struct {
+		mode                      string
+		parse, attachment, sender int
+	}{
+		// Без явных значений пороги выключены, устаревший общий порог их не задает
+		{"", 0, 0, 0},
+		{"MaxErrorCountForAutoRestart = 50", 0, 0, 0},
+		{"MaxParseErrorsForAutoRestart = 10\nMaxSendErrorsForAutoRestart = 3", 10, 0, 3},
+		{"MaxAttachmentErrorsForAutoRestart = 7", 0, 7, 0},
+	}
+	for _, tt := range tests {
+		f, err := ini.Load([]byte("[Mode]\n" + tt.mode + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{File: f}
+		if err := c.loadModeConfig(); err != nil {
+			t.Fatalf("%q: %v", tt.mode, err)
+		}
+		got := []int{c.Mode.MaxParseErrorsForAutoRestart, c.Mode.MaxAttachmentErrorsForAutoRestart, c.Mode.MaxSendErrorsForAutoRestart}
+		if want := []int{tt.parse, tt.attachment, tt.sender}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: пороги parse/attachment/send = %v, ожидалось %v", tt.mode, got, want)
+		}
+	}
+}
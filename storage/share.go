@@ -20,6 +20,13 @@ import (
 	"email-service/settings"
 )
 
+const (
+	// defaultReadBufferSize - размер буфера чтения файла, если ReadBufferKB не задан
+	defaultReadBufferSize = 256 * 1024
+	// defaultDirWorkers - количество параллельных запросов Stat, если DirWorkers не задан
+	defaultDirWorkers = 64
+)
+
 // CIFSManager управляет пулом подключений к SMB-шарам
 type CIFSManager struct {
 	clients map[string]*CIFSClient // key: "server:share"
@@ -44,6 +51,9 @@ type CIFSClient struct {
 	Port      string
 	Domain    string
 
+	readBufferSize int // Размер буфера чтения файла (ShareConfig.ReadBufferKB)
+	dirWorkers     int // Параллельные запросы Stat при чтении папки (ShareConfig.DirWorkers)
+
 	conn     net.Conn
 	session  *smb2.Session
 	fs       *smb2.Share
@@ -61,6 +71,9 @@ func NewCIFSClient(address string, shareName string, cfg *settings.ShareConfig)
 		Port:      cfg.Port,
 		Domain:    cfg.Domain,
 		lastUsed:  time.Now(),
+
+		readBufferSize: cfg.ReadBufferKB * 1024,
+		dirWorkers:     cfg.DirWorkers,
 	}
 }
 
@@ -374,7 +387,10 @@ func (c *CIFSClient) readFileOnce(dirPath string) ([]string, error) {
 		return nil, fmt.Errorf("ошибка чтения папки %s на шаре: %w", dirPath, err)
 	}
 
-	const workers = 64
+	workers := c.dirWorkers
+	if workers <= 0 {
+		workers = defaultDirWorkers
+	}
 	sem := make(chan struct{}, workers)
 	type result struct {
 		path string
@@ -516,7 +532,14 @@ func (c *CIFSClient) readFileContentOnce(filePath string) ([]byte, error) {
 	}
 	defer file.Close()
 
-	data, err := io.ReadAll(file)
+	var size int64
+	if st, ok := file.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := st.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	data, err := readAllBuffered(file, size, c.readBufferSize)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка чтения файла %s: %w", filePath, err)
 	}
@@ -524,6 +547,48 @@ func (c *CIFSClient) readFileContentOnce(filePath string) ([]byte, error) {
 	return data, nil
 }
 
+// readAllBuffered читает r до конца запросами по bufSize байт (0 - defaultReadBufferSize)
+// size - ожидаемый размер данных для выделения памяти одним блоком (0 - неизвестен)
+// В отличие от io.ReadAll размер запроса не растет постепенно с 512 байт, что на шарах
+// с большой задержкой сокращает число обращений к серверу
+func readAllBuffered(r io.Reader, size int64, bufSize int) ([]byte, error) {
+	if bufSize <= 0 {
+		bufSize = defaultReadBufferSize
+	}
+	data := make([]byte, 0, size)
+	buf := make([]byte, bufSize)
+	for {
+		n, err := r.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ListFiles возвращает имена файлов (без поддиректорий) в директории на шаре
+func (c *CIFSClient) ListFiles(dirPath string) ([]string, error) {
+	if c.fs == nil {
+		return nil, fmt.Errorf("шара не смонтирована: вызовите Connect() перед ListFiles")
+	}
+
+	entries, err := c.fs.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения папки %s на шаре: %w", dirPath, err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
 // ListRoot — выводит и возвращает список элементов в корне смонтированной шары
 // NOTE: Функция оставлена для возможного использования в production для диагностики и отладки подключений к шарам
 func (c *CIFSClient) ListRoot(relativePath string) ([]string, error) {